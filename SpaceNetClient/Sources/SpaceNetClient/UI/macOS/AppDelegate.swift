@@ -55,7 +55,12 @@ class AppDelegate: NSObject, NSApplicationDelegate {
                 let statusMenu = StatusMenu(tunnelsManager: tunnelsManager, windowDelegate: self)
 
                 // **** AppBricks: Initialize SpaceNet
-                snInitializeContext(nil)
+                // failures are reported to the status
+                // change handler as a locked status
+                let errorCode = snInitializeContext(nil)
+                if errorCode != SN_ERROR_NONE {
+                    wg_log(.error, message: "Failed to initialize SpaceNet context with error code \(errorCode)")
+                }
                 // ****
 
                 let statusItemController = StatusItemController()
@@ -77,19 +82,8 @@ class AppDelegate: NSObject, NSApplicationDelegate {
 
                         // **** AppBricks: Check if EULA accepted
                         if snEULAAccepted() == 0 {
-                            _ = showSimpleDialog(
-                                window: manageTunnelsWindow,
-                                dialogType: SN_DIALOG_ALERT,
-                                title: "Terms of Use",
-                                msg: "",
-                                accessoryType: SN_DIALOG_ACCESSORY_YES_NO,
-                                accessoryText: "Before you can use the MyCS SpaceNet client you need to review and accept the [AppBricks, Inc. Software End User Agreement](https://appbricks.io/eula/).\n\nDo you agree to the terms?"
-                            ) { ok, _ in
-                                if ok {
-                                    snSetEULAAccepted()
-                                } else {
-                                    manageTunnelsWindow.contentViewController?.dismiss(self)
-                                }
+                            showEULAAcceptanceDialog(window: manageTunnelsWindow) {
+                                manageTunnelsWindow.contentViewController?.dismiss(self)
                             }
                         }
                         // ****
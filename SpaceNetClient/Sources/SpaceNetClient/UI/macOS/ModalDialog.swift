@@ -270,6 +270,64 @@ func setDialogHandlers(target: NSViewController) {
     }
 }
 
+// **** AppBricks: EULA acceptance
+
+struct EULAStatus: Decodable {
+    let version: String
+    let url: String
+    let acceptedVersion: String?
+    let needsAcceptance: Bool
+}
+
+func eulaStatus() -> EULAStatus? {
+    guard let statusJSON = snEULAStatus() else { return nil }
+    defer { free(UnsafeMutableRawPointer(mutating: statusJSON)) }
+
+    return try? JSONDecoder().decode(EULAStatus.self, from: Data(String(cString: statusJSON).utf8))
+}
+
+// asks the user to accept the bundled EULA if it has not been
+// accepted or if it has changed since it was last accepted
+func showEULAAcceptanceDialog(window: NSWindow, onDeclined: @escaping () -> Void) {
+    guard
+        let status = eulaStatus(),
+        status.needsAcceptance
+    else { return }
+
+    let eulaLink = "[AppBricks, Inc. Software End User Agreement](\(status.url))"
+    var prompt = "Before you can use the MyCS SpaceNet client you need to review and accept the \(eulaLink)."
+    if let acceptedVersion = status.acceptedVersion, !acceptedVersion.isEmpty {
+        prompt = "The \(eulaLink) has changed since you accepted version \(acceptedVersion). You need to review and accept version \(status.version) to continue using the MyCS SpaceNet client."
+    }
+
+    _ = showSimpleDialog(
+        window: window,
+        dialogType: SN_DIALOG_ALERT,
+        title: "Terms of Use",
+        msg: "",
+        accessoryType: SN_DIALOG_ACCESSORY_YES_NO,
+        accessoryText: "\(prompt)\n\nDo you agree to the terms?"
+    ) { ok, _ in
+        guard ok else {
+            onDeclined()
+            return
+        }
+        let errorCode = snSetEULAAccepted()
+        if errorCode != SN_ERROR_NONE {
+            wg_log(.error, message: "Failed to save EULA acceptance with error code \(errorCode)")
+            _ = showSimpleDialog(
+                window: window,
+                dialogType: SN_DIALOG_ERROR,
+                title: "Error",
+                msg: "Your acceptance of the terms could not be saved. You will be asked to accept them again the next time the MyCS SpaceNet client starts.",
+                accessoryType: SN_DIALOG_ACCESSORY_NONE
+            ) { _, _ in }
+        }
+    }
+}
+
+// ****
+
 func resetDialogHandlers(target: NSViewController) {
     snUnregisterShowDialogFunc(Unmanaged.passUnretained(target).toOpaque())
 }
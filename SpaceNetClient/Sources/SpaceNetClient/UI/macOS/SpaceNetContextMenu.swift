@@ -6,6 +6,7 @@ import Cocoa
 class SpaceNetContextMenu {
 
     var snCfgStatus: UInt8
+    var snStatusHandlerID: UInt = 0
 
     weak var windowDelegate: StatusMenuWindowDelegate?
 
@@ -29,13 +30,17 @@ class SpaceNetContextMenu {
         self.loginMenuItem.target = self
 
         // snInitialize callback
-        snRegisterStatusChangeHandler(Unmanaged.passUnretained(self).toOpaque()) { context, snCfgStatus in
+        self.snStatusHandlerID = snRegisterStatusChangeHandler(Unmanaged.passUnretained(self).toOpaque()) { context, snCfgStatus, _ in
             guard let context = context else { return }
             let unretainedSelf = Unmanaged<SpaceNetContextMenu>.fromOpaque(context).takeUnretainedValue()
             unretainedSelf.update(snCfgStatus: snCfgStatus)
         }
     }
 
+    deinit {
+        snUnregisterStatusChangeHandler(self.snStatusHandlerID)
+    }
+
     func update(snCfgStatus: UInt8) {
         self.settingsMenuItem.title = tr("macMenuSettings")
         self.settingsMenuItem.action = nil
@@ -109,12 +114,15 @@ class SpaceNetContextMenu {
                 else { return }
 
                 if ok {
-                    if snInitializeContext(passphrase) == 0 {
+                    let errorCode = snInitializeContext(passphrase)
+                    if errorCode != SN_ERROR_NONE {
                         _ = showSimpleDialog(
                             window: manageTunnelsWindow,
                             dialogType: SN_DIALOG_ERROR,
                             title: "Error",
-                            msg: "Failed to unlock device.",
+                            msg: errorCode == SN_ERROR_LOCK
+                                ? "Failed to unlock device. The passphrase is incorrect."
+                                : "Failed to unlock device. The device configuration could not be read.",
                             accessoryType: SN_DIALOG_ACCESSORY_NONE
                         ) { _, _ in }
                     }
@@ -132,8 +140,8 @@ class SpaceNetContextMenu {
         windowDelegate.showManageTunnelsWindow { manageTunnelsWindow in
             guard let manageTunnelsWindow = manageTunnelsWindow else { return }
 
-            snLogin(Unmanaged.passUnretained(manageTunnelsWindow.contentViewController!).toOpaque()) { context, ok in
-                if ok == 0 {
+            snLogin(Unmanaged.passUnretained(manageTunnelsWindow.contentViewController!).toOpaque()) { context, ok, cancelled in
+                if ok == 0 && cancelled == 0 {
                     guard let context = context else { return }
                     let settingsVC = Unmanaged<SettingsViewController>.fromOpaque(context).takeUnretainedValue()
 
@@ -154,7 +162,8 @@ class SpaceNetContextMenu {
     }
 
     @objc func logoutClicked() {
-        if snLogout() == 0 {
+        let errorCode = snLogout()
+        if errorCode != SN_ERROR_NONE {
             DispatchQueue.main.async { [weak self ] in
                 guard
                     let self = self
@@ -168,7 +177,9 @@ class SpaceNetContextMenu {
                             window: manageTunnelsWindow,
                             dialogType: SN_DIALOG_ERROR,
                             title: "Error",
-                            msg: "Logout failed",
+                            msg: errorCode == SN_ERROR_NETWORK
+                                ? "Logout failed as the service could not be reached."
+                                : "Logout failed",
                             accessoryType: SN_DIALOG_ACCESSORY_NONE
                         ) { _, _ in
                         }
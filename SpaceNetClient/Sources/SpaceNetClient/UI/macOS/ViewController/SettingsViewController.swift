@@ -104,6 +104,7 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
     }()
 
     var settingsViewModel: SettingsViewModel?
+    var settingsSession: UInt = 0
     var configLoadError = false
 
     init() {
@@ -115,16 +116,20 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
     }
 
     override func loadView() {
-        snSettingsInit(Unmanaged.passUnretained(self).toOpaque()) { context, ok, initialized, deviceUser, deviceName, deviceLockPassphrase, unlockedTimeout in
+        settingsSession = snSettingsBegin(Unmanaged.passUnretained(self).toOpaque()) { context, session, ok, initialized, deviceUser, deviceName, deviceLockPassphrase, unlockedTimeout in
+            guard let context = context else { return }
+
+            // the handler is called before snSettingsBegin
+            // returns the session handle
+            let unretainedSelf = Unmanaged<SettingsViewController>.fromOpaque(context).takeUnretainedValue()
+            unretainedSelf.settingsSession = session
+
             guard
-                let context = context,
                 let deviceUser = deviceUser,
                 let deviceName = deviceName,
                 let deviceLockPassphrase = deviceLockPassphrase
             else { return }
 
-            let unretainedSelf = Unmanaged<SettingsViewController>.fromOpaque(context).takeUnretainedValue()
-
             unretainedSelf.configLoadError = (ok == 0)
             if !unretainedSelf.configLoadError {
                 unretainedSelf.settingsViewModel = SettingsViewModel(
@@ -265,19 +270,8 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
                 else { return }
 
                 if let window = self.view.window {
-                    _ = showSimpleDialog(
-                        window: window,
-                        dialogType: SN_DIALOG_ALERT,
-                        title: "Terms of Use",
-                        msg: "",
-                        accessoryType: SN_DIALOG_ACCESSORY_YES_NO,
-                        accessoryText: "Before you can use the MyCS SpaceNet client you need to review and accept the [AppBricks, Inc. Software End User Agreement](https://appbricks.io/eula/).\n\nDo you agree to the terms?"
-                    ) { ok, _ in
-                        if ok {
-                            snSetEULAAccepted()
-                        } else {
-                            self.presentingViewController?.dismiss(self)
-                        }
+                    showEULAAcceptanceDialog(window: window) {
+                        self.presentingViewController?.dismiss(self)
                     }
                 }
             }
@@ -286,6 +280,15 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
 
     override func viewDidDisappear() {
         resetDialogHandlers(target: self)
+
+        // discard any changes that were not saved
+        if settingsSession != 0 {
+            let errorCode = snSettingsCancel(settingsSession)
+            if errorCode != SN_ERROR_NONE {
+                wg_log(.error, message: "Failed to discard unsaved settings with error code \(errorCode)")
+            }
+            settingsSession = 0
+        }
     }
 
     func populateFields() {
@@ -338,8 +341,9 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
     }
 
     func handleResetDeviceOwner(_: Int) {
-        snSettingsResetDeviceOwner(Unmanaged.passUnretained(self).toOpaque()) { context, username, devicename, needsKey in
+        snSettingsResetDeviceOwner(settingsSession, Unmanaged.passUnretained(self).toOpaque()) { context, ok, username, devicename, needsKey in
             guard
+                ok == 1,
                 let context = context,
                 let username = username,
                 let devicename = devicename
@@ -369,6 +373,7 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
             let settingsViewModel = self.settingsViewModel
         else { return }
 
+        let session = self.settingsSession
         let context = Unmanaged.passUnretained(self).toOpaque()
         if i == 0 {
             let openPanel = NSOpenPanel()
@@ -377,7 +382,7 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
             openPanel.allowsMultipleSelection = false
             openPanel.beginSheetModal(for: window) { response in
                 guard response == .OK else { return }
-                snSettingsLoadUserKey(context, openPanel.urls[0].absoluteString, FALSE) { context, ok, fileName in
+                snSettingsLoadUserKey(session, context, openPanel.urls[0].absoluteString, nil, FALSE) { context, ok, fileName in
                     guard
                         let context = context,
                         let fileName = fileName
@@ -399,9 +404,23 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
             }
             savePanel.nameFieldStringValue = "key.pem"
             savePanel.isExtensionHidden = false
+
+            // the user chooses how the new key file is protected
+            let keyFileFormats = [
+                (format: "pkcs8", title: tr("macKeyFileFormatPKCS8")),
+                (format: "encryptedPEM", title: tr("macKeyFileFormatEncryptedPEM")),
+                (format: "pem", title: tr("macKeyFileFormatPEM"))
+            ]
+            let formatPopup = NSPopUpButton()
+            formatPopup.addItems(withTitles: keyFileFormats.map { $0.title })
+            let formatView = NSStackView(views: [NSTextField(labelWithString: tr("macLabelKeyFileFormat")), formatPopup])
+            formatView.edgeInsets = NSEdgeInsets(top: 8, left: 8, bottom: 8, right: 8)
+            savePanel.accessoryView = formatView
+
             savePanel.beginSheetModal(for: window) { response in
                 guard response == .OK else { return }
-                snSettingsLoadUserKey(context, savePanel.url?.absoluteString, TRUE) { context, ok, fileName in
+                let keyFormat = keyFileFormats[formatPopup.indexOfSelectedItem].format
+                snSettingsLoadUserKey(session, context, savePanel.url?.absoluteString, keyFormat, TRUE) { context, ok, fileName in
                     guard
                         let context = context,
                         let fileName = fileName
@@ -450,7 +469,7 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
             self.discardButton.isEnabled = false
             self.saveButton.isEnabled = false
 
-            snSettingsSave(Unmanaged.passUnretained(self).toOpaque(), model.deviceName, model.deviceLockPassphrase, model.unlockedTimeout.value) { context, ok in
+            snSettingsSave(self.settingsSession, Unmanaged.passUnretained(self).toOpaque(), model.deviceName, model.deviceLockPassphrase, model.unlockedTimeout.value) { context, ok in
                 guard
                     let context = context
                 else { return }
@@ -462,9 +481,13 @@ class SettingsViewController: NSViewController, SettingsViewModelBinding {
                             let unretainedSelf = unretainedSelf
                         else { return }
 
+                        // the session ends once its changes are saved
+                        unretainedSelf.settingsSession = 0
                         unretainedSelf.presentingViewController?.dismiss(unretainedSelf)
                     }
-                    snInitializeContext(unretainedSelf.settingsViewModel!.deviceLockPassphrase)
+                    // failures are reported to the status
+                    // change handler as a locked status
+                    _ = snInitializeContext(unretainedSelf.settingsViewModel!.deviceLockPassphrase)
 
                 } else {
                     unretainedSelf.discardButton.isEnabled = true
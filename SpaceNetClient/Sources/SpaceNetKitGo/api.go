@@ -12,62 +12,28 @@ package main
 // typedef unsigned char BOOL;
 //
 // typedef unsigned char SN_CFG_STATUS;
-// const SN_CFG_STATUS SN_CFG_STATUS_ERROR = 0;
-// const SN_CFG_STATUS SN_CFG_STATUS_NEEDS_INIT = 1;
-// const SN_CFG_STATUS SN_CFG_STATUS_NEEDS_LOGIN = 2;
-// const SN_CFG_STATUS SN_CFG_STATUS_LOGGED_IN = 3;
-// const SN_CFG_STATUS SN_CFG_STATUS_LOGGED_OUT = 4;
-// const SN_CFG_STATUS SN_CFG_STATUS_LOCKED = 5;
 //
-// static void postStatusChange(void *func, void *ctx, const SN_CFG_STATUS status)
-// {
-//   ((void(*)(void *, const unsigned char))func)(ctx, status);
-// }
-// static void onDone(void *func, void *ctx, const BOOL ok)
-// {
-//	 ((void(*)(void *, const BOOL))func)(ctx, ok);
-// }
-// static void onSettingsInit(void *func, void *ctx, const BOOL ok, const BOOL isInitialized, const char *deviceUser, const char *deviceName, const char *deviceLockPassphrase, const int unlockedTimeout)
-// {
-//	 ((void(*)(void *, const BOOL, const BOOL, const char *, const char *, const char *, const int))func)(ctx, ok, isInitialized, deviceUser, deviceName, deviceLockPassphrase, unlockedTimeout);
-// }
-// static void onSettingsDeviceOwnerLoggedIn(void *func, void *ctx, const char *username, const char *deviceName, const BOOL needsKey)
-// {
-//	 ((void(*)(void *, const char *, const char *, const BOOL))func)(ctx, username, deviceName, needsKey);
-// }
-// static void onSettingsOwnerKeyLoaded(void *func, void *ctx, const BOOL ok, const char *keyFile)
-// {
-//	 ((void(*)(void *, const BOOL, const char *))func)(ctx, ok, keyFile);
-// }
+// typedef unsigned char SN_ERROR_CODE;
 import "C"
 
 import (
-	"context"
-	"path/filepath"
-	"unsafe"
+	"sync"
 
 	"github.com/appbricks/cloud-builder/config"
-	"github.com/appbricks/mycloudspace-client/api"
 	"github.com/appbricks/mycloudspace-client/auth"
-	mycsconfig "github.com/appbricks/mycloudspace-client/config"
-
-	// "github.com/appbricks/mycloudspace-client/mycscloud"
-	// "github.com/appbricks/mycloudspace-common/monitors"
 
 	"github.com/mevansam/goutils/logger"
 )
 
 var (
-	cfgStatusHandlers = [][2]uintptr{}
-
-	// Global configuration
-	appConfig config.Config
-
-	// // Monitor Service
-	// monitorService *monitors.MonitorService
-
-	// // Space Targets
-	// spaceNodes *mycscloud.SpaceNodes
+	// Global configuration. it is replaced when the context
+	// is initialized and cleared when it is reset so it must
+	// only be accessed via currentConfig() and setConfig().
+	appConfig   config.Config
+	appConfigMx sync.RWMutex
+
+	// serializes all writes of the config file
+	configSaveMx sync.Mutex
 )
 
 const (
@@ -77,27 +43,21 @@ const (
 	SN_CFG_STATUS_LOGGED_IN   = 3
 	SN_CFG_STATUS_LOGGED_OUT  = 4
 	SN_CFG_STATUS_LOCKED      = 5
-)
 
-var configInitializer *mycsconfig.ConfigInitializer
-
-//export snRegisterStatusChangeHandler
-func snRegisterStatusChangeHandler(context, handler uintptr) {
-	cfgStatusHandlers = append(cfgStatusHandlers, [2]uintptr{handler, context})
-}
-func postStatusChange(status C.uchar) {
-	logger.DebugMessage("Posting config status change: %d", status)
-	for _, h := range cfgStatusHandlers {
-		if h[0] != 0 {
-			fn  := unsafe.Pointer(h[0])
-			ctx := unsafe.Pointer(h[1])
-			C.postStatusChange(fn, ctx, status)
-		}
-	}
-}
+	// status change reasons
+	SN_REASON_PASSPHRASE_REQUIRED = "passphraseRequired"
+	SN_REASON_UNLOCK_FAILED       = "unlockFailed"
+	SN_REASON_NOT_INITIALIZED     = "notInitialized"
+	SN_REASON_TOKEN_INVALID       = "tokenInvalid"
+	SN_REASON_TOKEN_VALID         = "tokenValid"
+	SN_REASON_LOGIN               = "login"
+	SN_REASON_LOGIN_FAILED        = "loginFailed"
+	SN_REASON_LOGOUT              = "logout"
+	SN_REASON_SAVE_FAILED         = "saveFailed"
+)
 
 //export snInitializeContext
-func snInitializeContext(passphrase *C.char) C.uchar {	
+func snInitializeContext(passphrase *C.char) C.SN_ERROR_CODE {
 
 	var (
 		ppProvided bool
@@ -112,12 +72,25 @@ func snInitializeContext(passphrase *C.char) C.uchar {
 	var (
 		err error
 
+		cfg config.Config
+
 		isAuthenticated bool
+		loadErr         error
+		unlockErr       error
 	)
-	ok := C.uchar(1)
+	code := C.SN_ERROR_CODE(SN_ERROR_NONE)
+
+	// the keys saved with the config are not read or saved
+	// if the secret store protecting them is unavailable
+	if _, err = systemPassphrase(); err != nil {
+		setConfig(nil)
+		code = setLastErrorCode("snInitializeContext", err)
+		postStatusChange(SN_CFG_STATUS_LOCKED, SN_REASON_UNLOCK_FAILED, err)
+		return code
+	}
 
-	// initialize / load config file
-	configFile := filepath.Join(homeDir, ".cb", "config.yml")
+	// initialize / load config file of the active profile
+	configFile := activeProfileConfigFile()
 	logger.DebugMessage("Loading config: %s", configFile)
 
 	needsPassphrase := false
@@ -131,112 +104,113 @@ func snInitializeContext(passphrase *C.char) C.uchar {
 		return ppValue
 	}
 
-	if appConfig, err = config.InitFileConfig(
-		configFile, nil, 
-		getPassphrase, nil,
-	); err != nil {
-		logger.ErrorMessage("Failed to initialize the config file instance: %s", err.Error())
-		ok = C.uchar(0)
+	if cfg, err = initFileConfig(configFile, getPassphrase); err != nil {
+		setConfig(nil)
+		return setLastErrorCode("snInitializeContext", storageError(err))
+	}
+	// the config is loaded before it is made available
+	// so that concurrent calls never see it partially
+	// loaded. a config that is locked or could not be
+	// loaded is never made available as it would have
+	// an empty device context.
+	if !needsPassphrase {
+		loadErr = cfg.Load()
 	}
+	if needsPassphrase || loadErr != nil {
+		setConfig(nil)
+	} else {
+		setConfig(cfg)
+	}
+
 	if needsPassphrase {
-		postStatusChange(SN_CFG_STATUS_LOCKED)
+		postStatusChange(SN_CFG_STATUS_LOCKED, SN_REASON_PASSPHRASE_REQUIRED, nil)
 
 	} else {
-		if err = appConfig.Load(); err != nil {
-			logger.ErrorMessage("Failed to load the configuration data: %s", err.Error())
-			postStatusChange(SN_CFG_STATUS_LOCKED)
-			ok = C.uchar(0)
-
-		} else if appConfig.Initialized() {
-			if isAuthenticated, err = auth.ValidateAuthenticatedToken(getServiceConfig(), appConfig); err != nil {
-				logger.ErrorMessage("Error loading the configuration data: %s", err.Error())
-				postStatusChange(SN_CFG_STATUS_NEEDS_LOGIN)
+		if err = loadErr; err != nil {
+			// the passphrase may be wrong or the config unreadable
+			unlockErr = lockError(err)
+			code = setLastErrorCode("snInitializeContext", unlockErr)
+			postStatusChange(SN_CFG_STATUS_LOCKED, SN_REASON_UNLOCK_FAILED, unlockErr)
+
+		} else if cfg.Initialized() {
+			if isAuthenticated, err = auth.ValidateAuthenticatedToken(getServiceConfig(), cfg); err != nil {
+				_ = setLastError("snInitializeContext", authError(err))
+				postStatusChange(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_INVALID, authError(err))
 			} else if isAuthenticated {
-				postStatusChange(SN_CFG_STATUS_LOGGED_IN)
+				postStatusChange(SN_CFG_STATUS_LOGGED_IN, SN_REASON_TOKEN_VALID, nil)
 			} else {
-				postStatusChange(SN_CFG_STATUS_NEEDS_LOGIN)
+				postStatusChange(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_INVALID, nil)
 			}
 		} else {
-			postStatusChange(SN_CFG_STATUS_NEEDS_INIT)
+			postStatusChange(SN_CFG_STATUS_NEEDS_INIT, SN_REASON_NOT_INITIALIZED, nil)
 		}	
 	}	
+	if ppProvided && !needsPassphrase {
+		auditLog(AUDIT_UNLOCK, "", unlockErr)
+	}
+	if code == SN_ERROR_NONE && !needsPassphrase {
+		// lock the device again once it has been idle
+		// for longer than the saved unlocked timeout
+		armIdleTimer()
+	}
 
-	return ok
+	return code
 }
 
 //export snLogin
 func snLogin(dlgContext uintptr, handler uintptr) {
 
-	context := unsafe.Pointer(dlgContext)
-	handlerFunc := unsafe.Pointer(handler)
-
-	appUI := NewAppUI(dlgContext)
+	cfg := currentConfig()
+	appUI := NewAppUI(dlgContext).(*appUI)
+	login := newLoginOperation(appUI, loginCompletion("snLogin", cfg, dlgContext, handler))
+	if cfg == nil {
+		login.finish(newError(SN_ERROR_LOCK, "the device is locked"), false)
+		return
+	}
 
+	// the login flow is cancelled via the cancel functions
+	// of the messages it shows so the ui cancels them when
+	// the login's context is done
 	auth.Login(
 		getServiceConfig(),
-		appConfig,
-		appUI,
+		cfg,
+		appUI.withContext(login.ctx),
 		func(err error) {
-
-			defer func() {
-				if err = appConfig.Save(); err != nil {
-					logger.ErrorMessage("Failed to save configuration after login: %s", err.Error())
-
-					_ = appConfig.AuthContext().Reset()
-					postStatusChange(SN_CFG_STATUS_LOGGED_OUT)				
-				}
-			}()
-			
-			if err != nil {
-				logger.ErrorMessage("Failed to login: %s", err.Error())
-				postStatusChange(SN_CFG_STATUS_LOGGED_OUT)
-
-			} else if appConfig.AuthContext().IsLoggedIn() {
-				postStatusChange(SN_CFG_STATUS_LOGGED_IN)
-
-			} else {
-				postStatusChange(SN_CFG_STATUS_LOGGED_OUT)
-			}
-
-			if uintptr(handlerFunc) != 0 {
-				ok := C.uchar(1)
-				if err != nil {
-					ok = C.uchar(0)
-				}
-				C.onDone(
-					handlerFunc, 
-					context, 
-					ok,
-				)
+			if !login.finish(err, false) && err == nil {
+				// the login completed after it was cancelled
+				// so the token it retrieved is discarded
+				login.discardResult(cfg)
 			}
 		},
 	)
 }
 
 //export snLogout
-func snLogout() C.uchar {
+func snLogout() C.SN_ERROR_CODE {
 
 	var (
 		err error
 	)
 
-	if err = auth.Logout(getServiceConfig(), appConfig); err != nil {
-		logger.ErrorMessage("Failed to logout: %s", err.Error())
-
-	} else {
-		if err = appConfig.Save(); err != nil {
-			logger.ErrorMessage("Failed to save configuration after logout: %s", err.Error())
-		
-		} else {
-			postStatusChange(SN_CFG_STATUS_LOGGED_OUT)
-		}
+	cfg := currentConfig()
+	if cfg == nil {
+		return setLastErrorCode("snLogout", newError(SN_ERROR_LOCK, "the device is locked"))
 	}
-
-	ok := C.uchar(1)
-	if err != nil {
-		ok = C.uchar(0)
+	username := cfg.DeviceContext().GetLoggedInUserName()
+	if err = auth.Logout(getServiceConfig(), cfg); err != nil {
+		auditLogForUser(AUDIT_LOGOUT, username, "", err)
+		return setLastErrorCode("snLogout", authError(err))
 	}
-	return ok
+	if err = saveConfig(cfg); err != nil {
+		auditLogForUser(AUDIT_LOGOUT, username, "", err)
+		return setLastErrorCode("snLogout", storageError(err))
+	}
+	auditLogForUser(AUDIT_LOGOUT, username, "", nil)
+	disconnectAllSpaces()
+	resetSpaceNodes()
+	postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGOUT, nil)
+
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
 }
 
 //export snLoggedInUser
@@ -248,12 +222,12 @@ func snLoggedInUser() *C.char {
 		awsAuth *auth.AWSCognitoJWT
 	)
 
-	if appConfig != nil {
+	if cfg := currentConfig(); cfg != nil {
 		if awsAuth, err = auth.NewAWSCognitoJWT(
 			getServiceConfig(),
-			appConfig.AuthContext(),
+			cfg.AuthContext(),
 		); err != nil {
-			logger.ErrorMessage("Failed to extract auth token: %s", err.Error())	
+			_ = setLastError("snLoggedInUser", authError(err))
 		} else {
 			return C.CString(awsAuth.Username())
 		}
@@ -263,8 +237,8 @@ func snLoggedInUser() *C.char {
 
 //export snIsLoggedInUserOwner
 func snIsLoggedInUserOwner() C.uchar {
-	if appConfig != nil {
-		deviceContext := appConfig.DeviceContext()
+	if cfg := currentConfig(); cfg != nil {
+		deviceContext := cfg.DeviceContext()
 		if ownerName, ok := deviceContext.GetOwnerUserName(); 
 			ok && ownerName == deviceContext.GetLoggedInUserName() {
 			return C.uchar(1)
@@ -273,196 +247,64 @@ func snIsLoggedInUserOwner() C.uchar {
 	return C.uchar(0)
 }
 
-//export snEULAAccepted
-func snEULAAccepted() C.uchar {	
-	if appConfig != nil && appConfig.EULAAccepted() {
-		return C.uchar(1)
-	}
-	return C.uchar(0)
-}
+// returns the configuration of the active profile or nil if
+// the device is locked or the context is not initialized. an
+// operation should retrieve it once and use that reference
+// throughout so that a concurrent reset does not affect it.
+func currentConfig() config.Config {
+	appConfigMx.RLock()
+	defer appConfigMx.RUnlock()
 
-//export snSetEULAAccepted
-func snSetEULAAccepted() {
-	appConfig.SetEULAAccepted()
-	if err := appConfig.Save(); err != nil {
-		panic(err.Error())
-	}
+	return appConfig
 }
 
-//export snSettingsInit
-func snSettingsInit(dlgContext uintptr, handler uintptr) {
-
-	var (
-		err error
-	)
-
-	dialogCtx := unsafe.Pointer(dlgContext)
-	handlerFunc := unsafe.Pointer(handler)
-
-	ok := C.uchar(1)
-	if configInitializer, err = mycsconfig.NewConfigInitializer(
-		appConfig,
-		context.Background(),
-		getServiceConfig(), 
-		NewAppUIBackground(dlgContext),
-	); err != nil {
-		logger.ErrorMessage("Error initializing the config initializer: %s", err.Error())
-		ok = C.uchar(0)
-	}
-
-	if uintptr(handlerFunc) != 0 {
-
-		cDeviceUserName := C.CString(configInitializer.DeviceUsername())
-		cDeviceName := C.CString(configInitializer.DeviceName())
-		cDevicePassphrase := C.CString(configInitializer.DevicePassphrase())
-
-		initialized := C.uchar(0)
-		if configInitializer.Initialized() {
-			initialized = C.uchar(1)
-		}
+func setConfig(cfg config.Config) {
+	appConfigMx.Lock()
+	defer appConfigMx.Unlock()
 
-		C.onSettingsInit(
-			handlerFunc, 
-			dialogCtx, 
-			ok,
-			initialized,
-			cDeviceUserName,
-			cDeviceName,
-			cDevicePassphrase,
-			C.int(configInitializer.UnlockedTimeout()),
-		)
-
-		C.free(unsafe.Pointer(cDeviceUserName))
-		C.free(unsafe.Pointer(cDeviceName))
-		C.free(unsafe.Pointer(cDevicePassphrase))
-	}
+	appConfig = cfg
 }
 
-//export snSettingsResetDeviceOwner
-func snSettingsResetDeviceOwner(dlgContext, handler uintptr) {	
-
-	context := unsafe.Pointer(dlgContext)
-	handlerFunc := unsafe.Pointer(handler)
-
-	configInitializer.ResetDeviceOwner(
-		func(userName, deviceName string, userNeedsNewKey bool, err error) {
-
-			if err != nil {
-				logger.ErrorMessage("Authentication failed: %s", err.Error())	
+// saves the given config. saves made from exports, the token
+// refresher and login completions are serialized with each
+// other and with operations that replace the config file so
+// that a save never interleaves with the file being replaced.
+func saveConfig(cfg config.Config) error {
+	configSaveMx.Lock()
+	defer configSaveMx.Unlock()
 
-			} else {
-				needsKey := C.uchar(0)
-				if userNeedsNewKey {
-					needsKey = C.uchar(1)
-				}
-
-				if uintptr(handlerFunc) != 0 {
-
-					cUserName := C.CString(userName)
-					cDeviceName := C.CString(deviceName)
-
-					C.onSettingsDeviceOwnerLoggedIn(
-						handlerFunc, 
-						context, 
-						cUserName,
-						cDeviceName,
-						needsKey,
-					)
-
-					C.free(unsafe.Pointer(cUserName))
-					C.free(unsafe.Pointer(cDeviceName))
-				}
-			}
-		},
-	)
+	return cfg.Save()
 }
 
-//export snSettingsLoadUserKey
-func snSettingsLoadUserKey(
-	dlgContext uintptr, 
-	keyFile *C.char, 
-	createKey uint8, 
-	handler uintptr,
-) {	
-	context := unsafe.Pointer(dlgContext)
-	handlerFunc := unsafe.Pointer(handler)
-
-	configInitializer.LoadDeviceOwnerKey(
-		C.GoString(keyFile),
-		createKey == 1,
-		func(keyFileName string, err error) {
-			if uintptr(handlerFunc) != 0 {
-
-				ok := C.uchar(1)
-				if err != nil {
-					logger.ErrorMessage("Failed to load key file: %s", err.Error())	
-					ok = C.uchar(0)
-				}
-
-				cKeyFileName := C.CString(keyFileName)
-
-				C.onSettingsOwnerKeyLoaded(
-					handlerFunc, 
-					context, 
-					ok,
-					cKeyFileName,
-				)
-
-				C.free(unsafe.Pointer(cKeyFileName))
-			}
-		},
-	)
+// applies a change to the given config and saves it if the change
+// reports that it modified the config. the change is made while the
+// save lock is held so that a concurrent save does not write it
+// partially applied and must not save the config itself. a change
+// that fails must leave the config unmodified. a lock error is
+// returned if the config has since been unloaded.
+func updateConfig(cfg config.Config, change func() (bool, error)) error {
+	configSaveMx.Lock()
+	defer configSaveMx.Unlock()
+
+	if cfg == nil || cfg != currentConfig() {
+		return newError(SN_ERROR_LOCK, "the configuration was unloaded before it could be updated")
+	}
+	changed, err := change()
+	if err != nil || !changed {
+		return err
+	}
+	if err = cfg.Save(); err != nil {
+		return storageError(err)
+	}
+	return nil
 }
 
-//export snSettingsSave
-func snSettingsSave(
-	dlgContext uintptr, 
-	deviceName *C.char, 
-	deviceLockPassphrase *C.char, 
-	unlockedTimeout int, 
-	handler uintptr,
-) {
-	context := unsafe.Pointer(dlgContext)
-	handlerFunc := unsafe.Pointer(handler)
-
-	configInitializer.Save(
-		C.GoString(deviceName),
-		C.GoString(deviceLockPassphrase),
-		ClientType,
-		Version,
-		unlockedTimeout,
-
-		func(err error) {
-			if uintptr(handlerFunc) != 0 {
-
-				ok := C.uchar(1)
-				if err != nil {
-					ok = C.uchar(0)
-				}
-
-				C.onDone(
-					handlerFunc, 
-					context, 
-					ok,
-				)
-			}
-		},
-	)
+// A config whose saves are serialized via saveConfig. it is
+// passed to library code that saves the config it is given.
+type serializedConfig struct {
+	config.Config
 }
 
-func getServiceConfig() api.ServiceConfig {
-	return api.ServiceConfig{			
-		// AWS Region
-		Region: AWS_COGNITO_REGION,
-		// Cognito user pool ID
-		UserPoolID: AWS_COGNITO_USER_POOL_ID,
-		// User pool resource app 
-		// client ID and secret
-		CliendID: CLIENT_ID,
-		ClientSecret: CLIENT_SECRET,
-		// Endpoint URLs
-		AuthURL: AUTH_URL,
-		TokenURL: TOKEN_URL,
-		ApiURL: AWS_USERSPACE_API_URL,
-	}
+func (c serializedConfig) Save() error {
+	return saveConfig(c.Config)
 }
@@ -21,13 +21,54 @@ extern const SN_CFG_STATUS SN_CFG_STATUS_LOGGED_IN;
 extern const SN_CFG_STATUS SN_CFG_STATUS_LOGGED_OUT;
 extern const SN_CFG_STATUS SN_CFG_STATUS_LOCKED;
 
+typedef unsigned char SN_ERROR_CODE;
+extern const SN_ERROR_CODE SN_ERROR_NONE;
+extern const SN_ERROR_CODE SN_ERROR_UNKNOWN;
+extern const SN_ERROR_CODE SN_ERROR_LOCK;
+extern const SN_ERROR_CODE SN_ERROR_AUTH;
+extern const SN_ERROR_CODE SN_ERROR_NETWORK;
+extern const SN_ERROR_CODE SN_ERROR_STORAGE;
+extern const SN_ERROR_CODE SN_ERROR_VALIDATION;
+extern const SN_ERROR_CODE SN_ERROR_CANCELLED;
+
 // Callback function types
 
-typedef void (*post_status_change)(void *context, const SN_CFG_STATUS status);
+// The event JSON describes the status change and contains the
+// fields kind, status, reason, timestamp and optionally username,
+// deviceUser, error and errorCode. It is only valid for the duration of
+// the callback. The kind is "status" for a change of the status or
+// "deviceUser" for a change of the access of the device user given
+// by deviceUser in which case the status is the current status.
+typedef void (*post_status_change)(
+  void *context, 
+  const SN_CFG_STATUS status, 
+  const char *eventJSON);
 typedef void (*on_done)(void *context, const BOOL ok);
+typedef void (*on_login_done)(
+  void *context, 
+  const BOOL ok, 
+  const BOOL cancelled);
+typedef void (*on_device_code)(
+  void *context, 
+  const char *verificationURI, 
+  const char *userCode, 
+  const char *verificationURIComplete, 
+  const int expiresIn);
+
+// The get function returns false if the secret could not be
+// read. Otherwise it sets value to a copy of the secret allocated
+// with malloc, which is freed by the caller, or to NULL if the
+// secret does not exist.
+typedef BOOL (*get_secret)(void *context, const char *name, char **value);
+typedef BOOL (*set_secret)(
+  void *context, 
+  const char *name, 
+  const char *value);
+typedef BOOL (*delete_secret)(void *context, const char *name);
 
 typedef void (*on_settings_init)(
   void *context, 
+  const unsigned long session, 
   const BOOL ok, 
   const BOOL isInitialized,
   const char *deviceUser, 
@@ -36,6 +77,7 @@ typedef void (*on_settings_init)(
   const int unlockedTimeout);
 typedef void (*on_settings_device_owner_logged_in)(
   void *context, 
+  const BOOL ok,
   const char *username, 
   const char *deviceName, 
   const BOOL needsKey);
@@ -43,39 +85,295 @@ typedef void (*on_settings_owner_key_loaded)(
   void *context, 
   const BOOL ok,
   const char *keyFile);
+// The validation JSON has the fields valid, passphraseScore and
+// errors, which is a list of the fields that are not valid with
+// the fields field, code and message.
+typedef void (*on_settings_validated)(
+  void *context, 
+  const BOOL ok,
+  const char *validationJSON);
+
+typedef void (*on_device_users_loaded)(
+  void *context, 
+  const BOOL ok,
+  const char *usersJSON);
+
+typedef void (*on_spaces_loaded)(
+  void *context, 
+  const BOOL ok,
+  const char *spacesJSON);
+typedef void (*on_space_connected)(
+  void *context, 
+  const BOOL ok,
+  const char *tunnelConfigJSON);
+
 
+// Secret store
+
+// Selects where the system passphrase used to encrypt the keys
+// saved with the configuration is stored. The store must be
+// selected before snInitializeContext is called. If no store
+// is selected the CBS_SYSTEM_PASSPHRASE environment variable
+// or a default is used. A passphrase is created in the store
+// if it does not have one. The context is not initialized if
+// the passphrase cannot be read from the selected store. If
+// the path of the file store is NULL a default path is used.
+// The key of the file store is derived from its passphrase
+// and a salt saved next to the store or if its passphrase is
+// NULL a random key is saved next to the store.
+extern const SN_ERROR_CODE snUseFileSecretStore(const char *path, const char *passphrase);
+extern const SN_ERROR_CODE snUseMemorySecretStore(const char *systemPassphrase);
+extern const SN_ERROR_CODE snUseHostSecretStore(
+  void *context, 
+  get_secret getFunc, 
+  set_secret setFunc, 
+  delete_secret deleteFunc);
 
 // Application context apis
 
-extern void snRegisterStatusChangeHandler(void *context, post_status_change handler);
+extern unsigned long snRegisterStatusChangeHandler(void *context, post_status_change handler);
+// Once unregistering returns the handler will not be called again.
+// If the handler is being called on another thread unregistering
+// waits for that call to return. A handler may unregister itself.
+extern void snUnregisterStatusChangeHandler(unsigned long handlerID);
 
-extern const BOOL snInitializeContext(const char *passphrase);
+// Synchronous operations return an SN_ERROR_CODE which is
+// SN_ERROR_NONE if they succeed. Otherwise the error is also
+// recorded and can be retrieved via snOperationError. Calls
+// that return a BOOL are predicates that do not fail.
+extern const SN_ERROR_CODE snInitializeContext(const char *passphrase);
 
-extern void snLogin(void *context, on_done handler);
-extern const BOOL snLogout();
+// A login that is cancelled or that is not completed within
+// the login timeout calls the handler with cancelled set.
+extern void snLogin(void *context, on_login_done handler);
+extern const SN_ERROR_CODE snCancelLogin();
+extern void snSetLoginTimeout(const int timeoutSecs);
+// Logs in without a dialog host by having the user enter the
+// code passed to the code handler at the verification URI on
+// another device. If the code handler is NULL the code is
+// printed to stdout. The login can be cancelled and times
+// out like snLogin. It is only available in environments
+// with a device authorization endpoint which is set via
+// the deviceAuthURL field of the environment JSON built in
+// with -ldflags "-X main.prodEnvironment=..." or added with
+// snAddEnvironment. snListEnvironments reports whether an
+// environment supports it via supportsDeviceCode. In any
+// other environment the handler is called with ok set to
+// false and the error code SN_ERROR_VALIDATION.
+extern void snLoginWithDeviceCode(
+  void *context, 
+  on_device_code codeHandler, 
+  on_login_done handler);
+extern const SN_ERROR_CODE snLogout();
 extern const char *snLoggedInUser();
 extern const BOOL snIsLoggedInUserOwner();
+// Returns the logged in user's profile as JSON with the fields
+// userID, username, email, displayName, groups, issuedAt and
+// expiresAt in milliseconds since the epoch and isOwner.
+extern const char *snUserProfile();
+
+// Locks the device after the unlocked timeout has elapsed
+// without activity. The host should call snTouchActivity
+// on user interaction to reset the timer.
+extern void snTouchActivity();
+extern const SN_ERROR_CODE snLock();
 
+// The EULA is accepted only if the accepted version and hash
+// match the EULA bundled with the client, so the user needs to
+// accept it again when the bundled EULA changes. The status is
+// returned as JSON with the fields version, hash, url,
+// acceptedVersion, acceptedHash, acceptedAt in milliseconds
+// since the epoch and needsAcceptance.
 extern const BOOL snEULAAccepted();
-extern void snSetEULAAccepted();
+extern const SN_ERROR_CODE snSetEULAAccepted();
+extern const char *snEULAStatus();
+
+// Error details
+
+// When a call fails its error is recorded and can be retrieved
+// as JSON with the fields code, kind, message, retryable,
+// operation and timestamp. The operation is the name of the
+// failed call i.e. "snLogin". NULL is returned if no error
+// has been recorded.
+extern const char *snLastError();
+extern const SN_ERROR_CODE snLastErrorCode();
+extern const char *snOperationError(const char *operation);
+extern void snClearLastError();
+
+// Audit log
+
+// Security relevant events such as unlock attempts, logins,
+// logouts, owner resets, key loads and settings changes are
+// appended to a hash-chained log whose hashes are keyed with a
+// secret from the secret store. The events between from and
+// to, in milliseconds since the epoch, of the given comma
+// separated types are returned as JSON with the fields events
+// and verified, which is false if the chain of hashes has been
+// broken or events have been removed from the end of the log,
+// and brokenAt. A zero time or NULL types does not
+// filter the events. The event types are unlock, lock, login,
+// logout, ownerReset, keyLoad, settingsSave, passphraseChange,
+// deviceUser, configExport and configImport.
+extern const char *snAuditEvents(
+  const long long from, 
+  const long long to, 
+  const char *types);
+
+// Configuration backup
+
+// Exports an encrypted backup of the saved configuration of the
+// active profile, including the device owner's key when it is
+// available and the profile and EULA metadata, to a file which
+// can be restored on another device with the backup passphrase.
+extern const SN_ERROR_CODE snExportConfigBackup(
+  const char *path, 
+  const char *backupPassphrase);
+// Validates a backup and restores it into the active profile.
+// The device must be unlocked and, if it has an owner, the
+// owner must be logged in. The context is re-initialized from
+// the restored configuration and the resulting status is
+// posted. Returns JSON with the fields profile, createdAt,
+// environment and ownerKeyFile, which is the file the backed
+// up owner key was restored to, or NULL if the backup could
+// not be restored. The restored owner key is protected with
+// the backup passphrase and the file is removed once the key
+// has been loaded via snSettingsLoadUserKey.
+extern const char *snImportConfigBackup(
+  const char *path, 
+  const char *backupPassphrase);
+
+// Configuration profiles
+
+extern const char *snListProfiles();
+extern const char *snActiveProfile();
+extern const SN_ERROR_CODE snCreateProfile(const char *name);
+extern const SN_ERROR_CODE snDeleteProfile(const char *name);
+extern const SN_ERROR_CODE snSwitchProfile(const char *name);
+
+// Service environments
+
+extern const char *snListEnvironments();
+extern const SN_ERROR_CODE snAddEnvironment(const char *environmentJSON);
+extern const SN_ERROR_CODE snRemoveEnvironment(const char *name);
+extern const SN_ERROR_CODE snSetEnvironment(const char *name);
 
 // AppConfig Settings Initialization and Update
 
-extern void snSettingsInit(void *context, on_settings_init handler);
+// Settings are edited within a session. The session handle
+// returned by snSettingsBegin is passed to the other settings
+// functions and is 0 if the session could not be started in
+// which case the handler is called with ok set to false. The
+// handler is called before snSettingsBegin returns so it is
+// also given the session handle. The
+// session ends when its settings are saved successfully or
+// when snSettingsCancel discards the unsaved changes.
+extern unsigned long snSettingsBegin(void *context, on_settings_init handler);
 
 extern void snSettingsResetDeviceOwner(
+  unsigned long session, 
   void *context, 
   on_settings_device_owner_logged_in handler);
+// The owner's key file may be protected with a passphrase. The
+// format of an existing key file is detected when it is loaded
+// and the user is prompted for its passphrase if it is encrypted.
+// A created key file is saved in the given format which is "pem"
+// for a plain key, "encryptedPEM" for an encrypted PEM key or
+// "pkcs8" for an encrypted PKCS#8 key. If the format is NULL a
+// plain key is created. The decrypted key of an encrypted key
+// file is never written to disk.
 extern void snSettingsLoadUserKey(
+  unsigned long session, 
   void *context, 
   const char *keyFile, 
+  const char *keyFormat, 
   const BOOL createKey, 
   on_settings_owner_key_loaded handler);
 extern void snSettingsSave(
+  unsigned long session, 
   void *context, 
   const char *deviceName, 
   const char *deviceLockPassphrase, 
   const int unlockedTimeout, 
   on_done handler);
+extern const SN_ERROR_CODE snSettingsCancel(unsigned long session);
+
+// Validates the settings before they are saved so the settings
+// form can show the errors next to its fields. The device name
+// must be at most 64 letters, digits, spaces or . - _ ' and must
+// not be the name of another of the logged in user's devices.
+// The passphrase strength is scored from 0 to 4 and must score
+// at least 2. The unlocked timeout must be between 15 and 1440
+// minutes. The passphrase and timeout are only validated if a
+// passphrase is given. If the device name could not be checked
+// with the MyCS service ok is false but the errors of the other
+// fields are still returned.
+extern void snSettingsValidate(
+  unsigned long session, 
+  void *context, 
+  const char *deviceName, 
+  const char *deviceLockPassphrase, 
+  const int unlockedTimeout, 
+  on_settings_validated handler);
+
+// Replaces the device owner's key with a new key which is
+// registered with the MyCS service and saved to keyFile. The
+// old key file is securely deleted. If oldKeyFile is NULL or
+// the same as keyFile the key file is replaced. The owner must
+// be logged in and the session must not have unsaved changes.
+// The new key file is saved in the format of the key file it
+// replaces and the user is prompted for a passphrase to protect
+// it with if that key file is encrypted. On failure the old key
+// is restored.
+extern void snSettingsRotateUserKey(
+  unsigned long session, 
+  void *context, 
+  const char *keyFile, 
+  const char *oldKeyFile, 
+  on_settings_owner_key_loaded handler);
+
+extern void snChangeDeviceLockPassphrase(
+  void *context, 
+  const char *oldPassphrase, 
+  const char *newPassphrase, 
+  on_done handler);
+
+// Device users
+
+// Only the owner of the device can manage its users. Users are
+// returned as a JSON list with the fields userID, username,
+// status ("active", "pending" or "inactive") and isOwner.
+// Approving or revoking a user's access posts a status change
+// with the user in the deviceUser field of the event.
+extern void snListDeviceUsers(void *context, on_device_users_loaded handler);
+extern void snApproveDeviceUser(
+  void *context, 
+  const char *username, 
+  on_done handler);
+extern void snRevokeDeviceUser(
+  void *context, 
+  const char *username, 
+  on_done handler);
+
+// Space node discovery
+
+// The spaces JSON is an array of the spaces the logged in user has
+// access to with the fields spaceID, spaceName, isOwned, ownerName,
+// accessLevel, isEgressNode, recipe, iaas, region, version, status,
+// isRunning, lastSeen and endpoints.
+
+extern void snListSpaces(void *context, on_spaces_loaded handler);
+extern void snRefreshSpaces(void *context, on_spaces_loaded handler);
+
+extern void snConnectSpace(
+  void *context, 
+  const char *spaceID, 
+  on_space_connected handler);
+extern const SN_ERROR_CODE snDisconnectSpace(const char *spaceID);
+
+// Monitor service
+
+extern const SN_ERROR_CODE snStartMonitors();
+extern void snStopMonitors();
+extern const SN_ERROR_CODE snMonitorTunnelStats(const char *spaceID, const char *uapiConfig);
 
 #endif
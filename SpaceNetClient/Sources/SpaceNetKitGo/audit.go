@@ -0,0 +1,438 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import "C"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// sequence number and hash of the last event
+	// in the log which are loaded on first append
+	auditSeq      uint64
+	auditLastHash string
+	auditLoaded   bool
+	auditMx       sync.Mutex
+)
+
+const (
+	AUDIT_UNLOCK            = "unlock"
+	AUDIT_LOCK              = "lock"
+	AUDIT_LOGIN             = "login"
+	AUDIT_LOGOUT            = "logout"
+	AUDIT_OWNER_RESET       = "ownerReset"
+	AUDIT_KEY_LOAD          = "keyLoad"
+	AUDIT_KEY_ROTATE        = "keyRotate"
+	AUDIT_SETTINGS_SAVE     = "settingsSave"
+	AUDIT_PASSPHRASE_CHANGE = "passphraseChange"
+	AUDIT_DEVICE_USER       = "deviceUser"
+	AUDIT_CONFIG_EXPORT     = "configExport"
+	AUDIT_CONFIG_IMPORT     = "configImport"
+
+	// hash preceding the first event of the log
+	AUDIT_GENESIS_HASH = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	// name of the secret the events of the log are
+	// hashed with and its length in bytes
+	AUDIT_KEY_SECRET = "auditKey"
+	AUDIT_KEY_LENGTH = 32
+)
+
+// A security relevant event. Each event contains the hash of
+// the event before it so that modifying or removing an event
+// breaks the chain of hashes that follow it. The hashes are
+// keyed with a secret so that the chain cannot be recomputed
+// by someone who is only able to modify the log.
+type auditEvent struct {
+	Seq       uint64 `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+	Type      string `json:"type"`
+	Success   bool   `json:"success"`
+
+	Profile  string `json:"profile"`
+	Username string `json:"username,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// JSON representation of the filtered audit log
+// returned to the host application
+type auditEvents struct {
+	Events []*auditEvent `json:"events"`
+
+	// whether the chain of hashes of the complete log
+	// is intact and the first event where it is not. the
+	// log is not verified without an event it is broken
+	// at if only its head was modified or removed.
+	Verified bool   `json:"verified"`
+	BrokenAt uint64 `json:"brokenAt,omitempty"`
+}
+
+// The sequence number and hash of the last event of the log
+// which are saved outside of it so that removing events from
+// the end of the log can be detected
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac"`
+}
+
+//export snAuditEvents
+func snAuditEvents(from, to C.longlong, types *C.char) *C.char {
+
+	typeFilter := map[string]bool{}
+	if types != nil {
+		for _, t := range strings.Split(C.GoString(types), ",") {
+			if t = strings.TrimSpace(t); len(t) > 0 {
+				typeFilter[t] = true
+			}
+		}
+	}
+
+	events, err := readAuditEvents(int64(from), int64(to), typeFilter)
+	if err != nil {
+		_ = setLastError("snAuditEvents", storageError(err))
+		return nil
+	}
+	eventsJSON, err := json.Marshal(events)
+	if err != nil {
+		_ = setLastError("snAuditEvents", err)
+		return nil
+	}
+	return C.CString(string(eventsJSON))
+}
+
+// appends an event of the logged in user to the audit log
+func auditLog(eventType, detail string, err error) {
+	username := ""
+	if cfg := currentConfig(); cfg != nil {
+		username = cfg.DeviceContext().GetLoggedInUserName()
+	}
+	auditLogForUser(eventType, username, detail, err)
+}
+
+// appends an event to the audit log. failures to write to the
+// log are logged but do not fail the operation being audited.
+func auditLogForUser(eventType, username, detail string, err error) {
+
+	event := &auditEvent{
+		Timestamp: time.Now().UnixMilli(),
+		Type:      eventType,
+		Success:   err == nil,
+		Profile:   activeProfile(),
+		Username:  username,
+		Detail:    detail,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if err = appendAuditEvent(event); err != nil {
+		logger.ErrorMessage("Failed to write '%s' event to audit log: %s", eventType, err.Error())
+	}
+}
+
+func auditFile() string {
+	return filepath.Join(homeDir, ".cb", "spacenet-audit.log")
+}
+
+func auditHeadFile() string {
+	return filepath.Join(homeDir, ".cb", "spacenet-audit.head")
+}
+
+// returns the key the events of the log are hashed with. it is
+// kept in the active secret store or if no store has been
+// selected in a key file that is only readable by the user.
+func auditKey() ([]byte, error) {
+
+	secretStoreMx.Lock()
+	store := activeSecretStore
+	secretStoreMx.Unlock()
+
+	if store == nil {
+		return readOrCreateRandomFile(filepath.Join(homeDir, ".cb", "spacenet-audit.key"), AUDIT_KEY_LENGTH)
+	}
+	key, err := randomSecretFromStore(store, AUDIT_KEY_SECRET, AUDIT_KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(key)
+}
+
+func appendAuditEvent(event *auditEvent) error {
+
+	var (
+		err error
+	)
+
+	auditMx.Lock()
+	defer auditMx.Unlock()
+
+	key, err := auditKey()
+	if err != nil {
+		return err
+	}
+	if !auditLoaded {
+		if err = loadAuditHead(key); err != nil {
+			return err
+		}
+		auditLoaded = true
+	}
+
+	event.Seq = auditSeq + 1
+	event.PrevHash = auditLastHash
+	if event.Hash, err = auditEventHash(key, event); err != nil {
+		return err
+	}
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(auditFile()), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(auditFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(eventJSON, '\n')); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	auditSeq = event.Seq
+	auditLastHash = event.Hash
+
+	return writeAuditHead(key, event.Seq, event.Hash)
+}
+
+// loads the sequence number and hash of the last event of the
+// log. events are appended after the saved head if it is not
+// in the log so that events removed from the end of the log
+// remain detectable. must be called with the lock held.
+func loadAuditHead(key []byte) error {
+
+	auditSeq = 0
+	auditLastHash = AUDIT_GENESIS_HASH
+
+	head, valid, err := readAuditHead(key)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		logger.ErrorMessage("The head of the audit log has been modified")
+	}
+
+	// the log extends past its head if the
+	// head could not be saved after an append
+	var last *auditEvent
+	headFound := head == nil
+	if err = scanAuditLog(func(event *auditEvent) {
+		if event != nil {
+			if head != nil && event.Seq == head.Seq && event.Hash == head.Hash {
+				headFound = true
+			}
+			last = event
+		}
+	}); err != nil {
+		return err
+	}
+	if headFound {
+		if last != nil {
+			auditSeq = last.Seq
+			auditLastHash = last.Hash
+		}
+	} else {
+		auditSeq = head.Seq
+		auditLastHash = head.Hash
+	}
+	return nil
+}
+
+// reads the head of the log. the head is nil if it has not
+// been saved and not valid if it has been modified.
+func readAuditHead(key []byte) (*auditHead, bool, error) {
+
+	data, err := os.ReadFile(auditHeadFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	head := &auditHead{}
+	if err = json.Unmarshal(data, head); err != nil {
+		logger.ErrorMessage("The head of the audit log is not valid: %s", err.Error())
+		return nil, false, nil
+	}
+	mac, err := hex.DecodeString(head.MAC)
+	if err != nil || !hmac.Equal(mac, auditHeadMAC(key, head.Seq, head.Hash)) {
+		return head, false, nil
+	}
+	return head, true, nil
+}
+
+// saves the head of the log. it is written to a temporary
+// file and renamed so a failed write does not corrupt it.
+func writeAuditHead(key []byte, seq uint64, hash string) error {
+
+	data, err := json.Marshal(&auditHead{
+		Seq:  seq,
+		Hash: hash,
+		MAC:  hex.EncodeToString(auditHeadMAC(key, seq, hash)),
+	})
+	if err != nil {
+		return err
+	}
+	tmpFile := auditHeadFile() + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, auditHeadFile())
+}
+
+func auditHeadMAC(key []byte, seq uint64, hash string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%s", seq, hash)
+	return mac.Sum(nil)
+}
+
+// returns the events of the log within the given time range in
+// milliseconds since the epoch and of the given types. a zero
+// time or an empty set of types does not filter the events.
+func readAuditEvents(from, to int64, types map[string]bool) (*auditEvents, error) {
+
+	auditMx.Lock()
+	defer auditMx.Unlock()
+
+	key, err := auditKey()
+	if err != nil {
+		return nil, err
+	}
+	head, valid, err := readAuditHead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &auditEvents{
+		Events:   []*auditEvent{},
+		Verified: true,
+	}
+	prevHash := AUDIT_GENESIS_HASH
+	prevSeq := uint64(0)
+	headFound := head == nil
+
+	if err = scanAuditLog(func(event *auditEvent) {
+		if event == nil {
+			if result.Verified {
+				result.Verified = false
+				result.BrokenAt = prevSeq + 1
+			}
+			return
+		}
+		prevSeq = event.Seq
+		if head != nil && event.Seq == head.Seq && event.Hash == head.Hash {
+			headFound = true
+		}
+
+		if result.Verified {
+			hash, err := auditEventHash(key, event)
+			if err != nil || !hmac.Equal([]byte(hash), []byte(event.Hash)) || event.PrevHash != prevHash {
+				result.Verified = false
+				result.BrokenAt = event.Seq
+			}
+			prevHash = event.Hash
+		}
+		if (from > 0 && event.Timestamp < from) ||
+			(to > 0 && event.Timestamp > to) ||
+			(len(types) > 0 && !types[event.Type]) {
+			return
+		}
+		result.Events = append(result.Events, event)
+	}); err != nil {
+		return nil, err
+	}
+
+	// events have been removed from the end of the log if
+	// it does not contain its head. a log with events but
+	// no head has had its head removed.
+	if result.Verified {
+		if !headFound {
+			result.Verified = false
+			result.BrokenAt = prevSeq + 1
+		} else if !valid || (head == nil && prevSeq > 0) {
+			result.Verified = false
+		}
+	}
+	return result, nil
+}
+
+// calls the handler with each event of the log. the handler
+// is called with nil for lines that are not valid events.
+func scanAuditLog(handleEvent func(event *auditEvent)) error {
+
+	file, err := os.Open(auditFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		event := &auditEvent{}
+		if err = json.Unmarshal(data, event); err != nil {
+			logger.ErrorMessage("Audit log line %d is not a valid event: %s", line, err.Error())
+			event = nil
+		}
+		handleEvent(event)
+	}
+	return scanner.Err()
+}
+
+// returns the keyed hash of an event which covers all
+// its fields including the hash of the prior event
+func auditEventHash(key []byte, event *auditEvent) (string, error) {
+
+	unhashed := *event
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+// starts an empty audit log in a temporary home directory
+// with its key kept in a memory secret store
+func newTestAuditLog(t *testing.T) *memorySecretStore {
+
+	newTestContext(t)
+
+	store := newMemorySecretStore()
+	useSecretStore(t, store)
+
+	resetAuditLog()
+	t.Cleanup(resetAuditLog)
+	return store
+}
+
+// forces the head of the log to be loaded
+// again as if the client was restarted
+func resetAuditLog() {
+	auditMx.Lock()
+	defer auditMx.Unlock()
+
+	auditLoaded = false
+}
+
+func readAuditLines(t *testing.T) [][]byte {
+	data, err := os.ReadFile(auditFile())
+	if err != nil {
+		t.Fatalf("failed to read the audit log: %s", err.Error())
+	}
+	return bytes.Split(bytes.TrimSpace(data), []byte{'\n'})
+}
+
+func writeAuditLines(t *testing.T, lines [][]byte) {
+	data := append(bytes.Join(lines, []byte{'\n'}), '\n')
+	if err := os.WriteFile(auditFile(), data, 0600); err != nil {
+		t.Fatalf("failed to write the audit log: %s", err.Error())
+	}
+}
+
+func appendTestAuditEvents(t *testing.T) {
+	auditLogForUser(AUDIT_UNLOCK, testUsername, "", nil)
+	auditLogForUser(AUDIT_LOGIN, testUsername, "", nil)
+	auditLogForUser(AUDIT_SETTINGS_SAVE, testUsername, "name", errors.New("failed"))
+}
+
+func TestAuditLogAppendAndVerify(t *testing.T) {
+
+	store := newTestAuditLog(t)
+	appendTestAuditEvents(t)
+
+	if _, exists, _ := store.Get(AUDIT_KEY_SECRET); !exists {
+		t.Errorf("the audit key was not saved in the secret store")
+	}
+
+	result, err := readAuditEvents(0, 0, nil)
+	if err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if !result.Verified || result.BrokenAt != 0 {
+		t.Errorf("readAuditEvents() verified = %t at %d, expected an intact log", result.Verified, result.BrokenAt)
+	}
+	if len(result.Events) != 3 {
+		t.Fatalf("readAuditEvents() returned %d events, expected 3", len(result.Events))
+	}
+	prevHash := AUDIT_GENESIS_HASH
+	for i, event := range result.Events {
+		if event.Seq != uint64(i+1) || event.PrevHash != prevHash {
+			t.Errorf("event %d has seq %d and prevHash %s, expected seq %d and prevHash %s",
+				i, event.Seq, event.PrevHash, i+1, prevHash)
+		}
+		prevHash = event.Hash
+	}
+	if event := result.Events[2]; event.Success || event.Error != "failed" || event.Detail != "name" {
+		t.Errorf("failed event was not logged with its error: %+v", event)
+	}
+
+	result, err = readAuditEvents(0, 0, map[string]bool{AUDIT_LOGIN: true})
+	if err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if len(result.Events) != 1 || result.Events[0].Type != AUDIT_LOGIN || !result.Verified {
+		t.Errorf("readAuditEvents() of login events returned %v, verified %t", result.Events, result.Verified)
+	}
+
+	// the chain continues after the head is loaded again
+	resetAuditLog()
+	auditLogForUser(AUDIT_LOGOUT, testUsername, "", nil)
+
+	if result, err = readAuditEvents(0, 0, nil); err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if len(result.Events) != 4 || result.Events[3].Seq != 4 || !result.Verified {
+		t.Errorf("readAuditEvents() after reload returned %d events, verified %t", len(result.Events), result.Verified)
+	}
+}
+
+func TestAuditLogTamperDetection(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+
+		tamper func(t *testing.T, lines [][]byte) [][]byte
+
+		brokenAt uint64
+	}{
+		{
+			name: "modified event",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(AUDIT_LOGIN), []byte(AUDIT_LOGOUT), 1)
+				return lines
+			},
+			brokenAt: 2,
+		},
+		{
+			name: "rehashed event",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				event := &auditEvent{}
+				if err := json.Unmarshal(lines[1], event); err != nil {
+					t.Fatalf("invalid event: %s", err.Error())
+				}
+				// without the key the hash cannot be recomputed
+				event.Username = "intruder"
+				event.Hash, _ = auditEventHash([]byte("guessed key"), event)
+				lines[1], _ = json.Marshal(event)
+				return lines
+			},
+			brokenAt: 2,
+		},
+		{
+			name: "removed event",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				return append(lines[:1:1], lines[2:]...)
+			},
+			brokenAt: 3,
+		},
+		{
+			name: "removed last event",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				return lines[:2]
+			},
+			brokenAt: 3,
+		},
+		{
+			name: "invalid event",
+			tamper: func(t *testing.T, lines [][]byte) [][]byte {
+				lines[0] = []byte("not an event")
+				return lines
+			},
+			brokenAt: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+
+			newTestAuditLog(t)
+			appendTestAuditEvents(t)
+			writeAuditLines(t, tt.tamper(t, readAuditLines(t)))
+
+			result, err := readAuditEvents(0, 0, nil)
+			if err != nil {
+				t.Fatalf("readAuditEvents() failed: %s", err.Error())
+			}
+			if result.Verified || result.BrokenAt != tt.brokenAt {
+				t.Errorf("readAuditEvents() verified = %t at %d, expected broken at %d",
+					result.Verified, result.BrokenAt, tt.brokenAt)
+			}
+		})
+	}
+}
+
+func TestAuditLogHeadTamperDetection(t *testing.T) {
+
+	newTestAuditLog(t)
+	appendTestAuditEvents(t)
+
+	head, err := os.ReadFile(auditHeadFile())
+	if err != nil {
+		t.Fatalf("failed to read the audit log head: %s", err.Error())
+	}
+
+	// a modified head
+	if err = os.WriteFile(auditHeadFile(), bytes.Replace(head, []byte(`"seq":3`), []byte(`"seq":2`), 1), 0600); err != nil {
+		t.Fatalf("failed to write the audit log head: %s", err.Error())
+	}
+	result, err := readAuditEvents(0, 0, nil)
+	if err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if result.Verified {
+		t.Errorf("readAuditEvents() verified a log with a modified head")
+	}
+
+	// a removed head
+	if err = os.Remove(auditHeadFile()); err != nil {
+		t.Fatalf("failed to remove the audit log head: %s", err.Error())
+	}
+	if result, err = readAuditEvents(0, 0, nil); err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if result.Verified {
+		t.Errorf("readAuditEvents() verified a log without a head")
+	}
+}
+
+func TestAuditLogAppendAfterTruncation(t *testing.T) {
+
+	newTestAuditLog(t)
+	appendTestAuditEvents(t)
+	writeAuditLines(t, readAuditLines(t)[:2])
+
+	// appending must not hide the removed event
+	resetAuditLog()
+	auditLogForUser(AUDIT_LOGOUT, testUsername, "", nil)
+
+	result, err := readAuditEvents(0, 0, nil)
+	if err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if result.Verified || result.BrokenAt != 4 {
+		t.Errorf("readAuditEvents() verified = %t at %d, expected broken at 4", result.Verified, result.BrokenAt)
+	}
+}
+
+func TestAuditLogKeyedFromSecretStore(t *testing.T) {
+
+	newTestAuditLog(t)
+	appendTestAuditEvents(t)
+
+	// the log cannot be verified without its key
+	useSecretStore(t, newMemorySecretStore())
+
+	result, err := readAuditEvents(0, 0, nil)
+	if err != nil {
+		t.Fatalf("readAuditEvents() failed: %s", err.Error())
+	}
+	if result.Verified || result.BrokenAt != 1 {
+		t.Errorf("readAuditEvents() with another key verified = %t at %d, expected broken at 1",
+			result.Verified, result.BrokenAt)
+	}
+
+	// the key cannot be read from an unavailable store
+	useSecretStore(t, &failingSecretStore{})
+	if _, err = readAuditEvents(0, 0, nil); err == nil {
+		t.Errorf("readAuditEvents() succeeded without access to the secret store")
+	}
+}
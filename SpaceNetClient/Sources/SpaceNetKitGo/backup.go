@@ -0,0 +1,631 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mevansam/goutils/crypto"
+	"github.com/mevansam/goutils/logger"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SN_REASON_CONFIG_RESTORED = "configRestored"
+
+	CONFIG_BACKUP_FORMAT  = "spacenet-config-backup"
+	CONFIG_BACKUP_VERSION = 1
+
+	// scrypt parameters of the key derived
+	// from the backup passphrase
+	CONFIG_BACKUP_KEY_N    = 32768
+	CONFIG_BACKUP_KEY_R    = 8
+	CONFIG_BACKUP_KEY_P    = 1
+	CONFIG_BACKUP_SALT_LEN = 16
+
+	CONFIG_BACKUP_MAX_KEY_N  = 1 << 20
+	CONFIG_BACKUP_MAX_KEY_RP = 64
+
+	// names of the entries of the backup archive
+	BACKUP_MANIFEST_ENTRY  = "manifest.json"
+	BACKUP_CONFIG_ENTRY    = "config.yml"
+	BACKUP_OWNER_KEY_ENTRY = "owner-key.pem"
+
+	// the largest entry that is read from a backup archive
+	BACKUP_MAX_ENTRY_SIZE = 16 << 20
+
+	// name of the file the owner key of a restored backup is
+	// written to protected with the backup passphrase
+	RESTORED_OWNER_KEY_FILE = "spacenet-owner-key.pem"
+)
+
+// A backup file contains an encrypted gzipped tar archive of
+// the configuration along with the parameters required to
+// derive the archive's key from the backup passphrase
+type configBackupFile struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+
+	Salt string `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+
+	Archive string `json:"archive"`
+}
+
+// The manifest of a backup archive describes its contents
+// and the profile and EULA metadata of the configuration
+type configBackupManifest struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedAt int64  `json:"createdAt"`
+
+	ClientVersion string `json:"clientVersion"`
+	HasOwnerKey   bool   `json:"hasOwnerKey"`
+
+	Profile     *profile            `json:"profile"`
+	Environment *serviceEnvironment `json:"environment,omitempty"`
+	EULA        *eulaStatus         `json:"eula,omitempty"`
+}
+
+// JSON representation of a restored backup
+// returned to the host application
+type configRestoreInfo struct {
+	Profile      string `json:"profile"`
+	CreatedAt    int64  `json:"createdAt"`
+	Environment  string `json:"environment,omitempty"`
+	OwnerKeyFile string `json:"ownerKeyFile,omitempty"`
+}
+
+// the entries of a decrypted backup archive
+type configBackup struct {
+	manifest *configBackupManifest
+
+	config        []byte
+	configModTime time.Time
+	ownerKey      []byte
+}
+
+//export snExportConfigBackup
+func snExportConfigBackup(path, backupPassphrase *C.char) C.SN_ERROR_CODE {
+
+	err := exportConfigBackup(C.GoString(path), C.GoString(backupPassphrase))
+	auditLog(AUDIT_CONFIG_EXPORT, C.GoString(path), err)
+	if err != nil {
+		return setLastErrorCode("snExportConfigBackup", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snImportConfigBackup
+func snImportConfigBackup(path, backupPassphrase *C.char) *C.char {
+
+	info, err := importConfigBackup(C.GoString(path), C.GoString(backupPassphrase))
+	auditLog(AUDIT_CONFIG_IMPORT, C.GoString(path), err)
+	if err != nil {
+		_ = setLastError("snImportConfigBackup", err)
+		return nil
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		_ = setLastError("snImportConfigBackup", err)
+		return nil
+	}
+	return C.CString(string(infoJSON))
+}
+
+// writes an encrypted backup of the saved configuration of
+// the active profile. the owner's key is only included if it
+// is available in the configuration i.e. when the device was
+// last saved while the owner was logged in.
+func exportConfigBackup(path, backupPassphrase string) error {
+
+	var (
+		err error
+
+		fileInfo os.FileInfo
+	)
+
+	cfg := currentConfig()
+	if cfg == nil {
+		return newError(SN_ERROR_LOCK, "the device is locked")
+	}
+	if len(path) == 0 {
+		return newError(SN_ERROR_VALIDATION, "the backup file path cannot be empty")
+	}
+	if len(backupPassphrase) == 0 {
+		return newError(SN_ERROR_VALIDATION, "the backup passphrase cannot be empty")
+	}
+
+	// the file modification time is the seed of the config's
+	// encryption key so it is retained in the archive
+	configFile := activeProfileConfigFile()
+	backup := &configBackup{}
+	if fileInfo, err = os.Stat(configFile); err != nil {
+		return storageError(err)
+	}
+	if backup.config, err = os.ReadFile(configFile); err != nil {
+		return storageError(err)
+	}
+	backup.configModTime = fileInfo.ModTime()
+
+	if owner := cfg.DeviceContext().GetOwner(); owner != nil && len(owner.RSAPrivateKey) > 0 {
+		backup.ownerKey = []byte(owner.RSAPrivateKey)
+	}
+
+	backup.manifest = &configBackupManifest{
+		Format:        CONFIG_BACKUP_FORMAT,
+		Version:       CONFIG_BACKUP_VERSION,
+		CreatedAt:     time.Now().UnixMilli(),
+		ClientVersion: Version,
+		HasOwnerKey:   len(backup.ownerKey) > 0,
+		Profile:       activeProfileMetadata(),
+	}
+	if env := getEnvironment(); !env.BuiltIn {
+		// environments added by the user are not
+		// available on the device being restored
+		backup.manifest.Environment = env
+	}
+	if backup.manifest.EULA, err = getEULAStatus(); err != nil {
+		logger.ErrorMessage("Exporting configuration backup without EULA status: %s", err.Error())
+	}
+
+	archive, err := backup.pack()
+	if err != nil {
+		return err
+	}
+	backupData, err := encryptConfigBackup(archive, backupPassphrase)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return storageError(err)
+	}
+	tmpFile := path + ".tmp"
+	if err = os.WriteFile(tmpFile, backupData, 0600); err != nil {
+		return storageError(err)
+	}
+	if err = os.Rename(tmpFile, path); err != nil {
+		return storageError(err)
+	}
+	logger.DebugMessage("Exported configuration backup of profile '%s' to: %s", backup.manifest.Profile.Name, path)
+	return nil
+}
+
+// validates a backup and restores it into the active profile.
+// the replaced config file is retained next to the restored
+// file. the context is re-initialized from the restored
+// configuration which posts the resulting status. a configured
+// device can only be restored by its owner.
+func importConfigBackup(path, backupPassphrase string) (*configRestoreInfo, error) {
+
+	var (
+		err error
+
+		backupData []byte
+		archive    []byte
+		backup     *configBackup
+	)
+
+	cfg := currentConfig()
+	if cfg == nil {
+		return nil, newError(SN_ERROR_LOCK, "the device is locked")
+	}
+	deviceContext := cfg.DeviceContext()
+	if ownerName, isOwnerConfigured := deviceContext.GetOwnerUserName(); isOwnerConfigured &&
+		(!cfg.AuthContext().IsLoggedIn() || ownerName != deviceContext.GetLoggedInUserName()) {
+		return nil, newError(SN_ERROR_AUTH, "only the owner of the device can restore a configuration backup")
+	}
+	if len(backupPassphrase) == 0 {
+		return nil, newError(SN_ERROR_VALIDATION, "the backup passphrase cannot be empty")
+	}
+	if backupData, err = os.ReadFile(path); err != nil {
+		return nil, storageError(err)
+	}
+	if archive, err = decryptConfigBackup(backupData, backupPassphrase); err != nil {
+		return nil, err
+	}
+	if backup, err = unpackConfigBackup(archive); err != nil {
+		return nil, err
+	}
+
+	info := &configRestoreInfo{
+		Profile:   activeProfile(),
+		CreatedAt: backup.manifest.CreatedAt,
+	}
+	configFile := activeProfileConfigFile()
+	replacedFile := configFile + ".pre-restore"
+
+	if _, err = os.Stat(configFile); err == nil {
+		if err = copyConfigFile(configFile, replacedFile); err != nil {
+			return nil, storageError(err)
+		}
+	} else if os.IsNotExist(err) {
+		// a replaced file left by an earlier restore must not
+		// be restored if this restore fails
+		if err = os.Remove(replacedFile); err != nil && !os.IsNotExist(err) {
+			return nil, storageError(err)
+		}
+	} else {
+		return nil, storageError(err)
+	}
+
+	// tear down the state of the replaced configuration
+	resetContext()
+	postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_CONFIG_RESTORED, nil)
+
+	if err = writeConfigFile(configFile, backup.config, backup.configModTime); err != nil {
+		restoreReplacedConfig(configFile, replacedFile)
+		return nil, storageError(err)
+	}
+	if info.Environment, err = restoreProfileEnvironment(backup.manifest); err != nil {
+		logger.ErrorMessage("Unable to restore environment of the backed up profile: %s", err.Error())
+	}
+	if backup.manifest.HasOwnerKey {
+		info.OwnerKeyFile = restoredOwnerKeyFile()
+		if err = writeRestoredOwnerKey(info.OwnerKeyFile, backup.ownerKey, backupPassphrase); err != nil {
+			restoreReplacedConfig(configFile, replacedFile)
+			return nil, err
+		}
+	}
+
+	if snInitializeContext(nil) != SN_ERROR_NONE {
+		err = newError(SN_ERROR_STORAGE, "the restored configuration could not be loaded")
+		logger.ErrorMessage("Restoring replaced config file as the restored configuration cannot be loaded")
+		resetContext()
+		if len(info.OwnerKeyFile) > 0 {
+			_ = os.Remove(info.OwnerKeyFile)
+		}
+		restoreReplacedConfig(configFile, replacedFile)
+		_ = snInitializeContext(nil)
+		return nil, err
+	}
+	logger.DebugMessage("Restored configuration backup '%s' into profile '%s'", path, info.Profile)
+	return info, nil
+}
+
+// returns the file the owner key of a restored backup is written to
+func restoredOwnerKeyFile() string {
+	return filepath.Join(filepath.Dir(activeProfileConfigFile()), RESTORED_OWNER_KEY_FILE)
+}
+
+// writes the owner key of a restored backup to the given file as
+// an encrypted PKCS#8 key protected with the backup passphrase.
+// the file is removed once the key has been loaded.
+func writeRestoredOwnerKey(path string, ownerKey []byte, backupPassphrase string) error {
+
+	var (
+		err error
+
+		key    *crypto.RSAKey
+		keyPEM []byte
+	)
+
+	if key, err = readOwnerKey(ownerKey, nil); err != nil {
+		return err
+	}
+	if keyPEM, err = encryptOwnerKey(key, OWNER_KEY_FORMAT_PKCS8, []byte(backupPassphrase)); err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, keyPEM, 0600); err != nil {
+		return storageError(err)
+	}
+	return nil
+}
+
+// returns the metadata of the active profile
+func activeProfileMetadata() *profile {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		logger.ErrorMessage("Failed to load profiles: %s", err.Error())
+		return &profile{Name: DEFAULT_PROFILE}
+	}
+	return p.Profiles[p.Active]
+}
+
+// selects the environment of the backed up profile for the
+// active profile adding it if it was added by the user and
+// returns the name of the environment selected
+func restoreProfileEnvironment(manifest *configBackupManifest) (string, error) {
+
+	var (
+		err error
+	)
+
+	if manifest.Profile == nil || len(manifest.Profile.Environment) == 0 {
+		return "", nil
+	}
+	envName := manifest.Profile.Environment
+
+	envs, err := loadEnvironments()
+	if err != nil {
+		return "", err
+	}
+	if _, exists := envs[envName]; !exists {
+		if manifest.Environment == nil || manifest.Environment.Name != envName {
+			return "", newError(SN_ERROR_VALIDATION, "environment '%s' is not available", envName)
+		}
+		envJSON, err := json.Marshal(manifest.Environment)
+		if err != nil {
+			return "", err
+		}
+		if err = addEnvironment(string(envJSON)); err != nil {
+			return "", err
+		}
+	}
+	if err = setProfileEnvironment(envName); err != nil {
+		return "", err
+	}
+	resetEnvironment()
+	return envName, nil
+}
+
+// restores the config file that was replaced by a restore. if
+// no file was replaced the restored file is removed so that a
+// new configuration is created when the context is initialized.
+func restoreReplacedConfig(configFile, replacedFile string) {
+	configSaveMx.Lock()
+	defer configSaveMx.Unlock()
+
+	if _, err := os.Stat(replacedFile); os.IsNotExist(err) {
+		if err = os.Remove(configFile); err != nil && !os.IsNotExist(err) {
+			logger.ErrorMessage("Failed to remove restored config file '%s': %s", configFile, err.Error())
+		}
+		return
+	} else if err != nil {
+		logger.ErrorMessage("Failed to read replaced config file '%s': %s", replacedFile, err.Error())
+		return
+	}
+	if err := copyConfigFile(replacedFile, configFile); err != nil {
+		logger.ErrorMessage("Failed to restore config file from '%s': %s", replacedFile, err.Error())
+	}
+}
+
+// writes a config file with the given modification time
+// via a temporary file so a failed write does not leave
+// a partially written config file
+func writeConfigFile(configFile string, data []byte, modTime time.Time) error {
+
+	var (
+		err error
+	)
+
+	configSaveMx.Lock()
+	defer configSaveMx.Unlock()
+
+	if err = os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+		return err
+	}
+	tmpFile := configFile + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmpFile, modTime, modTime); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, configFile)
+}
+
+// returns the backup as a gzipped tar archive
+func (b *configBackup) pack() ([]byte, error) {
+
+	var (
+		err error
+
+		buffer bytes.Buffer
+	)
+
+	manifestJSON, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	addEntry := func(name string, data []byte, modTime time.Time) error {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		}); err != nil {
+			return err
+		}
+		_, err := tarWriter.Write(data)
+		return err
+	}
+
+	now := time.Now()
+	if err = addEntry(BACKUP_MANIFEST_ENTRY, manifestJSON, now); err != nil {
+		return nil, err
+	}
+	if err = addEntry(BACKUP_CONFIG_ENTRY, b.config, b.configModTime); err != nil {
+		return nil, err
+	}
+	if len(b.ownerKey) > 0 {
+		if err = addEntry(BACKUP_OWNER_KEY_ENTRY, b.ownerKey, now); err != nil {
+			return nil, err
+		}
+	}
+	if err = tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err = gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// reads and validates the entries of a backup archive
+func unpackConfigBackup(archive []byte) (*configBackup, error) {
+
+	var (
+		err error
+
+		gzipReader *gzip.Reader
+		header     *tar.Header
+		data       []byte
+	)
+
+	if gzipReader, err = gzip.NewReader(bytes.NewReader(archive)); err != nil {
+		return nil, validationError(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	backup := &configBackup{}
+	for {
+		if header, err = tarReader.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, validationError(err)
+		}
+		if header.Size > BACKUP_MAX_ENTRY_SIZE {
+			return nil, newError(SN_ERROR_VALIDATION, "backup entry '%s' is too large", header.Name)
+		}
+		if data, err = io.ReadAll(io.LimitReader(tarReader, BACKUP_MAX_ENTRY_SIZE)); err != nil {
+			return nil, validationError(err)
+		}
+
+		switch header.Name {
+		case BACKUP_MANIFEST_ENTRY:
+			backup.manifest = &configBackupManifest{}
+			if err = json.Unmarshal(data, backup.manifest); err != nil {
+				return nil, validationError(err)
+			}
+		case BACKUP_CONFIG_ENTRY:
+			backup.config = data
+			backup.configModTime = header.ModTime
+		case BACKUP_OWNER_KEY_ENTRY:
+			backup.ownerKey = data
+		default:
+			logger.DebugMessage("Ignoring unknown configuration backup entry '%s'", header.Name)
+		}
+	}
+
+	if backup.manifest == nil {
+		return nil, newError(SN_ERROR_VALIDATION, "the backup does not have a manifest")
+	}
+	if backup.manifest.Format != CONFIG_BACKUP_FORMAT || backup.manifest.Version > CONFIG_BACKUP_VERSION {
+		return nil, newError(SN_ERROR_VALIDATION, "unsupported backup format '%s' version %d", backup.manifest.Format, backup.manifest.Version)
+	}
+	if len(backup.config) == 0 {
+		return nil, newError(SN_ERROR_VALIDATION, "the backup does not contain a configuration")
+	}
+	values := map[string]interface{}{}
+	if err = yaml.Unmarshal(backup.config, &values); err != nil {
+		return nil, newError(SN_ERROR_VALIDATION, "the backed up configuration is not valid: %s", err.Error())
+	}
+	if backup.manifest.HasOwnerKey != (len(backup.ownerKey) > 0) {
+		return nil, newError(SN_ERROR_VALIDATION, "the backup owner key does not match its manifest")
+	}
+	if len(backup.ownerKey) > 0 {
+		if _, err = crypto.NewRSAKeyFromPEM(string(backup.ownerKey), nil); err != nil {
+			return nil, newError(SN_ERROR_VALIDATION, "the backed up owner key is not valid: %s", err.Error())
+		}
+	}
+	return backup, nil
+}
+
+// encrypts an archive with a key derived from the
+// passphrase and returns the contents of the backup file
+func encryptConfigBackup(archive []byte, backupPassphrase string) ([]byte, error) {
+
+	var (
+		err error
+
+		key, cipherData []byte
+	)
+
+	salt := make([]byte, CONFIG_BACKUP_SALT_LEN)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	backupFile := &configBackupFile{
+		Format:  CONFIG_BACKUP_FORMAT,
+		Version: CONFIG_BACKUP_VERSION,
+		Salt:    base64.StdEncoding.EncodeToString(salt),
+		N:       CONFIG_BACKUP_KEY_N,
+		R:       CONFIG_BACKUP_KEY_R,
+		P:       CONFIG_BACKUP_KEY_P,
+	}
+	if key, err = scrypt.Key([]byte(backupPassphrase), salt, backupFile.N, backupFile.R, backupFile.P, 32); err != nil {
+		return nil, err
+	}
+	crypt, err := crypto.NewCrypt(key)
+	if err != nil {
+		return nil, err
+	}
+	if cipherData, err = crypt.Encrypt(archive); err != nil {
+		return nil, err
+	}
+	backupFile.Archive = base64.StdEncoding.EncodeToString(cipherData)
+	return json.MarshalIndent(backupFile, "", "  ")
+}
+
+// returns the archive of a backup file
+func decryptConfigBackup(backupData []byte, backupPassphrase string) ([]byte, error) {
+
+	var (
+		err error
+
+		salt, key,
+		cipherData, archive []byte
+	)
+
+	backupFile := &configBackupFile{}
+	if err = json.Unmarshal(backupData, backupFile); err != nil {
+		return nil, newError(SN_ERROR_VALIDATION, "the file is not a configuration backup")
+	}
+	if backupFile.Format != CONFIG_BACKUP_FORMAT {
+		return nil, newError(SN_ERROR_VALIDATION, "the file is not a configuration backup")
+	}
+	if backupFile.Version > CONFIG_BACKUP_VERSION {
+		return nil, newError(SN_ERROR_VALIDATION, "backup version %d is not supported by this client", backupFile.Version)
+	}
+	if backupFile.N > CONFIG_BACKUP_MAX_KEY_N || backupFile.R*backupFile.P > CONFIG_BACKUP_MAX_KEY_RP {
+		// limit the memory and time the key derivation
+		// of a tampered backup file can consume
+		return nil, newError(SN_ERROR_VALIDATION, "the backup key parameters are not supported")
+	}
+	if salt, err = base64.StdEncoding.DecodeString(backupFile.Salt); err != nil {
+		return nil, validationError(err)
+	}
+	if cipherData, err = base64.StdEncoding.DecodeString(backupFile.Archive); err != nil {
+		return nil, validationError(err)
+	}
+	if key, err = scrypt.Key([]byte(backupPassphrase), salt, backupFile.N, backupFile.R, backupFile.P, 32); err != nil {
+		return nil, validationError(err)
+	}
+	crypt, err := crypto.NewCrypt(key)
+	if err != nil {
+		return nil, err
+	}
+	if archive, err = crypt.Decrypt(cipherData); err != nil {
+		return nil, newError(SN_ERROR_LOCK, "the backup passphrase is not valid or the backup is corrupt")
+	}
+	return archive, nil
+}
@@ -0,0 +1,311 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appbricks/mycloudspace-client/apple/mycsfake"
+	"gopkg.in/yaml.v2"
+)
+
+const testBackupPassphrase = "test backup passphrase"
+
+// saves the config of the test context and exports it
+// to a backup file returning the path of the file
+func (tc *testContext) exportBackup(t *testing.T) string {
+
+	if err := saveConfig(tc.config); err != nil {
+		t.Fatalf("failed to save the config: %s", err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "config.backup")
+	if err := exportConfigBackup(path, testBackupPassphrase); err != nil {
+		t.Fatalf("exportConfigBackup() failed: %s", err.Error())
+	}
+	return path
+}
+
+// writes a backup file of the given backup
+func writeTestBackup(t *testing.T, backup *configBackup) string {
+
+	archive, err := backup.pack()
+	if err != nil {
+		t.Fatalf("failed to pack the backup: %s", err.Error())
+	}
+	backupData, err := encryptConfigBackup(archive, testBackupPassphrase)
+	if err != nil {
+		t.Fatalf("failed to encrypt the backup: %s", err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "config.backup")
+	if err = os.WriteFile(path, backupData, 0600); err != nil {
+		t.Fatalf("failed to write the backup: %s", err.Error())
+	}
+	return path
+}
+
+func TestConfigBackupRoundTrip(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.login(t, testUsername)
+	path := tc.exportBackup(t)
+
+	configFile := activeProfileConfigFile()
+	saved, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := importConfigBackup(path, testBackupPassphrase)
+	if err != nil {
+		t.Fatalf("importConfigBackup() failed: %s", err.Error())
+	}
+	if info.Profile != DEFAULT_PROFILE || info.CreatedAt == 0 || len(info.OwnerKeyFile) > 0 {
+		t.Errorf("importConfigBackup() returned unexpected restore info: %+v", info)
+	}
+	restored, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, saved) {
+		t.Errorf("the restored config file does not match the backed up config file")
+	}
+	if _, err = os.Stat(configFile + ".pre-restore"); err != nil {
+		t.Errorf("the replaced config file was not retained: %s", err.Error())
+	}
+
+	// the restored configuration is loaded
+	cfg := currentConfig()
+	if cfg == nil || cfg == tc.config {
+		t.Fatalf("the context was not initialized from the restored configuration")
+	}
+	if !cfg.AuthContext().IsLoggedIn() {
+		t.Errorf("the restored configuration does not have the backed up auth context")
+	}
+}
+
+func TestConfigBackupWrongPassphrase(t *testing.T) {
+
+	tc := newTestContext(t)
+	path := tc.exportBackup(t)
+
+	_, err := importConfigBackup(path, "wrong passphrase")
+	if code := errorCode(err); code != SN_ERROR_LOCK {
+		t.Errorf("importConfigBackup() with a wrong passphrase returned error code %d, expected a lock error: %v", code, err)
+	}
+	if currentConfig() != tc.config {
+		t.Errorf("a failed import replaced the loaded configuration")
+	}
+}
+
+func TestConfigBackupTampered(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+
+		tamper func(backupFile *configBackupFile)
+
+		code int
+	}{
+		{
+			name: "modified archive",
+			tamper: func(backupFile *configBackupFile) {
+				archive, _ := base64.StdEncoding.DecodeString(backupFile.Archive)
+				archive[len(archive)/2] ^= 0xff
+				backupFile.Archive = base64.StdEncoding.EncodeToString(archive)
+			},
+			code: SN_ERROR_LOCK,
+		},
+		{
+			name: "modified salt",
+			tamper: func(backupFile *configBackupFile) {
+				backupFile.Salt = base64.StdEncoding.EncodeToString([]byte("another salt"))
+			},
+			code: SN_ERROR_LOCK,
+		},
+		{
+			name: "excessive key parameters",
+			tamper: func(backupFile *configBackupFile) {
+				backupFile.N = CONFIG_BACKUP_MAX_KEY_N << 1
+			},
+			code: SN_ERROR_VALIDATION,
+		},
+		{
+			name: "unknown format",
+			tamper: func(backupFile *configBackupFile) {
+				backupFile.Format = "other"
+			},
+			code: SN_ERROR_VALIDATION,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tc := newTestContext(t)
+			path := tc.exportBackup(t)
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backupFile := &configBackupFile{}
+			if err = json.Unmarshal(data, backupFile); err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(backupFile)
+			if data, err = json.Marshal(backupFile); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = importConfigBackup(path, testBackupPassphrase)
+			if code := errorCode(err); code != tt.code {
+				t.Errorf("importConfigBackup() of a tampered backup returned error code %d, expected %d: %v", code, tt.code, err)
+			}
+			if currentConfig() != tc.config {
+				t.Errorf("a failed import replaced the loaded configuration")
+			}
+		})
+	}
+}
+
+func TestConfigBackupImportRequiresOwner(t *testing.T) {
+
+	tc := newTestContext(t)
+	path := tc.exportBackup(t)
+
+	tc.registerDevice(t, nil)
+	guest := &mycsfake.User{Username: "guest"}
+	tc.service.AddUser(guest)
+	tc.config.DeviceContext().SetLoggedInUser(guest.UserID, guest.Username)
+
+	_, err := importConfigBackup(path, testBackupPassphrase)
+	if code := errorCode(err); code != SN_ERROR_AUTH {
+		t.Errorf("importConfigBackup() by a guest returned error code %d, expected an auth error: %v", code, err)
+	}
+
+	// a locked device cannot be restored by anyone
+	tc.lock(t)
+	configFile := activeProfileConfigFile()
+	locked, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = importConfigBackup(path, testBackupPassphrase)
+	if code := errorCode(err); code != SN_ERROR_LOCK {
+		t.Errorf("importConfigBackup() of a locked device returned error code %d, expected a lock error: %v", code, err)
+	}
+	if data, _ := os.ReadFile(configFile); !bytes.Equal(data, locked) {
+		t.Errorf("the config file of a locked device was replaced")
+	}
+}
+
+func TestConfigBackupRestoresOwnerKey(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.newKeyRotationSession(t)
+	owner := tc.config.DeviceContext().GetOwner()
+	path := tc.exportBackup(t)
+
+	info, err := importConfigBackup(path, testBackupPassphrase)
+	if err != nil {
+		t.Fatalf("importConfigBackup() failed: %s", err.Error())
+	}
+	if info.OwnerKeyFile != restoredOwnerKeyFile() {
+		t.Fatalf("importConfigBackup() restored the owner key to '%s', expected '%s'", info.OwnerKeyFile, restoredOwnerKeyFile())
+	}
+
+	// the restored key is protected with the backup passphrase
+	keyPEM, err := os.ReadFile(info.OwnerKeyFile)
+	if err != nil {
+		t.Fatalf("the owner key file was not restored: %s", err.Error())
+	}
+	if format, _ := ownerKeyFormat(keyPEM); format != OWNER_KEY_FORMAT_PKCS8 {
+		t.Errorf("the owner key was restored as %s, expected %s", format, OWNER_KEY_FORMAT_PKCS8)
+	}
+	key, err := readOwnerKey(keyPEM, []byte(testBackupPassphrase))
+	if err != nil {
+		t.Fatalf("the restored owner key cannot be read with the backup passphrase: %s", err.Error())
+	}
+	if mustPublicKeyPEM(t, key) != owner.RSAPublicKey {
+		t.Errorf("the restored owner key is not the backed up key")
+	}
+
+	// the file is removed once the key is loaded from it
+	keyFile, err := newOwnerKeyFile(info.OwnerKeyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile.removeIfRestored()
+	if _, err = os.Stat(info.OwnerKeyFile); !os.IsNotExist(err) {
+		t.Errorf("the restored owner key file was not removed: %v", err)
+	}
+}
+
+func TestConfigBackupFailedRestoreOnNewDevice(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.login(t, testUsername)
+	if err := saveConfig(tc.config); err != nil {
+		t.Fatal(err)
+	}
+
+	// a backup of a config that cannot be loaded
+	configFile := activeProfileConfigFile()
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{}
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+	values["authcontext"] = "!not-encrypted!"
+	if data, err = yaml.Marshal(values); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestBackup(t, &configBackup{
+		manifest: &configBackupManifest{
+			Format:    CONFIG_BACKUP_FORMAT,
+			Version:   CONFIG_BACKUP_VERSION,
+			CreatedAt: time.Now().UnixMilli(),
+			Profile:   &profile{Name: DEFAULT_PROFILE},
+		},
+		config:        data,
+		configModTime: time.Now(),
+	})
+
+	// the device has no saved configuration but a
+	// replaced file left behind by an earlier restore
+	if err = os.Rename(configFile, configFile+".pre-restore"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = importConfigBackup(path, testBackupPassphrase); err == nil {
+		t.Fatalf("importConfigBackup() of a config that cannot be loaded succeeded")
+	}
+	// a new configuration is created in place of the
+	// restored file instead of the stale replaced file
+	if _, err = os.Stat(configFile + ".pre-restore"); !os.IsNotExist(err) {
+		t.Errorf("the replaced file of the earlier restore was not removed: %v", err)
+	}
+	restored, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(restored, data) {
+		t.Errorf("the config file of the failed restore was not removed")
+	}
+	if cfg := currentConfig(); cfg == nil || cfg.Initialized() {
+		t.Errorf("the context was not initialized with a new configuration after the failed restore")
+	}
+}
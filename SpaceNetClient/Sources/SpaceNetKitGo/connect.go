@@ -0,0 +1,435 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+// typedef unsigned char SN_ERROR_CODE;
+//
+// static void onSpaceConnected(void *func, void *ctx, const BOOL ok, const char *tunnelConfigJSON)
+// {
+//	 ((void(*)(void *, const BOOL, const char *))func)(ctx, ok, tunnelConfigJSON);
+// }
+import "C"
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/userspace"
+	"github.com/appbricks/mycloudspace-client/mycsnode"
+	"github.com/appbricks/mycloudspace-client/vpn"
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// active space connections keyed by space id
+	spaceConnections = make(map[string]*spaceConnection)
+
+	spaceConnectionsMx sync.Mutex
+)
+
+type spaceConnection struct {
+	spaceName  string
+	apiClient  *mycsnode.ApiClient
+	configData vpn.ConfigData
+
+	// the connection is being negotiated
+	pending bool
+}
+
+// JSON representation of the tunnel configuration
+// returned to the host application. The UAPI config
+// can be passed as is to wgTurnOn, whereas addresses,
+// dns and mtu are required to configure the tunnel
+// network settings on the host.
+type tunnelConfig struct {
+	SpaceID   string `json:"spaceID"`
+	SpaceName string `json:"spaceName"`
+
+	UAPIConfig    string `json:"uapiConfig"`
+	WgQuickConfig string `json:"wgQuickConfig"`
+
+	Addresses []string `json:"addresses"`
+	DNS       []string `json:"dns"`
+	MTU       string   `json:"mtu,omitempty"`
+}
+
+//export snConnectSpace
+func snConnectSpace(context uintptr, spaceID *C.char, handler uintptr) {
+
+	id := C.GoString(spaceID)
+
+	go func() {
+		tc, err := connectSpace(id)
+		postSpaceConnected(context, handler, tc, err)
+	}()
+}
+
+//export snDisconnectSpace
+func snDisconnectSpace(spaceID *C.char) C.SN_ERROR_CODE {
+	if err := disconnectSpace(C.GoString(spaceID)); err != nil {
+		return setLastErrorCode("snDisconnectSpace", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// negotiates a device connection with the space node
+// having the given id and returns the tunnel configuration
+func connectSpace(spaceID string) (*tunnelConfig, error) {
+
+	var (
+		err error
+
+		nodes []userspace.SpaceNode
+		node  userspace.SpaceNode
+
+		apiClient  *mycsnode.ApiClient
+		configData vpn.ConfigData
+	)
+
+	cfg := currentConfig()
+	if cfg == nil {
+		return nil, newError(SN_ERROR_LOCK, "the device is locked")
+	}
+	if nodes, err = getSpaceNodes(false); err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if n.GetSpaceID() == spaceID {
+			node = n
+			break
+		}
+	}
+	if node == nil {
+		return nil, newError(SN_ERROR_VALIDATION, "space with id '%s' was not found", spaceID)
+	}
+	if !node.IsRunning() {
+		return nil, newError(SN_ERROR_VALIDATION, "space '%s' is not running", node.GetSpaceName())
+	}
+
+	// the space is reserved while the connection is negotiated
+	// so the lock is not held across calls to the space node
+	sc := &spaceConnection{
+		spaceName: node.GetSpaceName(),
+		pending:   true,
+	}
+
+	spaceConnectionsMx.Lock()
+	if _, exists := spaceConnections[spaceID]; exists {
+		spaceConnectionsMx.Unlock()
+		return nil, newError(SN_ERROR_VALIDATION, "space '%s' is already connected", node.GetSpaceName())
+	}
+	spaceConnections[spaceID] = sc
+	spaceConnectionsMx.Unlock()
+
+	release := func() {
+		spaceConnectionsMx.Lock()
+		defer spaceConnectionsMx.Unlock()
+
+		if spaceConnections[spaceID] == sc {
+			delete(spaceConnections, spaceID)
+		}
+	}
+
+	if apiClient, err = mycsnode.NewApiClient(cfg, node); err != nil {
+		release()
+		return nil, err
+	}
+	if err = apiClient.Start(); err != nil {
+		release()
+		return nil, err
+	}
+	if configData, err = vpn.NewVPNConfigData(apiClient); err != nil {
+		apiClient.Stop()
+		release()
+		return nil, err
+	}
+	stop := func() {
+		if derr := configData.Delete(); derr != nil {
+			logger.ErrorMessage("Failed to release space connection: %s", derr.Error())
+		}
+		apiClient.Stop()
+		release()
+	}
+
+	tc := &tunnelConfig{
+		SpaceID:   spaceID,
+		SpaceName: node.GetSpaceName(),
+
+		WgQuickConfig: string(configData.Data()),
+	}
+	if err = tc.parseWgQuickConfig(); err != nil {
+		stop()
+		return nil, err
+	}
+
+	spaceConnectionsMx.Lock()
+	if spaceConnections[spaceID] != sc {
+		// all spaces were disconnected while
+		// the connection was being negotiated
+		spaceConnectionsMx.Unlock()
+		stop()
+		return nil, newError(SN_ERROR_CANCELLED, "connection to space '%s' was cancelled", node.GetSpaceName())
+	}
+	sc.apiClient = apiClient
+	sc.configData = configData
+	sc.pending = false
+	spaceConnectionsMx.Unlock()
+
+	monitorConnectionEvent(MONITOR_EVENT_TYPE_CONNECT, spaceID, tc.SpaceName)
+	return tc, nil
+}
+
+// releases the device connection with the
+// space node having the given id
+func disconnectSpace(spaceID string) error {
+
+	// the connection is removed while the lock is held but
+	// released after as that calls the space node and posts
+	// monitor events
+	spaceConnectionsMx.Lock()
+	sc, exists := spaceConnections[spaceID]
+	if !exists {
+		spaceConnectionsMx.Unlock()
+		return newError(SN_ERROR_VALIDATION, "space with id '%s' is not connected", spaceID)
+	}
+	if sc.pending {
+		spaceConnectionsMx.Unlock()
+		return newError(SN_ERROR_VALIDATION, "space with id '%s' is still connecting", spaceID)
+	}
+	delete(spaceConnections, spaceID)
+	spaceConnectionsMx.Unlock()
+
+	return sc.release(spaceID)
+}
+
+// releases all active space connections
+func disconnectAllSpaces() {
+
+	connected := make(map[string]*spaceConnection)
+
+	spaceConnectionsMx.Lock()
+	for spaceID, sc := range spaceConnections {
+		if sc.pending {
+			// the connection is released by connectSpace
+			// once it finds that it has been removed
+			continue
+		}
+		connected[spaceID] = sc
+	}
+	spaceConnections = make(map[string]*spaceConnection)
+	spaceConnectionsMx.Unlock()
+
+	for spaceID, sc := range connected {
+		if err := sc.release(spaceID); err != nil {
+			logger.ErrorMessage("Failed to release connection to space '%s': %s", spaceID, err.Error())
+		}
+	}
+}
+
+// releases a connection that has been removed
+// from the active space connections
+func (sc *spaceConnection) release(spaceID string) error {
+
+	err := sc.configData.Delete()
+	sc.apiClient.Stop()
+	monitorConnectionEvent(MONITOR_EVENT_TYPE_DISCONNECT, spaceID, sc.spaceName)
+	return err
+}
+
+func postSpaceConnected(context, handler uintptr, tc *tunnelConfig, err error) {
+
+	var (
+		tunnelConfigJSON []byte
+	)
+
+	if err == nil {
+		tunnelConfigJSON, err = json.Marshal(tc)
+	}
+	ok := C.uchar(1)
+	if err != nil {
+		ok = setLastError("snConnectSpace", err)
+		tunnelConfigJSON = []byte("{}")
+	}
+
+	if handler != 0 {
+
+		cTunnelConfigJSON := C.CString(string(tunnelConfigJSON))
+
+		C.onSpaceConnected(
+			unsafe.Pointer(handler),
+			unsafe.Pointer(context),
+			ok,
+			cTunnelConfigJSON,
+		)
+
+		C.free(unsafe.Pointer(cTunnelConfigJSON))
+	}
+}
+
+// parses the wg-quick config returned by the space node and
+// converts it to the UAPI format expected by the wireguard
+// device. Interface addresses, dns and mtu are not part of
+// the UAPI protocol so they are returned separately.
+func (tc *tunnelConfig) parseWgQuickConfig() error {
+
+	var (
+		err error
+
+		uapi    strings.Builder
+		section string
+		value   string
+
+		// the UAPI protocol requires a peer's public key
+		// to precede all other attributes of that peer
+		peerKey  string
+		peerUAPI strings.Builder
+	)
+
+	flushPeer := func() error {
+		if section == "peer" {
+			if len(peerKey) == 0 {
+				return fmt.Errorf("wireguard config peer does not have a public key")
+			}
+			uapi.WriteString("public_key=" + peerKey + "\n")
+			uapi.WriteString("replace_allowed_ips=true\n")
+			uapi.WriteString(peerUAPI.String())
+		}
+		peerKey = ""
+		peerUAPI.Reset()
+		return nil
+	}
+
+	tc.Addresses = []string{}
+	tc.DNS = []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(tc.WgQuickConfig))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err = flushPeer(); err != nil {
+				return err
+			}
+			section = strings.ToLower(line[1 : len(line)-1])
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid wireguard config line: %s", line)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		val := strings.TrimSpace(kv[1])
+
+		switch section {
+		case "interface":
+			switch key {
+			case "privatekey":
+				if value, err = keyToHex(val); err != nil {
+					return err
+				}
+				uapi.WriteString("private_key=" + value + "\n")
+				uapi.WriteString("replace_peers=true\n")
+			case "listenport":
+				uapi.WriteString("listen_port=" + val + "\n")
+			case "fwmark":
+				uapi.WriteString("fwmark=" + val + "\n")
+			case "address":
+				tc.Addresses = append(tc.Addresses, splitList(val)...)
+			case "dns":
+				tc.DNS = append(tc.DNS, splitList(val)...)
+			case "mtu":
+				tc.MTU = val
+			}
+
+		case "peer":
+			switch key {
+			case "publickey":
+				if peerKey, err = keyToHex(val); err != nil {
+					return err
+				}
+			case "presharedkey":
+				if value, err = keyToHex(val); err != nil {
+					return err
+				}
+				peerUAPI.WriteString("preshared_key=" + value + "\n")
+			case "endpoint":
+				if value, err = resolveEndpoint(val); err != nil {
+					return err
+				}
+				peerUAPI.WriteString("endpoint=" + value + "\n")
+			case "persistentkeepalive":
+				peerUAPI.WriteString("persistent_keepalive_interval=" + val + "\n")
+			case "allowedips":
+				for _, ip := range splitList(val) {
+					peerUAPI.WriteString("allowed_ip=" + ip + "\n")
+				}
+			}
+
+		default:
+			return fmt.Errorf("unexpected wireguard config section: %s", section)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if err = flushPeer(); err != nil {
+		return err
+	}
+	if uapi.Len() == 0 {
+		return fmt.Errorf("space node returned an empty wireguard config")
+	}
+
+	tc.UAPIConfig = uapi.String()
+	return nil
+}
+
+// converts a base64 encoded wireguard key to hex
+func keyToHex(key string) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	if len(k) != 32 {
+		return "", fmt.Errorf("invalid wireguard key length %d", len(k))
+	}
+	return hex.EncodeToString(k), nil
+}
+
+// the UAPI protocol only accepts ip endpoints
+// so host names need to be resolved first
+func resolveEndpoint(endpoint string) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
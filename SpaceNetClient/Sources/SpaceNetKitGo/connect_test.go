@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/appbricks/mycloudspace-client/mycsnode"
+)
+
+func TestParseWgQuickConfig(t *testing.T) {
+
+	privateKey := testWgKey(1)
+	peerKey := testWgKey(2)
+	presharedKey := testWgKey(3)
+
+	tc := &tunnelConfig{
+		WgQuickConfig: `
+[Interface]
+PrivateKey = ` + privateKey + `
+Address = 192.168.111.2/32, fd00::2/128
+DNS = 192.168.111.1
+MTU = 1420
+ListenPort = 51820 # comments are ignored
+
+[Peer]
+# the public key is written first
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 10.0.0.1:3399
+PresharedKey = ` + presharedKey + `
+PublicKey = ` + peerKey + `
+PersistentKeepalive = 25
+`,
+	}
+	if err := tc.parseWgQuickConfig(); err != nil {
+		t.Fatalf("parseWgQuickConfig() failed: %s", err.Error())
+	}
+
+	expectedUAPI := "private_key=" + testWgKeyHex(1) + "\n" +
+		"replace_peers=true\n" +
+		"listen_port=51820\n" +
+		"public_key=" + testWgKeyHex(2) + "\n" +
+		"replace_allowed_ips=true\n" +
+		"allowed_ip=0.0.0.0/0\n" +
+		"allowed_ip=::/0\n" +
+		"endpoint=10.0.0.1:3399\n" +
+		"preshared_key=" + testWgKeyHex(3) + "\n" +
+		"persistent_keepalive_interval=25\n"
+
+	if tc.UAPIConfig != expectedUAPI {
+		t.Errorf("parseWgQuickConfig() UAPI config =\n%s\nexpected\n%s", tc.UAPIConfig, expectedUAPI)
+	}
+	if !reflect.DeepEqual(tc.Addresses, []string{"192.168.111.2/32", "fd00::2/128"}) {
+		t.Errorf("parseWgQuickConfig() addresses = %v", tc.Addresses)
+	}
+	if !reflect.DeepEqual(tc.DNS, []string{"192.168.111.1"}) {
+		t.Errorf("parseWgQuickConfig() dns = %v", tc.DNS)
+	}
+	if tc.MTU != "1420" {
+		t.Errorf("parseWgQuickConfig() mtu = %s", tc.MTU)
+	}
+}
+
+func TestParseWgQuickConfigErrors(t *testing.T) {
+
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "empty",
+			config: "# nothing but comments\n",
+			err:    "empty wireguard config",
+		},
+		{
+			name:   "peer without public key",
+			config: "[Interface]\nPrivateKey = " + testWgKey(1) + "\n[Peer]\nAllowedIPs = 0.0.0.0/0\n",
+			err:    "does not have a public key",
+		},
+		{
+			name:   "invalid line",
+			config: "[Interface]\nPrivateKey\n",
+			err:    "invalid wireguard config line",
+		},
+		{
+			name:   "unexpected section",
+			config: "[Server]\nName = node\n",
+			err:    "unexpected wireguard config section",
+		},
+		{
+			name:   "short key",
+			config: "[Interface]\nPrivateKey = " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+			err:    "invalid wireguard key length",
+		},
+		{
+			name:   "invalid key encoding",
+			config: "[Interface]\nPrivateKey = not*base64\n",
+			err:    "illegal base64 data",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc := &tunnelConfig{WgQuickConfig: test.config}
+			err := tc.parseWgQuickConfig()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseWgQuickConfig() error = %v, expected an error containing '%s'", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDisconnectPendingSpace(t *testing.T) {
+
+	spaceConnectionsMx.Lock()
+	spaceConnections["pending"] = &spaceConnection{pending: true}
+	spaceConnectionsMx.Unlock()
+
+	t.Cleanup(func() {
+		spaceConnectionsMx.Lock()
+		spaceConnections = make(map[string]*spaceConnection)
+		spaceConnectionsMx.Unlock()
+	})
+
+	err := disconnectSpace("pending")
+	snErr := &snError{}
+	if !errors.As(err, &snErr) || snErr.Code != SN_ERROR_VALIDATION {
+		t.Errorf("disconnectSpace() error = %v, expected a validation error", err)
+	}
+
+	// the pending connection is dropped so that
+	// connectSpace finds it has been cancelled
+	disconnectAllSpaces()
+
+	spaceConnectionsMx.Lock()
+	_, exists := spaceConnections["pending"]
+	spaceConnectionsMx.Unlock()
+	if exists {
+		t.Errorf("disconnectAllSpaces() did not drop the pending connection")
+	}
+}
+
+// vpn config data that records whether the space
+// connections were locked when it was deleted
+type testConfigData struct {
+	deletedWhileLocked bool
+}
+
+func (d *testConfigData) Name() string    { return "test" }
+func (d *testConfigData) VPNType() string { return "wireguard" }
+func (d *testConfigData) Data() []byte    { return nil }
+
+func (d *testConfigData) Delete() error {
+	if spaceConnectionsMx.TryLock() {
+		spaceConnectionsMx.Unlock()
+	} else {
+		d.deletedWhileLocked = true
+	}
+	return nil
+}
+
+// a monitor sink that reads the space
+// connections when it receives events
+type connectionsSink struct {
+	memorySink
+}
+
+func (s *connectionsSink) PostMeasurementEvents(events []*cloudevents.Event) error {
+	spaceConnectionsMx.Lock()
+	_ = len(spaceConnections)
+	spaceConnectionsMx.Unlock()
+
+	return s.memorySink.PostMeasurementEvents(events)
+}
+
+func TestDisconnectSpaceReleasesLock(t *testing.T) {
+
+	newTestMonitors(t)
+	sink := &connectionsSink{}
+	addMonitorSink(sink)
+
+	t.Cleanup(func() {
+		spaceConnectionsMx.Lock()
+		spaceConnections = make(map[string]*spaceConnection)
+		spaceConnectionsMx.Unlock()
+	})
+
+	for _, disconnect := range []func(spaceID string) error{
+		disconnectSpace,
+		func(spaceID string) error {
+			disconnectAllSpaces()
+			return nil
+		},
+	} {
+		configData := &testConfigData{}
+		spaceConnectionsMx.Lock()
+		spaceConnections["space-1"] = &spaceConnection{
+			spaceName:  "home",
+			apiClient:  &mycsnode.ApiClient{},
+			configData: configData,
+		}
+		spaceConnectionsMx.Unlock()
+		monitorConnectionEvent(MONITOR_EVENT_TYPE_CONNECT, "space-1", "home")
+
+		disconnected := make(chan error, 1)
+		go func() {
+			disconnected <- disconnect("space-1")
+		}()
+
+		select {
+		case err := <-disconnected:
+			if err != nil {
+				t.Fatalf("disconnect failed: %s", err.Error())
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("disconnect did not return while a monitor sink reads the space connections")
+		}
+		if configData.deletedWhileLocked {
+			t.Errorf("the connection config was deleted while the space connections were locked")
+		}
+
+		spaceConnectionsMx.Lock()
+		_, exists := spaceConnections["space-1"]
+		spaceConnectionsMx.Unlock()
+		if exists {
+			t.Errorf("the disconnected space was not removed from the space connections")
+		}
+		if events := sink.Events(); len(events) != 2 || events[1].Type() != MONITOR_EVENT_TYPE_DISCONNECT {
+			t.Errorf("%d events were published, expected a connect and a disconnect event", len(events))
+		}
+	}
+}
+
+// returns a base64 encoded 32 byte wireguard key
+func testWgKey(seed byte) string {
+	return base64.StdEncoding.EncodeToString(testWgKeyBytes(seed))
+}
+
+func testWgKeyHex(seed byte) string {
+	return hex.EncodeToString(testWgKeyBytes(seed))
+}
+
+func testWgKeyBytes(seed byte) []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = seed + byte(i)
+	}
+	return key
+}
@@ -0,0 +1,252 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+// Package devicecode implements the OAuth 2.0 device
+// authorization grant (RFC 8628) which allows a user to
+// login on a device without a browser or dialog host by
+// entering a code at a verification URL on another device.
+package devicecode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	GRANT_TYPE = "urn:ietf:params:oauth:grant-type:device_code"
+
+	DEFAULT_INTERVAL = 5 * time.Second
+	// added to the polling interval each time
+	// the server asks the client to slow down
+	SLOW_DOWN_INTERVAL = 5 * time.Second
+)
+
+// A client of an authorization server's
+// device authorization and token endpoints
+type Client struct {
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	DeviceAuthURL string
+	TokenURL      string
+
+	// the http client to use. if nil then
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// The response of the device authorization endpoint
+// containing the code the user needs to enter at the
+// verification URI to authorize this device
+type Authorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+
+	// time at which the device code expires
+	Expiry time.Time `json:"-"`
+}
+
+// An error returned by the token endpoint
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// logs in by requesting a device code, passing the
+// authorization to the prompt function so it can be
+// shown to the user and then polling for the token
+func Login(ctx context.Context, client *Client, prompt func(*Authorization)) (*oauth2.Token, error) {
+
+	authorization, err := client.Authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prompt(authorization)
+	return client.Poll(ctx, authorization)
+}
+
+// writes instructions for completing the login to w
+func PrintPrompt(w io.Writer) func(*Authorization) {
+	return func(a *Authorization) {
+		fmt.Fprintf(w, "To login open the following URL in a browser:\n\n  %s\n\n", a.VerificationURI)
+		fmt.Fprintf(w, "and enter the code: %s\n\n", a.UserCode)
+		if len(a.VerificationURIComplete) > 0 {
+			fmt.Fprintf(w, "Alternatively open: %s\n\n", a.VerificationURIComplete)
+		}
+	}
+}
+
+// requests a device and user code from the
+// device authorization endpoint
+func (c *Client) Authorize(ctx context.Context) (*Authorization, error) {
+
+	if len(c.DeviceAuthURL) == 0 {
+		return nil, fmt.Errorf("device code login is not supported as no device authorization url is configured")
+	}
+
+	params := url.Values{}
+	if len(c.Scopes) > 0 {
+		params.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	resp, err := c.post(ctx, c.DeviceAuthURL, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseError(resp.StatusCode, body)
+	}
+
+	a := &Authorization{}
+	if err = json.Unmarshal(body, a); err != nil {
+		return nil, err
+	}
+	if len(a.DeviceCode) == 0 || len(a.UserCode) == 0 || len(a.VerificationURI) == 0 {
+		return nil, fmt.Errorf("device authorization response is incomplete")
+	}
+	a.Expiry = time.Now().Add(time.Duration(a.ExpiresIn) * time.Second)
+	return a, nil
+}
+
+// polls the token endpoint until the user has authorized
+// the device, the device code expires or the context is done
+func (c *Client) Poll(ctx context.Context, a *Authorization) (*oauth2.Token, error) {
+
+	interval := time.Duration(a.Interval) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	if !a.Expiry.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, a.Expiry)
+		defer cancel()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		token, err := c.requestToken(ctx, a.DeviceCode)
+		if err == nil {
+			return token, nil
+		}
+		if tokenErr, ok := err.(*Error); ok {
+			switch tokenErr.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += SLOW_DOWN_INTERVAL
+				continue
+			}
+		}
+		return nil, err
+	}
+}
+
+func (c *Client) requestToken(ctx context.Context, deviceCode string) (*oauth2.Token, error) {
+
+	resp, err := c.post(ctx, c.TokenURL, url.Values{
+		"grant_type":  {GRANT_TYPE},
+		"device_code": {deviceCode},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseError(resp.StatusCode, body)
+	}
+
+	var (
+		tokenResp struct {
+			AccessToken  string `json:"access_token"`
+			TokenType    string `json:"token_type"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int    `json:"expires_in"`
+		}
+		raw map[string]interface{}
+	)
+	if err = json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if len(tokenResp.AccessToken) == 0 {
+		return nil, fmt.Errorf("token endpoint did not return an access token")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenResp.AccessToken,
+		TokenType:    tokenResp.TokenType,
+		RefreshToken: tokenResp.RefreshToken,
+	}
+	if tokenResp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	// retain additional fields such as the id token
+	return token.WithExtra(raw), nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint string, params url.Values) (*http.Response, error) {
+
+	params.Set("client_id", c.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(c.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+func parseError(statusCode int, body []byte) error {
+	tokenErr := &Error{}
+	if err := json.Unmarshal(body, tokenErr); err != nil || len(tokenErr.Code) == 0 {
+		return fmt.Errorf("request failed with status %d: %s", statusCode, string(body))
+	}
+	return tokenErr
+}
+
+func (e *Error) Error() string {
+	if len(e.Description) > 0 {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
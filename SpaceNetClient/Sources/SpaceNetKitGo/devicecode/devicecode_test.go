@@ -0,0 +1,220 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package devicecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "test-client"
+
+// a fake authorization server whose token endpoint returns
+// the given errors in turn before it issues a token
+type testServer struct {
+	*httptest.Server
+
+	mx     sync.Mutex
+	errors []string
+	polls  []time.Time
+}
+
+func newTestServer(t *testing.T, errors ...string) *testServer {
+
+	s := &testServer{errors: errors}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device_authorization", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("client_id") != testClientID {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_client"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      "device-code",
+			"user_code":        "USER-CODE",
+			"verification_uri": s.URL + "/activate",
+			"expires_in":       600,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil ||
+			r.PostForm.Get("grant_type") != GRANT_TYPE ||
+			r.PostForm.Get("device_code") != "device-code" {
+
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant"})
+			return
+		}
+
+		s.mx.Lock()
+		s.polls = append(s.polls, time.Now())
+		var tokenErr string
+		if len(s.errors) > 0 {
+			tokenErr, s.errors = s.errors[0], s.errors[1:]
+		}
+		s.mx.Unlock()
+
+		if len(tokenErr) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": tokenErr})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token":  "access-token",
+			"id_token":      "id-token",
+			"refresh_token": "refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) client() *Client {
+	return &Client{
+		ClientID:      testClientID,
+		DeviceAuthURL: s.URL + "/device_authorization",
+		TokenURL:      s.URL + "/token",
+	}
+}
+
+// returns the times at which the token endpoint was polled
+func (s *testServer) pollTimes() []time.Time {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return append([]time.Time{}, s.polls...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestLoginPending(t *testing.T) {
+
+	s := newTestServer(t, "authorization_pending", "authorization_pending")
+
+	var prompted *Authorization
+	token, err := Login(context.Background(), s.client(), func(a *Authorization) { prompted = a })
+	if err != nil {
+		t.Fatalf("Login() failed: %s", err.Error())
+	}
+	if prompted == nil || prompted.UserCode != "USER-CODE" || prompted.VerificationURI != s.URL+"/activate" {
+		t.Errorf("the prompt was called with %+v, expected the device authorization", prompted)
+	}
+	if prompted != nil && time.Until(prompted.Expiry) <= 0 {
+		t.Errorf("the device code expiry %s is not in the future", prompted.Expiry)
+	}
+	if n := len(s.pollTimes()); n != 3 {
+		t.Errorf("the token endpoint was polled %d times, expected 3", n)
+	}
+	if token.AccessToken != "access-token" || token.RefreshToken != "refresh-token" || token.Extra("id_token") != "id-token" {
+		t.Errorf("Login() returned %+v, expected the issued tokens", token)
+	}
+	if time.Until(token.Expiry) <= 0 {
+		t.Errorf("the token expiry %s is not in the future", token.Expiry)
+	}
+}
+
+func TestPollSlowDown(t *testing.T) {
+
+	s := newTestServer(t, "slow_down")
+
+	authorization, err := s.client().Authorize(context.Background())
+	if err != nil {
+		t.Fatalf("Authorize() failed: %s", err.Error())
+	}
+	if _, err = s.client().Poll(context.Background(), authorization); err != nil {
+		t.Fatalf("Poll() failed: %s", err.Error())
+	}
+
+	polls := s.pollTimes()
+	if len(polls) != 2 {
+		t.Fatalf("the token endpoint was polled %d times, expected 2", len(polls))
+	}
+	interval := time.Duration(authorization.Interval)*time.Second + SLOW_DOWN_INTERVAL
+	if elapsed := polls[1].Sub(polls[0]); elapsed < interval {
+		t.Errorf("polled again after %s when asked to slow down, expected at least %s", elapsed, interval)
+	}
+}
+
+func TestPollErrors(t *testing.T) {
+
+	for _, code := range []string{"expired_token", "access_denied"} {
+		t.Run(code, func(t *testing.T) {
+
+			s := newTestServer(t, "authorization_pending", code, "authorization_pending")
+
+			_, err := Login(context.Background(), s.client(), func(*Authorization) {})
+			tokenErr := &Error{}
+			if !errors.As(err, &tokenErr) || tokenErr.Code != code {
+				t.Fatalf("Login() error = %v, expected %s", err, code)
+			}
+			if n := len(s.pollTimes()); n != 2 {
+				t.Errorf("the token endpoint was polled %d times after %s, expected polling to stop", n, code)
+			}
+		})
+	}
+}
+
+func TestPollCancel(t *testing.T) {
+
+	s := newTestServer(t, "authorization_pending", "authorization_pending", "authorization_pending")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := Login(ctx, s.client(), func(*Authorization) {})
+		done <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Login() error = %v, expected the login to be cancelled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Login() did not return when cancelled")
+	}
+}
+
+func TestAuthorizeWithoutDeviceAuthURL(t *testing.T) {
+
+	s := newTestServer(t)
+	client := s.client()
+	client.DeviceAuthURL = ""
+
+	prompted := false
+	if _, err := Login(context.Background(), client, func(*Authorization) { prompted = true }); err == nil {
+		t.Errorf("Login() succeeded without a device authorization url")
+	}
+	if prompted {
+		t.Errorf("the prompt was called without a device authorization")
+	}
+}
+
+func TestAuthorizeInvalidClient(t *testing.T) {
+
+	s := newTestServer(t)
+	client := s.client()
+	client.ClientID = "unknown"
+
+	_, err := client.Authorize(context.Background())
+	tokenErr := &Error{}
+	if !errors.As(err, &tokenErr) || tokenErr.Code != "invalid_client" {
+		t.Errorf("Authorize() error = %v, expected invalid_client", err)
+	}
+}
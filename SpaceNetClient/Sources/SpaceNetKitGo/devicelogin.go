@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// static void onDeviceCode(void *func, void *ctx, const char *verificationURI, const char *userCode, const char *verificationURIComplete, const int expiresIn)
+// {
+//	 ((void(*)(void *, const char *, const char *, const char *, const int))func)(ctx, verificationURI, userCode, verificationURIComplete, expiresIn);
+// }
+import "C"
+
+import (
+	"context"
+	"errors"
+	"os"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/appbricks/mycloudspace-client/apple/devicecode"
+	"github.com/appbricks/mycloudspace-client/auth"
+)
+
+// scopes requested for tokens issued to a device
+var deviceCodeScopes = []string{"openid", "profile", "email"}
+
+//export snLoginWithDeviceCode
+func snLoginWithDeviceCode(dlgContext uintptr, codeHandler uintptr, handler uintptr) {
+
+	context := unsafe.Pointer(dlgContext)
+	codeHandlerFunc := unsafe.Pointer(codeHandler)
+
+	// there is no dialog host so there are
+	// no dialogs to dismiss on cancellation
+	cfg := currentConfig()
+	login := newLoginOperation(nil, loginCompletion("snLoginWithDeviceCode", cfg, dlgContext, handler))
+
+	prompt := devicecode.PrintPrompt(os.Stdout)
+	if uintptr(codeHandlerFunc) != 0 {
+		prompt = func(authorization *devicecode.Authorization) {
+			cVerificationURI := C.CString(authorization.VerificationURI)
+			defer C.free(unsafe.Pointer(cVerificationURI))
+			cUserCode := C.CString(authorization.UserCode)
+			defer C.free(unsafe.Pointer(cUserCode))
+			cVerificationURIComplete := C.CString(authorization.VerificationURIComplete)
+			defer C.free(unsafe.Pointer(cVerificationURIComplete))
+
+			C.onDeviceCode(
+				codeHandlerFunc,
+				context,
+				cVerificationURI,
+				cUserCode,
+				cVerificationURIComplete,
+				C.int(authorization.ExpiresIn),
+			)
+		}
+	}
+
+	go func() {
+		err := loginWithDeviceCode(login.ctx, cfg, prompt)
+		if !login.finish(err, false) && err == nil {
+			// the login completed after it was cancelled
+			// so the token it retrieved is discarded
+			login.discardResult(cfg)
+		}
+	}()
+}
+
+// logs the given config in using the device authorization
+// grant of the active environment. the prompt is called with the verification
+// URL and code the user needs to enter on another device
+// to authorize this one. this device then polls for the
+// user's token until the user completes the login, the
+// code expires or the context is done.
+func loginWithDeviceCode(ctx context.Context, cfg config.Config, prompt func(*devicecode.Authorization)) error {
+
+	var (
+		err error
+
+		isAuthenticated bool
+	)
+
+	if cfg == nil {
+		return newError(SN_ERROR_LOCK, "the device is locked")
+	}
+	env := getEnvironment()
+	if len(env.DeviceAuthURL) == 0 {
+		return newError(SN_ERROR_VALIDATION, "environment '%s' does not support device code login", env.Name)
+	}
+
+	client := &devicecode.Client{
+		ClientID:      env.ClientID,
+		ClientSecret:  env.ClientSecret,
+		Scopes:        deviceCodeScopes,
+		DeviceAuthURL: env.DeviceAuthURL,
+		TokenURL:      env.TokenURL,
+	}
+	token, err := devicecode.Login(ctx, client, prompt)
+	if err != nil {
+		var tokenErr *devicecode.Error
+		if errors.As(err, &tokenErr) {
+			return wrapError(SN_ERROR_AUTH, err)
+		}
+		return err
+	}
+
+	// validating the token also sets
+	// the logged in user of the device
+	authContext := cfg.AuthContext()
+	authContext.SetToken(token)
+	if isAuthenticated, err = auth.ValidateAuthenticatedToken(getServiceConfig(), cfg); err != nil || !isAuthenticated {
+		_ = authContext.Reset()
+		if err != nil {
+			return authError(err)
+		}
+		return newError(SN_ERROR_AUTH, "the token issued for the device code is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/appbricks/mycloudspace-client/apple/devicecode"
+)
+
+func TestLoginWithDeviceCodeErrors(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+
+		// called when the user is prompted for the code
+		prompt func(tc *testContext, cancel context.CancelFunc)
+
+		code  int
+		polls int
+	}{
+		{
+			name: "access denied",
+			prompt: func(tc *testContext, cancel context.CancelFunc) {
+				tc.service.SetLoginUser("")
+			},
+			code:  SN_ERROR_AUTH,
+			polls: 2,
+		},
+		{
+			name: "expired code",
+			prompt: func(tc *testContext, cancel context.CancelFunc) {
+				tc.service.ExpireDeviceCodes()
+			},
+			code:  SN_ERROR_AUTH,
+			polls: 1,
+		},
+		{
+			name: "cancelled",
+			prompt: func(tc *testContext, cancel context.CancelFunc) {
+				cancel()
+			},
+			code:  SN_ERROR_CANCELLED,
+			polls: 0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tc := newTestContext(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			var authorization *devicecode.Authorization
+			err := loginWithDeviceCode(ctx, tc.config, func(a *devicecode.Authorization) {
+				authorization = a
+				tt.prompt(tc, cancel)
+			})
+			if code := errorCode(err); code != tt.code {
+				t.Errorf("loginWithDeviceCode() error = %v with code %d, expected %d", err, code, tt.code)
+			}
+			if authorization == nil || len(authorization.UserCode) == 0 || len(authorization.VerificationURI) == 0 {
+				t.Errorf("the prompt was called with %+v, expected a user code and verification url", authorization)
+			}
+			if n := tc.service.Requests("/oauth2/token"); n != tt.polls {
+				t.Errorf("the token endpoint was polled %d times, expected %d", n, tt.polls)
+			}
+			if tc.config.AuthContext().IsLoggedIn() {
+				t.Errorf("the device is logged in after a failed device code login")
+			}
+		})
+	}
+}
+
+func TestLoginWithDeviceCodeNotSupported(t *testing.T) {
+
+	tc := newTestContext(t)
+	rec := newEventRecorder(t)
+
+	currentEnvironmentMx.Lock()
+	currentEnvironment.DeviceAuthURL = ""
+	currentEnvironmentMx.Unlock()
+
+	failed := make(chan *statusEvent, 1)
+	rec.intercept = func(sub *statusSubscriber, event *statusEvent) {
+		if event.Reason == SN_REASON_LOGIN_FAILED {
+			failed <- event
+		}
+	}
+	id := statusEvents.subscribe(1, 1)
+	t.Cleanup(func() { statusEvents.unsubscribe(id) })
+
+	snLoginWithDeviceCode(0, 0, 0)
+
+	select {
+	case event := <-failed:
+		if event.ErrorCode != SN_ERROR_VALIDATION {
+			t.Errorf("the login failed with error code %d, expected %d", event.ErrorCode, SN_ERROR_VALIDATION)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("snLoginWithDeviceCode() did not fail in an environment without a device authorization url")
+	}
+	if code := int(snLastErrorCode()); code != SN_ERROR_VALIDATION {
+		t.Errorf("recorded error code %d, expected %d", code, SN_ERROR_VALIDATION)
+	}
+	if n := tc.service.Requests("/oauth2/device_authorization"); n != 0 {
+		t.Errorf("a device code was requested in an environment without a device authorization url")
+	}
+}
@@ -0,0 +1,415 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+//
+// static void onDeviceUsersLoaded(void *func, void *ctx, const BOOL ok, const char *usersJSON)
+// {
+//	 ((void(*)(void *, const BOOL, const char *))func)(ctx, ok, usersJSON);
+// }
+// static void onDeviceUserUpdated(void *func, void *ctx, const BOOL ok)
+// {
+//	 ((void(*)(void *, const BOOL))func)(ctx, ok);
+// }
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/appbricks/cloud-builder/userspace"
+	"github.com/appbricks/mycloudspace-client/api"
+	"github.com/hasura/go-graphql-client"
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// serializes changes to the device's users
+	deviceUsersMx sync.Mutex
+)
+
+const (
+	DEVICE_USER_STATUS_ACTIVE   = "active"
+	DEVICE_USER_STATUS_PENDING  = "pending"
+	DEVICE_USER_STATUS_INACTIVE = "inactive"
+
+	SN_REASON_DEVICE_USER_APPROVED = "deviceUserApproved"
+	SN_REASON_DEVICE_USER_REVOKED  = "deviceUserRevoked"
+)
+
+// JSON representation of a user of the
+// device returned to the host application
+type deviceUserInfo struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	IsOwner  bool   `json:"isOwner"`
+}
+
+//export snListDeviceUsers
+func snListDeviceUsers(context, handler uintptr) {
+	go func() {
+		users, err := listDeviceUsers()
+		postDeviceUsersLoaded(context, handler, users, err)
+	}()
+}
+
+//export snApproveDeviceUser
+func snApproveDeviceUser(context uintptr, username *C.char, handler uintptr) {
+	name := C.GoString(username)
+	go func() {
+		ok := C.uchar(1)
+		err := approveDeviceUser(name)
+		auditLog(AUDIT_DEVICE_USER, "approve "+name, err)
+		if err != nil {
+			ok = setLastError("snApproveDeviceUser", err)
+		}
+		postDeviceUserUpdated(context, handler, ok)
+	}()
+}
+
+//export snRevokeDeviceUser
+func snRevokeDeviceUser(context uintptr, username *C.char, handler uintptr) {
+	name := C.GoString(username)
+	go func() {
+		ok := C.uchar(1)
+		err := revokeDeviceUser(name)
+		auditLog(AUDIT_DEVICE_USER, "revoke "+name, err)
+		if err != nil {
+			ok = setLastError("snRevokeDeviceUser", err)
+		}
+		postDeviceUserUpdated(context, handler, ok)
+	}()
+}
+
+// returns the users of the device from the MyCS service
+// and updates the device's guest users to match them
+func listDeviceUsers() ([]deviceUserInfo, error) {
+
+	var (
+		err error
+
+		users []deviceUserInfo
+	)
+
+	deviceUsersMx.Lock()
+	defer deviceUsersMx.Unlock()
+
+	cfg := currentConfig()
+	if users, err = fetchDeviceUsers(cfg); err != nil {
+		return nil, err
+	}
+	if err = updateConfig(cfg, func() (bool, error) {
+		return syncGuestUsers(cfg.DeviceContext(), users)
+	}); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// grants a user who has requested access to the device access
+func approveDeviceUser(username string) error {
+
+	var (
+		err error
+
+		user *deviceUserInfo
+
+		mutation struct {
+			ActivateDeviceUser struct {
+				Status graphql.String
+			} `graphql:"activateDeviceUser(deviceID: $deviceID, userID: $userID)"`
+		}
+	)
+
+	deviceUsersMx.Lock()
+	defer deviceUsersMx.Unlock()
+
+	cfg := currentConfig()
+	if user, err = findDeviceUser(cfg, username); err != nil {
+		return err
+	}
+	if user.IsOwner {
+		return newError(SN_ERROR_VALIDATION, "user '%s' is the owner of the device", username)
+	}
+	deviceID, _ := cfg.DeviceContext().GetDeviceID()
+	if err = deviceUsersClient(cfg).Mutate(
+		context.Background(),
+		&mutation,
+		map[string]interface{}{
+			"deviceID": graphql.ID(deviceID),
+			"userID":   graphql.ID(user.UserID),
+		},
+	); err != nil {
+		return err
+	}
+	logger.DebugMessage("Device user '%s' approved with status '%s'", username, mutation.ActivateDeviceUser.Status)
+
+	if err = updateConfig(cfg, func() (bool, error) {
+		deviceContext := cfg.DeviceContext()
+		guest, exists := deviceContext.GetGuestUser(username)
+		if !exists {
+			var err error
+			if guest, err = deviceContext.NewGuestUser(user.UserID, username); err != nil {
+				return false, err
+			}
+		}
+		guest.Active = true
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	postDeviceUserChange(SN_REASON_DEVICE_USER_APPROVED, username)
+	return nil
+}
+
+// removes a user's access to the device
+func revokeDeviceUser(username string) error {
+
+	var (
+		err error
+
+		user *deviceUserInfo
+
+		mutation struct {
+			RemoveDeviceUser struct {
+				User struct {
+					UserID graphql.String `graphql:"userID"`
+				}
+			} `graphql:"removeDeviceUser(deviceID: $deviceID, userID: $userID)"`
+		}
+	)
+
+	deviceUsersMx.Lock()
+	defer deviceUsersMx.Unlock()
+
+	cfg := currentConfig()
+	if user, err = findDeviceUser(cfg, username); err != nil {
+		return err
+	}
+	if user.IsOwner {
+		return newError(SN_ERROR_VALIDATION, "the access of the device owner '%s' cannot be revoked", username)
+	}
+	deviceID, _ := cfg.DeviceContext().GetDeviceID()
+	if err = deviceUsersClient(cfg).Mutate(
+		context.Background(),
+		&mutation,
+		map[string]interface{}{
+			"deviceID": graphql.ID(deviceID),
+			"userID":   graphql.ID(user.UserID),
+		},
+	); err != nil {
+		return err
+	}
+	logger.DebugMessage("Access of device user '%s' revoked", username)
+
+	if err = updateConfig(cfg, func() (bool, error) {
+		deviceContext := cfg.DeviceContext()
+		if _, exists := deviceContext.GetGuestUser(username); !exists {
+			return false, nil
+		}
+		// the device context does not allow a single guest
+		// to be removed so all other guests are added back
+		for name, guest := range deviceContext.ResetGuestUsers() {
+			if name != username {
+				deviceContext.AddGuestUser(guest)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	postDeviceUserChange(SN_REASON_DEVICE_USER_REVOKED, username)
+	return nil
+}
+
+// returns the user of the device with the given name. must
+// be called with the device users mutex held.
+func findDeviceUser(cfg config.Config, username string) (*deviceUserInfo, error) {
+
+	users, err := fetchDeviceUsers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Username == username {
+			return &user, nil
+		}
+	}
+	return nil, newError(SN_ERROR_VALIDATION, "user '%s' is not a user of this device", username)
+}
+
+// retrieves the users of the device from the MyCS service.
+// only the owner of the device may manage its users.
+func fetchDeviceUsers(cfg config.Config) ([]deviceUserInfo, error) {
+
+	var (
+		err error
+
+		query struct {
+			GetDevice struct {
+				Users struct {
+					DeviceUsers []struct {
+						User struct {
+							UserID   graphql.String `graphql:"userID"`
+							UserName graphql.String
+						}
+						Status graphql.String
+					}
+				}
+			} `graphql:"getDevice(deviceID: $deviceID)"`
+		}
+	)
+
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return nil, newError(SN_ERROR_AUTH, "device users cannot be managed as no user is logged in")
+	}
+	deviceContext := cfg.DeviceContext()
+	ownerName, isOwnerConfigured := deviceContext.GetOwnerUserName()
+	if !isOwnerConfigured || ownerName != deviceContext.GetLoggedInUserName() {
+		return nil, newError(SN_ERROR_AUTH, "only the owner of the device can manage its users")
+	}
+	deviceID, isRegistered := deviceContext.GetDeviceID()
+	if !isRegistered {
+		return nil, newError(SN_ERROR_VALIDATION, "the device has not been registered")
+	}
+
+	if err = deviceUsersClient(cfg).Query(
+		context.Background(),
+		&query,
+		map[string]interface{}{
+			"deviceID": graphql.ID(deviceID),
+		},
+	); err != nil {
+		return nil, err
+	}
+
+	users := make([]deviceUserInfo, 0, len(query.GetDevice.Users.DeviceUsers))
+	for _, du := range query.GetDevice.Users.DeviceUsers {
+		users = append(users, deviceUserInfo{
+			UserID:   string(du.User.UserID),
+			Username: string(du.User.UserName),
+			Status:   string(du.Status),
+			IsOwner:  string(du.User.UserName) == ownerName,
+		})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// updates the device's guest users to match the users
+// retrieved from the MyCS service returning whether
+// the device context was changed. the guests are only
+// replaced once all of them have been created so that
+// the device context is unchanged if that fails.
+func syncGuestUsers(deviceContext config.DeviceContext, users []deviceUserInfo) (bool, error) {
+
+	var (
+		err error
+
+		guest *userspace.User
+	)
+
+	previous := deviceContext.GetGuestUsers()
+	guests := make(map[string]*userspace.User, len(users))
+	active := make(map[string]bool, len(users))
+	changed := false
+
+	for _, user := range users {
+		if user.IsOwner {
+			continue
+		}
+		active[user.Username] = user.Status == DEVICE_USER_STATUS_ACTIVE
+
+		var exists bool
+		if guest, exists = deviceContext.GetGuestUser(user.Username); !exists {
+			// new guests are added to the device context
+			// when they are created so they are removed
+			// again if a later guest cannot be created
+			if guest, err = deviceContext.NewGuestUser(user.UserID, user.Username); err != nil {
+				setGuestUsers(deviceContext, previous)
+				return false, err
+			}
+			changed = true
+		}
+		guests[user.Username] = guest
+	}
+	// guests that were not retrieved no longer have access
+	if !changed && len(guests) != len(previous) {
+		changed = true
+	}
+
+	deviceContext.ResetGuestUsers()
+	for name, guest := range guests {
+		deviceContext.AddGuestUser(guest)
+		if guest.Active != active[name] {
+			guest.Active = active[name]
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// replaces the device's guest users with the given users
+func setGuestUsers(deviceContext config.DeviceContext, guests []*userspace.User) {
+	deviceContext.ResetGuestUsers()
+	for _, guest := range guests {
+		deviceContext.AddGuestUser(guest)
+	}
+}
+
+func deviceUsersClient(cfg config.Config) *graphql.Client {
+	return api.NewGraphQLClient(getServiceConfig().ApiURL, "", cfg)
+}
+
+func postDeviceUsersLoaded(context, handler uintptr, users []deviceUserInfo, err error) {
+
+	var (
+		usersJSON []byte
+	)
+
+	if err == nil {
+		usersJSON, err = json.Marshal(users)
+	}
+	ok := C.uchar(1)
+	if err != nil {
+		ok = setLastError("snListDeviceUsers", err)
+		usersJSON = []byte("[]")
+	}
+
+	if handler != 0 {
+
+		cUsersJSON := C.CString(string(usersJSON))
+
+		C.onDeviceUsersLoaded(
+			unsafe.Pointer(handler),
+			unsafe.Pointer(context),
+			ok,
+			cUsersJSON,
+		)
+
+		C.free(unsafe.Pointer(cUsersJSON))
+	}
+}
+
+func postDeviceUserUpdated(context, handler uintptr, ok C.uchar) {
+	if handler != 0 {
+		C.onDeviceUserUpdated(
+			unsafe.Pointer(handler),
+			unsafe.Pointer(context),
+			ok,
+		)
+	}
+}
@@ -0,0 +1,234 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/appbricks/mycloudspace-client/apple/mycsfake"
+)
+
+// registers the device of the test context with the fake service
+// owned by the logged in owner and with the given guest users
+func (tc *testContext) registerDevice(t *testing.T, guests map[*mycsfake.User]string) string {
+
+	tc.login(t, testUsername)
+
+	device := &mycsfake.Device{
+		Name:    "test device",
+		OwnerID: tc.owner.UserID,
+		Users:   map[string]string{},
+	}
+	for guest, status := range guests {
+		tc.service.AddUser(guest)
+		device.Users[guest.UserID] = status
+	}
+	tc.service.AddDevice(device)
+
+	deviceContext := tc.config.DeviceContext()
+	if _, err := deviceContext.NewDevice(); err != nil {
+		t.Fatalf("failed to create the device: %s", err.Error())
+	}
+	deviceContext.SetDeviceID("test device key", device.DeviceID, device.Name)
+	if _, err := deviceContext.NewOwnerUser(tc.owner.UserID, testUsername); err != nil {
+		t.Fatalf("failed to set the device owner: %s", err.Error())
+	}
+	deviceContext.SetLoggedInUser(tc.owner.UserID, testUsername)
+	return device.DeviceID
+}
+
+func TestManageDeviceUsers(t *testing.T) {
+
+	tc := newTestContext(t)
+	pending := &mycsfake.User{Username: "pending"}
+	active := &mycsfake.User{Username: "active"}
+	deviceID := tc.registerDevice(t, map[*mycsfake.User]string{
+		pending: mycsfake.USER_STATUS_PENDING,
+		active:  mycsfake.USER_STATUS_ACTIVE,
+	})
+	deviceContext := tc.config.DeviceContext()
+
+	// a guest that is no longer a user of the device
+	if _, err := deviceContext.NewGuestUser("removed-id", "removed"); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := listDeviceUsers()
+	if err != nil {
+		t.Fatalf("listDeviceUsers() failed: %s", err.Error())
+	}
+	if len(users) != 3 || users[0].Username != "active" || !users[1].IsOwner {
+		t.Errorf("listDeviceUsers() = %v", users)
+	}
+	if guest, exists := deviceContext.GetGuestUser("active"); !exists || !guest.Active {
+		t.Errorf("active user was not synced as an active guest")
+	}
+	if guest, exists := deviceContext.GetGuestUser("pending"); !exists || guest.Active {
+		t.Errorf("pending user was not synced as an inactive guest")
+	}
+	if _, exists := deviceContext.GetGuestUser("removed"); exists {
+		t.Errorf("guest that is no longer a user of the device was not removed")
+	}
+	if _, exists := deviceContext.GetGuestUser(testUsername); exists {
+		t.Errorf("the owner was added as a guest")
+	}
+
+	if err = approveDeviceUser("pending"); err != nil {
+		t.Fatalf("approveDeviceUser() failed: %s", err.Error())
+	}
+	if guest, _ := deviceContext.GetGuestUser("pending"); !guest.Active {
+		t.Errorf("approved user is not an active guest")
+	}
+	if device, _ := tc.service.GetDevice(deviceID); device.Users[pending.UserID] != mycsfake.USER_STATUS_ACTIVE {
+		t.Errorf("approved user is not active in the service")
+	}
+
+	if err = revokeDeviceUser("active"); err != nil {
+		t.Fatalf("revokeDeviceUser() failed: %s", err.Error())
+	}
+	if _, exists := deviceContext.GetGuestUser("active"); exists {
+		t.Errorf("revoked user is still a guest")
+	}
+	if _, exists := deviceContext.GetGuestUser("pending"); !exists {
+		t.Errorf("revoking a user removed another guest")
+	}
+
+	if err = revokeDeviceUser(testUsername); errorCode(err) != SN_ERROR_VALIDATION {
+		t.Errorf("revoking the owner's access returned %v, expected a validation error", err)
+	}
+
+	// the changes were saved
+	if err = tc.config.Load(); err != nil {
+		t.Fatalf("failed to reload the config: %s", err.Error())
+	}
+	if guest, exists := tc.config.DeviceContext().GetGuestUser("pending"); !exists || !guest.Active {
+		t.Errorf("approval of the pending user was not saved")
+	}
+	if _, exists := tc.config.DeviceContext().GetGuestUser("active"); exists {
+		t.Errorf("revocation of the active user was not saved")
+	}
+}
+
+func TestSyncGuestUsers(t *testing.T) {
+
+	tc := newTestContext(t)
+	deviceContext := tc.config.DeviceContext()
+
+	users := []deviceUserInfo{
+		{UserID: "owner-id", Username: testUsername, Status: DEVICE_USER_STATUS_ACTIVE, IsOwner: true},
+		{UserID: "guest-id", Username: "guest", Status: DEVICE_USER_STATUS_PENDING},
+	}
+	changed, err := syncGuestUsers(deviceContext, users)
+	if err != nil || !changed {
+		t.Fatalf("syncGuestUsers() = %t, %v, expected a change", changed, err)
+	}
+	if changed, err = syncGuestUsers(deviceContext, users); err != nil || changed {
+		t.Errorf("syncGuestUsers() = %t, %v when the guests are in sync", changed, err)
+	}
+
+	users[1].Status = DEVICE_USER_STATUS_ACTIVE
+	if changed, _ = syncGuestUsers(deviceContext, users); !changed {
+		t.Errorf("syncGuestUsers() did not report the change of a guest's status")
+	}
+	if changed, _ = syncGuestUsers(deviceContext, users[:1]); !changed {
+		t.Errorf("syncGuestUsers() did not report the removal of a guest")
+	}
+	if guests := deviceContext.GetGuestUsers(); len(guests) != 0 {
+		t.Errorf("guests %v remain after all guests were removed", guests)
+	}
+}
+
+func TestDeviceUserChangeEvent(t *testing.T) {
+
+	rec := newEventRecorder(t)
+	tc := newTestContext(t)
+	tc.registerDevice(t, map[*mycsfake.User]string{
+		{Username: "pending"}: mycsfake.USER_STATUS_PENDING,
+	})
+
+	statusEvents.publish(newStatusEvent(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_INVALID, nil))
+	id := statusEvents.subscribe(1, 1)
+	t.Cleanup(func() { statusEvents.unsubscribe(id) })
+
+	if err := approveDeviceUser("pending"); err != nil {
+		t.Fatalf("approveDeviceUser() failed: %s", err.Error())
+	}
+	statusEvents.flush()
+
+	events := rec.received(1)
+	if len(events) != 2 {
+		t.Fatalf("received %d events, expected the status and the device user change", len(events))
+	}
+	event := events[1]
+	if event.Kind != SN_EVENT_KIND_DEVICE_USER || event.DeviceUser != "pending" ||
+		event.Reason != SN_REASON_DEVICE_USER_APPROVED || event.Status != SN_CFG_STATUS_NEEDS_LOGIN {
+		t.Errorf("device user change event = %+v", event)
+	}
+
+	// new subscribers receive the last status and not the change
+	statusEvents.mx.Lock()
+	last := statusEvents.last
+	statusEvents.mx.Unlock()
+	if last.Kind != SN_EVENT_KIND_STATUS || last.Status != SN_CFG_STATUS_NEEDS_LOGIN {
+		t.Errorf("the device user change replaced the last status: %+v", last)
+	}
+}
+
+// meant to be run with the race detector enabled
+func TestManageDeviceUsersDuringSaves(t *testing.T) {
+
+	tc := newTestContext(t)
+	guests := map[*mycsfake.User]string{}
+	for _, name := range []string{"guest1", "guest2", "guest3", "revoked"} {
+		guests[&mycsfake.User{Username: name}] = mycsfake.USER_STATUS_PENDING
+	}
+	tc.registerDevice(t, guests)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := saveConfig(tc.config); err != nil {
+					t.Errorf("saveConfig() failed: %s", err.Error())
+					return
+				}
+			}
+		}()
+	}
+
+	var ops sync.WaitGroup
+	for _, name := range []string{"guest1", "guest2", "guest3"} {
+		ops.Add(1)
+		go func(name string) {
+			defer ops.Done()
+			if err := approveDeviceUser(name); err != nil {
+				t.Errorf("approveDeviceUser() failed: %s", err.Error())
+			}
+			if _, err := listDeviceUsers(); err != nil {
+				t.Errorf("listDeviceUsers() failed: %s", err.Error())
+			}
+		}(name)
+	}
+	ops.Add(1)
+	go func() {
+		defer ops.Done()
+		if err := revokeDeviceUser("revoked"); err != nil {
+			t.Errorf("revokeDeviceUser() failed: %s", err.Error())
+		}
+	}()
+	ops.Wait()
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,414 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/appbricks/mycloudspace-client/api"
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// JSON service environment descriptors of the prod
+	// and staging environments which are set at build
+	// time via -ldflags "-X main.prodEnvironment=..."
+	prodEnvironment    = ""
+	stagingEnvironment = ""
+
+	// the environment of the active profile
+	currentEnvironment   *serviceEnvironment
+	currentEnvironmentMx sync.Mutex
+
+	// serializes access to the user environments file.
+	// this lock may be acquired while currentEnvironmentMx
+	// is held but never the other way around.
+	environmentsMx sync.Mutex
+)
+
+const (
+	ENV_PROD    = "prod"
+	ENV_STAGING = "staging"
+	ENV_DEV     = "dev"
+
+	SN_REASON_ENVIRONMENT_CHANGED = "environmentChanged"
+)
+
+// describes the MyCS service endpoints of an environment
+type serviceEnvironment struct {
+	Name string `json:"name"`
+
+	Region       string `json:"region"`
+	UserPoolID   string `json:"userPoolID"`
+	ClientID     string `json:"clientID"`
+	ClientSecret string `json:"clientSecret"`
+
+	AuthURL  string `json:"authURL"`
+	TokenURL string `json:"tokenURL"`
+	ApiURL   string `json:"apiURL"`
+
+	// the device authorization endpoint used for device
+	// code logins. the login is not available if not set.
+	// none of the generated environments set it so a
+	// deployment enables it by setting deviceAuthURL in
+	// the environment JSON given at build time or added
+	// via snAddEnvironment.
+	DeviceAuthURL string `json:"deviceAuthURL,omitempty"`
+
+	BuiltIn bool `json:"builtIn"`
+}
+
+// JSON representation of an environment returned to the
+// host application. client secrets are never returned.
+type environmentInfo struct {
+	Name     string `json:"name"`
+	BuiltIn  bool   `json:"builtIn"`
+	IsActive bool   `json:"isActive"`
+	AuthURL  string `json:"authURL"`
+	ApiURL   string `json:"apiURL"`
+
+	SupportsDeviceCode bool `json:"supportsDeviceCode"`
+}
+
+//export snListEnvironments
+func snListEnvironments() *C.char {
+
+	envs, err := loadEnvironments()
+	if err != nil {
+		_ = setLastError("snListEnvironments", err)
+		return nil
+	}
+	active := getEnvironment().Name
+
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]environmentInfo, 0, len(names))
+	for _, name := range names {
+		env := envs[name]
+		infos = append(infos, environmentInfo{
+			Name:     env.Name,
+			BuiltIn:  env.BuiltIn,
+			IsActive: env.Name == active,
+			AuthURL:  env.AuthURL,
+			ApiURL:   env.ApiURL,
+
+			SupportsDeviceCode: len(env.DeviceAuthURL) > 0,
+		})
+	}
+	envsJSON, err := json.Marshal(infos)
+	if err != nil {
+		_ = setLastError("snListEnvironments", err)
+		return nil
+	}
+	return C.CString(string(envsJSON))
+}
+
+//export snAddEnvironment
+func snAddEnvironment(envJSON *C.char) C.SN_ERROR_CODE {
+	if err := addEnvironment(C.GoString(envJSON)); err != nil {
+		return setLastErrorCode("snAddEnvironment", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snRemoveEnvironment
+func snRemoveEnvironment(name *C.char) C.SN_ERROR_CODE {
+	if err := removeEnvironment(C.GoString(name)); err != nil {
+		return setLastErrorCode("snRemoveEnvironment", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snSetEnvironment
+func snSetEnvironment(name *C.char) C.SN_ERROR_CODE {
+
+	envName := C.GoString(name)
+	if err := setProfileEnvironment(envName); err != nil {
+		return setLastErrorCode("snSetEnvironment", err)
+	}
+
+	// credentials of the previous environment are
+	// not valid so the context is re-initialized
+	resetContext()
+	postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_ENVIRONMENT_CHANGED, nil)
+
+	if code := snInitializeContext(nil); code != SN_ERROR_NONE {
+		return code
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// returns the service configuration of the
+// environment selected for the active profile
+func getServiceConfig() api.ServiceConfig {
+	env := getEnvironment()
+	return api.ServiceConfig{
+		// AWS Region
+		Region: env.Region,
+		// Cognito user pool ID
+		UserPoolID: env.UserPoolID,
+		// User pool resource app
+		// client ID and secret
+		CliendID:     env.ClientID,
+		ClientSecret: env.ClientSecret,
+		// Endpoint URLs
+		AuthURL:  env.AuthURL,
+		TokenURL: env.TokenURL,
+		ApiURL:   env.ApiURL,
+	}
+}
+
+// returns the environment selected for the active profile
+func getEnvironment() *serviceEnvironment {
+
+	currentEnvironmentMx.Lock()
+	defer currentEnvironmentMx.Unlock()
+
+	if currentEnvironment == nil {
+		currentEnvironment = resolveEnvironment(profileEnvironment())
+	}
+	return currentEnvironment
+}
+
+// clears the cached environment so that it is
+// resolved again for the next service call
+func resetEnvironment() {
+	currentEnvironmentMx.Lock()
+	defer currentEnvironmentMx.Unlock()
+
+	currentEnvironment = nil
+}
+
+func resolveEnvironment(name string) *serviceEnvironment {
+
+	envs, err := loadEnvironments()
+	if err != nil {
+		logger.ErrorMessage("Failed to load environments: %s", err.Error())
+		envs = builtInEnvironments()
+	}
+	if len(name) > 0 {
+		if env, exists := envs[name]; exists {
+			return env
+		}
+		logger.ErrorMessage("Environment '%s' is not available. Using the default environment.", name)
+	}
+	if isProd == "yes" {
+		// verifyBuildEnvironment ensures prod builds
+		// always include the prod environment
+		return envs[ENV_PROD]
+	}
+	return envs[ENV_DEV]
+}
+
+// verifies that a prod build includes a valid prod
+// environment so that it never falls back to dev
+func verifyBuildEnvironment() error {
+
+	if isProd != "yes" {
+		return nil
+	}
+	if len(prodEnvironment) == 0 {
+		return fmt.Errorf(
+			"this prod build does not include the prod service environment. " +
+				"it must be set at build time via -ldflags \"-X main.prodEnvironment=...\"",
+		)
+	}
+	env := &serviceEnvironment{}
+	if err := json.Unmarshal([]byte(prodEnvironment), env); err != nil {
+		return fmt.Errorf("the prod service environment of this build is invalid: %s", err.Error())
+	}
+	if len(env.AuthURL) == 0 || len(env.TokenURL) == 0 || len(env.ApiURL) == 0 {
+		return fmt.Errorf("the prod service environment of this build must have an auth, token and api url")
+	}
+	return nil
+}
+
+// returns the built-in environments that are available in this build
+func builtInEnvironments() map[string]*serviceEnvironment {
+
+	envs := map[string]*serviceEnvironment{
+		// the dev environment is always available
+		// from the generated service constants
+		ENV_DEV: {
+			Name:         ENV_DEV,
+			Region:       AWS_COGNITO_REGION,
+			UserPoolID:   AWS_COGNITO_USER_POOL_ID,
+			ClientID:     CLIENT_ID,
+			ClientSecret: CLIENT_SECRET,
+			AuthURL:      AUTH_URL,
+			TokenURL:     TOKEN_URL,
+			ApiURL:       AWS_USERSPACE_API_URL,
+			BuiltIn:      true,
+		},
+	}
+	for name, envJSON := range map[string]string{
+		ENV_PROD:    prodEnvironment,
+		ENV_STAGING: stagingEnvironment,
+	} {
+		if len(envJSON) == 0 {
+			continue
+		}
+		env := &serviceEnvironment{}
+		if err := json.Unmarshal([]byte(envJSON), env); err != nil {
+			logger.ErrorMessage("Invalid built-in '%s' environment: %s", name, err.Error())
+			continue
+		}
+		env.Name = name
+		env.BuiltIn = true
+		envs[name] = env
+	}
+	return envs
+}
+
+// returns all available environments
+func loadEnvironments() (map[string]*serviceEnvironment, error) {
+
+	envs := builtInEnvironments()
+
+	environmentsMx.Lock()
+	userEnvs, err := loadUserEnvironments()
+	environmentsMx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range userEnvs {
+		envs[env.Name] = env
+	}
+	return envs, nil
+}
+
+func environmentsFile() string {
+	return filepath.Join(homeDir, ".cb", "spacenet-environments.json")
+}
+
+// returns the environments added by the user. the
+// caller must hold environmentsMx.
+func loadUserEnvironments() ([]*serviceEnvironment, error) {
+
+	userEnvs := []*serviceEnvironment{}
+
+	data, err := os.ReadFile(environmentsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return userEnvs, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &userEnvs); err != nil {
+		return nil, err
+	}
+	return userEnvs, nil
+}
+
+// saves the environments added by the user. the
+// caller must hold environmentsMx.
+func saveUserEnvironments(userEnvs []*serviceEnvironment) error {
+
+	data, err := json.MarshalIndent(userEnvs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(environmentsFile()), 0700); err != nil {
+		return err
+	}
+	tmpFile := environmentsFile() + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, environmentsFile())
+}
+
+// adds or replaces a user provided environment
+func addEnvironment(envJSON string) error {
+
+	env := &serviceEnvironment{}
+	if err := json.Unmarshal([]byte(envJSON), env); err != nil {
+		return validationError(err)
+	}
+	if !profileNamePattern.MatchString(env.Name) {
+		return newError(SN_ERROR_VALIDATION, "invalid environment name '%s'", env.Name)
+	}
+	if env.Name == ENV_PROD || env.Name == ENV_STAGING || env.Name == ENV_DEV {
+		return newError(SN_ERROR_VALIDATION, "built-in environment '%s' cannot be replaced", env.Name)
+	}
+	if len(env.AuthURL) == 0 || len(env.TokenURL) == 0 || len(env.ApiURL) == 0 {
+		return newError(SN_ERROR_VALIDATION, "environment '%s' must have an auth, token and api url", env.Name)
+	}
+	env.BuiltIn = false
+
+	if err := updateUserEnvironments(func(userEnvs []*serviceEnvironment) ([]*serviceEnvironment, error) {
+		replaced := false
+		for i, e := range userEnvs {
+			if e.Name == env.Name {
+				userEnvs[i] = env
+				replaced = true
+			}
+		}
+		if !replaced {
+			userEnvs = append(userEnvs, env)
+		}
+		return userEnvs, nil
+	}); err != nil {
+		return err
+	}
+	// environmentsMx must not be held when
+	// the cached environment is cleared
+	resetEnvironment()
+	return nil
+}
+
+// removes a user provided environment
+func removeEnvironment(name string) error {
+
+	if name == getEnvironment().Name {
+		return newError(SN_ERROR_VALIDATION, "environment '%s' is in use by the active profile", name)
+	}
+
+	return updateUserEnvironments(func(userEnvs []*serviceEnvironment) ([]*serviceEnvironment, error) {
+		filtered := []*serviceEnvironment{}
+		for _, e := range userEnvs {
+			if e.Name != name {
+				filtered = append(filtered, e)
+			}
+		}
+		if len(filtered) == len(userEnvs) {
+			return nil, newError(SN_ERROR_VALIDATION, "environment '%s' does not exist or is built-in", name)
+		}
+		return filtered, nil
+	})
+}
+
+// loads, updates and saves the environments added by
+// the user while holding the lock of the environments
+// file so that concurrent updates are not lost
+func updateUserEnvironments(
+	update func(userEnvs []*serviceEnvironment) ([]*serviceEnvironment, error),
+) error {
+
+	environmentsMx.Lock()
+	defer environmentsMx.Unlock()
+
+	userEnvs, err := loadUserEnvironments()
+	if err != nil {
+		return err
+	}
+	if userEnvs, err = update(userEnvs); err != nil {
+		return err
+	}
+	return saveUserEnvironments(userEnvs)
+}
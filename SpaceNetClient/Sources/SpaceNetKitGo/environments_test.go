@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestVerifyBuildEnvironment(t *testing.T) {
+
+	prevIsProd, prevProdEnvironment := isProd, prodEnvironment
+	t.Cleanup(func() {
+		isProd, prodEnvironment = prevIsProd, prevProdEnvironment
+	})
+
+	for _, tt := range []struct {
+		name        string
+		isProd      string
+		prodEnv     string
+		expectError bool
+	}{
+		{"dev build", "no", "", false},
+		{"prod build without prod environment", "yes", "", true},
+		{"prod build with invalid prod environment", "yes", "{", true},
+		{"prod build with incomplete prod environment", "yes", `{"authURL":"https://auth"}`, true},
+		{
+			"prod build with prod environment", "yes",
+			`{"authURL":"https://auth","tokenURL":"https://token","apiURL":"https://api"}`,
+			false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			isProd, prodEnvironment = tt.isProd, tt.prodEnv
+
+			err := verifyBuildEnvironment()
+			if tt.expectError && err == nil {
+				t.Errorf("verifyBuildEnvironment() did not fail")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("verifyBuildEnvironment() failed: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestConcurrentEnvironmentUpdates(t *testing.T) {
+
+	const workers = 16
+
+	newTestContext(t)
+
+	// concurrent updates of the environments
+	// file must not overwrite each other
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			envJSON := fmt.Sprintf(
+				`{"name":"env-%d","authURL":"https://auth","tokenURL":"https://token","apiURL":"https://api"}`, w,
+			)
+			if err := addEnvironment(envJSON); err != nil {
+				t.Errorf("addEnvironment() failed: %s", err.Error())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	envs, err := loadEnvironments()
+	if err != nil {
+		t.Fatalf("loadEnvironments() failed: %s", err.Error())
+	}
+	for w := 0; w < workers; w++ {
+		if _, exists := envs[fmt.Sprintf("env-%d", w)]; !exists {
+			t.Errorf("environment 'env-%d' was lost", w)
+		}
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if err := removeEnvironment(fmt.Sprintf("env-%d", w)); err != nil {
+				t.Errorf("removeEnvironment() failed: %s", err.Error())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	environmentsMx.Lock()
+	userEnvs, err := loadUserEnvironments()
+	environmentsMx.Unlock()
+	if err != nil || len(userEnvs) != 0 {
+		t.Errorf("%d user environments remain after all were removed: %v", len(userEnvs), err)
+	}
+}
@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevansam/goutils/logger"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// the most recent error and the most
+	// recent error of each operation
+	lastError       *snError
+	operationErrors = make(map[string]*snError)
+	lastErrorMx     sync.Mutex
+)
+
+const (
+	SN_ERROR_NONE       = 0
+	SN_ERROR_UNKNOWN    = 1
+	SN_ERROR_LOCK       = 2
+	SN_ERROR_AUTH       = 3
+	SN_ERROR_NETWORK    = 4
+	SN_ERROR_STORAGE    = 5
+	SN_ERROR_VALIDATION = 6
+	SN_ERROR_CANCELLED  = 7
+)
+
+var errorCodeNames = map[int]string{
+	SN_ERROR_NONE:       "none",
+	SN_ERROR_UNKNOWN:    "unknown",
+	SN_ERROR_LOCK:       "lock",
+	SN_ERROR_AUTH:       "auth",
+	SN_ERROR_NETWORK:    "network",
+	SN_ERROR_STORAGE:    "storage",
+	SN_ERROR_VALIDATION: "validation",
+	SN_ERROR_CANCELLED:  "cancelled",
+}
+
+// An error with a code that allows the host application
+// to distinguish between the different kinds of failures
+// and whether the failed operation can be retried.
+type snError struct {
+	Code      int    `json:"code"`
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+
+	Operation string `json:"operation,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+
+	cause error
+}
+
+//export snLastError
+func snLastError() *C.char {
+	lastErrorMx.Lock()
+	defer lastErrorMx.Unlock()
+
+	return lastError.toCString()
+}
+
+//export snLastErrorCode
+func snLastErrorCode() C.SN_ERROR_CODE {
+	lastErrorMx.Lock()
+	defer lastErrorMx.Unlock()
+
+	if lastError == nil {
+		return C.SN_ERROR_CODE(SN_ERROR_NONE)
+	}
+	return C.SN_ERROR_CODE(lastError.Code)
+}
+
+//export snOperationError
+func snOperationError(operation *C.char) *C.char {
+	lastErrorMx.Lock()
+	defer lastErrorMx.Unlock()
+
+	return operationErrors[C.GoString(operation)].toCString()
+}
+
+//export snClearLastError
+func snClearLastError() {
+	lastErrorMx.Lock()
+	defer lastErrorMx.Unlock()
+
+	lastError = nil
+	operationErrors = make(map[string]*snError)
+}
+
+func newError(code int, format string, args ...interface{}) *snError {
+	return &snError{
+		Code:      code,
+		Kind:      errorCodeNames[code],
+		Message:   fmt.Sprintf(format, args...),
+		Retryable: code == SN_ERROR_NETWORK,
+	}
+}
+
+// wraps an error with the given code unless
+// it has already been classified
+func wrapError(code int, err error) *snError {
+	var snErr *snError
+	if errors.As(err, &snErr) {
+		return snErr
+	}
+	return &snError{
+		Code:      code,
+		Kind:      errorCodeNames[code],
+		Message:   err.Error(),
+		Retryable: code == SN_ERROR_NETWORK,
+		cause:     err,
+	}
+}
+
+// returns a lock error if the config could not be decrypted
+// with the passphrase it was loaded with. any other failure to
+// load the config is a storage error.
+func lockError(err error) *snError {
+	var snErr *snError
+	if errors.As(err, &snErr) {
+		return snErr
+	}
+	if isDecryptionError(err) {
+		return wrapError(SN_ERROR_LOCK, err)
+	}
+	return storageError(err)
+}
+
+func authError(err error) *snError {
+	if e := classifyError(err); e.Code != SN_ERROR_UNKNOWN {
+		return e
+	}
+	return wrapError(SN_ERROR_AUTH, err)
+}
+
+func storageError(err error) *snError {
+	return wrapError(SN_ERROR_STORAGE, err)
+}
+
+func validationError(err error) *snError {
+	return wrapError(SN_ERROR_VALIDATION, err)
+}
+
+// returns whether the error is due to encrypted data that could
+// not be authenticated i.e. because it was encrypted with a key
+// derived from a different passphrase. the errors returned when
+// decrypting are not typed so they are matched by their message.
+func isDecryptionError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "message authentication failed") ||
+		strings.Contains(msg, "ciphertext too short")
+}
+
+// returns the error classified by its underlying cause
+func classifyError(err error) *snError {
+
+	var (
+		snErr       *snError
+		netErr      net.Error
+		pathErr     *fs.PathError
+		retrieveErr *oauth2.RetrieveError
+	)
+
+	switch {
+	case errors.As(err, &snErr):
+		return snErr
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return wrapError(SN_ERROR_CANCELLED, err)
+	case errors.As(err, &retrieveErr):
+		return wrapError(SN_ERROR_AUTH, err)
+	case errors.As(err, &netErr):
+		return wrapError(SN_ERROR_NETWORK, err)
+	case errors.As(err, &pathErr):
+		return wrapError(SN_ERROR_STORAGE, err)
+	}
+	return wrapError(SN_ERROR_UNKNOWN, err)
+}
+
+// records the error of an operation so it can be retrieved
+// by the host and returns false as a C boolean so exported
+// functions can return the result of this call on failure
+func setLastError(operation string, err error) C.uchar {
+
+	snErr := *classifyError(err)
+	snErr.Operation = operation
+	snErr.Timestamp = time.Now().UnixMilli()
+
+	logger.ErrorMessage("%s failed with %s error: %s", operation, snErr.Kind, snErr.Message)
+
+	lastErrorMx.Lock()
+	defer lastErrorMx.Unlock()
+
+	lastError = &snErr
+	operationErrors[operation] = &snErr
+	return C.uchar(0)
+}
+
+// records the error of an operation like setLastError but
+// returns its code for exported functions that return the
+// code of their error to the host
+func setLastErrorCode(operation string, err error) C.SN_ERROR_CODE {
+	_ = setLastError(operation, err)
+	return C.SN_ERROR_CODE(errorCode(err))
+}
+
+// returns the code of an error for reporting to the host
+func errorCode(err error) int {
+	if err == nil {
+		return SN_ERROR_NONE
+	}
+	return classifyError(err).Code
+}
+
+func (e *snError) Error() string {
+	return e.Message
+}
+
+func (e *snError) Unwrap() error {
+	return e.cause
+}
+
+func (e *snError) toCString() *C.char {
+	if e == nil {
+		return nil
+	}
+	errJSON, err := json.Marshal(e)
+	if err != nil {
+		logger.ErrorMessage("Failed to serialize error: %s", err.Error())
+		return nil
+	}
+	return C.CString(string(errJSON))
+}
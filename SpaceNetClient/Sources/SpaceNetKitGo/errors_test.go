@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/appbricks/cloud-builder/config"
+	"gopkg.in/yaml.v2"
+)
+
+// loads the config of the active profile with the given passphrase
+func loadConfigWithPassphrase(passphrase string) error {
+	cfg, err := config.InitFileConfig(
+		activeProfileConfigFile(), nil,
+		func() string { return passphrase }, nil,
+	)
+	if err != nil {
+		return err
+	}
+	return cfg.Load()
+}
+
+func TestLockError(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"authentication failure", errors.New("cipher: message authentication failed"), SN_ERROR_LOCK},
+		{"truncated ciphertext", fmt.Errorf("decrypting: %w", errors.New("ciphertext too short")), SN_ERROR_LOCK},
+		{"unreadable data", errors.New("illegal base64 data at input byte 0"), SN_ERROR_STORAGE},
+		{"classified error", newError(SN_ERROR_VALIDATION, "invalid"), SN_ERROR_VALIDATION},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := lockError(tt.err).Code; code != tt.code {
+				t.Errorf("lockError() code = %d, expected %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestLockErrorForConfigLoad(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.login(t, testUsername)
+	tc.setPassphrase(t)
+
+	// a wrong passphrase locks the device
+	err := loadConfigWithPassphrase("wrong passphrase")
+	if err == nil {
+		t.Fatal("config was loaded with a wrong passphrase")
+	}
+	if code := lockError(err).Code; code != SN_ERROR_LOCK {
+		t.Errorf("loading with a wrong passphrase returned error code %d, expected a lock error: %s", code, err.Error())
+	}
+
+	// a damaged config cannot be read with any passphrase
+	configFile := activeProfileConfigFile()
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{}
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := values["authcontext"]; !exists {
+		t.Fatalf("the config has no encrypted auth context: %v", values)
+	}
+	values["authcontext"] = "!not-encrypted!"
+	if data, err = yaml.Marshal(values); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(configFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = loadConfigWithPassphrase(testPassphrase)
+	if err == nil {
+		t.Fatal("a damaged config was loaded")
+	}
+	if code := lockError(err).Code; code != SN_ERROR_STORAGE {
+		t.Errorf("loading a damaged config returned error code %d, expected a storage error: %s", code, err.Error())
+	}
+}
+
+func TestOperationErrorCodes(t *testing.T) {
+
+	newTestContext(t)
+
+	for _, tt := range []struct {
+		name string
+
+		call func() int
+
+		code int
+	}{
+		{
+			name: "cancel without a login",
+			call: func() int { return int(snCancelLogin()) },
+			code: SN_ERROR_VALIDATION,
+		},
+		{
+			name: "lock without a passphrase",
+			call: func() int { return int(snLock()) },
+			code: SN_ERROR_LOCK,
+		},
+		{
+			name: "create a profile without a name",
+			call: func() int { return int(snCreateProfile(nil)) },
+			code: SN_ERROR_VALIDATION,
+		},
+		{
+			name: "switch to an unknown environment",
+			call: func() int { return int(snSetEnvironment(nil)) },
+			code: SN_ERROR_VALIDATION,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := tt.call(); code != tt.code {
+				t.Errorf("returned error code %d, expected %d", code, tt.code)
+			}
+			if code := int(snLastErrorCode()); code != tt.code {
+				t.Errorf("recorded error code %d, expected %d", code, tt.code)
+			}
+		})
+	}
+}
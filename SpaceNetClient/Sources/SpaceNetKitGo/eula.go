@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+var (
+	// the EULA bundled with the client. its version must be
+	// updated with its text and can be set at build time via
+	// -ldflags "-X main.eulaVersion=..."
+	//go:embed EULA.md
+	eulaText    []byte
+	eulaVersion = "1.0"
+
+	// SHA-256 hash of the bundled EULA so that a change of
+	// its text requires it to be accepted again even if the
+	// version was not changed
+	eulaHash = hashEULA(eulaText)
+)
+
+const (
+	EULA_URL = "https://appbricks.io/eula/"
+
+	// keys of the accepted EULA in the configuration. the
+	// accepted flag is the key used by the config itself.
+	EULA_ACCEPTED_KEY    = "eulaaccepted"
+	EULA_VERSION_KEY     = "eulaversion"
+	EULA_HASH_KEY        = "eulahash"
+	EULA_ACCEPTED_AT_KEY = "eulaacceptedat"
+)
+
+// JSON representation of the bundled EULA and the
+// EULA accepted by the user returned to the host
+type eulaStatus struct {
+	Version string `json:"version"`
+	Hash    string `json:"hash,omitempty"`
+	URL     string `json:"url"`
+
+	AcceptedVersion string `json:"acceptedVersion,omitempty"`
+	AcceptedHash    string `json:"acceptedHash,omitempty"`
+	// time of acceptance in milliseconds since the epoch
+	AcceptedAt int64 `json:"acceptedAt,omitempty"`
+
+	// the accepted EULA is not the bundled EULA
+	// so the user needs to accept it (again)
+	NeedsAcceptance bool `json:"needsAcceptance"`
+}
+
+// the acceptance is not exposed by the config interface
+// so it is saved via the underlying config store
+type eulaStore interface {
+	Set(key string, value interface{})
+	GetString(key string) string
+	GetInt64(key string) int64
+}
+
+//export snEULAAccepted
+func snEULAAccepted() C.uchar {
+	if status, err := getEULAStatus(); err == nil && !status.NeedsAcceptance {
+		return C.uchar(1)
+	}
+	return C.uchar(0)
+}
+
+//export snSetEULAAccepted
+func snSetEULAAccepted() C.SN_ERROR_CODE {
+	if err := acceptEULA(); err != nil {
+		return setLastErrorCode("snSetEULAAccepted", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snEULAStatus
+func snEULAStatus() *C.char {
+
+	status, err := getEULAStatus()
+	if err != nil {
+		_ = setLastError("snEULAStatus", err)
+		return nil
+	}
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		_ = setLastError("snEULAStatus", err)
+		return nil
+	}
+	return C.CString(string(statusJSON))
+}
+
+// returns the bundled EULA and the EULA accepted by the user.
+// an acceptance saved before EULAs were versioned needs to be
+// renewed as it is not known which version was accepted.
+func getEULAStatus() (*eulaStatus, error) {
+
+	cfg := currentConfig()
+	if cfg == nil {
+		return nil, newError(SN_ERROR_LOCK, "the device is locked")
+	}
+	store, ok := cfg.(eulaStore)
+	if !ok {
+		return nil, newError(SN_ERROR_STORAGE, "the configuration does not support saving the EULA acceptance")
+	}
+
+	status := &eulaStatus{
+		Version: eulaVersion,
+		Hash:    eulaHash,
+		URL:     EULA_URL,
+	}
+	if cfg.EULAAccepted() {
+		status.AcceptedVersion = store.GetString(EULA_VERSION_KEY)
+		status.AcceptedHash = store.GetString(EULA_HASH_KEY)
+		status.AcceptedAt = store.GetInt64(EULA_ACCEPTED_AT_KEY)
+	}
+	status.NeedsAcceptance = status.AcceptedVersion != status.Version ||
+		(len(status.Hash) > 0 && status.AcceptedHash != status.Hash)
+
+	return status, nil
+}
+
+// returns the hex encoded SHA-256 hash of the EULA text
+func hashEULA(text []byte) string {
+	hash := sha256.Sum256(text)
+	return hex.EncodeToString(hash[:])
+}
+
+// records the acceptance of the bundled EULA. the previous
+// acceptance is restored if the configuration cannot be saved.
+func acceptEULA() error {
+
+	cfg := currentConfig()
+	if cfg == nil {
+		return newError(SN_ERROR_LOCK, "the device is locked")
+	}
+	store, ok := cfg.(eulaStore)
+	if !ok {
+		return newError(SN_ERROR_STORAGE, "the configuration does not support saving the EULA acceptance")
+	}
+
+	prevAccepted := cfg.EULAAccepted()
+	prevVersion := store.GetString(EULA_VERSION_KEY)
+	prevHash := store.GetString(EULA_HASH_KEY)
+	prevAcceptedAt := store.GetInt64(EULA_ACCEPTED_AT_KEY)
+
+	cfg.SetEULAAccepted()
+	store.Set(EULA_VERSION_KEY, eulaVersion)
+	store.Set(EULA_HASH_KEY, eulaHash)
+	store.Set(EULA_ACCEPTED_AT_KEY, time.Now().UnixMilli())
+
+	if err := saveConfig(cfg); err != nil {
+		store.Set(EULA_ACCEPTED_KEY, prevAccepted)
+		store.Set(EULA_VERSION_KEY, prevVersion)
+		store.Set(EULA_HASH_KEY, prevHash)
+		store.Set(EULA_ACCEPTED_AT_KEY, prevAcceptedAt)
+		return storageError(err)
+	}
+	return nil
+}
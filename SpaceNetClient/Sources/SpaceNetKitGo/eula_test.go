@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// replaces the bundled EULA for the duration of a test
+func setBundledEULA(t *testing.T, version string, text []byte) {
+
+	prevVersion, prevHash := eulaVersion, eulaHash
+	eulaVersion, eulaHash = version, hashEULA(text)
+
+	t.Cleanup(func() {
+		eulaVersion, eulaHash = prevVersion, prevHash
+	})
+}
+
+func TestBundledEULAHash(t *testing.T) {
+
+	if len(eulaText) == 0 {
+		t.Fatal("no EULA is bundled with the client")
+	}
+	if eulaHash != hashEULA(eulaText) || len(eulaHash) != 64 {
+		t.Errorf("eulaHash = %q, expected the SHA-256 hash of the bundled EULA", eulaHash)
+	}
+}
+
+func TestEULAAcceptance(t *testing.T) {
+
+	tc := newTestContext(t)
+	setBundledEULA(t, "1.0", []byte("first"))
+
+	status, err := getEULAStatus()
+	if err != nil {
+		t.Fatalf("getEULAStatus() failed: %s", err.Error())
+	}
+	if !status.NeedsAcceptance || status.Hash != hashEULA([]byte("first")) {
+		t.Errorf("getEULAStatus() = %+v, expected the bundled EULA to need acceptance", status)
+	}
+
+	if err = acceptEULA(); err != nil {
+		t.Fatalf("acceptEULA() failed: %s", err.Error())
+	}
+	if status, _ = getEULAStatus(); status.NeedsAcceptance ||
+		status.AcceptedVersion != "1.0" || status.AcceptedHash != status.Hash || status.AcceptedAt == 0 {
+		t.Errorf("getEULAStatus() = %+v after the EULA was accepted", status)
+	}
+
+	// the acceptance was saved
+	if err = tc.config.Load(); err != nil {
+		t.Fatalf("failed to reload the config: %s", err.Error())
+	}
+	if status, _ = getEULAStatus(); status.NeedsAcceptance {
+		t.Errorf("acceptance of the EULA was not saved")
+	}
+
+	// a changed text needs to be accepted again
+	setBundledEULA(t, "1.0", []byte("second"))
+	if status, _ = getEULAStatus(); !status.NeedsAcceptance {
+		t.Errorf("a changed EULA text did not need to be accepted again")
+	}
+	if err = acceptEULA(); err != nil {
+		t.Fatalf("acceptEULA() failed: %s", err.Error())
+	}
+
+	// as does a new version
+	setBundledEULA(t, "2.0", []byte("second"))
+	if status, _ = getEULAStatus(); !status.NeedsAcceptance || status.AcceptedVersion != "1.0" {
+		t.Errorf("getEULAStatus() = %+v, expected a new EULA version to need acceptance", status)
+	}
+}
@@ -0,0 +1,292 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+// #include <pthread.h>
+//
+// static unsigned long currentThread()
+// {
+//   return (unsigned long)pthread_self();
+// }
+//
+// static void postStatusEvent(void *func, void *ctx, const unsigned char status, const char *eventJSON)
+// {
+//   ((void(*)(void *, const unsigned char, const char *))func)(ctx, status, eventJSON);
+// }
+import "C"
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	statusEvents = newStatusEventBus()
+)
+
+const (
+	// kinds of events. only status events change the
+	// status delivered to subscribers when they are added.
+	SN_EVENT_KIND_STATUS      = "status"
+	SN_EVENT_KIND_DEVICE_USER = "deviceUser"
+)
+
+// A status event describes a change of the application's
+// configuration status. Events are delivered to the host
+// in the order they were posted on a dedicated goroutine
+// so no locks are held while host handlers are running.
+type statusEvent struct {
+	Kind     string `json:"kind"`
+	Status   int    `json:"status"`
+	Reason   string `json:"reason"`
+	Username string `json:"username,omitempty"`
+	// the user whose access to the device changed
+	DeviceUser string `json:"deviceUser,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// the SN_ERROR_* code of the error
+	ErrorCode int `json:"errorCode,omitempty"`
+
+	Timestamp int64 `json:"timestamp"`
+}
+
+type statusSubscriber struct {
+	context,
+	handler uintptr
+
+	// the sequence number of the last event published
+	// before the subscriber was added. such events are
+	// not delivered to the subscriber as it receives
+	// the last of them when it is added.
+	since uint64
+
+	// held while an event is being delivered so
+	// that removing the subscriber waits for it
+	mx      sync.Mutex
+	removed bool
+}
+
+type statusEventBus struct {
+	subscribers *registry[uint64, *statusSubscriber]
+	nextID      uint64
+
+	// the most recent event which is delivered to new
+	// subscribers and the deliveries waiting to be made.
+	// the queue is unbounded so posting never blocks.
+	mx      sync.Mutex
+	cond    *sync.Cond
+	last    *statusEvent
+	seq     uint64
+	pending []func()
+
+	// the OS thread events are delivered on which
+	// identifies calls made by handlers themselves
+	deliveryThread atomic.Uint64
+}
+
+//export snRegisterStatusChangeHandler
+func snRegisterStatusChangeHandler(context, handler uintptr) C.ulong {
+	if handler == 0 {
+		return C.ulong(0)
+	}
+	return C.ulong(statusEvents.subscribe(context, handler))
+}
+
+//export snUnregisterStatusChangeHandler
+func snUnregisterStatusChangeHandler(id C.ulong) {
+	statusEvents.unsubscribe(uint64(id))
+}
+
+// posts a status change with the reason for
+// the change and the error that caused it if any
+func postStatusChange(status int, reason string, err error) {
+
+	event := newStatusEvent(status, reason, err)
+
+	logger.DebugMessage("Posting config status change: %d (%s)", status, reason)
+	statusEvents.publish(event)
+	updateMonitorsForStatus(status)
+	updateTokenRefresherForStatus(status)
+}
+
+// posts a change of a user's access to the device. the
+// logged in owner's status is unchanged so sessions only
+// need to update their view of the device's users and the
+// event carries the current status when it is published.
+func postDeviceUserChange(reason, deviceUser string) {
+
+	event := newStatusEvent(SN_CFG_STATUS_LOGGED_IN, reason, nil)
+	event.Kind = SN_EVENT_KIND_DEVICE_USER
+	event.DeviceUser = deviceUser
+
+	logger.DebugMessage("Posting device user change: %s (%s)", deviceUser, reason)
+	statusEvents.publish(event)
+}
+
+func newStatusEvent(status int, reason string, err error) *statusEvent {
+
+	event := &statusEvent{
+		Kind:      SN_EVENT_KIND_STATUS,
+		Status:    status,
+		Reason:    reason,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+		event.ErrorCode = errorCode(err)
+	}
+	if cfg := currentConfig(); cfg != nil && status == SN_CFG_STATUS_LOGGED_IN {
+		event.Username = cfg.DeviceContext().GetLoggedInUserName()
+	}
+	return event
+}
+
+func newStatusEventBus() *statusEventBus {
+
+	bus := &statusEventBus{
+		subscribers: newRegistry[uint64, *statusSubscriber]("statusSubscribers", 0),
+	}
+	bus.cond = sync.NewCond(&bus.mx)
+
+	started := make(chan struct{})
+	go func() {
+		// events are delivered on a single OS thread so
+		// that handlers unregistering themselves can be
+		// detected by the thread they are called on
+		runtime.LockOSThread()
+		bus.deliveryThread.Store(uint64(C.currentThread()))
+		close(started)
+
+		for {
+			bus.mx.Lock()
+			for len(bus.pending) == 0 {
+				bus.cond.Wait()
+			}
+			deliveries := bus.pending
+			bus.pending = nil
+			bus.mx.Unlock()
+
+			for _, deliver := range deliveries {
+				deliver()
+			}
+		}
+	}()
+	<-started
+	return bus
+}
+
+// queues a delivery. must be called with bus.mx held.
+func (bus *statusEventBus) enqueue(deliver func()) {
+	bus.pending = append(bus.pending, deliver)
+	bus.cond.Signal()
+}
+
+// adds a subscriber returning its id. the subscriber will
+// immediately receive the current status if one is known.
+func (bus *statusEventBus) subscribe(context, handler uintptr) uint64 {
+
+	id := atomic.AddUint64(&bus.nextID, 1)
+
+	bus.mx.Lock()
+	defer bus.mx.Unlock()
+
+	sub := &statusSubscriber{
+		context: context,
+		handler: handler,
+		since:   bus.seq,
+	}
+
+	bus.subscribers.register(id, sub)
+	if last := bus.last; last != nil {
+		bus.enqueue(func() {
+			sub.deliver(last)
+		})
+	}
+	return id
+}
+
+// removes a subscriber. once it returns the subscriber's
+// handler will not be called again and no call to it is
+// in progress unless it is called by the handler itself.
+func (bus *statusEventBus) unsubscribe(id uint64) {
+
+	sub, ok := bus.subscribers.unregister(id)
+	if !ok {
+		logger.ErrorMessage("Attempt to unregister unknown status change handler %d", id)
+		return
+	}
+	if uint64(C.currentThread()) == bus.deliveryThread.Load() {
+		// the handler is unregistering itself while it
+		// is being called so its lock is already held
+		sub.removed = true
+		return
+	}
+	sub.mx.Lock()
+	sub.removed = true
+	sub.mx.Unlock()
+}
+
+func (bus *statusEventBus) publish(event *statusEvent) {
+
+	bus.mx.Lock()
+	defer bus.mx.Unlock()
+
+	bus.seq++
+	seq := bus.seq
+
+	if event.Kind == SN_EVENT_KIND_STATUS {
+		bus.last = event
+	} else if bus.last != nil {
+		// other events do not change the status
+		event.Status = bus.last.Status
+	}
+	bus.enqueue(func() {
+		for _, item := range bus.subscribers.snapshot() {
+			if item.value.since < seq {
+				item.value.deliver(event)
+			}
+		}
+	})
+}
+
+func (sub *statusSubscriber) deliver(event *statusEvent) {
+
+	sub.mx.Lock()
+	defer sub.mx.Unlock()
+
+	if sub.removed {
+		// the subscriber was removed after
+		// the event was queued for it
+		return
+	}
+	postStatusEventFn(sub, event)
+}
+
+// calls the subscriber's host handler. replaced by tests.
+var postStatusEventFn = func(sub *statusSubscriber, event *statusEvent) {
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		logger.ErrorMessage("Failed to serialize status event: %s", err.Error())
+		eventJSON = []byte("{}")
+	}
+	cEventJSON := C.CString(string(eventJSON))
+
+	C.postStatusEvent(
+		unsafe.Pointer(sub.handler),
+		unsafe.Pointer(sub.context),
+		C.uchar(event.Status),
+		cEventJSON,
+	)
+
+	C.free(unsafe.Pointer(cEventJSON))
+}
@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the events delivered to host handlers instead of
+// calling them. the optional intercept function is called
+// for each delivery on the bus's delivery goroutine.
+type eventRecorder struct {
+	mx     sync.Mutex
+	events map[uintptr][]*statusEvent
+
+	intercept func(sub *statusSubscriber, event *statusEvent)
+}
+
+func newEventRecorder(t *testing.T) *eventRecorder {
+
+	rec := &eventRecorder{
+		events: make(map[uintptr][]*statusEvent),
+	}
+	prevFn := postStatusEventFn
+	postStatusEventFn = func(sub *statusSubscriber, event *statusEvent) {
+		rec.mx.Lock()
+		rec.events[sub.handler] = append(rec.events[sub.handler], event)
+		intercept := rec.intercept
+		rec.mx.Unlock()
+
+		if intercept != nil {
+			intercept(sub, event)
+		}
+	}
+	t.Cleanup(func() {
+		postStatusEventFn = prevFn
+	})
+	return rec
+}
+
+func (rec *eventRecorder) received(handler uintptr) []*statusEvent {
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+
+	return append([]*statusEvent{}, rec.events[handler]...)
+}
+
+// waits until all queued deliveries have been made
+func (bus *statusEventBus) flush() {
+	done := make(chan struct{})
+	bus.mx.Lock()
+	bus.enqueue(func() { close(done) })
+	bus.mx.Unlock()
+	<-done
+}
+
+func TestStatusEventDelivery(t *testing.T) {
+
+	rec := newEventRecorder(t)
+	bus := newStatusEventBus()
+
+	bus.subscribe(1, 1)
+	bus.publish(newStatusEvent(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_INVALID, nil))
+	bus.publish(newStatusEvent(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGOUT, nil))
+
+	// a new subscriber receives the last status
+	bus.subscribe(2, 2)
+	bus.flush()
+
+	events := rec.received(1)
+	if len(events) != 2 ||
+		events[0].Status != SN_CFG_STATUS_NEEDS_LOGIN ||
+		events[1].Status != SN_CFG_STATUS_LOGGED_OUT {
+		t.Errorf("first subscriber did not receive the events in order: %v", events)
+	}
+	events = rec.received(2)
+	if len(events) != 1 || events[0].Status != SN_CFG_STATUS_LOGGED_OUT {
+		t.Errorf("new subscriber did not receive only the last status: %v", events)
+	}
+}
+
+func TestUnsubscribeWaitsForDelivery(t *testing.T) {
+
+	rec := newEventRecorder(t)
+	bus := newStatusEventBus()
+
+	delivering := make(chan struct{})
+	release := make(chan struct{})
+	rec.intercept = func(sub *statusSubscriber, event *statusEvent) {
+		close(delivering)
+		<-release
+	}
+
+	id := bus.subscribe(1, 1)
+	bus.publish(newStatusEvent(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGOUT, nil))
+	<-delivering
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		bus.unsubscribe(id)
+		close(unsubscribed)
+	}()
+
+	select {
+	case <-unsubscribed:
+		t.Fatalf("unsubscribe returned while an event was being delivered to the handler")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	<-unsubscribed
+
+	rec.mx.Lock()
+	rec.intercept = nil
+	rec.mx.Unlock()
+
+	// no events are delivered once unsubscribe returns
+	bus.publish(newStatusEvent(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_INVALID, nil))
+	bus.flush()
+	if n := len(rec.received(1)); n != 1 {
+		t.Errorf("handler received %d events, expected 1", n)
+	}
+}
+
+func TestUnsubscribeFromHandler(t *testing.T) {
+
+	rec := newEventRecorder(t)
+	bus := newStatusEventBus()
+
+	var id uint64
+	rec.intercept = func(sub *statusSubscriber, event *statusEvent) {
+		// must not wait for the delivery it is part of
+		bus.unsubscribe(id)
+	}
+	id = bus.subscribe(1, 1)
+
+	bus.publish(newStatusEvent(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGOUT, nil))
+	bus.publish(newStatusEvent(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_INVALID, nil))
+
+	flushed := make(chan struct{})
+	go func() {
+		bus.flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler unsubscribing itself deadlocked the bus")
+	}
+	if n := len(rec.received(1)); n != 1 {
+		t.Errorf("handler received %d events after unsubscribing itself, expected 1", n)
+	}
+}
+
+func TestPublishDoesNotBlockOnSlowHandler(t *testing.T) {
+
+	rec := newEventRecorder(t)
+	bus := newStatusEventBus()
+
+	release := make(chan struct{})
+	rec.intercept = func(sub *statusSubscriber, event *statusEvent) {
+		<-release
+	}
+	bus.subscribe(1, 1)
+
+	// more events than the queue held previously
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			bus.publish(newStatusEvent(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGOUT, nil))
+		}
+		bus.subscribe(2, 2)
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publishing blocked while a handler was running")
+	}
+
+	rec.mx.Lock()
+	rec.intercept = nil
+	rec.mx.Unlock()
+	close(release)
+
+	bus.flush()
+	if n := len(rec.received(1)); n != 1000 {
+		t.Errorf("handler received %d events, expected 1000", n)
+	}
+}
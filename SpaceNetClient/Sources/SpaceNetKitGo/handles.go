@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"runtime/cgo"
+	"time"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// Go objects referenced by the host application. Go
+	// pointers cannot be retained by C so such objects are
+	// passed to the host as cgo handles. Handles are tracked
+	// here so that invalid or released handles returned by
+	// the host are detected instead of panicking the runtime.
+	liveHandles = newRegistry[cgo.Handle, liveHandle]("liveHandles", HANDLE_MAX_AGE)
+)
+
+const (
+	HANDLE_MAX_AGE = time.Hour
+)
+
+// the object referenced by a handle is retained with the
+// handle so it can be retrieved without calling Value()
+// on a handle that may be concurrently deleted
+type liveHandle struct {
+	kind  string
+	value interface{}
+}
+
+// returns a handle to the given Go object that can be
+// passed to the host application. the handle must be
+// explicitly released once the host no longer needs it.
+func newHandle(kind string, value interface{}) cgo.Handle {
+	h := cgo.NewHandle(value)
+	liveHandles.register(h, liveHandle{kind, value})
+	return h
+}
+
+// returns the Go object referenced by a handle received
+// from the host application if the handle is valid and
+// references an object of the expected type
+func handleValue[T any](h uintptr) (T, bool) {
+
+	lh, ok := liveHandles.lookup(cgo.Handle(h))
+	if !ok {
+		logger.ErrorMessage("Invalid or released handle %x received from host", h)
+		var none T
+		return none, false
+	}
+	return typedHandleValue[T](h, lh)
+}
+
+// releases the handle returning the Go object it
+// references. only one of any concurrent callers
+// receives the object so it can be used to ensure
+// a handle's object is only acted upon once.
+func takeHandle[T any](h uintptr) (T, bool) {
+
+	var (
+		none T
+	)
+
+	if _, ok := handleValue[T](h); !ok {
+		return none, false
+	}
+	lh, ok := liveHandles.unregister(cgo.Handle(h))
+	if !ok {
+		logger.ErrorMessage("Handle %x was released by a concurrent call", h)
+		return none, false
+	}
+	cgo.Handle(h).Delete()
+	return typedHandleValue[T](h, lh)
+}
+
+func typedHandleValue[T any](h uintptr, lh liveHandle) (T, bool) {
+	value, ok := lh.value.(T)
+	if !ok {
+		logger.ErrorMessage("Handle %x received from host does not reference a %T but a '%s'", h, value, lh.kind)
+		return value, false
+	}
+	return value, true
+}
+
+// returns whether the handle is valid
+func isLiveHandle(h uintptr) bool {
+	_, ok := liveHandles.lookup(cgo.Handle(h))
+	return ok
+}
+
+// releases the handle so the Go object it references
+// can be garbage collected. returns false if the handle
+// is invalid or has already been released.
+func releaseHandle(h uintptr) bool {
+	if _, ok := liveHandles.unregister(cgo.Handle(h)); !ok {
+		logger.ErrorMessage("Attempt to release invalid or already released handle %x", h)
+		return false
+	}
+	cgo.Handle(h).Delete()
+	return true
+}
@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestHandleLifecycle(t *testing.T) {
+
+	value := &dialogInputHandle{}
+	h := uintptr(newHandle("dialogInput", value))
+
+	if v, ok := handleValue[*dialogInputHandle](h); !ok || v != value {
+		t.Fatalf("handleValue() did not return the referenced object")
+	}
+	if _, ok := handleValue[*settingsSession](h); ok {
+		t.Errorf("handleValue() returned an object of the wrong type")
+	}
+	if !releaseHandle(h) {
+		t.Fatalf("releaseHandle() failed for a live handle")
+	}
+	if isLiveHandle(h) {
+		t.Errorf("handle is live after it was released")
+	}
+	if _, ok := handleValue[*dialogInputHandle](h); ok {
+		t.Errorf("handleValue() returned an object for a released handle")
+	}
+	if releaseHandle(h) {
+		t.Errorf("releaseHandle() succeeded for an already released handle")
+	}
+}
+
+func TestTakeHandleOnce(t *testing.T) {
+
+	const workers = 16
+
+	value := &dialogInputHandle{}
+	h := uintptr(newHandle("dialogInput", value))
+
+	var (
+		wg    sync.WaitGroup
+		mx    sync.Mutex
+		taken int
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok := takeHandle[*dialogInputHandle](h); ok {
+				if v != value {
+					t.Errorf("takeHandle() did not return the referenced object")
+				}
+				mx.Lock()
+				taken++
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if taken != 1 {
+		t.Errorf("handle was taken %d times, expected once", taken)
+	}
+	if isLiveHandle(h) {
+		t.Errorf("handle is live after it was taken")
+	}
+}
+
+func TestHandleDialogInputOnce(t *testing.T) {
+
+	const workers = 16
+
+	// the channel can hold an input from every caller
+	// so a second send would be detected not block
+	inputHandle := &dialogInputHandle{
+		input: make(chan *string, workers),
+	}
+	inputContext := uintptr(newHandle("dialogInput", inputHandle))
+	dialogHandleLookup.register(inputContext, 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snHandleDialogInput(inputContext, 0, nil)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(inputHandle.input); n != 1 {
+		t.Errorf("dialog input was sent %d times, expected once", n)
+	}
+	if _, ok := dialogHandleLookup.lookup(inputContext); ok {
+		t.Errorf("dialog handle lookup was not removed")
+	}
+}
+
+func TestDialogReleaseInput(t *testing.T) {
+
+	inputHandle := &dialogInputHandle{
+		input: make(chan *string, 1),
+	}
+	handle := &dialogHandle{
+		dlgInputContext: uintptr(newHandle("dialogInput", inputHandle)),
+	}
+
+	handle.releaseInput()
+	if isLiveHandle(handle.dlgInputContext) {
+		t.Errorf("input context is live after the dialog was dismissed")
+	}
+	select {
+	case input := <-inputHandle.input:
+		if input != nil {
+			t.Errorf("dismissed dialog returned input '%s'", *input)
+		}
+	default:
+		t.Fatalf("dismissed dialog did not release its input")
+	}
+
+	// a late response from the host is ignored
+	handle.releaseInput()
+	snHandleDialogInput(handle.dlgInputContext, 1, nil)
+	if n := len(inputHandle.input); n != 0 {
+		t.Errorf("dialog input was sent after the dialog was dismissed")
+	}
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/appbricks/mycloudspace-client/apple/mycsfake"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testUsername   = "owner"
+	testPassphrase = "test device passphrase"
+)
+
+// A fake MyCS service and the config of the active
+// profile in a temporary home directory
+type testContext struct {
+	service *mycsfake.Server
+	owner   *mycsfake.User
+	config  config.Config
+}
+
+// starts a fake MyCS service and loads the config of the active
+// profile from a temporary home directory with the environment
+// pointed at the fake. the global state is restored when the
+// test completes.
+func newTestContext(t *testing.T) *testContext {
+
+	var (
+		err error
+	)
+
+	tc := &testContext{
+		owner: &mycsfake.User{
+			Username: testUsername,
+			Email:    testUsername + "@example.com",
+			Name:     "Device Owner",
+		},
+	}
+	if tc.service, err = mycsfake.NewServer(tc.owner); err != nil {
+		t.Fatalf("failed to start the fake MyCS service: %s", err.Error())
+	}
+
+	prevHomeDir := homeDir
+	homeDir = t.TempDir()
+
+	currentEnvironmentMx.Lock()
+	currentEnvironment = &serviceEnvironment{
+		Name:          "test",
+		Region:        mycsfake.REGION,
+		UserPoolID:    mycsfake.USER_POOL_ID,
+		ClientID:      mycsfake.CLIENT_ID,
+		ClientSecret:  mycsfake.CLIENT_SECRET,
+		AuthURL:       tc.service.AuthURL(),
+		TokenURL:      tc.service.TokenURL(),
+		ApiURL:        tc.service.ApiURL(),
+		DeviceAuthURL: tc.service.DeviceAuthURL(),
+	}
+	currentEnvironmentMx.Unlock()
+
+	if tc.config, err = config.InitFileConfig(
+		activeProfileConfigFile(), nil,
+		func() string { return testPassphrase }, nil,
+	); err != nil {
+		t.Fatalf("failed to initialize the config: %s", err.Error())
+	}
+	if err = tc.config.Load(); err != nil {
+		t.Fatalf("failed to load the config: %s", err.Error())
+	}
+	setConfig(tc.config)
+
+	t.Cleanup(func() {
+		setConfig(nil)
+		resetSpaceNodes()
+		resetEnvironment()
+		tc.service.Close()
+		homeDir = prevHomeDir
+	})
+	return tc
+}
+
+// logs the config in to the fake service as the given user
+func (tc *testContext) login(t *testing.T, username string) {
+
+	accessToken, err := tc.service.AccessToken(username)
+	if err != nil {
+		t.Fatalf("failed to issue an access token: %s", err.Error())
+	}
+	tc.config.AuthContext().SetToken(&oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(mycsfake.TOKEN_EXPIRY),
+	})
+}
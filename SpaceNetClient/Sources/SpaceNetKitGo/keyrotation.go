@@ -0,0 +1,347 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import "C"
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/appbricks/cloud-builder/userspace"
+	"github.com/appbricks/mycloudspace-client/api"
+	"github.com/hasura/go-graphql-client"
+	"github.com/mevansam/goutils/crypto"
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// serializes rotations of the owner's key
+	keyRotationMx sync.Mutex
+)
+
+// The state of a key rotation required to roll it back
+type keyRotation struct {
+	config config.Config
+
+	owner *userspace.User
+	// the owner's key before the rotation
+	prevOwner userspace.User
+
+	// the new key until it is moved to the key file
+	stagedKeyFile string
+
+	registered bool
+}
+
+//export snSettingsRotateUserKey
+func snSettingsRotateUserKey(
+	sessionHandle uintptr,
+	dlgContext uintptr,
+	keyFile *C.char,
+	oldKeyFile *C.char,
+	handler uintptr,
+) {
+	session, err := settingsSessionValue(sessionHandle)
+	if err != nil {
+		ok := setLastError("snSettingsRotateUserKey", err)
+		postSettingsOwnerKeyLoaded(dlgContext, handler, ok, "")
+		return
+	}
+
+	newKeyFileName := C.GoString(keyFile)
+	oldKeyFileName := ""
+	if oldKeyFile != nil {
+		oldKeyFileName = C.GoString(oldKeyFile)
+	}
+
+	go func() {
+		ok := C.uchar(1)
+		err := rotateOwnerKey(session, dlgContext, newKeyFileName, oldKeyFileName)
+		auditLog(AUDIT_KEY_ROTATE, newKeyFileName, err)
+		if err != nil {
+			ok = setLastError("snSettingsRotateUserKey", err)
+		}
+		postSettingsOwnerKeyLoaded(dlgContext, handler, ok, newKeyFileName)
+	}()
+}
+
+// replaces the device owner's key with a new key. the new
+// public key is registered with the MyCS service and the
+// device context, which holds the only copy of the owner's
+// key saved by this client, is re-encrypted by saving the
+// configuration with the new key. the new key is written to
+// the key file, in the format of the key file it replaces,
+// and the old key file is securely deleted.
+// if any step fails the old key is restored.
+func rotateOwnerKey(session *settingsSession, dlgContext uintptr, keyFile, oldKeyFile string) error {
+
+	var (
+		err error
+
+		newKey     *crypto.RSAKey
+		keyPEM     []byte
+		passphrase *string
+	)
+
+	keyRotationMx.Lock()
+	defer keyRotationMx.Unlock()
+
+	if len(keyFile) == 0 {
+		return newError(SN_ERROR_VALIDATION, "a file to save the new key to is required")
+	}
+	session.mx.Lock()
+	modified := session.modified
+	session.mx.Unlock()
+	if modified {
+		// the rotation saves the configuration which
+		// would also save the session's pending changes
+		return newError(SN_ERROR_VALIDATION, "pending settings changes must be saved or cancelled before the owner key is rotated")
+	}
+
+	// the rotation is made with the configuration
+	// the settings session was started with
+	cfg := session.config
+	owner, err := loggedInOwner(cfg)
+	if err != nil {
+		return err
+	}
+	if len(owner.RSAPrivateKey) == 0 {
+		return newError(SN_ERROR_VALIDATION, "the owner's key has not been loaded")
+	}
+
+	// the new key is protected like the key it replaces
+	currentKey := &ownerKeyFile{name: oldKeyFile, path: oldKeyFile, format: OWNER_KEY_FORMAT_PEM}
+	if len(oldKeyFile) == 0 {
+		currentKey.name, currentKey.path = keyFile, keyFile
+	}
+	if _, err = os.Stat(currentKey.path); err == nil {
+		if err = currentKey.detectFormat(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return storageError(err)
+	}
+	if currentKey.encrypted() {
+		if passphrase = promptKeyFilePassphraseFn(dlgContext, currentKey, true); passphrase == nil {
+			return newError(SN_ERROR_CANCELLED, "the key file passphrase was not entered")
+		}
+	} else {
+		passphrase = new(string)
+	}
+
+	rotation := &keyRotation{
+		config:        cfg,
+		owner:         owner,
+		prevOwner:     *owner,
+		stagedKeyFile: keyFile + ".new",
+	}
+
+	if newKey, err = crypto.NewRSAKey(); err != nil {
+		return err
+	}
+	if keyPEM, err = encryptOwnerKey(newKey, currentKey.format, []byte(*passphrase)); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return storageError(err)
+	}
+	if err = os.WriteFile(rotation.stagedKeyFile, keyPEM, 0600); err != nil {
+		return storageError(err)
+	}
+
+	// the new key is registered before it is set in the device
+	// context so that a concurrent save of the config never
+	// writes a key that the MyCS service has not accepted. the
+	// known public key is cleared as it is used to validate the
+	// key being set.
+	newOwner := *owner
+	newOwner.RSAPublicKey = ""
+	if err = newOwner.SetKey(newKey); err != nil {
+		return rotation.rollback(err)
+	}
+	if err = registerOwnerKey(cfg, &newOwner); err != nil {
+		return rotation.rollback(err)
+	}
+	rotation.registered = true
+
+	if err = updateConfig(cfg, func() (bool, error) {
+		*owner = newOwner
+		return true, nil
+	}); err != nil {
+		return rotation.rollback(err)
+	}
+
+	if len(oldKeyFile) > 0 && oldKeyFile != keyFile {
+		if err = os.Rename(rotation.stagedKeyFile, keyFile); err != nil {
+			return rotation.rollback(storageError(err))
+		}
+		if err = secureDelete(oldKeyFile); err != nil {
+			// the rotation is complete so the old key
+			// file is left for the user to remove
+			logger.ErrorMessage("Failed to securely delete old key file '%s': %s", oldKeyFile, err.Error())
+		}
+	} else {
+		// the key file is replaced so the old key is moved
+		// aside until the new key has been moved in
+		movedKeyFile := keyFile + ".old"
+		if err = os.Rename(keyFile, movedKeyFile); err != nil {
+			if !os.IsNotExist(err) {
+				logger.ErrorMessage("New owner key retained in '%s' as the old key in '%s' could not be moved aside", rotation.stagedKeyFile, keyFile)
+				return storageError(err)
+			}
+			movedKeyFile = ""
+		}
+		if err = os.Rename(rotation.stagedKeyFile, keyFile); err != nil {
+			// the new key is the registered key so it is
+			// retained in the staged file for the user
+			logger.ErrorMessage("New owner key retained in '%s' as it could not be moved to '%s'", rotation.stagedKeyFile, keyFile)
+			if len(movedKeyFile) > 0 {
+				if restoreErr := os.Rename(movedKeyFile, keyFile); restoreErr != nil {
+					logger.ErrorMessage("Old owner key retained in '%s': %s", movedKeyFile, restoreErr.Error())
+				}
+			}
+			return storageError(err)
+		}
+		if len(movedKeyFile) > 0 {
+			if err = secureDelete(movedKeyFile); err != nil {
+				logger.ErrorMessage("Failed to securely delete old key file '%s': %s", movedKeyFile, err.Error())
+			}
+		}
+	}
+
+	// a copy of the old key may have been
+	// restored from a configuration backup
+	restoredKeyFile := restoredOwnerKeyFile()
+	if restoredKeyFile != keyFile {
+		if err = secureDelete(restoredKeyFile); err != nil && !os.IsNotExist(err) {
+			logger.ErrorMessage("Failed to securely delete restored key file '%s': %s", restoredKeyFile, err.Error())
+		}
+	}
+
+	logger.DebugMessage("Rotated key of device owner '%s'", owner.Name)
+	return nil
+}
+
+// restores the owner's previous key in the device context,
+// saving it in case a concurrent save wrote the new key, and
+// with the MyCS service if the new key was registered and
+// returns the error that failed the rotation. the new key is
+// retained in the staged file if the previous key could not
+// be registered again as it remains registered.
+func (r *keyRotation) rollback(rotationErr error) error {
+
+	restored := false
+	if err := updateConfig(r.config, func() (bool, error) {
+		*r.owner = r.prevOwner
+		restored = true
+		return true, nil
+	}); err != nil {
+		logger.ErrorMessage("Failed to save configuration with previous owner key: %s", err.Error())
+	}
+	if !restored {
+		// the config is no longer loaded
+		configSaveMx.Lock()
+		*r.owner = r.prevOwner
+		configSaveMx.Unlock()
+	}
+
+	if r.registered {
+		if err := registerOwnerKey(r.config, r.owner); err != nil {
+			logger.ErrorMessage("Failed to restore registration of previous owner key: %s", err.Error())
+			return newError(
+				classifyError(err).Code,
+				"the owner key rotation failed (%s) and the previous key could not be registered again. "+
+					"the new key which remains registered has been retained in '%s': %s",
+				rotationErr.Error(), r.stagedKeyFile, err.Error(),
+			)
+		}
+	}
+	_ = os.Remove(r.stagedKeyFile)
+	return rotationErr
+}
+
+// returns the owner of the device if the
+// owner is logged in to the given config
+func loggedInOwner(cfg config.Config) (*userspace.User, error) {
+
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return nil, newError(SN_ERROR_AUTH, "no user is logged in")
+	}
+	deviceContext := cfg.DeviceContext()
+	ownerName, isOwnerConfigured := deviceContext.GetOwnerUserName()
+	if !isOwnerConfigured || ownerName != deviceContext.GetLoggedInUserName() {
+		return nil, newError(SN_ERROR_AUTH, "only the owner of the device can rotate its key")
+	}
+	return deviceContext.GetOwner(), nil
+}
+
+// registers the public key of the user with the MyCS service
+func registerOwnerKey(cfg config.Config, user *userspace.User) error {
+
+	type Key struct {
+		PublicKey    string `json:"publicKey"`
+		KeyTimestamp int64  `json:"keyTimestamp"`
+	}
+
+	var (
+		mutation struct {
+			UpdateUserKey struct {
+				UserID graphql.String `graphql:"userID"`
+			} `graphql:"updateUserKey(userKey: $userKey)"`
+		}
+	)
+
+	return api.NewGraphQLClient(getServiceConfig().ApiURL, "", cfg).Mutate(
+		context.Background(),
+		&mutation,
+		map[string]interface{}{
+			"userKey": Key{
+				PublicKey:    user.RSAPublicKey,
+				KeyTimestamp: user.KeyTimestamp,
+			},
+		},
+	)
+}
+
+// overwrites a file with random data and removes it. this is
+// best effort as copy-on-write file systems and flash storage
+// may retain the original blocks.
+func secureDelete(path string) error {
+	if err := secureOverwrite(path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// overwrites the contents of a file with random data
+func secureOverwrite(path string) error {
+
+	var (
+		err error
+
+		fileInfo os.FileInfo
+		file     *os.File
+	)
+
+	if fileInfo, err = os.Stat(path); err != nil {
+		return err
+	}
+	if file, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = io.CopyN(file, rand.Reader, fileInfo.Size()); err != nil {
+		return err
+	}
+	return file.Sync()
+}
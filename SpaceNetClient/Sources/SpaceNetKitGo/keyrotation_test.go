@@ -0,0 +1,315 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/appbricks/mycloudspace-client/apple/mycsfake"
+	"github.com/mevansam/goutils/crypto"
+)
+
+// registers the device with an owner whose key has been
+// loaded and returns a settings session of its config
+func (tc *testContext) newKeyRotationSession(t *testing.T) *settingsSession {
+
+	tc.registerDevice(t, nil)
+
+	key, err := crypto.NewRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.config.DeviceContext().GetOwner().SetKey(key); err != nil {
+		t.Fatalf("failed to set the owner key: %s", err.Error())
+	}
+	return &settingsSession{config: tc.config}
+}
+
+// records the public keys registered with the fake service
+// failing the registrations after the given number of them
+type keyRegistrations struct {
+	mx   sync.Mutex
+	keys []string
+
+	failAfter int
+}
+
+func (tc *testContext) recordKeyRegistrations(failAfter int) *keyRegistrations {
+
+	registrations := &keyRegistrations{failAfter: failAfter}
+	tc.service.HandleOperation("updateUserKey", func(user *mycsfake.User, variables map[string]interface{}) (interface{}, error) {
+		registrations.mx.Lock()
+		defer registrations.mx.Unlock()
+
+		if registrations.failAfter >= 0 && len(registrations.keys) >= registrations.failAfter {
+			return nil, errors.New("key registration failed")
+		}
+		userKey, _ := variables["userKey"].(map[string]interface{})
+		publicKey, _ := userKey["publicKey"].(string)
+		registrations.keys = append(registrations.keys, publicKey)
+		return map[string]interface{}{"userID": user.UserID}, nil
+	})
+	return registrations
+}
+
+func (r *keyRegistrations) registered() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return append([]string{}, r.keys...)
+}
+
+func TestRotateOwnerKey(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := tc.newKeyRotationSession(t)
+	registrations := tc.recordKeyRegistrations(-1)
+
+	owner := tc.config.DeviceContext().GetOwner()
+	prevPrivateKey := owner.RSAPrivateKey
+
+	dir := t.TempDir()
+	oldKeyFile := filepath.Join(dir, "old-key.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(oldKeyFile, []byte(prevPrivateKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rotateOwnerKey(session, 0, keyFile, oldKeyFile); err != nil {
+		t.Fatalf("rotateOwnerKey() failed: %s", err.Error())
+	}
+	if owner.RSAPrivateKey == prevPrivateKey {
+		t.Errorf("the owner key was not replaced")
+	}
+	if keys := registrations.registered(); len(keys) != 1 || keys[0] != owner.RSAPublicKey {
+		t.Errorf("the new public key was not registered: %v", keys)
+	}
+	if _, err := crypto.NewRSAKeyFromFile(keyFile, nil); err != nil {
+		t.Errorf("the new key file is not a valid key: %s", err.Error())
+	}
+	if _, err := os.Stat(oldKeyFile); !os.IsNotExist(err) {
+		t.Errorf("the old key file was not deleted: %v", err)
+	}
+	if _, err := os.Stat(keyFile + ".new"); !os.IsNotExist(err) {
+		t.Errorf("the staged key file was not moved: %v", err)
+	}
+}
+
+func TestRotateOwnerKeyRollback(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := tc.newKeyRotationSession(t)
+	registrations := tc.recordKeyRegistrations(-1)
+
+	owner := tc.config.DeviceContext().GetOwner()
+	prevOwner := *owner
+
+	// the new key cannot be moved to a key file
+	// that is a directory after it is registered
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.MkdirAll(filepath.Join(keyFile, "entry"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldKeyFile := filepath.Join(dir, "old-key.pem")
+	if err := os.WriteFile(oldKeyFile, []byte(prevOwner.RSAPrivateKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := rotateOwnerKey(session, 0, keyFile, oldKeyFile)
+	if code := errorCode(err); code != SN_ERROR_STORAGE {
+		t.Fatalf("rotateOwnerKey() returned error code %d, expected a storage error: %v", code, err)
+	}
+	if owner.RSAPrivateKey != prevOwner.RSAPrivateKey || owner.RSAPublicKey != prevOwner.RSAPublicKey {
+		t.Errorf("the previous owner key was not restored")
+	}
+	keys := registrations.registered()
+	if len(keys) != 2 || keys[1] != prevOwner.RSAPublicKey {
+		t.Errorf("the previous public key was not registered again: %v", keys)
+	}
+	if _, err = os.Stat(keyFile + ".new"); !os.IsNotExist(err) {
+		t.Errorf("the staged key file was not removed: %v", err)
+	}
+	if _, err = os.Stat(oldKeyFile); err != nil {
+		t.Errorf("the old key file was removed: %s", err.Error())
+	}
+}
+
+func TestRotateOwnerKeyFailedRollback(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := tc.newKeyRotationSession(t)
+	// only the new key can be registered
+	registrations := tc.recordKeyRegistrations(1)
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.MkdirAll(filepath.Join(keyFile, "entry"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldKeyFile := filepath.Join(dir, "old-key.pem")
+
+	err := rotateOwnerKey(session, 0, keyFile, oldKeyFile)
+	if err == nil {
+		t.Fatalf("rotateOwnerKey() succeeded")
+	}
+	stagedKeyFile := keyFile + ".new"
+	if !strings.Contains(err.Error(), stagedKeyFile) {
+		t.Errorf("rotateOwnerKey() error does not reference the retained key file: %s", err.Error())
+	}
+
+	// the new key remains registered so it must be retained
+	keys := registrations.registered()
+	if len(keys) != 1 {
+		t.Fatalf("%d keys were registered, expected 1", len(keys))
+	}
+	stagedKey, err := crypto.NewRSAKeyFromFile(stagedKeyFile, nil)
+	if err != nil {
+		t.Fatalf("the staged key file was not retained: %s", err.Error())
+	}
+	publicKey, err := stagedKey.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKey != keys[0] {
+		t.Errorf("the retained key is not the registered key")
+	}
+}
+
+func TestRotateOwnerKeyKeepsFormat(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := tc.newKeyRotationSession(t)
+	tc.recordKeyRegistrations(-1)
+
+	owner := tc.config.DeviceContext().GetOwner()
+	prevKey, err := readOwnerKey([]byte(owner.RSAPrivateKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevKeyPEM, err := encryptOwnerKey(prevKey, OWNER_KEY_FORMAT_PKCS8, []byte(testKeyFilePassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(keyFile, prevKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rotation is cancelled if no passphrase is entered
+	stubKeyFilePassphrasePrompt(t, nil)
+	err = rotateOwnerKey(session, 0, keyFile, "")
+	if code := errorCode(err); code != SN_ERROR_CANCELLED {
+		t.Fatalf("rotateOwnerKey() without a passphrase returned error code %d, expected cancelled: %v", code, err)
+	}
+	if _, err = os.Stat(keyFile + ".new"); !os.IsNotExist(err) {
+		t.Errorf("a key was staged for a cancelled rotation: %v", err)
+	}
+
+	passphrase := testKeyFilePassphrase
+	prompted := stubKeyFilePassphrasePrompt(t, &passphrase)
+	if err = rotateOwnerKey(session, 0, keyFile, ""); err != nil {
+		t.Fatalf("rotateOwnerKey() failed: %s", err.Error())
+	}
+	if !*prompted {
+		t.Errorf("the passphrase of the new key file was not prompted for")
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format, _ := ownerKeyFormat(keyPEM); format != OWNER_KEY_FORMAT_PKCS8 {
+		t.Errorf("the new key file was saved as %s, expected %s", format, OWNER_KEY_FORMAT_PKCS8)
+	}
+	newKey, err := readOwnerKey(keyPEM, []byte(testKeyFilePassphrase))
+	if err != nil {
+		t.Fatalf("the new key file cannot be read with the passphrase: %s", err.Error())
+	}
+	if mustPublicKeyPEM(t, newKey) != owner.RSAPublicKey {
+		t.Errorf("the new key file does not contain the owner's new key")
+	}
+}
+
+func TestRotateOwnerKeyInPlace(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := tc.newKeyRotationSession(t)
+	tc.recordKeyRegistrations(-1)
+
+	owner := tc.config.DeviceContext().GetOwner()
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, []byte(owner.RSAPrivateKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rotateOwnerKey(session, 0, keyFile, ""); err != nil {
+		t.Fatalf("rotateOwnerKey() failed: %s", err.Error())
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(keyPEM) != owner.RSAPrivateKey {
+		t.Errorf("the key file does not contain the owner's new key")
+	}
+	for _, file := range []string{keyFile + ".old", keyFile + ".new"} {
+		if _, err = os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("the key file '%s' was not removed: %v", file, err)
+		}
+	}
+}
+
+func TestRotateOwnerKeySaveDuringRegistration(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := tc.newKeyRotationSession(t)
+
+	owner := tc.config.DeviceContext().GetOwner()
+	prevPrivateKey := owner.RSAPrivateKey
+	if err := saveConfig(tc.config); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config is saved while the new key is
+	// registered which then fails
+	tc.service.HandleOperation("updateUserKey", func(user *mycsfake.User, variables map[string]interface{}) (interface{}, error) {
+		if err := saveConfig(tc.config); err != nil {
+			t.Errorf("saveConfig() failed: %s", err.Error())
+		}
+		return nil, errors.New("key registration failed")
+	})
+
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := rotateOwnerKey(session, 0, keyFile, ""); err == nil {
+		t.Fatalf("rotateOwnerKey() succeeded")
+	}
+
+	savedConfig, err := config.InitFileConfig(
+		activeProfileConfigFile(), nil,
+		func() string { return testPassphrase }, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = savedConfig.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if savedOwner := savedConfig.DeviceContext().GetOwner(); savedOwner == nil || savedOwner.RSAPrivateKey != prevPrivateKey {
+		t.Errorf("a key that was not registered was saved with the config")
+	}
+	if owner.RSAPrivateKey != prevPrivateKey {
+		t.Errorf("the previous owner key was not restored")
+	}
+}
@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// the decrypted configuration is dropped from
+	// memory when this timer fires. the generation
+	// ensures a timer that has been stopped or reset
+	// while its callback was pending does not lock.
+	idleTimer    *time.Timer
+	idleTimeout  time.Duration
+	idleTimerGen uint64
+	idleTimerMx  sync.Mutex
+)
+
+const (
+	DEFAULT_UNLOCKED_TIMEOUT = 24 * time.Hour
+
+	SN_REASON_IDLE_TIMEOUT = "idleTimeout"
+	SN_REASON_LOCKED       = "locked"
+)
+
+//export snTouchActivity
+func snTouchActivity() {
+	idleTimerMx.Lock()
+	defer idleTimerMx.Unlock()
+
+	if idleTimer != nil {
+		idleTimerGen++
+		idleTimer.Stop()
+		idleTimer = newIdleTimer(idleTimeout, idleTimerGen)
+	}
+}
+
+//export snLock
+func snLock() C.SN_ERROR_CODE {
+	if cfg := currentConfig(); cfg == nil || !cfg.HasPassphrase() {
+		return setLastErrorCode("snLock", newError(SN_ERROR_LOCK, "the device does not have an unlocked passphrase protected configuration"))
+	}
+	lockContext(SN_REASON_LOCKED)
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// starts the idle timer with the unlocked
+// timeout saved for the active profile
+func armIdleTimer() {
+	startIdleTimer(profileUnlockedTimeout())
+}
+
+// (re)starts the idle timer. the timer is only started
+// if the configuration is protected by a passphrase as
+// otherwise there is nothing to unlock it with.
+func startIdleTimer(timeout time.Duration) {
+	idleTimerMx.Lock()
+	defer idleTimerMx.Unlock()
+
+	idleTimerGen++
+	if idleTimer != nil {
+		idleTimer.Stop()
+		idleTimer = nil
+	}
+	if cfg := currentConfig(); cfg == nil || !cfg.HasPassphrase() || timeout <= 0 {
+		return
+	}
+	logger.DebugMessage("Device will be locked after %s of inactivity", timeout.String())
+
+	idleTimeout = timeout
+	idleTimer = newIdleTimer(timeout, idleTimerGen)
+}
+
+func stopIdleTimer() {
+	idleTimerMx.Lock()
+	defer idleTimerMx.Unlock()
+
+	idleTimerGen++
+	if idleTimer != nil {
+		idleTimer.Stop()
+		idleTimer = nil
+	}
+}
+
+// must be called with the idle timer mutex held
+func newIdleTimer(timeout time.Duration, gen uint64) *time.Timer {
+	return time.AfterFunc(timeout, func() {
+		idleTimerMx.Lock()
+		expired := gen == idleTimerGen
+		idleTimerMx.Unlock()
+
+		if expired {
+			logger.DebugMessage("Locking device after %s of inactivity", timeout.String())
+			lockContext(SN_REASON_IDLE_TIMEOUT)
+		}
+	})
+}
+
+// drops the decrypted configuration from memory
+// so the passphrase is required to unlock it again
+func lockContext(reason string) {
+	auditLog(AUDIT_LOCK, reason, nil)
+	resetContext()
+	postStatusChange(SN_CFG_STATUS_LOCKED, reason, nil)
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// protects the config of the test context with the test
+// passphrase and initializes the context again without it
+// which leaves the device locked as it is on a restart
+func (tc *testContext) lock(t *testing.T) {
+	tc.setPassphrase(t)
+	if code := snInitializeContext(nil); code != SN_ERROR_NONE {
+		t.Fatalf("snInitializeContext() returned error code %d", code)
+	}
+}
+
+func TestInitializeLockedContext(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.login(t, testUsername)
+	tc.lock(t)
+
+	if cfg := currentConfig(); cfg != nil {
+		t.Fatalf("the config of a locked device is available")
+	}
+	if err := changeDeviceLockPassphrase(testPassphrase, "new passphrase"); errorCode(err) != SN_ERROR_LOCK {
+		t.Errorf("changeDeviceLockPassphrase() of a locked device returned %v, expected a lock error", err)
+	}
+	if _, err := getEULAStatus(); errorCode(err) != SN_ERROR_LOCK {
+		t.Errorf("getEULAStatus() of a locked device returned %v, expected a lock error", err)
+	}
+}
+
+func TestProfileUnlockedTimeout(t *testing.T) {
+
+	newTestContext(t)
+
+	if timeout := profileUnlockedTimeout(); timeout != DEFAULT_UNLOCKED_TIMEOUT {
+		t.Errorf("profileUnlockedTimeout() = %s, expected the default", timeout.String())
+	}
+	if err := setProfileUnlockedTimeout(15); err != nil {
+		t.Fatalf("setProfileUnlockedTimeout() failed: %s", err.Error())
+	}
+	if timeout := profileUnlockedTimeout(); timeout != 15*time.Minute {
+		t.Errorf("profileUnlockedTimeout() = %s, expected 15m", timeout.String())
+	}
+
+	// the timeout is saved per profile
+	if err := createProfile("work"); err != nil {
+		t.Fatalf("createProfile() failed: %s", err.Error())
+	}
+	if err := setActiveProfile("work"); err != nil {
+		t.Fatalf("setActiveProfile() failed: %s", err.Error())
+	}
+	if timeout := profileUnlockedTimeout(); timeout != DEFAULT_UNLOCKED_TIMEOUT {
+		t.Errorf("profileUnlockedTimeout() = %s for a new profile, expected the default", timeout.String())
+	}
+}
+
+// meant to be run with the race detector enabled
+func TestConfigResetWhileInUse(t *testing.T) {
+
+	const iterations = 200
+
+	tc := newTestContext(t)
+	tc.login(t, testUsername)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// exports using the config while the
+	// device is repeatedly locked and unlocked
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, _ = getUserProfile()
+				_, _ = getEULAStatus()
+				auditLog(AUDIT_UNLOCK, "", nil)
+				_ = newStatusEvent(SN_CFG_STATUS_LOGGED_IN, SN_REASON_LOGIN, nil)
+			}
+		}()
+	}
+	for i := 0; i < iterations; i++ {
+		setConfig(nil)
+		setConfig(tc.config)
+	}
+	close(done)
+	wg.Wait()
+}
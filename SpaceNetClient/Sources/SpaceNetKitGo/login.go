@@ -0,0 +1,245 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char BOOL;
+// typedef unsigned char SN_ERROR_CODE;
+//
+// static void onLoginDone(void *func, void *ctx, const BOOL ok, const BOOL cancelled)
+// {
+//	 ((void(*)(void *, const BOOL, const BOOL))func)(ctx, ok, cancelled);
+// }
+import "C"
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// the login flow in progress if any and the
+	// generation of the most recently started flow
+	activeLogin   *loginOperation
+	loginGen      uint64
+	activeLoginMx sync.Mutex
+
+	loginTimeout = DEFAULT_LOGIN_TIMEOUT
+)
+
+const (
+	DEFAULT_LOGIN_TIMEOUT = 5 * time.Minute
+
+	SN_REASON_LOGIN_CANCELLED = "loginCancelled"
+	SN_REASON_LOGIN_TIMED_OUT = "loginTimedOut"
+)
+
+// A login flow that can be cancelled by the host or
+// that times out if the user does not complete it.
+// The flow completes exactly once either with the
+// result of the login or when its context is done.
+type loginOperation struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	appUI *appUI
+	gen   uint64
+
+	once     sync.Once
+	complete func(err error, cancelled bool)
+}
+
+//export snCancelLogin
+func snCancelLogin() C.SN_ERROR_CODE {
+	activeLoginMx.Lock()
+	op := activeLogin
+	activeLoginMx.Unlock()
+
+	if op == nil {
+		return setLastErrorCode("snCancelLogin", newError(SN_ERROR_VALIDATION, "no login is in progress"))
+	}
+	logger.DebugMessage("Cancelling login")
+	op.cancel()
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snSetLoginTimeout
+func snSetLoginTimeout(timeoutSecs C.int) {
+	activeLoginMx.Lock()
+	defer activeLoginMx.Unlock()
+
+	if timeoutSecs > 0 {
+		loginTimeout = time.Duration(timeoutSecs) * time.Second
+	} else {
+		loginTimeout = DEFAULT_LOGIN_TIMEOUT
+	}
+}
+
+// starts tracking a new login flow. any login flow already
+// in progress is cancelled. the complete function is called
+// once with the result of the flow.
+func newLoginOperation(appUI *appUI, complete func(err error, cancelled bool)) *loginOperation {
+
+	activeLoginMx.Lock()
+	defer activeLoginMx.Unlock()
+
+	if activeLogin != nil {
+		logger.DebugMessage("Cancelling login in progress as a new login has been started")
+		activeLogin.cancel()
+	}
+
+	loginGen++
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout)
+	op := &loginOperation{
+		ctx:      ctx,
+		cancel:   cancel,
+		appUI:    appUI,
+		gen:      loginGen,
+		complete: complete,
+	}
+	activeLogin = op
+
+	go func() {
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			op.finish(ctx.Err(), true)
+		} else {
+			op.finish(context.Canceled, true)
+		}
+	}()
+	return op
+}
+
+// completes the login flow returning false if
+// it had already been completed or cancelled
+func (op *loginOperation) finish(err error, cancelled bool) bool {
+
+	finished := false
+	op.once.Do(func() {
+		finished = true
+
+		activeLoginMx.Lock()
+		if activeLogin == op {
+			activeLogin = nil
+		}
+		activeLoginMx.Unlock()
+
+		if cancelled && op.appUI != nil {
+			// dialogs shown by the flow would otherwise
+			// remain open waiting for the user
+			op.appUI.dismissAll()
+		}
+		op.complete(err, cancelled)
+		op.cancel()
+	})
+	return finished
+}
+
+// resets the auth context of the given config after the flow
+// retrieved a token once it had been cancelled. the token is
+// kept if a newer flow has been started as the auth context
+// may then hold the token that flow retrieved.
+func (op *loginOperation) discardResult(cfg config.Config) {
+	activeLoginMx.Lock()
+	defer activeLoginMx.Unlock()
+
+	if op.gen != loginGen {
+		logger.DebugMessage("Not discarding result of cancelled login as a newer login has been started")
+		return
+	}
+	logger.DebugMessage("Discarding result of cancelled login")
+	_ = cfg.AuthContext().Reset()
+}
+
+// returns the function that completes a login flow started
+// by the given operation with the given config. it saves the
+// result of the login, posts the resulting status change and
+// calls the handler.
+func loginCompletion(operation string, cfg config.Config, dlgContext uintptr, handler uintptr) func(err error, cancelled bool) {
+
+	context := unsafe.Pointer(dlgContext)
+	handlerFunc := unsafe.Pointer(handler)
+
+	return func(err error, cancelled bool) {
+
+		// the result is discarded if the device was locked
+		// or the context was reset while the login was in
+		// progress as the config it was made with is unloaded
+		unloaded := cfg == nil || cfg != currentConfig()
+		if unloaded && err == nil {
+			err = newError(SN_ERROR_LOCK, "the configuration was unloaded before the login completed")
+		}
+
+		defer func() {
+			if unloaded {
+				return
+			}
+			if err = saveConfig(cfg); err != nil {
+				_ = setLastError(operation, storageError(err))
+
+				_ = cfg.AuthContext().Reset()
+				postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_SAVE_FAILED, storageError(err))
+			}
+		}()
+
+		if unloaded {
+			// the status is that of the
+			// newly loaded context if any
+			_ = setLastError(operation, err)
+
+		} else if cancelled {
+			reason := loginCancelledReason(err)
+			auditLog(AUDIT_LOGIN, operation, wrapError(SN_ERROR_CANCELLED, err))
+			_ = setLastError(operation, wrapError(SN_ERROR_CANCELLED, err))
+			postStatusChange(SN_CFG_STATUS_LOGGED_OUT, reason, nil)
+
+		} else if err != nil {
+			auditLog(AUDIT_LOGIN, operation, authError(err))
+			_ = setLastError(operation, authError(err))
+			postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGIN_FAILED, authError(err))
+
+		} else if cfg.AuthContext().IsLoggedIn() {
+			auditLog(AUDIT_LOGIN, operation, nil)
+			resetSpaceNodes()
+			postStatusChange(SN_CFG_STATUS_LOGGED_IN, SN_REASON_LOGIN, nil)
+
+		} else {
+			auditLog(AUDIT_LOGIN, operation, newError(SN_ERROR_AUTH, "login did not authenticate a user"))
+			postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_LOGIN_FAILED, nil)
+		}
+
+		if uintptr(handlerFunc) != 0 {
+			ok := C.uchar(1)
+			if err != nil || cancelled {
+				ok = C.uchar(0)
+			}
+			isCancelled := C.uchar(0)
+			if cancelled {
+				isCancelled = C.uchar(1)
+			}
+			C.onLoginDone(
+				handlerFunc,
+				context,
+				ok,
+				isCancelled,
+			)
+		}
+	}
+}
+
+// returns the status change reason of a login
+// flow that was cancelled or that timed out
+func loginCancelledReason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return SN_REASON_LOGIN_TIMED_OUT
+	}
+	return SN_REASON_LOGIN_CANCELLED
+}
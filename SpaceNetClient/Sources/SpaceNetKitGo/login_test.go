@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscardCancelledLoginResult(t *testing.T) {
+
+	tc := newTestContext(t)
+
+	complete := func(err error, cancelled bool) {}
+	first := newLoginOperation(nil, complete)
+	second := newLoginOperation(nil, complete)
+	t.Cleanup(func() { second.cancel() })
+
+	// the first login is cancelled when the second starts
+	select {
+	case <-first.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the first login was not cancelled by the second")
+	}
+
+	// the result of the second login is kept when the
+	// first login completes after it was cancelled
+	tc.login(t, testUsername)
+	first.discardResult(tc.config)
+	if !tc.config.AuthContext().IsLoggedIn() {
+		t.Errorf("discarding the result of a superseded login reset the auth context")
+	}
+
+	second.cancel()
+	second.discardResult(tc.config)
+	if tc.config.AuthContext().IsLoggedIn() {
+		t.Errorf("the result of the latest cancelled login was not discarded")
+	}
+}
+
+func TestUIContextCancelsMessages(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	appUI := NewAppUI(0).(*appUI).withContext(ctx)
+
+	var cancelled sync.WaitGroup
+	cancelled.Add(2)
+	_ = appUI.NewUIMessageWithCancel("first", func() { cancelled.Done() })
+	cancel()
+	// messages created after the context is done are cancelled
+	_ = appUI.NewUIMessageWithCancel("second", func() { cancelled.Done() })
+
+	done := make(chan struct{})
+	go func() {
+		cancelled.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("message cancel functions were not called when the ui context was done")
+	}
+}
+
+// meant to be run with the race detector enabled
+func TestDismissMessageConcurrently(t *testing.T) {
+
+	appUI := NewAppUI(0).(*appUI)
+	msg := appUI.NewUIMessage("test").(*appMessage)
+	msg.dlgHandle.Store(&dialogHandle{})
+	appUI.trackMessage(msg)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg.DismissMessage()
+		}()
+	}
+	appUI.dismissAll()
+	wg.Wait()
+
+	if msg.dlgHandle.Load() != nil {
+		t.Errorf("the dialog handle was not cleared when the message was dismissed")
+	}
+}
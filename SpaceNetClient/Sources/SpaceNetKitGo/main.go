@@ -10,12 +10,50 @@ package main
 // typedef unsigned char BOOL;
 // const BOOL FALSE = 0;
 // const BOOL TRUE = 1;
+//
+// // the constants of the C API are defined here as cgo copies
+// // the preamble of files with exports into the export stubs
+// typedef unsigned char SN_CFG_STATUS;
+// const SN_CFG_STATUS SN_CFG_STATUS_ERROR = 0;
+// const SN_CFG_STATUS SN_CFG_STATUS_NEEDS_INIT = 1;
+// const SN_CFG_STATUS SN_CFG_STATUS_NEEDS_LOGIN = 2;
+// const SN_CFG_STATUS SN_CFG_STATUS_LOGGED_IN = 3;
+// const SN_CFG_STATUS SN_CFG_STATUS_LOGGED_OUT = 4;
+// const SN_CFG_STATUS SN_CFG_STATUS_LOCKED = 5;
+//
+// typedef unsigned char SN_ERROR_CODE;
+// const SN_ERROR_CODE SN_ERROR_NONE = 0;
+// const SN_ERROR_CODE SN_ERROR_UNKNOWN = 1;
+// const SN_ERROR_CODE SN_ERROR_LOCK = 2;
+// const SN_ERROR_CODE SN_ERROR_AUTH = 3;
+// const SN_ERROR_CODE SN_ERROR_NETWORK = 4;
+// const SN_ERROR_CODE SN_ERROR_STORAGE = 5;
+// const SN_ERROR_CODE SN_ERROR_VALIDATION = 6;
+// const SN_ERROR_CODE SN_ERROR_CANCELLED = 7;
+//
+// typedef unsigned char SN_DIALOG_TYPE;
+// const SN_DIALOG_TYPE SN_DIALOG_APP = 0;
+// const SN_DIALOG_TYPE SN_DIALOG_NOTIFY = 1;
+// const SN_DIALOG_TYPE SN_DIALOG_ALERT = 2;
+// const SN_DIALOG_TYPE SN_DIALOG_ERROR = 3;
+// const SN_DIALOG_TYPE SN_DIALOG_WAIT_MSG = 10;
+// const SN_DIALOG_TYPE SN_DIALOG_WAIT_LOGIN = 11;
+//
+// typedef unsigned char SN_DIALOG_ACCESSORY_TYPE;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_NONE = 0;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_YES_NO = 1;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_OK_CANCEL = 2;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_TEXT_INPUT = 3;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_PASSWORD_INPUT = 4;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_PASSWORD_INPUT_WITH_VERIFY = 5;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_FILE_OPEN = 6;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_SPINNER = 7;
+// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_PROGRESS_BAR = 8;
 import "C"
 
 import (
 	"os"
 
-	"github.com/appbricks/cloud-builder/config"
 	"github.com/mevansam/goutils/logger"
 	homedir "github.com/mitchellh/go-homedir"
 )
@@ -52,18 +90,24 @@ func init() {
 	}
 	logger.Initialize()
 
+	// a prod build must never fall back
+	// to the dev service environment
+	if err = verifyBuildEnvironment(); err != nil {
+		showErrorAndExit(err.Error())
+	}
+
 	// find users home directory.
 	homeDir, err = homedir.Dir()
 	if err != nil {
 		showErrorAndExit(err.Error())
 	}
 
-	// set default device lock password
-	if systemPassphrase := os.Getenv("CBS_SYSTEM_PASSPHRASE"); len(systemPassphrase) > 0 {
-		config.SystemPassphrase = func() string {
-			return systemPassphrase
-		}
-	}
+	// report cgo shared state that is never released
+	startRegistryLeakDetector(REGISTRY_LEAK_CHECK_INTERVAL)
+
+	// the system passphrase is retrieved from the secret
+	// store selected by the host before initialization
+	initSystemPassphrase()
 }
 
 func main() {
@@ -0,0 +1,311 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+
+	"github.com/appbricks/mycloudspace-client/api"
+	"github.com/appbricks/mycloudspace-client/mycscloud"
+	"github.com/appbricks/mycloudspace-common/monitors"
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// Monitor Service
+	monitorService *monitors.MonitorService
+
+	// tunnel traffic monitors keyed by space id
+	tunnelMonitors = make(map[string]*tunnelMonitor)
+
+	// sinks to which monitor events are published
+	monitorSinks   = []monitorSink{}
+	monitorSinksMx sync.Mutex
+
+	monitorMx sync.Mutex
+)
+
+const (
+	MONITOR_EVENT_SOURCE = "io.appbricks.spacenet-client"
+
+	MONITOR_EVENT_TYPE_CONNECT    = "io.appbricks.spacenet.connect"
+	MONITOR_EVENT_TYPE_DISCONNECT = "io.appbricks.spacenet.disconnect"
+
+	MONITOR_BUFFER_SIZE      = 100
+	MONITOR_PUBLISH_INTERVAL = 30 * time.Second
+)
+
+// a monitor sink receives batches of events published
+// by the monitor service or by connection state changes
+type monitorSink interface {
+	PostMeasurementEvents(events []*cloudevents.Event) error
+}
+
+// publishes monitor events to the MyCS service
+type serviceSink struct {
+	deviceAPI *mycscloud.DeviceAPI
+}
+
+// fans out events sent by the monitor
+// service to all registered sinks
+type sinkSender struct{}
+
+type tunnelMonitor struct {
+	rxBytes,
+	txBytes *monitors.Counter
+}
+
+//export snStartMonitors
+func snStartMonitors() C.SN_ERROR_CODE {
+	if err := startMonitors(); err != nil {
+		return setLastErrorCode("snStartMonitors", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snStopMonitors
+func snStopMonitors() {
+	stopMonitors()
+}
+
+//export snMonitorTunnelStats
+func snMonitorTunnelStats(spaceID *C.char, uapiConfig *C.char) C.SN_ERROR_CODE {
+	if err := updateTunnelStats(C.GoString(spaceID), C.GoString(uapiConfig)); err != nil {
+		return setLastErrorCode("snMonitorTunnelStats", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// starts or stops the monitor service
+// based on the given config status
+func updateMonitorsForStatus(status int) {
+	switch status {
+	case SN_CFG_STATUS_LOGGED_IN:
+		if err := startMonitors(); err != nil {
+			logger.ErrorMessage("Failed to start monitor service: %s", err.Error())
+		}
+	case SN_CFG_STATUS_LOGGED_OUT, SN_CFG_STATUS_NEEDS_LOGIN, SN_CFG_STATUS_LOCKED:
+		stopMonitors()
+	}
+}
+
+func startMonitors() error {
+
+	monitorMx.Lock()
+	defer monitorMx.Unlock()
+
+	if monitorService != nil {
+		return nil
+	}
+	cfg := currentConfig()
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return newError(SN_ERROR_AUTH, "monitors cannot be started as no user is logged in")
+	}
+
+	addMonitorSink(
+		&serviceSink{
+			deviceAPI: mycscloud.NewDeviceAPI(
+				api.NewGraphQLClient(getServiceConfig().ApiURL, "", cfg),
+			),
+		},
+	)
+	if err := newMonitorService(); err != nil {
+		removeServiceSinks()
+		return err
+	}
+	logger.DebugMessage("Monitor service started")
+	return nil
+}
+
+// creates and starts the monitor service with monitors for
+// the active tunnels. must be called with monitorMx held.
+func newMonitorService() error {
+
+	monitorService = monitors.NewMonitorService(
+		&sinkSender{},
+		MONITOR_BUFFER_SIZE,
+		MONITOR_PUBLISH_INTERVAL,
+	)
+	for spaceID, tm := range tunnelMonitors {
+		monitorService.AddMonitor(tm.newMonitor(spaceID))
+	}
+	if err := monitorService.Start(); err != nil {
+		monitorService = nil
+		return err
+	}
+	return nil
+}
+
+func stopMonitors() {
+
+	monitorMx.Lock()
+	defer monitorMx.Unlock()
+
+	if monitorService != nil {
+		monitorService.Stop()
+		monitorService = nil
+		removeServiceSinks()
+		logger.DebugMessage("Monitor service stopped")
+	}
+}
+
+// adds a sink to which monitor events will be published
+func addMonitorSink(sink monitorSink) {
+	monitorSinksMx.Lock()
+	defer monitorSinksMx.Unlock()
+
+	monitorSinks = append(monitorSinks, sink)
+}
+
+// removes the sinks publishing to the MyCS service
+// as they are bound to the logged in user
+func removeServiceSinks() {
+	monitorSinksMx.Lock()
+	defer monitorSinksMx.Unlock()
+
+	filtered := []monitorSink{}
+	for _, s := range monitorSinks {
+		if _, isServiceSink := s.(*serviceSink); !isServiceSink {
+			filtered = append(filtered, s)
+		}
+	}
+	monitorSinks = filtered
+}
+
+// records a connection state change event for the given space
+func monitorConnectionEvent(eventType, spaceID, spaceName string) {
+
+	monitorMx.Lock()
+	if eventType == MONITOR_EVENT_TYPE_CONNECT {
+		tm := &tunnelMonitor{}
+		tunnelMonitors[spaceID] = tm
+		if monitorService != nil {
+			monitorService.AddMonitor(tm.newMonitor(spaceID))
+		}
+	} else if _, exists := tunnelMonitors[spaceID]; exists {
+		delete(tunnelMonitors, spaceID)
+		if monitorService != nil {
+			// monitors cannot be removed from a running
+			// service so it is restarted without the
+			// monitor of the disconnected tunnel
+			monitorService.Stop()
+			if err := newMonitorService(); err != nil {
+				logger.ErrorMessage("Failed to restart monitor service: %s", err.Error())
+				removeServiceSinks()
+			}
+		}
+	}
+	isRunning := monitorService != nil
+	monitorMx.Unlock()
+
+	if !isRunning {
+		return
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource(MONITOR_EVENT_SOURCE)
+	event.SetType(eventType)
+	event.SetTime(time.Now())
+	if err := event.SetData(cloudevents.ApplicationJSON,
+		map[string]string{
+			"spaceID":   spaceID,
+			"spaceName": spaceName,
+		},
+	); err != nil {
+		logger.ErrorMessage("Failed to create connection event: %s", err.Error())
+		return
+	}
+	if err := (&sinkSender{}).PostMeasurementEvents([]*cloudevents.Event{&event}); err != nil {
+		logger.ErrorMessage("Failed to publish connection event: %s", err.Error())
+	}
+}
+
+// updates the traffic counters of the tunnel to the given
+// space from the UAPI config returned by wgGetConfig
+func updateTunnelStats(spaceID, uapiConfig string) error {
+
+	var (
+		err error
+
+		rxBytes, txBytes int64
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(uapiConfig))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "rx_bytes", "tx_bytes":
+			var v int64
+			if v, err = strconv.ParseInt(kv[1], 10, 64); err != nil {
+				return err
+			}
+			if kv[0] == "rx_bytes" {
+				rxBytes += v
+			} else {
+				txBytes += v
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	monitorMx.Lock()
+	defer monitorMx.Unlock()
+
+	tm, exists := tunnelMonitors[spaceID]
+	if !exists || tm.rxBytes == nil {
+		return newError(SN_ERROR_VALIDATION, "space with id '%s' is not being monitored", spaceID)
+	}
+	tm.rxBytes.Set(rxBytes)
+	tm.txBytes.Set(txBytes)
+	return nil
+}
+
+func (tm *tunnelMonitor) newMonitor(spaceID string) *monitors.Monitor {
+	tm.rxBytes = monitors.NewCounter("rxBytes", false)
+	tm.txBytes = monitors.NewCounter("txBytes", false)
+
+	monitor := monitors.NewMonitor(spaceID)
+	monitor.AddCounter(tm.rxBytes)
+	monitor.AddCounter(tm.txBytes)
+	return monitor
+}
+
+func (s *sinkSender) PostMeasurementEvents(events []*cloudevents.Event) error {
+
+	monitorSinksMx.Lock()
+	sinks := make([]monitorSink, len(monitorSinks))
+	copy(sinks, monitorSinks)
+	monitorSinksMx.Unlock()
+
+	var lastErr error
+	for _, sink := range sinks {
+		if err := sink.PostMeasurementEvents(events); err != nil {
+			logger.ErrorMessage("Failed to publish monitor events to sink: %s", err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (s *serviceSink) PostMeasurementEvents(events []*cloudevents.Event) error {
+	return s.deviceAPI.PostMeasurementEvents(events)
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/appbricks/mycloudspace-common/monitors"
+)
+
+// retains published monitor events in memory
+type memorySink struct {
+	mx     sync.Mutex
+	events []*cloudevents.Event
+}
+
+func (s *memorySink) PostMeasurementEvents(events []*cloudevents.Event) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.events = append(s.events, events...)
+	return nil
+}
+
+// returns and clears the events retained by the sink
+func (s *memorySink) Events() []*cloudevents.Event {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	events := s.events
+	s.events = nil
+	return events
+}
+
+// starts a monitor service publishing to a memory sink
+func newTestMonitors(t *testing.T) *memorySink {
+
+	sink := &memorySink{}
+	addMonitorSink(sink)
+
+	monitorMx.Lock()
+	monitorService = monitors.NewMonitorService(&sinkSender{}, MONITOR_BUFFER_SIZE, time.Hour)
+	monitorMx.Unlock()
+
+	t.Cleanup(func() {
+		stopMonitors()
+
+		monitorSinksMx.Lock()
+		monitorSinks = []monitorSink{}
+		monitorSinksMx.Unlock()
+
+		monitorMx.Lock()
+		tunnelMonitors = make(map[string]*tunnelMonitor)
+		monitorMx.Unlock()
+	})
+	return sink
+}
+
+func TestMonitorConnectionEvents(t *testing.T) {
+
+	sink := newTestMonitors(t)
+
+	monitorConnectionEvent(MONITOR_EVENT_TYPE_CONNECT, "space-1", "home")
+	if err := updateTunnelStats("space-1", "rx_bytes=100\ntx_bytes=50\nrx_bytes=1\n"); err != nil {
+		t.Fatalf("updateTunnelStats() failed for a connected space: %s", err.Error())
+	}
+	monitorConnectionEvent(MONITOR_EVENT_TYPE_DISCONNECT, "space-1", "home")
+
+	events := sink.Events()
+	if len(events) != 2 {
+		t.Fatalf("%d events were published, expected 2", len(events))
+	}
+	for i, eventType := range []string{MONITOR_EVENT_TYPE_CONNECT, MONITOR_EVENT_TYPE_DISCONNECT} {
+		data := map[string]string{}
+		if err := events[i].DataAs(&data); err != nil {
+			t.Fatalf("invalid event data: %s", err.Error())
+		}
+		if events[i].Type() != eventType || data["spaceID"] != "space-1" || data["spaceName"] != "home" {
+			t.Errorf("event %d is '%s' %v, expected '%s' for space 'home'", i, events[i].Type(), data, eventType)
+		}
+	}
+
+	// the monitor of a disconnected tunnel is removed
+	monitorMx.Lock()
+	_, exists := tunnelMonitors["space-1"]
+	isRunning := monitorService != nil
+	monitorMx.Unlock()
+	if exists {
+		t.Errorf("the tunnel monitor was not removed on disconnect")
+	}
+	if !isRunning {
+		t.Errorf("the monitor service was not restarted on disconnect")
+	}
+
+	err := updateTunnelStats("space-1", "rx_bytes=1\n")
+	snErr := &snError{}
+	if !errors.As(err, &snErr) || snErr.Code != SN_ERROR_VALIDATION {
+		t.Errorf("updateTunnelStats() error = %v, expected a validation error", err)
+	}
+}
+
+func TestUpdateTunnelStatsInvalidCounter(t *testing.T) {
+
+	newTestMonitors(t)
+
+	monitorConnectionEvent(MONITOR_EVENT_TYPE_CONNECT, "space-1", "home")
+	if err := updateTunnelStats("space-1", "rx_bytes=lots\n"); err == nil {
+		t.Errorf("updateTunnelStats() did not fail for an invalid counter")
+	}
+}
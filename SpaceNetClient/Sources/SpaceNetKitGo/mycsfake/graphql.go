@@ -0,0 +1,644 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package mycsfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// matches the first top-level field of an
+	// operation along with its alias if any
+	topLevelField = regexp.MustCompile(`^\s*(?:([_A-Za-z][_0-9A-Za-z]*)\s*:\s*)?([_A-Za-z][_0-9A-Za-z]*)`)
+
+	// tokens of a GraphQL selection set
+	selectionToken = regexp.MustCompile(`\.\.\.|"(?:[^"\\]|\\.)*"|\$?[_A-Za-z][_0-9A-Za-z]*|[{}():]|[^\s,]`)
+)
+
+// the fields selected by a GraphQL selection set in the
+// order they appear in the query. leaf fields have a nil
+// selection set.
+type selectionSet []selectedField
+
+type selectedField struct {
+	name      string
+	selection selectionSet
+}
+
+// Handles a GraphQL operation returning the value of its
+// top-level field. handlers are called without the server
+// lock held and receive the authenticated user.
+type OperationHandler func(user *User, variables map[string]interface{}) (interface{}, error)
+
+// A device registered with the fake service
+type Device struct {
+	DeviceID   string
+	Name       string
+	Type       string
+	Version    string
+	PublicKey  string
+	OwnerID    string
+	Registered time.Time
+
+	// the access status of the device's
+	// users by user id i.e. "active"
+	Users map[string]string
+}
+
+// A space deployed by a user of the fake service
+type Space struct {
+	SpaceID string
+	Name    string
+	OwnerID string
+	Recipe  string
+	IaaS    string
+	Region  string
+	Version string
+	Status  string
+	FQDN    string
+	Port    int
+
+	// the access of the space's users by user id
+	// i.e. "active". the owner is always active.
+	Users  map[string]string
+	Admins map[string]bool
+}
+
+const (
+	USER_STATUS_ACTIVE  = "active"
+	USER_STATUS_PENDING = "pending"
+)
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphQLError struct {
+	Message   string `json:"message"`
+	ErrorType string `json:"errorType,omitempty"`
+}
+
+// adds or replaces the handler of the operation with
+// the given top-level field name i.e. "addDevice"
+func (s *Server) HandleOperation(field string, handler OperationHandler) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.operations[field] = handler
+}
+
+// returns a copy of a registered device
+func (s *Server) GetDevice(deviceID string) (Device, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	device, exists := s.devices[deviceID]
+	if !exists {
+		return Device{}, false
+	}
+	return *device, true
+}
+
+// adds or replaces a registered device. the device's owner
+// is added as an active user of the device if it is not
+// already a user.
+func (s *Server) AddDevice(device *Device) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(device.DeviceID) == 0 {
+		device.DeviceID = uuid.New().String()
+	}
+	if device.Users == nil {
+		device.Users = make(map[string]string)
+	}
+	if _, exists := device.Users[device.OwnerID]; !exists {
+		device.Users[device.OwnerID] = USER_STATUS_ACTIVE
+	}
+	s.devices[device.DeviceID] = device
+}
+
+// adds or replaces a space. the space's owner is added as
+// an admin user of the space if it is not already a user.
+func (s *Server) AddSpace(space *Space) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(space.SpaceID) == 0 {
+		space.SpaceID = uuid.New().String()
+	}
+	if space.Users == nil {
+		space.Users = make(map[string]string)
+	}
+	if space.Admins == nil {
+		space.Admins = make(map[string]bool)
+	}
+	if _, exists := space.Users[space.OwnerID]; !exists {
+		space.Users[space.OwnerID] = USER_STATUS_ACTIVE
+		space.Admins[space.OwnerID] = true
+	}
+	s.spaces[space.SpaceID] = space
+}
+
+// AppSync style GraphQL endpoint. operations are dispatched
+// on the name of their first top-level field as the
+// client does not always send an operation name.
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		req graphQLRequest
+	)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]interface{}{
+			"errors": []graphQLError{{Message: err.Error(), ErrorType: "UnauthorizedException"}},
+		})
+		return
+	}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alias, field, err := parseOperation(req.Query)
+	if err != nil {
+		writeJSON(w, map[string]interface{}{
+			"errors": []graphQLError{{Message: err.Error(), ErrorType: "MalformedQuery"}},
+		})
+		return
+	}
+
+	s.mx.Lock()
+	handler, exists := s.operations[field]
+	s.mx.Unlock()
+	if !exists {
+		writeJSON(w, map[string]interface{}{
+			"errors": []graphQLError{{Message: fmt.Sprintf("operation '%s' is not supported", field), ErrorType: "ValidationError"}},
+		})
+		return
+	}
+
+	result, err := handler(user, req.Variables)
+	if err != nil {
+		writeJSON(w, map[string]interface{}{
+			"data":   map[string]interface{}{alias: nil},
+			"errors": []graphQLError{{Message: err.Error()}},
+		})
+		return
+	}
+	// only the selected fields are returned as
+	// a client may reject fields it did not select
+	if selection, ok := parseSelection(req.Query); ok {
+		result = selection.prune(result)
+	}
+	writeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{alias: result},
+	})
+}
+
+// returns the alias and name of the first
+// top-level field of a GraphQL operation
+func parseOperation(query string) (string, string, error) {
+
+	query = stripComments(query)
+
+	i := strings.Index(query, "{")
+	if i < 0 {
+		return "", "", fmt.Errorf("query has no selection set")
+	}
+	match := topLevelField.FindStringSubmatch(query[i+1:])
+	if match == nil {
+		return "", "", fmt.Errorf("query has no top-level field")
+	}
+	if len(match[1]) > 0 {
+		return match[1], match[2], nil
+	}
+	return match[2], match[2], nil
+}
+
+// returns the selection set of the first top-level field of
+// a GraphQL operation. false is returned if the selection
+// cannot be determined i.e. if it contains fragments.
+func parseSelection(query string) (selectionSet, bool) {
+
+	tokens := selectionToken.FindAllString(stripComments(query), -1)
+
+	// skip the operation's name and
+	// variables up to its selection set
+	i := 0
+	for i < len(tokens) && tokens[i] != "{" {
+		if tokens[i] == "(" {
+			i = skipArguments(tokens, i)
+		} else {
+			i++
+		}
+	}
+	operation, _, ok := parseSelectionSet(tokens, i)
+	if !ok || len(operation) == 0 {
+		return nil, false
+	}
+	// the fake dispatches on the first top-level
+	// field so only its selection is returned
+	return operation[0].selection, true
+}
+
+// parses the selection set starting at the "{" token at
+// index i returning it and the index following it
+func parseSelectionSet(tokens []string, i int) (selectionSet, int, bool) {
+
+	if i >= len(tokens) || tokens[i] != "{" {
+		return nil, i, false
+	}
+	selection := selectionSet{}
+	i++
+	for i < len(tokens) && tokens[i] != "}" {
+		if tokens[i] == "..." {
+			return nil, i, false
+		}
+		name := tokens[i]
+		i++
+		// results are keyed by field name so aliases are ignored
+		if i+1 < len(tokens) && tokens[i] == ":" {
+			name = tokens[i+1]
+			i += 2
+		}
+		if i < len(tokens) && tokens[i] == "(" {
+			i = skipArguments(tokens, i)
+		}
+		var (
+			child selectionSet
+			ok    bool
+		)
+		if i < len(tokens) && tokens[i] == "{" {
+			if child, i, ok = parseSelectionSet(tokens, i); !ok {
+				return nil, i, false
+			}
+		}
+		selection = append(selection, selectedField{name: name, selection: child})
+	}
+	if i >= len(tokens) {
+		return nil, i, false
+	}
+	return selection, i + 1, true
+}
+
+// returns the index of the token following the
+// arguments starting at the "(" token at index i
+func skipArguments(tokens []string, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// returns the value with only the selected fields
+func (selection selectionSet) prune(value interface{}) interface{} {
+
+	if selection == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		pruned := make(map[string]interface{}, len(selection))
+		for _, field := range selection {
+			if fieldValue, exists := v[field.name]; exists {
+				pruned[field.name] = field.selection.prune(fieldValue)
+			}
+		}
+		return pruned
+	case []interface{}:
+		pruned := make([]interface{}, len(v))
+		for i, item := range v {
+			pruned[i] = selection.prune(item)
+		}
+		return pruned
+	}
+	return value
+}
+
+func stripComments(query string) string {
+	lines := strings.Split(query, "\n")
+	for i, line := range lines {
+		if j := strings.Index(line, "#"); j >= 0 {
+			lines[i] = line[:j]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the operations used by the login and
+// device configuration flows of the client
+func (s *Server) addDefaultOperations() {
+
+	s.operations["getUser"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		return s.userResult(user), nil
+	}
+
+	s.operations["updateUserKey"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		userKey, _ := variables["userKey"].(map[string]interface{})
+		if publicKey, ok := userKey["publicKey"].(string); ok {
+			user.PublicKey = publicKey
+		} else if publicKey, ok := variables["publicKey"].(string); ok {
+			user.PublicKey = publicKey
+		} else {
+			return nil, fmt.Errorf("a public key is required")
+		}
+		return s.userResult(user), nil
+	}
+
+	s.operations["addDevice"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device := &Device{
+			DeviceID:   uuid.New().String(),
+			Name:       stringVar(variables, "deviceName"),
+			Type:       stringVar(variables, "deviceType"),
+			Version:    stringVar(variables, "clientVersion"),
+			OwnerID:    user.UserID,
+			Users:      map[string]string{user.UserID: USER_STATUS_ACTIVE},
+			Registered: time.Now(),
+		}
+		if len(device.Name) == 0 {
+			return nil, fmt.Errorf("a device name is required")
+		}
+		for _, d := range s.devices {
+			if d.OwnerID == user.UserID && d.Name == device.Name {
+				return nil, fmt.Errorf("device '%s' already exists", device.Name)
+			}
+		}
+		if deviceKey, ok := variables["deviceKey"].(map[string]interface{}); ok {
+			device.PublicKey, _ = deviceKey["publicKey"].(string)
+		}
+		s.devices[device.DeviceID] = device
+
+		return map[string]interface{}{
+			"idKey": uuid.New().String(),
+			"deviceUser": map[string]interface{}{
+				"bytesUploaded":   "0",
+				"bytesDownloaded": "0",
+				"device":          s.deviceResult(device),
+				"user":            s.userResult(user),
+			},
+		}, nil
+	}
+
+	s.operations["getDevice"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device, err := s.userDevice(user, stringVar(variables, "deviceID"), false)
+		if err != nil {
+			return nil, err
+		}
+		return s.deviceResult(device), nil
+	}
+
+	s.operations["updateDevice"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device, err := s.userDevice(user, stringVar(variables, "deviceID"), true)
+		if err != nil {
+			return nil, err
+		}
+		if version := stringVar(variables, "clientVersion"); len(version) > 0 {
+			device.Version = version
+		}
+		if deviceKey, ok := variables["deviceKey"].(map[string]interface{}); ok {
+			device.PublicKey, _ = deviceKey["publicKey"].(string)
+		}
+		return s.deviceResult(device), nil
+	}
+
+	s.operations["deleteDevice"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device, err := s.userDevice(user, stringVar(variables, "deviceID"), true)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.devices, device.DeviceID)
+
+		userIDs := []string{}
+		for userID := range device.Users {
+			userIDs = append(userIDs, userID)
+		}
+		return userIDs, nil
+	}
+
+	s.operations["addDeviceUser"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device, exists := s.devices[stringVar(variables, "deviceID")]
+		if !exists {
+			return nil, fmt.Errorf("device does not exist")
+		}
+		userID := stringVar(variables, "userID")
+		if len(userID) == 0 {
+			userID = user.UserID
+		}
+		if _, exists := device.Users[userID]; !exists {
+			device.Users[userID] = USER_STATUS_PENDING
+		}
+
+		return map[string]interface{}{
+			"status": device.Users[userID],
+			"device": s.deviceResult(device),
+			"user":   map[string]interface{}{"userID": userID},
+		}, nil
+	}
+
+	s.operations["removeDeviceUser"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device, err := s.userDevice(user, stringVar(variables, "deviceID"), true)
+		if err != nil {
+			return nil, err
+		}
+		userID := stringVar(variables, "userID")
+		if _, exists := device.Users[userID]; !exists {
+			return nil, fmt.Errorf("user is not a user of the device")
+		}
+		delete(device.Users, userID)
+
+		return map[string]interface{}{
+			"device": s.deviceResult(device),
+			"user":   map[string]interface{}{"userID": userID},
+		}, nil
+	}
+
+	s.operations["activateDeviceUser"] = func(user *User, variables map[string]interface{}) (interface{}, error) {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		device, err := s.userDevice(user, stringVar(variables, "deviceID"), true)
+		if err != nil {
+			return nil, err
+		}
+		userID := stringVar(variables, "userID")
+		if _, exists := device.Users[userID]; !exists {
+			return nil, fmt.Errorf("user is not a user of the device")
+		}
+		device.Users[userID] = USER_STATUS_ACTIVE
+
+		return map[string]interface{}{
+			"status": USER_STATUS_ACTIVE,
+			"device": s.deviceResult(device),
+			"user":   map[string]interface{}{"userID": userID},
+		}, nil
+	}
+}
+
+// returns a device the user has access to. must
+// be called with the server lock held.
+func (s *Server) userDevice(user *User, deviceID string, ownerOnly bool) (*Device, error) {
+
+	device, exists := s.devices[deviceID]
+	if !exists {
+		return nil, fmt.Errorf("device '%s' does not exist", deviceID)
+	}
+	if ownerOnly && device.OwnerID != user.UserID {
+		return nil, fmt.Errorf("user '%s' is not the owner of the device", user.Username)
+	}
+	if !ownerOnly && device.Users[user.UserID] != USER_STATUS_ACTIVE {
+		return nil, fmt.Errorf("user '%s' does not have access to the device", user.Username)
+	}
+	return device, nil
+}
+
+// must be called with the server lock held
+func (s *Server) userResult(user *User) map[string]interface{} {
+
+	deviceUsers := []interface{}{}
+	for _, device := range s.devices {
+		if _, exists := device.Users[user.UserID]; exists {
+			deviceUsers = append(deviceUsers, map[string]interface{}{
+				"device": s.deviceResult(device),
+			})
+		}
+	}
+	spaceUsers := []interface{}{}
+	for _, space := range s.spaces {
+		if status, exists := space.Users[user.UserID]; exists {
+			spaceUsers = append(spaceUsers, map[string]interface{}{
+				"isOwner":      space.OwnerID == user.UserID,
+				"isAdmin":      space.Admins[user.UserID],
+				"accessStatus": status,
+				"space":        s.spaceResult(space),
+			})
+		}
+	}
+	return map[string]interface{}{
+		"userID":       user.UserID,
+		"userName":     user.Username,
+		"emailAddress": user.Email,
+		"publicKey":    user.PublicKey,
+		"devices": map[string]interface{}{
+			"deviceUsers": deviceUsers,
+		},
+		"spaces": map[string]interface{}{
+			"spaceUsers": spaceUsers,
+		},
+	}
+}
+
+// must be called with the server lock held
+func (s *Server) spaceResult(space *Space) map[string]interface{} {
+	return map[string]interface{}{
+		"spaceID":   space.SpaceID,
+		"spaceName": space.Name,
+		"recipe":    space.Recipe,
+		"iaas":      space.IaaS,
+		"region":    space.Region,
+		"version":   space.Version,
+		"status":    space.Status,
+		"fqdn":      space.FQDN,
+		"port":      space.Port,
+		"owner":     s.userRef(space.OwnerID),
+	}
+}
+
+// returns the id and name of a user. must be
+// called with the server lock held.
+func (s *Server) userRef(userID string) map[string]interface{} {
+	userName := ""
+	for _, u := range s.users {
+		if u.UserID == userID {
+			userName = u.Username
+		}
+	}
+	return map[string]interface{}{
+		"userID":   userID,
+		"userName": userName,
+	}
+}
+
+// must be called with the server lock held
+func (s *Server) deviceResult(device *Device) map[string]interface{} {
+	return map[string]interface{}{
+		"deviceID":      device.DeviceID,
+		"deviceName":    device.Name,
+		"deviceType":    device.Type,
+		"clientVersion": device.Version,
+		"publicKey":     device.PublicKey,
+		"ownerID":       device.OwnerID,
+		"users": map[string]interface{}{
+			"deviceUsers": s.deviceUsersResult(device),
+		},
+	}
+}
+
+// must be called with the server lock held
+func (s *Server) deviceUsersResult(device *Device) []interface{} {
+
+	deviceUsers := []interface{}{}
+	for userID, status := range device.Users {
+		deviceUsers = append(deviceUsers, map[string]interface{}{
+			"user":   s.userRef(userID),
+			"status": status,
+		})
+	}
+	return deviceUsers
+}
+
+func stringVar(variables map[string]interface{}, name string) string {
+	value, _ := variables[name].(string)
+	return value
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package mycsfake
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOperation(t *testing.T) {
+
+	for _, tt := range []struct {
+		query string
+		alias string
+		field string
+		isErr bool
+	}{
+		{`query { getUser { userID } }`, "getUser", "getUser", false},
+		{`query GetUser($id: ID!) { getUser(userID: $id) { userID } }`, "getUser", "getUser", false},
+		{`mutation { result: addDevice(deviceName: "a") { idKey } }`, "result", "addDevice", false},
+		{"# a comment {\n{ getDevice { deviceID } }", "getDevice", "getDevice", false},
+		{`query GetUser`, "", "", true},
+		{`{ }`, "", "", true},
+	} {
+		alias, field, err := parseOperation(tt.query)
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("parseOperation(%q) did not fail", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseOperation(%q) failed: %s", tt.query, err.Error())
+			continue
+		}
+		if alias != tt.alias || field != tt.field {
+			t.Errorf("parseOperation(%q) = %q, %q, expected %q, %q", tt.query, alias, field, tt.alias, tt.field)
+		}
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+
+	query := `query GetUser($id: ID!) {
+		user: getUser(userID: $id) {
+			userName
+			# comments are ignored
+			id: userID
+			spaces(limit: 10) {
+				spaceUsers { isOwner space { spaceID } }
+			}
+		}
+		getDevice { deviceID }
+	}`
+	expected := selectionSet{
+		{name: "userName"},
+		{name: "userID"},
+		{name: "spaces", selection: selectionSet{
+			{name: "spaceUsers", selection: selectionSet{
+				{name: "isOwner"},
+				{name: "space", selection: selectionSet{
+					{name: "spaceID"},
+				}},
+			}},
+		}},
+	}
+
+	// the selection of the first top-level field
+	// must be returned in query order every time
+	for i := 0; i < 50; i++ {
+		selection, ok := parseSelection(query)
+		if !ok {
+			t.Fatalf("parseSelection() failed")
+		}
+		if !reflect.DeepEqual(selection, expected) {
+			t.Fatalf("parseSelection() = %v, expected %v", selection, expected)
+		}
+	}
+}
+
+func TestParseSelectionNotDetermined(t *testing.T) {
+
+	for _, query := range []string{
+		`query { getUser { ...userFields } }`,
+		`query { getUser { userID }`,
+		`query`,
+	} {
+		if selection, ok := parseSelection(query); ok {
+			t.Errorf("parseSelection(%q) = %v, expected no selection", query, selection)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+
+	selection, ok := parseSelection(`{ getUser { userID devices { deviceUsers { device { deviceID } } } } }`)
+	if !ok {
+		t.Fatalf("parseSelection() failed")
+	}
+	value := map[string]interface{}{
+		"userID":   "user-1",
+		"userName": "owner",
+		"devices": map[string]interface{}{
+			"deviceUsers": []interface{}{
+				map[string]interface{}{
+					"device": map[string]interface{}{"deviceID": "device-1", "deviceName": "mac"},
+				},
+			},
+		},
+	}
+	expected := map[string]interface{}{
+		"userID": "user-1",
+		"devices": map[string]interface{}{
+			"deviceUsers": []interface{}{
+				map[string]interface{}{
+					"device": map[string]interface{}{"deviceID": "device-1"},
+				},
+			},
+		},
+	}
+	if pruned := selection.prune(value); !reflect.DeepEqual(pruned, expected) {
+		t.Errorf("prune() = %v, expected %v", pruned, expected)
+	}
+}
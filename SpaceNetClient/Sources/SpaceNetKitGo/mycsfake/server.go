@@ -0,0 +1,565 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+// Package mycsfake provides an in-process fake of the MyCS
+// service. It implements the subset of the Cognito OAuth2
+// endpoints and AppSync GraphQL operations used by the login
+// and device configuration flows so that they can be
+// exercised without access to the live service.
+package mycsfake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	REGION       = "us-east-1"
+	USER_POOL_ID = "us-east-1_fake"
+
+	CLIENT_ID     = "fake-client-id"
+	CLIENT_SECRET = "fake-client-secret"
+
+	TOKEN_EXPIRY = time.Hour
+
+	DEVICE_CODE_EXPIRY   = 10 * time.Minute
+	DEVICE_CODE_INTERVAL = 1
+
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	signingKeyID = "fake-key"
+)
+
+// A user that can login to the fake service
+type User struct {
+	UserID    string
+	Username  string
+	Email     string
+	Name      string
+	Groups    []string
+	PublicKey string
+}
+
+type Server struct {
+	server *httptest.Server
+
+	signingKey *rsa.PrivateKey
+
+	mx sync.Mutex
+
+	// users by username and the user the authorize
+	// endpoint will login without prompting
+	users     map[string]*User
+	loginUser string
+
+	// issued authorization codes and refresh tokens
+	authCodes     map[string]string
+	refreshTokens map[string]string
+
+	// issued device codes
+	deviceCodes map[string]*deviceCode
+
+	// registered devices by device id
+	devices map[string]*Device
+
+	// spaces by space id
+	spaces map[string]*Space
+
+	// graphql operation handlers by top-level field name
+	operations map[string]OperationHandler
+
+	// number of requests received by path
+	requests map[string]int
+}
+
+// A device code issued by the device authorization
+// endpoint. the first poll for its token is always
+// pending after which the login user is authorized.
+type deviceCode struct {
+	userCode string
+	expiry   time.Time
+	polled   bool
+}
+
+// starts a new fake service with a single user
+// which is logged in by the authorize endpoint
+func NewServer(user *User) (*Server, error) {
+
+	var (
+		err error
+	)
+
+	s := &Server{
+		users:         make(map[string]*User),
+		authCodes:     make(map[string]string),
+		refreshTokens: make(map[string]string),
+		deviceCodes:   make(map[string]*deviceCode),
+		devices:       make(map[string]*Device),
+		spaces:        make(map[string]*Space),
+		operations:    make(map[string]OperationHandler),
+		requests:      make(map[string]int),
+	}
+	if s.signingKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return nil, err
+	}
+	s.AddUser(user)
+	s.loginUser = user.Username
+	s.addDefaultOperations()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", s.handleAuthorize)
+	mux.HandleFunc("/oauth2/authorize", s.handleAuthorize)
+	mux.HandleFunc("/oauth2/token", s.handleToken)
+	mux.HandleFunc("/oauth2/device_authorization", s.handleDeviceAuthorization)
+	mux.HandleFunc("/oauth2/userInfo", s.handleUserInfo)
+	mux.HandleFunc("/logout", s.handleLogout)
+	mux.HandleFunc("/"+USER_POOL_ID+"/.well-known/jwks.json", s.handleJWKS)
+	mux.HandleFunc("/graphql", s.handleGraphQL)
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mx.Lock()
+		s.requests[r.URL.Path]++
+		s.mx.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	return s, nil
+}
+
+// stops the fake service
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+func (s *Server) AuthURL() string {
+	return s.server.URL + "/login"
+}
+
+func (s *Server) TokenURL() string {
+	return s.server.URL + "/oauth2/token"
+}
+
+func (s *Server) DeviceAuthURL() string {
+	return s.server.URL + "/oauth2/device_authorization"
+}
+
+func (s *Server) UserInfoURL() string {
+	return s.server.URL + "/oauth2/userInfo"
+}
+
+func (s *Server) ApiURL() string {
+	return s.server.URL + "/graphql"
+}
+
+// the issuer of the tokens signed by the fake service.
+// the signing keys are served at <issuer>/.well-known/jwks.json.
+func (s *Server) Issuer() string {
+	return s.server.URL + "/" + USER_POOL_ID
+}
+
+// returns a JSON service environment descriptor that
+// points the client at this service. the result can
+// be passed to snAddEnvironment.
+func (s *Server) Environment(name string) string {
+	env, _ := json.Marshal(map[string]string{
+		"name":         name,
+		"region":       REGION,
+		"userPoolID":   USER_POOL_ID,
+		"clientID":     CLIENT_ID,
+		"clientSecret": CLIENT_SECRET,
+		"authURL":      s.AuthURL(),
+		"tokenURL":     s.TokenURL(),
+		"apiURL":       s.ApiURL(),
+
+		"deviceAuthURL": s.DeviceAuthURL(),
+	})
+	return string(env)
+}
+
+// adds or replaces a user
+func (s *Server) AddUser(user *User) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(user.UserID) == 0 {
+		user.UserID = uuid.New().String()
+	}
+	s.users[user.Username] = user
+}
+
+// sets the user the authorize endpoint will login. if
+// username is empty then authorization will be denied.
+func (s *Server) SetLoginUser(username string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.loginUser = username
+}
+
+// returns an access token of a user for tests that do
+// not exercise the login flow
+func (s *Server) AccessToken(username string) (string, error) {
+	s.mx.Lock()
+	user, exists := s.users[username]
+	s.mx.Unlock()
+
+	if !exists {
+		return "", fmt.Errorf("user '%s' does not exist", username)
+	}
+	return s.signToken(user, "access", nil)
+}
+
+// returns an "access" or "id" token of a user with the given
+// claims replacing its claims. claims with a nil value are
+// removed from the token.
+func (s *Server) Token(username, tokenUse string, claims map[string]interface{}) (string, error) {
+	s.mx.Lock()
+	user, exists := s.users[username]
+	s.mx.Unlock()
+
+	if !exists {
+		return "", fmt.Errorf("user '%s' does not exist", username)
+	}
+	return s.signToken(user, tokenUse, claims)
+}
+
+// returns a refresh token of a user that can be exchanged
+// at the token endpoint for tests that renew tokens
+func (s *Server) RefreshToken(username string) (string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, exists := s.users[username]; !exists {
+		return "", fmt.Errorf("user '%s' does not exist", username)
+	}
+	refreshToken := uuid.New().String()
+	s.refreshTokens[refreshToken] = username
+	return refreshToken, nil
+}
+
+// expires all issued device codes so that polling
+// for their tokens returns an expired_token error
+func (s *Server) ExpireDeviceCodes() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, dc := range s.deviceCodes {
+		dc.expiry = time.Now().Add(-time.Second)
+	}
+}
+
+// returns the number of requests received for a path
+func (s *Server) Requests(path string) int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.requests[path]
+}
+
+// Cognito's hosted UI authorize endpoint. the login user is
+// authorized immediately and redirected back to the client
+// so a client's UI only needs to follow the redirect.
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || len(redirectURI.String()) == 0 {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("client_id") != CLIENT_ID {
+		http.Error(w, "invalid client_id", http.StatusBadRequest)
+		return
+	}
+
+	params := redirectURI.Query()
+	if state := query.Get("state"); len(state) > 0 {
+		params.Set("state", state)
+	}
+
+	s.mx.Lock()
+	if _, exists := s.users[s.loginUser]; exists {
+		code := uuid.New().String()
+		s.authCodes[code] = s.loginUser
+		params.Set("code", code)
+	} else {
+		params.Set("error", "access_denied")
+	}
+	s.mx.Unlock()
+
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		username string
+		exists   bool
+	)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	if clientID != CLIENT_ID || clientSecret != CLIENT_SECRET {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		if username, exists = s.authCodes[code]; exists {
+			// codes can only be used once
+			delete(s.authCodes, code)
+		}
+	case "refresh_token":
+		username, exists = s.refreshTokens[r.PostForm.Get("refresh_token")]
+	case deviceCodeGrantType:
+		code := r.PostForm.Get("device_code")
+		dc, dcExists := s.deviceCodes[code]
+		switch {
+		case !dcExists:
+			tokenError(w, "invalid_grant")
+			return
+		case time.Now().After(dc.expiry):
+			delete(s.deviceCodes, code)
+			tokenError(w, "expired_token")
+			return
+		case !dc.polled:
+			dc.polled = true
+			tokenError(w, "authorization_pending")
+			return
+		}
+		delete(s.deviceCodes, code)
+		if _, exists = s.users[s.loginUser]; !exists {
+			tokenError(w, "access_denied")
+			return
+		}
+		username = s.loginUser
+	default:
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+	user, userExists := s.users[username]
+	if !exists || !userExists {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	accessToken, err := s.signToken(user, "access", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, err := s.signToken(user, "id", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refreshToken := uuid.New().String()
+	s.refreshTokens[refreshToken] = username
+
+	writeJSON(w, map[string]interface{}{
+		"access_token":  accessToken,
+		"id_token":      idToken,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(TOKEN_EXPIRY.Seconds()),
+	})
+}
+
+// the device authorization endpoint of the device
+// code grant which issues a device and user code
+func (s *Server) handleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	if r.PostForm.Get("client_id") != CLIENT_ID {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	code := uuid.New().String()
+	userCode := strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:8])
+
+	s.mx.Lock()
+	s.deviceCodes[code] = &deviceCode{
+		userCode: userCode,
+		expiry:   time.Now().Add(DEVICE_CODE_EXPIRY),
+	}
+	s.mx.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"device_code":               code,
+		"user_code":                 userCode,
+		"verification_uri":          s.server.URL + "/activate",
+		"verification_uri_complete": s.server.URL + "/activate?user_code=" + userCode,
+		"expires_in":                int(DEVICE_CODE_EXPIRY.Seconds()),
+		"interval":                  DEVICE_CODE_INTERVAL,
+	})
+}
+
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+
+	user, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"sub":            user.UserID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"email_verified": "true",
+		"name":           user.Name,
+	})
+}
+
+// Cognito's logout endpoint redirects to the logout uri
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if logoutURI := r.URL.Query().Get("logout_uri"); len(logoutURI) > 0 {
+		http.Redirect(w, r, logoutURI, http.StatusFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+
+	pub := s.signingKey.PublicKey
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": signingKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	})
+}
+
+// returns a token signed with the fake service's key having
+// the claims of a Cognito user pool token and the overrides
+func (s *Server) signToken(user *User, tokenUse string, overrides map[string]interface{}) (string, error) {
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub":              user.UserID,
+		"iss":              s.Issuer(),
+		"token_use":        tokenUse,
+		"auth_time":        now.Unix(),
+		"iat":              now.Unix(),
+		"exp":              now.Add(TOKEN_EXPIRY).Unix(),
+		"jti":              uuid.New().String(),
+		"cognito:username": user.Username,
+		"cognito:groups":   user.Groups,
+	}
+	if tokenUse == "id" {
+		claims["aud"] = CLIENT_ID
+		claims["email"] = user.Email
+		claims["name"] = user.Name
+		claims["custom:publicKey"] = user.PublicKey
+	} else {
+		claims["client_id"] = CLIENT_ID
+		claims["username"] = user.Username
+		claims["scope"] = "openid profile email"
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = signingKeyID
+	return token.SignedString(s.signingKey)
+}
+
+// returns the user of the bearer token of a request
+func (s *Server) authenticate(r *http.Request) (*User, error) {
+
+	authHeader := r.Header.Get("Authorization")
+	tokenString := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	if len(tokenString) == 0 {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return &s.signingKey.PublicKey, nil
+	}); err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(s.Issuer(), true) {
+		return nil, fmt.Errorf("invalid token issuer")
+	}
+
+	username, _ := claims["cognito:username"].(string)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return nil, fmt.Errorf("user '%s' does not exist", username)
+	}
+	return user, nil
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,266 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package mycsfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *Server {
+
+	s, err := NewServer(&User{
+		Username: "owner",
+		Email:    "owner@example.com",
+		Name:     "Device Owner",
+	})
+	if err != nil {
+		t.Fatalf("NewServer() failed: %s", err.Error())
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// posts a token request returning the decoded response
+func requestToken(t *testing.T, s *Server, form url.Values) (int, map[string]interface{}) {
+
+	form.Set("client_id", CLIENT_ID)
+	form.Set("client_secret", CLIENT_SECRET)
+
+	resp, err := http.PostForm(s.TokenURL(), form)
+	if err != nil {
+		t.Fatalf("token request failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	result := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("invalid token response: %s", err.Error())
+	}
+	return resp.StatusCode, result
+}
+
+// posts a graphql operation returning the decoded response
+func requestGraphQL(t *testing.T, s *Server, accessToken, query string) (int, map[string]interface{}) {
+
+	body, _ := json.Marshal(map[string]interface{}{"query": query})
+	req, _ := http.NewRequest(http.MethodPost, s.ApiURL(), bytes.NewReader(body))
+	if len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("graphql request failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	result := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("invalid graphql response: %s", err.Error())
+	}
+	return resp.StatusCode, result
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+
+	s := newTestServer(t)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(s.AuthURL() + "?" + url.Values{
+		"client_id":    {CLIENT_ID},
+		"redirect_uri": {"http://localhost/callback"},
+		"state":        {"state-1"},
+	}.Encode())
+	if err != nil {
+		t.Fatalf("authorize request failed: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil {
+		t.Fatalf("authorize did not redirect: %d", resp.StatusCode)
+	}
+	code := location.Query().Get("code")
+	if len(code) == 0 || location.Query().Get("state") != "state-1" {
+		t.Fatalf("authorize redirected to '%s', expected a code and the state", location.String())
+	}
+
+	status, token := requestToken(t, s, url.Values{"grant_type": {"authorization_code"}, "code": {code}})
+	if status != http.StatusOK || token["access_token"] == nil || token["refresh_token"] == nil {
+		t.Fatalf("authorization code was not exchanged: %d %v", status, token)
+	}
+
+	// codes can only be used once
+	status, result := requestToken(t, s, url.Values{"grant_type": {"authorization_code"}, "code": {code}})
+	if status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("authorization code was exchanged twice: %d %v", status, result)
+	}
+
+	refreshToken, _ := token["refresh_token"].(string)
+	status, result = requestToken(t, s, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	if status != http.StatusOK || result["access_token"] == nil {
+		t.Errorf("token was not refreshed: %d %v", status, result)
+	}
+
+	// authorization is denied if there is no login user
+	s.SetLoginUser("")
+	resp, err = client.Get(s.AuthURL() + "?" + url.Values{
+		"client_id":    {CLIENT_ID},
+		"redirect_uri": {"http://localhost/callback"},
+	}.Encode())
+	if err != nil {
+		t.Fatalf("authorize request failed: %s", err.Error())
+	}
+	resp.Body.Close()
+	if !strings.Contains(resp.Header.Get("Location"), "error=access_denied") {
+		t.Errorf("authorize redirected to '%s', expected access to be denied", resp.Header.Get("Location"))
+	}
+}
+
+func TestDeviceCodeFlow(t *testing.T) {
+
+	s := newTestServer(t)
+
+	resp, err := http.PostForm(s.DeviceAuthURL(), url.Values{"client_id": {CLIENT_ID}})
+	if err != nil {
+		t.Fatalf("device authorization request failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	authorization := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&authorization); err != nil {
+		t.Fatalf("invalid device authorization response: %s", err.Error())
+	}
+	deviceCode, _ := authorization["device_code"].(string)
+	if len(deviceCode) == 0 || authorization["user_code"] == nil {
+		t.Fatalf("device authorization did not return a device and user code: %v", authorization)
+	}
+
+	form := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {deviceCode}}
+
+	// the first poll is always pending
+	status, result := requestToken(t, s, form)
+	if status != http.StatusBadRequest || result["error"] != "authorization_pending" {
+		t.Errorf("first poll returned %d %v, expected authorization to be pending", status, result)
+	}
+	status, result = requestToken(t, s, form)
+	if status != http.StatusOK || result["access_token"] == nil {
+		t.Errorf("second poll returned %d %v, expected a token", status, result)
+	}
+	// device codes can only be used once
+	status, result = requestToken(t, s, form)
+	if status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("device code was exchanged twice: %d %v", status, result)
+	}
+}
+
+func TestTokenInvalidClient(t *testing.T) {
+
+	s := newTestServer(t)
+
+	resp, err := http.PostForm(s.TokenURL(), url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {CLIENT_ID},
+		"client_secret": {"wrong"},
+	})
+	if err != nil {
+		t.Fatalf("token request failed: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("token request with an invalid client secret returned %d", resp.StatusCode)
+	}
+}
+
+func TestGraphQLAuthentication(t *testing.T) {
+
+	s := newTestServer(t)
+
+	status, result := requestGraphQL(t, s, "", `query { getUser { userID } }`)
+	if status != http.StatusUnauthorized || result["errors"] == nil {
+		t.Errorf("unauthenticated request returned %d %v", status, result)
+	}
+	status, _ = requestGraphQL(t, s, "not-a-token", `query { getUser { userID } }`)
+	if status != http.StatusUnauthorized {
+		t.Errorf("request with an invalid token returned %d", status)
+	}
+}
+
+func TestGraphQLGetUser(t *testing.T) {
+
+	s := newTestServer(t)
+	s.AddSpace(&Space{
+		Name:    "home",
+		OwnerID: s.users["owner"].UserID,
+	})
+
+	accessToken, err := s.AccessToken("owner")
+	if err != nil {
+		t.Fatalf("AccessToken() failed: %s", err.Error())
+	}
+	_, result := requestGraphQL(t, s, accessToken, `query {
+		user: getUser {
+			userName
+			spaces { spaceUsers { isOwner space { spaceName owner { userName } } } }
+		}
+	}`)
+
+	data, _ := result["data"].(map[string]interface{})
+	user, _ := data["user"].(map[string]interface{})
+	if user == nil {
+		t.Fatalf("getUser returned no user: %v", result)
+	}
+	// only the selected fields are returned
+	if _, exists := user["userID"]; exists || user["userName"] != "owner" {
+		t.Errorf("getUser returned %v, expected only the selected fields", user)
+	}
+	spaceUsers, _ := user["spaces"].(map[string]interface{})["spaceUsers"].([]interface{})
+	if len(spaceUsers) != 1 {
+		t.Fatalf("getUser returned %d spaces, expected 1", len(spaceUsers))
+	}
+	spaceUser := spaceUsers[0].(map[string]interface{})
+	space := spaceUser["space"].(map[string]interface{})
+	owner := space["owner"].(map[string]interface{})
+	if spaceUser["isOwner"] != true || space["spaceName"] != "home" || owner["userName"] != "owner" {
+		t.Errorf("getUser returned space %v", spaceUser)
+	}
+
+	if s.Requests("/graphql") != 1 {
+		t.Errorf("%d graphql requests were counted, expected 1", s.Requests("/graphql"))
+	}
+}
+
+func TestGraphQLUnsupportedOperation(t *testing.T) {
+
+	s := newTestServer(t)
+
+	accessToken, err := s.AccessToken("owner")
+	if err != nil {
+		t.Fatalf("AccessToken() failed: %s", err.Error())
+	}
+	_, result := requestGraphQL(t, s, accessToken, `query { listEverything { id } }`)
+	if result["errors"] == nil {
+		t.Errorf("unsupported operation did not fail: %v", result)
+	}
+
+	s.HandleOperation("listEverything", func(user *User, variables map[string]interface{}) (interface{}, error) {
+		return []interface{}{map[string]interface{}{"id": "1", "other": "x"}}, nil
+	})
+	_, result = requestGraphQL(t, s, accessToken, `query { listEverything { id } }`)
+	data, _ := result["data"].(map[string]interface{})
+	items, _ := data["listEverything"].([]interface{})
+	if len(items) != 1 || len(items[0].(map[string]interface{})) != 1 {
+		t.Errorf("custom operation returned %v", result)
+	}
+}
@@ -0,0 +1,494 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mevansam/goutils/crypto"
+	"github.com/mevansam/goutils/logger"
+)
+
+const (
+	// formats the owner's key file may be saved in
+	OWNER_KEY_FORMAT_PEM           = "pem"
+	OWNER_KEY_FORMAT_ENCRYPTED_PEM = "encryptedPEM"
+	OWNER_KEY_FORMAT_PKCS8         = "pkcs8"
+
+	// pem block types of the owner's key. the plain key is
+	// saved with a PKCS#8 encoded key in an "RSA PRIVATE KEY"
+	// block which is the form the device context reads.
+	PEM_TYPE_RSA_PRIVATE_KEY       = "RSA PRIVATE KEY"
+	PEM_TYPE_ENCRYPTED_PRIVATE_KEY = "ENCRYPTED PRIVATE KEY"
+)
+
+// A key file of the owner which, if it is protected with a
+// passphrase, is passed to or from the config initializer
+// in plain form through a named pipe so that the plain key
+// is never written to disk
+type ownerKeyFile struct {
+	// the key file as given by the host which may be a file URL
+	name string
+	path string
+
+	format string
+
+	// the named pipe the config initializer reads the plain
+	// key from or writes a created plain key to
+	pipeDir  string
+	pipePath string
+
+	// the transfer of the plain key through the pipe, the
+	// flag the pipe is opened with at the other end and
+	// whether the pipe has been opened for the transfer
+	transfer chan ownerKeyTransfer
+	peerFlag int
+	pipeOpen chan struct{}
+}
+
+// the result of passing the plain key through the pipe
+type ownerKeyTransfer struct {
+	keyPEM []byte
+	err    error
+}
+
+var (
+	// prompts for the passphrase of a key file. replaced by tests.
+	promptKeyFilePassphraseFn = promptKeyFilePassphrase
+
+	// how long the user has to enter the passphrase of a key file
+	keyFilePassphraseTimeout = DEFAULT_LOGIN_TIMEOUT
+)
+
+// returns the owner key file with the given name as passed
+// by the host, which may be a path or a file URL
+func newOwnerKeyFile(name, format string) (*ownerKeyFile, error) {
+
+	var (
+		err error
+	)
+
+	keyFile := &ownerKeyFile{
+		name:   name,
+		path:   name,
+		format: format,
+	}
+	if len(keyFile.format) == 0 {
+		keyFile.format = OWNER_KEY_FORMAT_PEM
+	}
+	switch keyFile.format {
+	case OWNER_KEY_FORMAT_PEM, OWNER_KEY_FORMAT_ENCRYPTED_PEM, OWNER_KEY_FORMAT_PKCS8:
+	default:
+		return nil, newError(SN_ERROR_VALIDATION, "unknown owner key format '%s'", format)
+	}
+
+	if strings.HasPrefix(name, "file://") {
+		var fileURL *url.URL
+		if fileURL, err = url.Parse(name); err != nil {
+			return nil, newError(SN_ERROR_VALIDATION, "invalid key file URL '%s': %s", name, err.Error())
+		}
+		keyFile.path = fileURL.Path
+	}
+	return keyFile, nil
+}
+
+// detects the format of an existing key file
+func (k *ownerKeyFile) detectFormat() error {
+
+	var (
+		err error
+
+		keyPEM []byte
+	)
+
+	if keyPEM, err = os.ReadFile(k.path); err != nil {
+		return storageError(err)
+	}
+	if k.format, err = ownerKeyFormat(keyPEM); err != nil {
+		return err
+	}
+	return nil
+}
+
+// whether the key file is protected with a passphrase
+func (k *ownerKeyFile) encrypted() bool {
+	return k.format != OWNER_KEY_FORMAT_PEM
+}
+
+// returns the name of the plain key file to pass to the config
+// initializer in the same form as the name given by the host
+func (k *ownerKeyFile) plainName() (string, error) {
+
+	var (
+		err error
+	)
+
+	if !k.encrypted() {
+		return k.name, nil
+	}
+	if len(k.pipeDir) == 0 {
+		// the pipe is only accessible by the user
+		configDir := filepath.Join(homeDir, ".cb")
+		if err = os.MkdirAll(configDir, 0700); err != nil {
+			return "", storageError(err)
+		}
+		if k.pipeDir, err = os.MkdirTemp(configDir, "owner-key-"); err != nil {
+			return "", storageError(err)
+		}
+		k.pipePath = filepath.Join(k.pipeDir, "owner-key.pem")
+		if err = syscall.Mkfifo(k.pipePath, 0600); err != nil {
+			_ = os.RemoveAll(k.pipeDir)
+			k.pipeDir = ""
+			return "", storageError(err)
+		}
+	}
+	if strings.HasPrefix(k.name, "file://") {
+		return (&url.URL{Scheme: "file", Path: k.pipePath}).String(), nil
+	}
+	return k.pipePath, nil
+}
+
+// decrypts the key file and passes the plain key to
+// the config initializer when it reads the plain key
+func (k *ownerKeyFile) decrypt(passphrase string) error {
+
+	var (
+		err error
+
+		keyPEM []byte
+		key    *crypto.RSAKey
+		plain  string
+	)
+
+	if keyPEM, err = os.ReadFile(k.path); err != nil {
+		return storageError(err)
+	}
+	if key, err = readOwnerKey(keyPEM, []byte(passphrase)); err != nil {
+		return err
+	}
+	if plain, err = key.GetPrivateKeyPEM(); err != nil {
+		return err
+	}
+	if _, err = k.plainName(); err != nil {
+		return err
+	}
+	k.startTransfer(os.O_WRONLY, os.O_RDONLY, func(pipe *os.File) ([]byte, error) {
+		_, err := pipe.Write([]byte(plain))
+		return nil, err
+	})
+	return nil
+}
+
+// receives the plain key created by the config
+// initializer when it writes the plain key
+func (k *ownerKeyFile) receive() error {
+
+	if _, err := k.plainName(); err != nil {
+		return err
+	}
+	k.startTransfer(os.O_RDONLY, os.O_WRONLY, func(pipe *os.File) ([]byte, error) {
+		return io.ReadAll(pipe)
+	})
+	return nil
+}
+
+// passes the plain key through the pipe once the config
+// initializer opens it at the other end
+func (k *ownerKeyFile) startTransfer(flag, peerFlag int, transfer func(pipe *os.File) ([]byte, error)) {
+
+	k.transfer = make(chan ownerKeyTransfer, 1)
+	k.peerFlag = peerFlag
+	k.pipeOpen = make(chan struct{})
+
+	go func() {
+		pipe, err := os.OpenFile(k.pipePath, flag, 0)
+		close(k.pipeOpen)
+		if err != nil {
+			k.transfer <- ownerKeyTransfer{err: err}
+			return
+		}
+		keyPEM, err := transfer(pipe)
+		if closeErr := pipe.Close(); err == nil {
+			err = closeErr
+		}
+		k.transfer <- ownerKeyTransfer{keyPEM: keyPEM, err: err}
+	}()
+}
+
+// encrypts the plain key created by the config
+// initializer and saves it to the key file
+func (k *ownerKeyFile) encrypt(passphrase string) error {
+
+	var (
+		err error
+
+		key    *crypto.RSAKey
+		keyPEM []byte
+	)
+
+	if k.transfer == nil {
+		return newError(SN_ERROR_UNKNOWN, "the created key was not received from the config initializer")
+	}
+	transfer := <-k.transfer
+	k.transfer = nil
+	if transfer.err != nil {
+		return storageError(transfer.err)
+	}
+
+	if key, err = readOwnerKey(transfer.keyPEM, nil); err != nil {
+		return err
+	}
+	if keyPEM, err = encryptOwnerKey(key, k.format, []byte(passphrase)); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return storageError(err)
+	}
+	if err = os.WriteFile(k.path, keyPEM, 0600); err != nil {
+		return storageError(err)
+	}
+	return nil
+}
+
+// removes the key file if it is the owner key file of a
+// restored backup as the loaded key is saved with the
+// device context
+func (k *ownerKeyFile) removeIfRestored() {
+	if k.path != restoredOwnerKeyFile() {
+		return
+	}
+	if err := secureDelete(k.path); err != nil && !os.IsNotExist(err) {
+		logger.ErrorMessage("Failed to securely delete restored key file '%s': %s", k.path, err.Error())
+	}
+}
+
+// removes the pipe releasing a transfer the
+// config initializer did not take part in
+func (k *ownerKeyFile) cleanup() {
+	if len(k.pipeDir) == 0 {
+		return
+	}
+	if k.transfer != nil {
+		select {
+		case <-k.pipeOpen:
+		default:
+			// the pending open of the transfer completes
+			// once the pipe is opened at the other end
+			if pipe, err := os.OpenFile(k.pipePath, k.peerFlag, 0); err == nil {
+				_ = pipe.Close()
+			}
+		}
+		<-k.transfer
+		k.transfer = nil
+	}
+	if err := os.RemoveAll(k.pipeDir); err != nil {
+		logger.ErrorMessage("Failed to remove owner key pipe '%s': %s", k.pipePath, err.Error())
+	}
+	k.pipeDir = ""
+}
+
+// returns the format of the given PEM encoded owner key
+func ownerKeyFormat(keyPEM []byte) (string, error) {
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return "", newError(SN_ERROR_VALIDATION, "the key file does not contain a PEM encoded key")
+	}
+	switch block.Type {
+	case PEM_TYPE_ENCRYPTED_PRIVATE_KEY:
+		return OWNER_KEY_FORMAT_PKCS8, nil
+	case PEM_TYPE_RSA_PRIVATE_KEY:
+		//lint:ignore SA1019 legacy encrypted PEM keys are supported
+		if x509.IsEncryptedPEMBlock(block) {
+			return OWNER_KEY_FORMAT_ENCRYPTED_PEM, nil
+		}
+		return OWNER_KEY_FORMAT_PEM, nil
+	}
+	return "", newError(SN_ERROR_VALIDATION, "the key file contains an unsupported PEM block '%s'", block.Type)
+}
+
+// reads an owner key in any of the supported formats
+// decrypting it with the passphrase if it is encrypted
+func readOwnerKey(keyPEM, passphrase []byte) (*crypto.RSAKey, error) {
+
+	var (
+		err error
+
+		format   string
+		keyDER   []byte
+		rsaKey   *rsa.PrivateKey
+		plainKey []byte
+		key      *crypto.RSAKey
+	)
+
+	if format, err = ownerKeyFormat(keyPEM); err != nil {
+		return nil, err
+	}
+	if format == OWNER_KEY_FORMAT_PKCS8 {
+		if key, err = crypto.NewRSAKeyFromPEM(string(keyPEM), passphrase); err != nil {
+			return nil, newError(SN_ERROR_LOCK, "the key file passphrase is incorrect or the key is not an RSA key")
+		}
+		return key, nil
+	}
+
+	// legacy PEM keys may be encrypted and may contain a PKCS#1
+	// encoded key so they are converted to the plain form read
+	// by the device context
+	block, _ := pem.Decode(keyPEM)
+	keyDER = block.Bytes
+	if format == OWNER_KEY_FORMAT_ENCRYPTED_PEM {
+		//lint:ignore SA1019 legacy encrypted PEM keys are supported
+		if keyDER, err = x509.DecryptPEMBlock(block, passphrase); err != nil {
+			return nil, newError(SN_ERROR_LOCK, "the key file passphrase is incorrect")
+		}
+	}
+	if rsaKey, err = parseRSAPrivateKey(keyDER); err != nil {
+		return nil, err
+	}
+	if plainKey, err = plainOwnerKeyPEM(rsaKey); err != nil {
+		return nil, err
+	}
+	if key, err = crypto.NewRSAKeyFromPEM(string(plainKey), nil); err != nil {
+		return nil, newError(SN_ERROR_VALIDATION, "the key file does not contain a valid RSA key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// returns the owner key in the given format protecting it
+// with the passphrase if the format is encrypted. encrypted
+// keys are read back to verify them before they are saved.
+func encryptOwnerKey(key *crypto.RSAKey, format string, passphrase []byte) ([]byte, error) {
+
+	var (
+		err error
+
+		plainKey,
+		keyPEM,
+		verifyPlainKey string
+
+		rsaKey    *rsa.PrivateKey
+		block     *pem.Block
+		verifyKey *crypto.RSAKey
+	)
+
+	if plainKey, err = key.GetPrivateKeyPEM(); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case OWNER_KEY_FORMAT_PKCS8:
+		if keyPEM, err = key.GetEncryptedPrivateKeyPEM(passphrase); err != nil {
+			return nil, err
+		}
+
+	case OWNER_KEY_FORMAT_ENCRYPTED_PEM:
+		block, _ = pem.Decode([]byte(plainKey))
+		if rsaKey, err = parseRSAPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+		//lint:ignore SA1019 legacy encrypted PEM keys are supported
+		if block, err = x509.EncryptPEMBlock(
+			rand.Reader,
+			PEM_TYPE_RSA_PRIVATE_KEY,
+			x509.MarshalPKCS1PrivateKey(rsaKey),
+			passphrase,
+			x509.PEMCipherAES256,
+		); err != nil {
+			return nil, err
+		}
+		keyPEM = string(pem.EncodeToMemory(block))
+
+	default:
+		return []byte(plainKey), nil
+	}
+
+	if verifyKey, err = readOwnerKey([]byte(keyPEM), passphrase); err != nil {
+		return nil, newError(SN_ERROR_UNKNOWN, "the encrypted key could not be read back: %s", err.Error())
+	}
+	if verifyPlainKey, err = verifyKey.GetPrivateKeyPEM(); err != nil {
+		return nil, err
+	}
+	if verifyPlainKey != plainKey {
+		return nil, newError(SN_ERROR_UNKNOWN, "the encrypted key does not match the key it was created from")
+	}
+	return []byte(keyPEM), nil
+}
+
+// returns the key in the plain form read by the device context
+func plainOwnerKeyPEM(key *rsa.PrivateKey) ([]byte, error) {
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(
+		&pem.Block{
+			Type:  PEM_TYPE_RSA_PRIVATE_KEY,
+			Bytes: keyDER,
+		},
+	), nil
+}
+
+// parses a PKCS#8 or PKCS#1 encoded RSA private key
+func parseRSAPrivateKey(keyDER []byte) (*rsa.PrivateKey, error) {
+
+	if key, err := x509.ParsePKCS8PrivateKey(keyDER); err == nil {
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, newError(SN_ERROR_VALIDATION, "the key file does not contain an RSA key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(keyDER); err == nil {
+		return key, nil
+	}
+	return nil, newError(SN_ERROR_VALIDATION, "the key file does not contain a valid RSA key")
+}
+
+// prompts the user for the passphrase of the key file. if
+// the key file is being created the passphrase is verified.
+// returns nil if the user cancels the prompt, does not enter
+// the passphrase in time or if no dialog can be shown.
+func promptKeyFilePassphrase(dlgContext uintptr, keyFile *ownerKeyFile, create bool) *string {
+
+	msg := NewAppUIBackground(dlgContext).NewUIMessage("Owner Key Passphrase")
+	input := make(chan *string, 1)
+
+	if create {
+		msg.WriteMessage("Enter a passphrase to protect the new device owner key file with. The key file cannot be loaded without it.")
+		msg.ShowMessageWithSecureVerifiedInput(func(passphrase *string) {
+			input <- passphrase
+		})
+	} else {
+		msg.WriteMessage("Enter the passphrase of the device owner key file '" + filepath.Base(keyFile.path) + "'.")
+		msg.ShowMessageWithSecureInput(func(passphrase *string) {
+			input <- passphrase
+		})
+	}
+
+	// the prompt is dismissed if the user does not respond
+	// as operations such as key rotations wait for it
+	timer := time.NewTimer(keyFilePassphraseTimeout)
+	defer timer.Stop()
+
+	select {
+	case passphrase := <-input:
+		return passphrase
+	case <-timer.C:
+		logger.ErrorMessage("Dismissing the owner key passphrase prompt as it timed out")
+		msg.DismissMessage()
+		return nil
+	}
+}
@@ -0,0 +1,243 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mevansam/goutils/crypto"
+)
+
+const testKeyFilePassphrase = "test key file passphrase"
+
+func newTestOwnerKey(t *testing.T) (*crypto.RSAKey, string) {
+
+	key, err := crypto.NewRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainKey, err := key.GetPrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, plainKey
+}
+
+// replaces the passphrase prompt with one that returns the
+// given passphrase recording whether a key is being created
+func stubKeyFilePassphrasePrompt(t *testing.T, passphrase *string) *bool {
+
+	prompted := new(bool)
+	prevPrompt := promptKeyFilePassphraseFn
+	promptKeyFilePassphraseFn = func(dlgContext uintptr, keyFile *ownerKeyFile, create bool) *string {
+		*prompted = create
+		return passphrase
+	}
+	t.Cleanup(func() {
+		promptKeyFilePassphraseFn = prevPrompt
+	})
+	return prompted
+}
+
+func TestOwnerKeyFormats(t *testing.T) {
+
+	key, plainKey := newTestOwnerKey(t)
+
+	for _, format := range []string{
+		OWNER_KEY_FORMAT_PEM,
+		OWNER_KEY_FORMAT_ENCRYPTED_PEM,
+		OWNER_KEY_FORMAT_PKCS8,
+	} {
+		t.Run(format, func(t *testing.T) {
+
+			keyPEM, err := encryptOwnerKey(key, format, []byte(testKeyFilePassphrase))
+			if err != nil {
+				t.Fatalf("encryptOwnerKey() failed: %s", err.Error())
+			}
+			if detected, err := ownerKeyFormat(keyPEM); err != nil || detected != format {
+				t.Errorf("ownerKeyFormat() = %s, %v, expected %s", detected, err, format)
+			}
+
+			readKey, err := readOwnerKey(keyPEM, []byte(testKeyFilePassphrase))
+			if err != nil {
+				t.Fatalf("readOwnerKey() failed: %s", err.Error())
+			}
+			if readPlainKey, _ := readKey.GetPrivateKeyPEM(); readPlainKey != plainKey {
+				t.Errorf("readOwnerKey() did not return the encrypted key")
+			}
+
+			if format != OWNER_KEY_FORMAT_PEM {
+				_, err = readOwnerKey(keyPEM, []byte("wrong passphrase"))
+				if code := errorCode(err); code != SN_ERROR_LOCK {
+					t.Errorf("readOwnerKey() with a wrong passphrase returned error code %d, expected a lock error: %v", code, err)
+				}
+			}
+		})
+	}
+
+	if _, err := readOwnerKey([]byte("not a key"), nil); errorCode(err) != SN_ERROR_VALIDATION {
+		t.Errorf("readOwnerKey() of data without a key returned %v, expected a validation error", err)
+	}
+}
+
+func TestOwnerKeyFileDecrypt(t *testing.T) {
+
+	newTestContext(t)
+	key, plainKey := newTestOwnerKey(t)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	keyPEM, err := encryptOwnerKey(key, OWNER_KEY_FORMAT_PKCS8, []byte(testKeyFilePassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, err := newOwnerKeyFile((&url.URL{Scheme: "file", Path: path}).String(), "")
+	if err != nil {
+		t.Fatalf("newOwnerKeyFile() failed: %s", err.Error())
+	}
+	if err = keyFile.detectFormat(); err != nil || keyFile.format != OWNER_KEY_FORMAT_PKCS8 {
+		t.Fatalf("detectFormat() detected %s, %v, expected %s", keyFile.format, err, OWNER_KEY_FORMAT_PKCS8)
+	}
+	if err = keyFile.decrypt(testKeyFilePassphrase); err != nil {
+		t.Fatalf("decrypt() failed: %s", err.Error())
+	}
+	plainName, err := keyFile.plainName()
+	if err != nil {
+		t.Fatalf("plainName() failed: %s", err.Error())
+	}
+	plainURL, err := url.Parse(plainName)
+	if err != nil {
+		t.Fatalf("plainName() returned an invalid file URL: %s", err.Error())
+	}
+
+	// the plain key is passed through a pipe and not a file
+	if info, err := os.Lstat(plainURL.Path); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("the plain key file is not a named pipe: %v", err)
+	}
+	readKey, err := os.ReadFile(plainURL.Path)
+	if err != nil {
+		t.Fatalf("failed to read the plain key: %s", err.Error())
+	}
+	if string(readKey) != plainKey {
+		t.Errorf("the decrypted key passed through the pipe does not match the key")
+	}
+
+	keyFile.cleanup()
+	if _, err = os.Stat(filepath.Dir(plainURL.Path)); !os.IsNotExist(err) {
+		t.Errorf("the pipe was not removed: %v", err)
+	}
+}
+
+func TestOwnerKeyFileEncrypt(t *testing.T) {
+
+	newTestContext(t)
+	key, plainKey := newTestOwnerKey(t)
+
+	path := filepath.Join(t.TempDir(), "keys", "key.pem")
+	keyFile, err := newOwnerKeyFile(path, OWNER_KEY_FORMAT_ENCRYPTED_PEM)
+	if err != nil {
+		t.Fatalf("newOwnerKeyFile() failed: %s", err.Error())
+	}
+	if err = keyFile.receive(); err != nil {
+		t.Fatalf("receive() failed: %s", err.Error())
+	}
+	plainName, err := keyFile.plainName()
+	if err != nil {
+		t.Fatalf("plainName() failed: %s", err.Error())
+	}
+
+	// the config initializer writes the created key
+	if err = os.WriteFile(plainName, []byte(plainKey), 0600); err != nil {
+		t.Fatalf("failed to write the plain key: %s", err.Error())
+	}
+	if err = keyFile.encrypt(testKeyFilePassphrase); err != nil {
+		t.Fatalf("encrypt() failed: %s", err.Error())
+	}
+	keyFile.cleanup()
+
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("the key file was not saved: %s", err.Error())
+	}
+	if format, _ := ownerKeyFormat(keyPEM); format != OWNER_KEY_FORMAT_ENCRYPTED_PEM {
+		t.Errorf("the key file was saved as %s, expected %s", format, OWNER_KEY_FORMAT_ENCRYPTED_PEM)
+	}
+	readKey, err := readOwnerKey(keyPEM, []byte(testKeyFilePassphrase))
+	if err != nil {
+		t.Fatalf("readOwnerKey() of the saved key failed: %s", err.Error())
+	}
+	if readPublicKey, _ := readKey.GetPublicKeyPEM(); readPublicKey != mustPublicKeyPEM(t, key) {
+		t.Errorf("the saved key does not match the created key")
+	}
+}
+
+func TestOwnerKeyFileCleanupWithoutTransfer(t *testing.T) {
+
+	newTestContext(t)
+	key, _ := newTestOwnerKey(t)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	keyPEM, err := encryptOwnerKey(key, OWNER_KEY_FORMAT_PKCS8, []byte(testKeyFilePassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config initializer never opens the pipe
+	for _, start := range []func(keyFile *ownerKeyFile) error{
+		func(keyFile *ownerKeyFile) error { return keyFile.decrypt(testKeyFilePassphrase) },
+		func(keyFile *ownerKeyFile) error { return keyFile.receive() },
+	} {
+		keyFile, err := newOwnerKeyFile(path, OWNER_KEY_FORMAT_PKCS8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = start(keyFile); err != nil {
+			t.Fatalf("failed to start the transfer: %s", err.Error())
+		}
+		pipeDir := keyFile.pipeDir
+
+		keyFile.cleanup()
+		if _, err = os.Stat(pipeDir); !os.IsNotExist(err) {
+			t.Errorf("the pipe was not removed: %v", err)
+		}
+	}
+}
+
+func mustPublicKeyPEM(t *testing.T, key *crypto.RSAKey) string {
+	publicKey, err := key.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+func TestPromptKeyFilePassphraseWithoutDialog(t *testing.T) {
+
+	prompted := make(chan *string, 1)
+	go func() {
+		// no dialog host is registered for the context
+		prompted <- promptKeyFilePassphrase(0, &ownerKeyFile{path: "key.pem"}, false)
+	}()
+
+	select {
+	case passphrase := <-prompted:
+		if passphrase != nil {
+			t.Errorf("promptKeyFilePassphrase() returned a passphrase without a dialog")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("promptKeyFilePassphrase() did not return without a dialog")
+	}
+}
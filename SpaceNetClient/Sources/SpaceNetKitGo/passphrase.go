@@ -0,0 +1,270 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+//
+// static void onPassphraseChanged(void *func, void *ctx, const BOOL ok)
+// {
+//	 ((void(*)(void *, const BOOL))func)(ctx, ok);
+// }
+import "C"
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/mevansam/goutils/logger"
+	"gopkg.in/yaml.v2"
+)
+
+//export snChangeDeviceLockPassphrase
+func snChangeDeviceLockPassphrase(
+	context uintptr,
+	oldPassphrase, newPassphrase *C.char,
+	handler uintptr,
+) {
+	oldValue := C.GoString(oldPassphrase)
+	newValue := C.GoString(newPassphrase)
+
+	go func() {
+
+		ok := C.uchar(1)
+		err := changeDeviceLockPassphrase(oldValue, newValue)
+		auditLog(AUDIT_PASSPHRASE_CHANGE, "", err)
+		if err != nil {
+			ok = setLastError("snChangeDeviceLockPassphrase", err)
+		}
+		if handler != 0 {
+			C.onPassphraseChanged(
+				unsafe.Pointer(handler),
+				unsafe.Pointer(context),
+				ok,
+			)
+		}
+	}()
+}
+
+// re-encrypts the config file of the active profile with
+// a new passphrase. the config is written to a staging file
+// which replaces the config file only once it has been
+// verified. a copy of the previous file is retained until
+// the replaced config file has been verified readable.
+func changeDeviceLockPassphrase(oldPassphrase, newPassphrase string) error {
+
+	var (
+		err error
+
+		stagedConfig config.Config
+	)
+
+	cfg := currentConfig()
+	if cfg == nil || !cfg.HasPassphrase() {
+		return newError(SN_ERROR_LOCK, "the device is locked or does not have a lock passphrase")
+	}
+	if len(newPassphrase) == 0 {
+		return newError(SN_ERROR_VALIDATION, "the new passphrase cannot be empty")
+	}
+
+	// a save of the loaded config while the file is replaced
+	// would write it with the old passphrase so saves are
+	// blocked until the loaded config has the new passphrase
+	configSaveMx.Lock()
+	defer configSaveMx.Unlock()
+
+	configFile := activeProfileConfigFile()
+	ext := filepath.Ext(configFile)
+	stagingFile := strings.TrimSuffix(configFile, ext) + "-pending" + ext
+	rollbackFile := configFile + ".rollback"
+
+	if err = verifyConfigPassphrase(configFile, oldPassphrase); err != nil {
+		return err
+	}
+
+	// the file modification time is the seed of the config's
+	// encryption key so copies must retain the original time
+	if err = copyConfigFile(configFile, rollbackFile); err != nil {
+		return err
+	}
+	keepRollback := false
+	defer func() {
+		if !keepRollback {
+			_ = os.Remove(rollbackFile)
+		}
+	}()
+	if err = copyConfigFile(configFile, stagingFile); err != nil {
+		return err
+	}
+	defer os.Remove(stagingFile)
+
+	if stagedConfig, err = initFileConfig(
+		stagingFile,
+		func() string { return oldPassphrase },
+	); err != nil {
+		return err
+	}
+	if err = stagedConfig.Load(); err != nil {
+		return err
+	}
+	stagedConfig.SetPassphrase(newPassphrase)
+	if err = stagedConfig.Save(); err != nil {
+		return err
+	}
+	if err = verifyConfigPassphrase(stagingFile, newPassphrase); err != nil {
+		return err
+	}
+
+	if err = os.Rename(stagingFile, configFile); err != nil {
+		return err
+	}
+	if err = verifyConfigPassphrase(configFile, newPassphrase); err != nil {
+		logger.ErrorMessage("Restoring previous config file as the re-encrypted file is not readable: %s", err.Error())
+		if rollbackErr := os.Rename(rollbackFile, configFile); rollbackErr != nil {
+			logger.ErrorMessage("Failed to restore config file from '%s': %s", rollbackFile, rollbackErr.Error())
+			keepRollback = true
+		}
+		return err
+	}
+
+	// subsequent saves of the loaded
+	// config use the new passphrase
+	cfg.SetPassphrase(newPassphrase)
+	return nil
+}
+
+// verifies that the config file can be loaded with the given
+// passphrase by loading it the way the context is loaded
+func verifyConfigPassphrase(configFile, passphrase string) error {
+
+	var (
+		err error
+
+		verifyFile string
+		cfg        config.Config
+	)
+
+	// the file must exist and be readable as
+	// otherwise it would be replaced when loaded
+	if err = checkConfigFile(configFile); err != nil {
+		return err
+	}
+	// the passphrase saved with the file while the device is
+	// unlocked would be used instead of the given passphrase
+	// so a copy of the file without it is loaded
+	if verifyFile, err = copyConfigFileWithoutSavedKey(configFile); err != nil {
+		return storageError(err)
+	}
+	defer os.Remove(verifyFile)
+
+	passphraseUsed := false
+	if cfg, err = initFileConfig(
+		verifyFile,
+		func() string {
+			passphraseUsed = true
+			return passphrase
+		},
+	); err != nil {
+		return storageError(err)
+	}
+	if !passphraseUsed {
+		// the file is not protected by a passphrase
+		return newError(SN_ERROR_LOCK, "the config file was not unlocked with the passphrase")
+	}
+	if err = cfg.Load(); err != nil {
+		return newError(SN_ERROR_LOCK, "the passphrase is not valid for the config file")
+	}
+	return nil
+}
+
+// copies a config file, without the passphrase saved with it, to
+// a temporary file next to it retaining its modification time and
+// returns the name of the copy
+func copyConfigFileWithoutSavedKey(configFile string) (string, error) {
+
+	var (
+		err error
+
+		fileInfo os.FileInfo
+		data     []byte
+		values   yaml.MapSlice
+		out      *os.File
+	)
+
+	if fileInfo, err = os.Stat(configFile); err != nil {
+		return "", err
+	}
+	if data, err = os.ReadFile(configFile); err != nil {
+		return "", err
+	}
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		return "", err
+	}
+	copyValues := yaml.MapSlice{}
+	for _, item := range values {
+		if key, ok := item.Key.(string); !ok || !strings.EqualFold(key, "key") {
+			copyValues = append(copyValues, item)
+		}
+	}
+	if data, err = yaml.Marshal(copyValues); err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(configFile)
+	if out, err = os.CreateTemp(filepath.Dir(configFile), strings.TrimSuffix(filepath.Base(configFile), ext)+"-verify-*"+ext); err != nil {
+		return "", err
+	}
+	if _, err = out.Write(data); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err = os.Chtimes(out.Name(), fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// copies a config file retaining its modification time
+func copyConfigFile(src, dst string) error {
+
+	var (
+		err error
+
+		fileInfo os.FileInfo
+		in, out  *os.File
+	)
+
+	if fileInfo, err = os.Stat(src); err != nil {
+		return err
+	}
+	if in, err = os.Open(src); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if out, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fileInfo.ModTime(), fileInfo.ModTime())
+}
@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// protects the config of the test context with the test passphrase
+func (tc *testContext) setPassphrase(t *testing.T) {
+	tc.config.SetPassphrase(testPassphrase)
+	if err := saveConfig(tc.config); err != nil {
+		t.Fatalf("failed to save the config: %s", err.Error())
+	}
+}
+
+func TestChangeDeviceLockPassphrase(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.setPassphrase(t)
+	configFile := activeProfileConfigFile()
+
+	err := changeDeviceLockPassphrase("wrong passphrase", "new passphrase")
+	snErr := &snError{}
+	if !errors.As(err, &snErr) || snErr.Code != SN_ERROR_LOCK {
+		t.Errorf("changeDeviceLockPassphrase() error = %v, expected a lock error", err)
+	}
+	if err = verifyConfigPassphrase(configFile, testPassphrase); err != nil {
+		t.Fatalf("config is not readable with the old passphrase after a failed change: %s", err.Error())
+	}
+
+	if err = changeDeviceLockPassphrase(testPassphrase, "new passphrase"); err != nil {
+		t.Fatalf("changeDeviceLockPassphrase() failed: %s", err.Error())
+	}
+	if err = verifyConfigPassphrase(configFile, "new passphrase"); err != nil {
+		t.Errorf("config is not readable with the new passphrase: %s", err.Error())
+	}
+	if err = verifyConfigPassphrase(configFile, testPassphrase); err == nil {
+		t.Errorf("config is still readable with the old passphrase")
+	}
+
+	// the loaded config is saved with the new passphrase
+	if err = saveConfig(tc.config); err != nil {
+		t.Fatalf("failed to save the config: %s", err.Error())
+	}
+	if err = verifyConfigPassphrase(configFile, "new passphrase"); err != nil {
+		t.Errorf("loaded config was not saved with the new passphrase: %s", err.Error())
+	}
+}
+
+func TestChangeDeviceLockPassphraseWithSavedKey(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.config.SetPassphrase(testPassphrase)
+	// the passphrase is saved with the config while it is unlocked
+	tc.config.SetKeyTimeout(time.Hour)
+	if err := saveConfig(tc.config); err != nil {
+		t.Fatalf("failed to save the config: %s", err.Error())
+	}
+	configFile := activeProfileConfigFile()
+
+	if err := verifyConfigPassphrase(configFile, testPassphrase); err != nil {
+		t.Fatalf("config is not readable with its passphrase: %s", err.Error())
+	}
+	if err := verifyConfigPassphrase(configFile, "wrong passphrase"); errorCode(err) != SN_ERROR_LOCK {
+		t.Errorf("verifyConfigPassphrase() with a wrong passphrase returned %v, expected a lock error", err)
+	}
+
+	if err := changeDeviceLockPassphrase(testPassphrase, "new passphrase"); err != nil {
+		t.Fatalf("changeDeviceLockPassphrase() failed: %s", err.Error())
+	}
+	if err := verifyConfigPassphrase(configFile, "new passphrase"); err != nil {
+		t.Errorf("config is not readable with the new passphrase: %s", err.Error())
+	}
+	if err := verifyConfigPassphrase(configFile, testPassphrase); err == nil {
+		t.Errorf("config is still readable with the old passphrase")
+	}
+
+	// the copies used to verify the passphrase are removed
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(configFile), "*-verify-*")); len(matches) > 0 {
+		t.Errorf("the copies of the config file were not removed: %v", matches)
+	}
+}
+
+func TestVerifyConfigPassphraseUnreadableFile(t *testing.T) {
+
+	configFile := t.TempDir() + "/config.yml"
+	corrupt := []byte("authContext: [\n")
+	if err := os.WriteFile(configFile, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyConfigPassphrase(configFile, testPassphrase); err == nil {
+		t.Errorf("verifyConfigPassphrase() did not fail for an unreadable file")
+	}
+	if data, _ := os.ReadFile(configFile); string(data) != string(corrupt) {
+		t.Errorf("the unreadable config file was modified: %q", string(data))
+	}
+}
+
+// meant to be run with the race detector enabled
+func TestSaveDuringPassphraseChange(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.setPassphrase(t)
+
+	// saves of the loaded config made while the passphrase
+	// is changed must not write it with the old passphrase
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := saveConfig(tc.config); err != nil {
+					t.Errorf("saveConfig() failed: %s", err.Error())
+					return
+				}
+			}
+		}()
+	}
+	err := changeDeviceLockPassphrase(testPassphrase, "new passphrase")
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("changeDeviceLockPassphrase() failed: %s", err.Error())
+	}
+	if err = verifyConfigPassphrase(activeProfileConfigFile(), "new passphrase"); err != nil {
+		t.Errorf("config is not readable with the new passphrase: %s", err.Error())
+	}
+}
@@ -0,0 +1,436 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// typedef unsigned char SN_ERROR_CODE;
+import "C"
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/mevansam/goutils/logger"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	profilesMx sync.Mutex
+
+	profileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+)
+
+const (
+	DEFAULT_PROFILE = "default"
+
+	SN_REASON_PROFILE_SWITCHED = "profileSwitched"
+)
+
+// Profile metadata is saved to a file alongside the
+// default config file. Each profile has its own config
+// file with the default profile using the config file
+// at ~/.cb/config.yml for backwards compatibility.
+type profiles struct {
+	Active   string              `json:"active"`
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+type profile struct {
+	Name        string `json:"name"`
+	CreatedAt   int64  `json:"createdAt"`
+	Environment string `json:"environment,omitempty"`
+
+	// minutes the device remains unlocked while idle
+	UnlockedTimeout int `json:"unlockedTimeout,omitempty"`
+}
+
+// JSON representation of a profile
+// returned to the host application
+type profileInfo struct {
+	Name        string `json:"name"`
+	IsActive    bool   `json:"isActive"`
+	ConfigFile  string `json:"configFile"`
+	Environment string `json:"environment,omitempty"`
+}
+
+//export snListProfiles
+func snListProfiles() *C.char {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		_ = setLastError("snListProfiles", err)
+		return nil
+	}
+
+	names := make([]string, 0, len(p.Profiles))
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]profileInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, profileInfo{
+			Name:        name,
+			IsActive:    name == p.Active,
+			ConfigFile:  profileConfigFile(name),
+			Environment: p.Profiles[name].Environment,
+		})
+	}
+	profilesJSON, err := json.Marshal(infos)
+	if err != nil {
+		_ = setLastError("snListProfiles", err)
+		return nil
+	}
+	return C.CString(string(profilesJSON))
+}
+
+//export snActiveProfile
+func snActiveProfile() *C.char {
+	return C.CString(activeProfile())
+}
+
+//export snCreateProfile
+func snCreateProfile(name *C.char) C.SN_ERROR_CODE {
+	if err := createProfile(C.GoString(name)); err != nil {
+		return setLastErrorCode("snCreateProfile", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snDeleteProfile
+func snDeleteProfile(name *C.char) C.SN_ERROR_CODE {
+	if err := deleteProfile(C.GoString(name)); err != nil {
+		return setLastErrorCode("snDeleteProfile", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snSwitchProfile
+func snSwitchProfile(name *C.char) C.SN_ERROR_CODE {
+
+	profileName := C.GoString(name)
+	// the switch is only persisted once the config
+	// of the new profile is known to be loadable
+	if err := verifyProfileConfig(profileName); err != nil {
+		return setLastErrorCode("snSwitchProfile", err)
+	}
+	if err := setActiveProfile(profileName); err != nil {
+		return setLastErrorCode("snSwitchProfile", err)
+	}
+
+	// tear down the state of the previous profile
+	// and initialize the context of the new profile
+	resetContext()
+	postStatusChange(SN_CFG_STATUS_LOGGED_OUT, SN_REASON_PROFILE_SWITCHED, nil)
+
+	if code := snInitializeContext(nil); code != SN_ERROR_NONE {
+		return code
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// releases all state associated with the loaded configuration
+func resetContext() {
+	stopIdleTimer()
+	stopTokenRefresher()
+	disconnectAllSpaces()
+	resetSpaceNodes()
+	stopMonitors()
+
+	setConfig(nil)
+
+	resetEnvironment()
+}
+
+// returns the name of the active profile
+func activeProfile() string {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		logger.ErrorMessage("Failed to load profiles: %s", err.Error())
+		return DEFAULT_PROFILE
+	}
+	return p.Active
+}
+
+// returns the path of the config file of the active profile
+func activeProfileConfigFile() string {
+	return profileConfigFile(activeProfile())
+}
+
+func profileConfigFile(name string) string {
+	if name == DEFAULT_PROFILE {
+		return filepath.Join(homeDir, ".cb", "config.yml")
+	}
+	return filepath.Join(profileDir(name), "config.yml")
+}
+
+func profileDir(name string) string {
+	return filepath.Join(homeDir, ".cb", "profiles", name)
+}
+
+func createProfile(name string) error {
+
+	if !profileNamePattern.MatchString(name) {
+		return newError(SN_ERROR_VALIDATION, "invalid profile name '%s'", name)
+	}
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, exists := p.Profiles[name]; exists {
+		return newError(SN_ERROR_VALIDATION, "profile '%s' already exists", name)
+	}
+	if err = os.MkdirAll(profileDir(name), 0700); err != nil {
+		return err
+	}
+	p.Profiles[name] = &profile{
+		Name:      name,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	return p.save()
+}
+
+func deleteProfile(name string) error {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, exists := p.Profiles[name]; !exists {
+		return newError(SN_ERROR_VALIDATION, "profile '%s' does not exist", name)
+	}
+	if name == DEFAULT_PROFILE {
+		return newError(SN_ERROR_VALIDATION, "the default profile cannot be deleted")
+	}
+	if name == p.Active {
+		return newError(SN_ERROR_VALIDATION, "the active profile cannot be deleted")
+	}
+	if err = os.RemoveAll(profileDir(name)); err != nil {
+		return err
+	}
+	delete(p.Profiles, name)
+	return p.save()
+}
+
+// returns the name of the environment selected
+// for the active profile or an empty string if
+// the default environment should be used
+func profileEnvironment() string {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		logger.ErrorMessage("Failed to load profiles: %s", err.Error())
+		return ""
+	}
+	return p.Profiles[p.Active].Environment
+}
+
+// persists the environment selected for the active profile
+func setProfileEnvironment(envName string) error {
+
+	envs, err := loadEnvironments()
+	if err != nil {
+		return err
+	}
+	if _, exists := envs[envName]; !exists {
+		return newError(SN_ERROR_VALIDATION, "environment '%s' does not exist", envName)
+	}
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	p.Profiles[p.Active].Environment = envName
+	return p.save()
+}
+
+// returns the time the active profile remains unlocked
+// while idle as last saved with the device settings
+func profileUnlockedTimeout() time.Duration {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		logger.ErrorMessage("Failed to load profiles: %s", err.Error())
+		return DEFAULT_UNLOCKED_TIMEOUT
+	}
+	if timeout := p.Profiles[p.Active].UnlockedTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Minute
+	}
+	return DEFAULT_UNLOCKED_TIMEOUT
+}
+
+// persists the unlocked timeout in minutes of the active profile
+func setProfileUnlockedTimeout(minutes int) error {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	p.Profiles[p.Active].UnlockedTimeout = minutes
+	return p.save()
+}
+
+// verifies that the config of a profile can be loaded. a
+// config protected by a device lock passphrase cannot be
+// loaded until it is unlocked so only its file is read.
+func verifyProfileConfig(name string) error {
+
+	var (
+		err error
+
+		cfg config.Config
+	)
+
+	profilesMx.Lock()
+	p, err := loadProfiles()
+	profilesMx.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, exists := p.Profiles[name]; !exists {
+		return newError(SN_ERROR_VALIDATION, "profile '%s' does not exist", name)
+	}
+
+	// an unreadable config would be replaced with
+	// an empty config when it is initialized
+	configFile := profileConfigFile(name)
+	if err = checkConfigFile(configFile); err != nil && !os.IsNotExist(err) {
+		return newError(SN_ERROR_STORAGE, "the config of profile '%s' cannot be read: %s", name, err.Error())
+	}
+
+	needsPassphrase := false
+	if cfg, err = initFileConfig(
+		configFile,
+		func() string {
+			needsPassphrase = true
+			return ""
+		},
+	); err != nil {
+		return storageError(err)
+	}
+	if !needsPassphrase {
+		if err = cfg.Load(); err != nil {
+			return newError(SN_ERROR_STORAGE, "the config of profile '%s' cannot be loaded: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// returns an error if the config file does not exist or
+// cannot be parsed. config files that cannot be parsed are
+// replaced with an empty config when they are initialized.
+func checkConfigFile(configFile string) error {
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	return yaml.Unmarshal(data, &values)
+}
+
+func setActiveProfile(name string) error {
+
+	profilesMx.Lock()
+	defer profilesMx.Unlock()
+
+	p, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, exists := p.Profiles[name]; !exists {
+		return newError(SN_ERROR_VALIDATION, "profile '%s' does not exist", name)
+	}
+	p.Active = name
+	return p.save()
+}
+
+func profilesFile() string {
+	return filepath.Join(homeDir, ".cb", "spacenet-profiles.json")
+}
+
+// loads the profile metadata. must be
+// called with the profiles mutex held.
+func loadProfiles() (*profiles, error) {
+
+	p := &profiles{
+		Active: DEFAULT_PROFILE,
+		Profiles: map[string]*profile{
+			DEFAULT_PROFILE: {Name: DEFAULT_PROFILE},
+		},
+	}
+
+	data, err := os.ReadFile(profilesFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if _, exists := p.Profiles[DEFAULT_PROFILE]; !exists {
+		p.Profiles[DEFAULT_PROFILE] = &profile{Name: DEFAULT_PROFILE}
+	}
+	if _, exists := p.Profiles[p.Active]; !exists {
+		logger.ErrorMessage("Active profile '%s' does not exist. Using default profile.", p.Active)
+		p.Active = DEFAULT_PROFILE
+	}
+	return p, nil
+}
+
+// saves the profile metadata. must be
+// called with the profiles mutex held.
+func (p *profiles) save() error {
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(profilesFile()), 0700); err != nil {
+		return err
+	}
+	// write to a temporary file and rename so
+	// a failed write does not corrupt the file
+	tmpFile := profilesFile() + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, profilesFile())
+}
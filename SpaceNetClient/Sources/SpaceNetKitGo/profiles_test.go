@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyProfileConfig(t *testing.T) {
+
+	newTestContext(t)
+
+	if err := createProfile("work"); err != nil {
+		t.Fatalf("createProfile() failed: %s", err.Error())
+	}
+	if err := verifyProfileConfig("work"); err != nil {
+		t.Errorf("verifyProfileConfig() failed for a new profile: %s", err.Error())
+	}
+
+	err := verifyProfileConfig("unknown")
+	snErr := &snError{}
+	if !errors.As(err, &snErr) || snErr.Code != SN_ERROR_VALIDATION {
+		t.Errorf("verifyProfileConfig() error = %v, expected a validation error", err)
+	}
+}
+
+func TestVerifyUnreadableProfileConfig(t *testing.T) {
+
+	newTestContext(t)
+
+	if err := createProfile("work"); err != nil {
+		t.Fatalf("createProfile() failed: %s", err.Error())
+	}
+	configFile := profileConfigFile("work")
+	if err := os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := []byte("initialized: [true\n")
+	if err := os.WriteFile(configFile, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := verifyProfileConfig("work")
+	snErr := &snError{}
+	if !errors.As(err, &snErr) || snErr.Code != SN_ERROR_STORAGE {
+		t.Errorf("verifyProfileConfig() error = %v, expected a storage error", err)
+	}
+	// the unreadable config must be left as is
+	if data, _ := os.ReadFile(configFile); string(data) != string(corrupt) {
+		t.Errorf("the unreadable config was modified: %q", string(data))
+	}
+	if name := activeProfile(); name != DEFAULT_PROFILE {
+		t.Errorf("active profile is '%s' after a failed verification", name)
+	}
+}
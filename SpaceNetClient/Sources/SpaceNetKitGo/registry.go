@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// all registries that should be
+	// checked for leaked entries
+	leakCheckedRegistries   = []leakChecker{}
+	leakCheckedRegistriesMx sync.Mutex
+)
+
+const (
+	REGISTRY_LEAK_CHECK_INTERVAL = 5 * time.Minute
+)
+
+// A registry holds state shared with the host application
+// via cgo. Entries are added and removed by exported calls
+// made on arbitrary host threads and read by goroutines so
+// all access is synchronized.
+type registry[K comparable, V any] struct {
+	name string
+
+	mx      sync.RWMutex
+	entries map[K]*registryEntry[V]
+
+	// entries held longer than this
+	// are reported as possible leaks
+	maxAge time.Duration
+}
+
+type registryEntry[V any] struct {
+	value      V
+	registered time.Time
+}
+
+type registryItem[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+type leakChecker interface {
+	checkLeaks(now time.Time)
+}
+
+// creates a new registry. if maxAge is greater than
+// zero then entries older than maxAge will be logged
+// as leaked by the periodic leak check.
+func newRegistry[K comparable, V any](name string, maxAge time.Duration) *registry[K, V] {
+
+	r := &registry[K, V]{
+		name:    name,
+		entries: make(map[K]*registryEntry[V]),
+		maxAge:  maxAge,
+	}
+	if maxAge > 0 {
+		leakCheckedRegistriesMx.Lock()
+		leakCheckedRegistries = append(leakCheckedRegistries, r)
+		leakCheckedRegistriesMx.Unlock()
+	}
+	return r
+}
+
+// adds or replaces the entry with the given key
+func (r *registry[K, V]) register(key K, value V) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.entries[key] = &registryEntry[V]{
+		value:      value,
+		registered: time.Now(),
+	}
+}
+
+// adds the entry only if no entry with the given key
+// exists returning whether the entry was added
+func (r *registry[K, V]) registerIfAbsent(key K, value V) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if _, exists := r.entries[key]; exists {
+		return false
+	}
+	r.entries[key] = &registryEntry[V]{
+		value:      value,
+		registered: time.Now(),
+	}
+	return true
+}
+
+// removes the entry with the given key returning
+// its value and whether the entry existed
+func (r *registry[K, V]) unregister(key K) (V, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	entry, exists := r.entries[key]
+	if !exists {
+		var none V
+		return none, false
+	}
+	delete(r.entries, key)
+	return entry.value, true
+}
+
+// returns the value of the entry with the given key
+func (r *registry[K, V]) lookup(key K) (V, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	entry, exists := r.entries[key]
+	if !exists {
+		var none V
+		return none, false
+	}
+	return entry.value, true
+}
+
+// atomically replaces the value of an existing entry
+// with the result of the given update function. the
+// entry's registration time is retained.
+func (r *registry[K, V]) update(key K, updateFn func(V) V) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	entry, exists := r.entries[key]
+	if !exists {
+		return false
+	}
+	entry.value = updateFn(entry.value)
+	return true
+}
+
+// returns a snapshot of the registered entries which
+// can be safely iterated without holding the lock
+func (r *registry[K, V]) snapshot() []registryItem[K, V] {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	items := make([]registryItem[K, V], 0, len(r.entries))
+	for key, entry := range r.entries {
+		items = append(items, registryItem[K, V]{key, entry.value})
+	}
+	return items
+}
+
+func (r *registry[K, V]) count() int {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	return len(r.entries)
+}
+
+// returns the keys of entries registered longer than maxAge
+func (r *registry[K, V]) leaked(now time.Time) []K {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	leaked := []K{}
+	for key, entry := range r.entries {
+		if now.Sub(entry.registered) > r.maxAge {
+			leaked = append(leaked, key)
+		}
+	}
+	return leaked
+}
+
+func (r *registry[K, V]) checkLeaks(now time.Time) {
+	for _, key := range r.leaked(now) {
+		logger.WarnMessage(
+			"Registry '%s' entry '%v' has been held longer than %s and may have leaked",
+			r.name, key, r.maxAge.String(),
+		)
+	}
+}
+
+// periodically logs entries of registries that
+// have been held longer than their maximum age
+func startRegistryLeakDetector(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			leakCheckedRegistriesMx.Lock()
+			checkers := make([]leakChecker, len(leakCheckedRegistries))
+			copy(checkers, leakCheckedRegistries)
+			leakCheckedRegistriesMx.Unlock()
+
+			for _, c := range checkers {
+				c.checkLeaks(now)
+			}
+		}
+	}()
+}
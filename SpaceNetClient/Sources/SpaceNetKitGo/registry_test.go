@@ -0,0 +1,183 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// these tests are meant to be run with the race
+// detector enabled i.e. "go test -race"
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+
+	const (
+		workers    = 16
+		iterations = 500
+	)
+
+	r := newRegistry[int, int]("test", 0)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < iterations; i++ {
+				key := w*iterations + i
+				r.register(key, i)
+				if value, ok := r.lookup(key); !ok || value != i {
+					t.Errorf("lookup(%d) = %d, %t after register", key, value, ok)
+				}
+				r.update(key, func(value int) int { return value + 1 })
+				_ = r.snapshot()
+				_ = r.count()
+				if value, ok := r.unregister(key); !ok || value != i+1 {
+					t.Errorf("unregister(%d) = %d, %t after update", key, value, ok)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if count := r.count(); count != 0 {
+		t.Errorf("registry has %d entries after all were unregistered", count)
+	}
+}
+
+func TestRegistryConcurrentUnregister(t *testing.T) {
+
+	const workers = 16
+
+	r := newRegistry[string, string]("test", 0)
+	r.register("key", "value")
+
+	// only one of the concurrent callers
+	// may remove and receive the entry
+	var (
+		wg      sync.WaitGroup
+		mx      sync.Mutex
+		removed int
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := r.unregister("key"); ok {
+				mx.Lock()
+				removed++
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if removed != 1 {
+		t.Errorf("entry was removed %d times, expected once", removed)
+	}
+}
+
+func TestRegistryRegisterIfAbsent(t *testing.T) {
+
+	const workers = 16
+
+	r := newRegistry[int, int]("test", 0)
+
+	var (
+		wg    sync.WaitGroup
+		mx    sync.Mutex
+		added []int
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if r.registerIfAbsent(0, w) {
+				mx.Lock()
+				added = append(added, w)
+				mx.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(added) != 1 {
+		t.Fatalf("entry was added %d times, expected once", len(added))
+	}
+	if value, _ := r.lookup(0); value != added[0] {
+		t.Errorf("entry has value %d, expected %d", value, added[0])
+	}
+}
+
+func TestRegistryUpdateMissingEntry(t *testing.T) {
+
+	r := newRegistry[int, int]("test", 0)
+	if r.update(1, func(value int) int { return value + 1 }) {
+		t.Errorf("update() of a missing entry returned true")
+	}
+	if _, ok := r.lookup(1); ok {
+		t.Errorf("update() of a missing entry added it")
+	}
+}
+
+func TestRegistryLeaked(t *testing.T) {
+
+	r := newRegistry[int, string]("test", time.Minute)
+	r.register(1, "old")
+	r.register(2, "old")
+	r.register(3, "new")
+
+	r.mx.Lock()
+	r.entries[1].registered = time.Now().Add(-2 * time.Minute)
+	r.entries[2].registered = time.Now().Add(-2 * time.Minute)
+	r.mx.Unlock()
+
+	// updating an entry does not reset its age
+	r.update(2, func(value string) string { return "updated" })
+
+	leaked := r.leaked(time.Now())
+	sort.Ints(leaked)
+	if len(leaked) != 2 || leaked[0] != 1 || leaked[1] != 2 {
+		t.Errorf("leaked() = %v, expected [1 2]", leaked)
+	}
+
+	leakCheckedRegistriesMx.Lock()
+	found := false
+	for _, c := range leakCheckedRegistries {
+		if c == r {
+			found = true
+		}
+	}
+	leakCheckedRegistriesMx.Unlock()
+	if !found {
+		t.Errorf("registry with a maximum age was not added to the leak check")
+	}
+}
+
+func TestStatusSubscribersWithSameContext(t *testing.T) {
+
+	bus := newStatusEventBus()
+
+	// handlers registered with the same context
+	// must not replace each other
+	id1 := bus.subscribe(1, 1)
+	id2 := bus.subscribe(1, 2)
+	if id1 == id2 {
+		t.Fatalf("subscribers with the same context have the same id %d", id1)
+	}
+	if count := bus.subscribers.count(); count != 2 {
+		t.Fatalf("bus has %d subscribers, expected 2", count)
+	}
+
+	bus.unsubscribe(id1)
+	if sub, ok := bus.subscribers.lookup(id2); !ok || sub.handler != 2 {
+		t.Errorf("unsubscribing one handler removed the other handler with the same context")
+	}
+}
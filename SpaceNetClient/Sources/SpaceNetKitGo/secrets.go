@@ -0,0 +1,496 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+// typedef unsigned char SN_ERROR_CODE;
+//
+// static BOOL getHostSecret(void *func, void *ctx, const char *name, char **value)
+// {
+//	 return ((BOOL(*)(void *, const char *, char **))func)(ctx, name, value);
+// }
+// static BOOL setHostSecret(void *func, void *ctx, const char *name, const char *value)
+// {
+//	 return ((BOOL(*)(void *, const char *, const char *))func)(ctx, name, value);
+// }
+// static BOOL deleteHostSecret(void *func, void *ctx, const char *name)
+// {
+//	 return ((BOOL(*)(void *, const char *))func)(ctx, name);
+// }
+import "C"
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/mevansam/goutils/crypto"
+	"github.com/mevansam/goutils/logger"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// the store the system passphrase is retrieved from.
+	// if nil the passphrase provided by the environment
+	// or the cloud-builder default is used.
+	activeSecretStore secretStore
+	secretStoreMx     sync.Mutex
+
+	// the cloud-builder default system passphrase
+	defaultSystemPassphrase config.GetSystemPassphrase
+)
+
+const (
+	// name of the secret used to encrypt
+	// the keys saved with the configuration
+	SYSTEM_PASSPHRASE_SECRET = "systemPassphrase"
+
+	SYSTEM_PASSPHRASE_LENGTH = 32
+
+	// scrypt parameters of the key derived from
+	// the passphrase of a file secret store
+	SECRET_STORE_KEY_N    = 32768
+	SECRET_STORE_KEY_R    = 8
+	SECRET_STORE_KEY_P    = 1
+	SECRET_STORE_SALT_LEN = 16
+)
+
+// A store of secrets such as the system passphrase
+// which must not be kept in the host's environment
+type secretStore interface {
+	// returns the secret with the given name
+	// and whether it exists in the store
+	Get(name string) (string, bool, error)
+	Set(name, value string) error
+	Delete(name string) error
+}
+
+// stores secrets in a file encrypted with a key that is
+// derived from a passphrase and a salt saved next to the
+// store or that is read from a key file next to the store.
+// both files are only readable by the user.
+type fileSecretStore struct {
+	path string
+	key  []byte
+
+	mx sync.Mutex
+}
+
+// stores secrets in memory only
+type memorySecretStore struct {
+	secrets map[string]string
+	mx      sync.Mutex
+}
+
+// retrieves secrets from the host application i.e.
+// from the Keychain via callbacks into the host
+type hostSecretStore struct {
+	context uintptr
+
+	getFunc,
+	setFunc,
+	deleteFunc uintptr
+}
+
+//export snUseFileSecretStore
+func snUseFileSecretStore(path, passphrase *C.char) C.SN_ERROR_CODE {
+
+	storePath := filepath.Join(homeDir, ".cb", "spacenet-secrets")
+	if path != nil && len(C.GoString(path)) > 0 {
+		storePath = C.GoString(path)
+	}
+	keyPassphrase := ""
+	if passphrase != nil {
+		keyPassphrase = C.GoString(passphrase)
+	}
+
+	store, err := newFileSecretStore(storePath, keyPassphrase)
+	if err != nil {
+		return setLastErrorCode("snUseFileSecretStore", storageError(err))
+	}
+	if err = setSecretStore(store); err != nil {
+		return setLastErrorCode("snUseFileSecretStore", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snUseMemorySecretStore
+func snUseMemorySecretStore(systemPassphrase *C.char) C.SN_ERROR_CODE {
+
+	store := newMemorySecretStore()
+	if systemPassphrase != nil && len(C.GoString(systemPassphrase)) > 0 {
+		_ = store.Set(SYSTEM_PASSPHRASE_SECRET, C.GoString(systemPassphrase))
+	}
+	if err := setSecretStore(store); err != nil {
+		return setLastErrorCode("snUseMemorySecretStore", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+//export snUseHostSecretStore
+func snUseHostSecretStore(context, getFunc, setFunc, deleteFunc uintptr) C.SN_ERROR_CODE {
+
+	if getFunc == 0 || setFunc == 0 || deleteFunc == 0 {
+		return setLastErrorCode("snUseHostSecretStore", newError(SN_ERROR_VALIDATION, "get, set and delete secret functions are required"))
+	}
+	store := &hostSecretStore{
+		context:    context,
+		getFunc:    getFunc,
+		setFunc:    setFunc,
+		deleteFunc: deleteFunc,
+	}
+	if err := setSecretStore(store); err != nil {
+		return setLastErrorCode("snUseHostSecretStore", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// installs the system passphrase provider. the passphrase
+// is taken from the active secret store if one has been
+// selected otherwise from the environment for backwards
+// compatibility or the cloud-builder default.
+func initSystemPassphrase() {
+
+	defaultSystemPassphrase = config.SystemPassphrase
+	if systemPassphrase := os.Getenv("CBS_SYSTEM_PASSPHRASE"); len(systemPassphrase) > 0 {
+		defaultSystemPassphrase = func() string {
+			return systemPassphrase
+		}
+	}
+	config.SystemPassphrase = getSystemPassphrase
+}
+
+// selects the store the system passphrase is retrieved from.
+// the store must be selected before the context is initialized
+// as the passphrase is read when the configuration is loaded.
+func setSecretStore(store secretStore) error {
+
+	if currentConfig() != nil {
+		return newError(SN_ERROR_VALIDATION, "the secret store must be selected before the context is initialized")
+	}
+
+	secretStoreMx.Lock()
+	defer secretStoreMx.Unlock()
+
+	activeSecretStore = store
+	return nil
+}
+
+// returns the system passphrase or an empty passphrase if it
+// cannot be retrieved from the active secret store. the default
+// is not used in that case as keys would then be saved with the
+// configuration encrypted with a passphrase that is not secret.
+// configs are only initialized via initFileConfig which fails
+// before the passphrase is read if the store is unavailable.
+func getSystemPassphrase() string {
+
+	passphrase, err := systemPassphrase()
+	if err != nil {
+		logger.ErrorMessage("Unable to retrieve system passphrase from secret store: %s", err.Error())
+		return ""
+	}
+	return passphrase
+}
+
+// initializes the config of the given file once it is known that
+// the system passphrase, which encrypts the keys saved with the
+// config, can be retrieved. a config must only be initialized via
+// this function as otherwise its keys would be read and saved
+// with an empty passphrase if the secret store is unavailable.
+func initFileConfig(configFile string, getPassphrase config.GetPassphrase) (config.Config, error) {
+
+	if _, err := systemPassphrase(); err != nil {
+		return nil, err
+	}
+	return config.InitFileConfig(configFile, nil, getPassphrase, nil)
+}
+
+// returns the system passphrase from the active secret
+// store if one has been selected otherwise the default
+func systemPassphrase() (string, error) {
+
+	secretStoreMx.Lock()
+	store := activeSecretStore
+	secretStoreMx.Unlock()
+
+	if store == nil {
+		return defaultSystemPassphrase(), nil
+	}
+	passphrase, err := systemPassphraseFromStore(store)
+	if err != nil {
+		return "", storageError(err)
+	}
+	return passphrase, nil
+}
+
+// returns the system passphrase saved in the store
+// creating a random passphrase if one does not exist
+func systemPassphraseFromStore(store secretStore) (string, error) {
+	return randomSecretFromStore(store, SYSTEM_PASSPHRASE_SECRET, SYSTEM_PASSPHRASE_LENGTH)
+}
+
+// returns the base64 encoded secret with the given name
+// saved in the store creating a secret of the given number
+// of random bytes if one does not exist
+func randomSecretFromStore(store secretStore, name string, size int) (string, error) {
+
+	secret, exists, err := store.Get(name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return secret, nil
+	}
+
+	key, err := crypto.RandomKey(size)
+	if err != nil {
+		return "", err
+	}
+	secret = base64.StdEncoding.EncodeToString(key)
+	if err = store.Set(name, secret); err != nil {
+		return "", err
+	}
+	logger.DebugMessage("Created new secret '%s' in secret store", name)
+	return secret, nil
+}
+
+// creates a file secret store. if a passphrase is given the
+// key is derived from it and a random salt that is saved to a
+// salt file next to the store. otherwise a random key is saved
+// to a key file next to the store. both are only readable by
+// the user.
+func newFileSecretStore(path, passphrase string) (*fileSecretStore, error) {
+
+	var (
+		err error
+
+		salt []byte
+	)
+
+	store := &fileSecretStore{path: path}
+	if len(passphrase) > 0 {
+		if salt, err = readOrCreateRandomFile(path+".salt", SECRET_STORE_SALT_LEN); err != nil {
+			return nil, err
+		}
+		if store.key, err = scrypt.Key([]byte(passphrase), salt, SECRET_STORE_KEY_N, SECRET_STORE_KEY_R, SECRET_STORE_KEY_P, 32); err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	if store.key, err = readOrCreateRandomFile(path+".key", 32); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// returns the contents of the given file creating it
+// with the given number of random bytes if it does
+// not exist
+func readOrCreateRandomFile(path string, size int) ([]byte, error) {
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if data, err = crypto.RandomKey(size); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *fileSecretStore) Get(name string) (string, bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return "", false, err
+	}
+	value, exists := secrets[name]
+	return value, exists, nil
+}
+
+func (s *fileSecretStore) Set(name, value string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	secrets[name] = value
+	return s.save(secrets)
+}
+
+func (s *fileSecretStore) Delete(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	delete(secrets, name)
+	return s.save(secrets)
+}
+
+func (s *fileSecretStore) load() (map[string]string, error) {
+
+	secrets := make(map[string]string)
+
+	cipherData, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secrets, nil
+		}
+		return nil, err
+	}
+	crypt, err := crypto.NewCrypt(s.key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := crypt.Decrypt(cipherData)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func (s *fileSecretStore) save(secrets map[string]string) error {
+
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	crypt, err := crypto.NewCrypt(s.key)
+	if err != nil {
+		return err
+	}
+	cipherData, err := crypt.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmpFile := s.path + ".tmp"
+	if err = os.WriteFile(tmpFile, cipherData, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.path)
+}
+
+func newMemorySecretStore() *memorySecretStore {
+	return &memorySecretStore{
+		secrets: make(map[string]string),
+	}
+}
+
+func (s *memorySecretStore) Get(name string) (string, bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	value, exists := s.secrets[name]
+	return value, exists, nil
+}
+
+func (s *memorySecretStore) Set(name, value string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.secrets[name] = value
+	return nil
+}
+
+func (s *memorySecretStore) Delete(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	delete(s.secrets, name)
+	return nil
+}
+
+// the host returns false if the secret could not be read.
+// otherwise it sets the value to a copy of the secret
+// allocated with malloc which is freed once it has been
+// read or to NULL if the secret does not exist.
+func (s *hostSecretStore) Get(name string) (string, bool, error) {
+
+	var (
+		cValue *C.char
+	)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	if C.getHostSecret(
+		unsafe.Pointer(s.getFunc),
+		unsafe.Pointer(s.context),
+		cName,
+		&cValue,
+	) == 0 {
+		if cValue != nil {
+			C.free(unsafe.Pointer(cValue))
+		}
+		return "", false, newError(SN_ERROR_STORAGE, "host failed to read secret '%s'", name)
+	}
+	if cValue == nil {
+		return "", false, nil
+	}
+	defer C.free(unsafe.Pointer(cValue))
+	return C.GoString(cValue), true, nil
+}
+
+func (s *hostSecretStore) Set(name, value string) error {
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+
+	if C.setHostSecret(
+		unsafe.Pointer(s.setFunc),
+		unsafe.Pointer(s.context),
+		cName,
+		cValue,
+	) == 0 {
+		return newError(SN_ERROR_STORAGE, "host failed to save secret '%s'", name)
+	}
+	return nil
+}
+
+func (s *hostSecretStore) Delete(name string) error {
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	if C.deleteHostSecret(
+		unsafe.Pointer(s.deleteFunc),
+		unsafe.Pointer(s.context),
+		cName,
+	) == 0 {
+		return newError(SN_ERROR_STORAGE, "host failed to delete secret '%s'", name)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a secret store that fails to read secrets
+type failingSecretStore struct {
+	memorySecretStore
+}
+
+func (s *failingSecretStore) Get(name string) (string, bool, error) {
+	return "", false, errors.New("secret store is unavailable")
+}
+
+// selects the given secret store for the duration of a test
+func useSecretStore(t *testing.T, store secretStore) {
+
+	secretStoreMx.Lock()
+	prevStore := activeSecretStore
+	activeSecretStore = store
+	secretStoreMx.Unlock()
+
+	t.Cleanup(func() {
+		secretStoreMx.Lock()
+		activeSecretStore = prevStore
+		secretStoreMx.Unlock()
+	})
+}
+
+func TestMemorySecretStore(t *testing.T) {
+
+	store := newMemorySecretStore()
+	if _, exists, err := store.Get("name"); exists || err != nil {
+		t.Errorf("Get() of a missing secret = %t, %v", exists, err)
+	}
+	if err := store.Set("name", "value"); err != nil {
+		t.Fatalf("Set() failed: %s", err.Error())
+	}
+	if value, exists, err := store.Get("name"); !exists || err != nil || value != "value" {
+		t.Errorf("Get() = %q, %t, %v, expected the saved secret", value, exists, err)
+	}
+	if err := store.Delete("name"); err != nil {
+		t.Fatalf("Delete() failed: %s", err.Error())
+	}
+	if _, exists, _ := store.Get("name"); exists {
+		t.Errorf("deleted secret still exists")
+	}
+}
+
+func TestSystemPassphraseFromStore(t *testing.T) {
+
+	store := newMemorySecretStore()
+	useSecretStore(t, store)
+
+	// a passphrase is created in a store that does not have one
+	passphrase := getSystemPassphrase()
+	if len(passphrase) == 0 || passphrase == defaultSystemPassphrase() {
+		t.Fatalf("getSystemPassphrase() = %q, expected a new random passphrase", passphrase)
+	}
+	if saved, exists, _ := store.Get(SYSTEM_PASSPHRASE_SECRET); !exists || saved != passphrase {
+		t.Errorf("the created passphrase was not saved in the store")
+	}
+	if getSystemPassphrase() != passphrase {
+		t.Errorf("getSystemPassphrase() did not return the saved passphrase")
+	}
+}
+
+func TestSystemPassphraseStoreFailure(t *testing.T) {
+
+	useSecretStore(t, &failingSecretStore{})
+
+	// the default is not used if the store is unavailable
+	if passphrase := getSystemPassphrase(); passphrase != "" {
+		t.Errorf("getSystemPassphrase() = %q when the store is unavailable, expected no passphrase", passphrase)
+	}
+	if _, err := systemPassphrase(); errorCode(err) != SN_ERROR_STORAGE {
+		t.Errorf("systemPassphrase() error = %v, expected a storage error", err)
+	}
+}
+
+func TestConfigNotInitializedWithoutSecretStore(t *testing.T) {
+
+	tc := newTestContext(t)
+	tc.setPassphrase(t)
+	configFile := activeProfileConfigFile()
+	saved, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useSecretStore(t, &failingSecretStore{})
+
+	if err = verifyConfigPassphrase(configFile, testPassphrase); errorCode(err) != SN_ERROR_STORAGE {
+		t.Errorf("verifyConfigPassphrase() error = %v, expected a storage error", err)
+	}
+	if err = changeDeviceLockPassphrase(testPassphrase, "new passphrase"); errorCode(err) != SN_ERROR_STORAGE {
+		t.Errorf("changeDeviceLockPassphrase() error = %v, expected a storage error", err)
+	}
+	if err = verifyProfileConfig(DEFAULT_PROFILE); errorCode(err) != SN_ERROR_STORAGE {
+		t.Errorf("verifyProfileConfig() error = %v, expected a storage error", err)
+	}
+	if data, _ := os.ReadFile(configFile); string(data) != string(saved) {
+		t.Errorf("the config file was modified while the secret store was unavailable")
+	}
+}
+
+func TestFileSecretStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "secrets")
+
+	store, err := newFileSecretStore(path, "store passphrase")
+	if err != nil {
+		t.Fatalf("newFileSecretStore() failed: %s", err.Error())
+	}
+	if err = store.Set("name", "value"); err != nil {
+		t.Fatalf("Set() failed: %s", err.Error())
+	}
+	info, err := os.Stat(path + ".salt")
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("salt file was not created readable only by the user: %v", err)
+	}
+
+	// the store is read with a key derived from the same passphrase and salt
+	if store, err = newFileSecretStore(path, "store passphrase"); err != nil {
+		t.Fatalf("newFileSecretStore() failed: %s", err.Error())
+	}
+	if value, exists, err := store.Get("name"); !exists || err != nil || value != "value" {
+		t.Errorf("Get() = %q, %t, %v after reopening the store", value, exists, err)
+	}
+	if store, err = newFileSecretStore(path, "wrong passphrase"); err != nil {
+		t.Fatalf("newFileSecretStore() failed: %s", err.Error())
+	}
+	if _, _, err = store.Get("name"); err == nil {
+		t.Errorf("store was read with a wrong passphrase")
+	}
+
+	// a store without a passphrase uses a random key file
+	keyPath := filepath.Join(t.TempDir(), "secrets")
+	if store, err = newFileSecretStore(keyPath, ""); err != nil {
+		t.Fatalf("newFileSecretStore() failed: %s", err.Error())
+	}
+	if err = store.Set("name", "value"); err != nil {
+		t.Fatalf("Set() failed: %s", err.Error())
+	}
+	if store, err = newFileSecretStore(keyPath, ""); err != nil {
+		t.Fatalf("newFileSecretStore() failed: %s", err.Error())
+	}
+	if value, _, err := store.Get("name"); err != nil || value != "value" {
+		t.Errorf("Get() = %q, %v after reopening the store with its key file", value, err)
+	}
+}
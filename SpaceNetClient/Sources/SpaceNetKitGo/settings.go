@@ -0,0 +1,506 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+//
+// typedef unsigned char SN_ERROR_CODE;
+//
+// static void onSettingsInit(void *func, void *ctx, const unsigned long session, const BOOL ok, const BOOL isInitialized, const char *deviceUser, const char *deviceName, const char *deviceLockPassphrase, const int unlockedTimeout)
+// {
+//	 ((void(*)(void *, const unsigned long, const BOOL, const BOOL, const char *, const char *, const char *, const int))func)(ctx, session, ok, isInitialized, deviceUser, deviceName, deviceLockPassphrase, unlockedTimeout);
+// }
+// static void onSettingsDeviceOwnerLoggedIn(void *func, void *ctx, const BOOL ok, const char *username, const char *deviceName, const BOOL needsKey)
+// {
+//	 ((void(*)(void *, const BOOL, const char *, const char *, const BOOL))func)(ctx, ok, username, deviceName, needsKey);
+// }
+// static void onSettingsOwnerKeyLoaded(void *func, void *ctx, const BOOL ok, const char *keyFile)
+// {
+//	 ((void(*)(void *, const BOOL, const char *))func)(ctx, ok, keyFile);
+// }
+// static void onSettingsSaved(void *func, void *ctx, const BOOL ok)
+// {
+//	 ((void(*)(void *, const BOOL))func)(ctx, ok);
+// }
+import "C"
+
+import (
+	"context"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	mycsconfig "github.com/appbricks/mycloudspace-client/config"
+	"github.com/mevansam/goutils/logger"
+)
+
+// A settings session holds the initializer used to edit the
+// configuration from a settings window. Changes the initializer
+// makes to the configuration before it is saved are discarded
+// if the session is cancelled.
+type settingsSession struct {
+	// the configuration being edited
+	config      config.Config
+	initializer *mycsconfig.ConfigInitializer
+
+	// the user logged in when the session began which
+	// is restored if the device owner was reset
+	loggedInUserID   string
+	loggedInUserName string
+
+	mx sync.Mutex
+	// whether the configuration has been changed
+	// and whether the session has been closed
+	modified bool
+	closed   bool
+}
+
+//export snSettingsBegin
+func snSettingsBegin(dlgContext uintptr, handler uintptr) C.ulong {
+
+	var (
+		err error
+
+		initializer *mycsconfig.ConfigInitializer
+	)
+
+	cfg := currentConfig()
+	if cfg == nil {
+		err = newError(SN_ERROR_LOCK, "the device is locked")
+
+	} else if initializer, err = mycsconfig.NewConfigInitializer(
+		serializedConfig{cfg},
+		context.Background(),
+		getServiceConfig(),
+		NewAppUIBackground(dlgContext),
+	); err == nil && initializer == nil {
+		err = newError(SN_ERROR_UNKNOWN, "no config initializer was created")
+	}
+	if err != nil {
+		ok := setLastError("snSettingsBegin", err)
+		postSettingsInit(dlgContext, handler, 0, ok, nil)
+		return C.ulong(0)
+	}
+
+	deviceContext := cfg.DeviceContext()
+	session := &settingsSession{
+		config:           cfg,
+		initializer:      initializer,
+		loggedInUserID:   deviceContext.GetLoggedInUserID(),
+		loggedInUserName: deviceContext.GetLoggedInUserName(),
+	}
+	sessionHandle := newHandle("settingsSession", session)
+
+	// the handler is called before the handle is returned
+	// so it is also given the handle of the session
+	postSettingsInit(dlgContext, handler, uintptr(sessionHandle), C.uchar(1), initializer)
+	return C.ulong(sessionHandle)
+}
+
+//export snSettingsResetDeviceOwner
+func snSettingsResetDeviceOwner(sessionHandle, dlgContext, handler uintptr) {
+
+	session, err := settingsSessionValue(sessionHandle)
+	if err != nil {
+		ok := setLastError("snSettingsResetDeviceOwner", err)
+		postSettingsDeviceOwnerLoggedIn(dlgContext, handler, ok, "", "", false)
+		return
+	}
+
+	session.initializer.ResetDeviceOwner(
+		func(userName, deviceName string, userNeedsNewKey bool, err error) {
+
+			auditLogForUser(AUDIT_OWNER_RESET, userName, deviceName, err)
+
+			ok := C.uchar(1)
+			if err != nil {
+				ok = setLastError("snSettingsResetDeviceOwner", authError(err))
+			} else {
+				session.changed()
+			}
+			postSettingsDeviceOwnerLoggedIn(dlgContext, handler, ok, userName, deviceName, userNeedsNewKey)
+		},
+	)
+}
+
+//export snSettingsLoadUserKey
+func snSettingsLoadUserKey(
+	sessionHandle uintptr,
+	dlgContext uintptr,
+	keyFile *C.char,
+	keyFormat *C.char,
+	createKey uint8,
+	handler uintptr,
+) {
+	var (
+		err error
+
+		ownerKey *ownerKeyFile
+		session  *settingsSession
+	)
+
+	format := ""
+	if keyFormat != nil {
+		format = C.GoString(keyFormat)
+	}
+	if session, err = settingsSessionValue(sessionHandle); err == nil {
+		ownerKey, err = newOwnerKeyFile(C.GoString(keyFile), format)
+	}
+	if err != nil {
+		ok := setLastError("snSettingsLoadUserKey", err)
+		postSettingsOwnerKeyLoaded(dlgContext, handler, ok, "")
+		return
+	}
+
+	go func() {
+		var (
+			err error
+
+			passphrase    *string
+			plainFileName string
+		)
+
+		create := createKey == 1
+		done := func(keyFileName string, err error) {
+			ownerKey.cleanup()
+			auditLog(AUDIT_KEY_LOAD, keyFileName, err)
+
+			ok := C.uchar(1)
+			if err != nil {
+				ok = setLastError("snSettingsLoadUserKey", err)
+			} else {
+				if !create {
+					ownerKey.removeIfRestored()
+				}
+				session.changed()
+			}
+			postSettingsOwnerKeyLoaded(dlgContext, handler, ok, keyFileName)
+		}
+
+		if !create {
+			// the format of an existing key file is
+			// detected from its contents
+			if err = ownerKey.detectFormat(); err != nil {
+				done(ownerKey.name, err)
+				return
+			}
+		}
+		if ownerKey.encrypted() {
+			if passphrase = promptKeyFilePassphraseFn(dlgContext, ownerKey, create); passphrase == nil {
+				done(ownerKey.name, newError(SN_ERROR_CANCELLED, "the key file passphrase was not entered"))
+				return
+			}
+			if create {
+				err = ownerKey.receive()
+			} else {
+				err = ownerKey.decrypt(*passphrase)
+			}
+			if err != nil {
+				done(ownerKey.name, err)
+				return
+			}
+		}
+		if plainFileName, err = ownerKey.plainName(); err != nil {
+			done(ownerKey.name, err)
+			return
+		}
+
+		session.initializer.LoadDeviceOwnerKey(
+			plainFileName,
+			create,
+			func(keyFileName string, err error) {
+				if ownerKey.encrypted() {
+					// the plain key is only passed through a pipe
+					// known to this client so the host is given
+					// the key file
+					keyFileName = ownerKey.name
+					if err == nil && create {
+						// the key created by the initializer is saved
+						// to the key file protected by the passphrase
+						err = ownerKey.encrypt(*passphrase)
+					}
+				}
+				done(keyFileName, err)
+			},
+		)
+	}()
+}
+
+//export snSettingsSave
+func snSettingsSave(
+	sessionHandle uintptr,
+	dlgContext uintptr,
+	deviceName *C.char,
+	deviceLockPassphrase *C.char,
+	unlockedTimeout int,
+	handler uintptr,
+) {
+	session, err := settingsSessionValue(sessionHandle)
+	if err != nil {
+		ok := setLastError("snSettingsSave", err)
+		postSettingsSaved(dlgContext, handler, ok)
+		return
+	}
+
+	name := C.GoString(deviceName)
+
+	session.initializer.Save(
+		name,
+		C.GoString(deviceLockPassphrase),
+		ClientType,
+		Version,
+		unlockedTimeout,
+
+		func(err error) {
+			auditLog(AUDIT_SETTINGS_SAVE, name, err)
+
+			ok := C.uchar(1)
+			if err != nil {
+				// the session remains open so that
+				// the save can be retried or cancelled
+				ok = setLastError("snSettingsSave", err)
+			} else {
+				// the saved changes can no longer be
+				// discarded so the session is ended
+				if session.close() {
+					releaseHandle(sessionHandle)
+				}
+				// the timeout is retained with the profile
+				// to re-arm the idle timer when unlocked
+				if err := setProfileUnlockedTimeout(unlockedTimeout); err != nil {
+					logger.ErrorMessage("Failed to save the unlocked timeout: %s", err.Error())
+				}
+				startIdleTimer(time.Duration(unlockedTimeout) * time.Minute)
+			}
+			postSettingsSaved(dlgContext, handler, ok)
+		},
+	)
+}
+
+//export snSettingsCancel
+func snSettingsCancel(sessionHandle uintptr) C.SN_ERROR_CODE {
+
+	session, ok := handleValue[*settingsSession](sessionHandle)
+	if !ok {
+		return setLastErrorCode("snSettingsCancel", newError(SN_ERROR_VALIDATION, "invalid or ended settings session"))
+	}
+	ended, err := session.cancel()
+	if !ended {
+		// the session was ended by a concurrent save
+		return C.SN_ERROR_CODE(SN_ERROR_NONE)
+	}
+	releaseHandle(sessionHandle)
+
+	if err != nil {
+		return setLastErrorCode("snSettingsCancel", err)
+	}
+	return C.SN_ERROR_CODE(SN_ERROR_NONE)
+}
+
+// returns the session referenced by the given handle
+func settingsSessionValue(sessionHandle uintptr) (*settingsSession, error) {
+	session, ok := handleValue[*settingsSession](sessionHandle)
+	if !ok {
+		return nil, newError(SN_ERROR_VALIDATION, "invalid or ended settings session")
+	}
+	if session.config != currentConfig() {
+		// the device was locked or the
+		// profile switched since it began
+		return nil, newError(SN_ERROR_LOCK, "the configuration of the settings session is no longer loaded")
+	}
+	return session, nil
+}
+
+// records that the configuration has been changed. if the
+// session was cancelled while the change was being made
+// then the change is discarded immediately.
+func (s *settingsSession) changed() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		logger.DebugMessage("Discarding configuration change made after settings session ended")
+		if err := s.discard(); err != nil {
+			logger.ErrorMessage("Failed to discard settings changes: %s", err.Error())
+		}
+		return
+	}
+	s.modified = true
+}
+
+// marks the session as closed returning
+// false if it had already been closed
+func (s *settingsSession) close() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	return true
+}
+
+// closes the session discarding any changes made to the
+// configuration. returns false if it had already been closed.
+func (s *settingsSession) cancel() (bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return false, nil
+	}
+	s.closed = true
+
+	if s.modified {
+		return true, s.discard()
+	}
+	return true, nil
+}
+
+// restores the auth and device contexts from the last saved
+// configuration and the user who was logged in when the
+// session began
+func (s *settingsSession) discard() error {
+
+	var (
+		err error
+	)
+
+	if s.config != currentConfig() {
+		// the configuration has been unloaded
+		// along with any unsaved changes
+		return nil
+	}
+	if err = s.config.AuthContext().Reset(); err != nil {
+		return err
+	}
+	if err = s.config.DeviceContext().Reset(); err != nil {
+		return err
+	}
+	if err = s.config.Load(); err != nil {
+		return storageError(err)
+	}
+	if len(s.loggedInUserID) > 0 {
+		if err = s.config.SetLoggedInUser(s.loggedInUserID, s.loggedInUserName); err != nil {
+			return storageError(err)
+		}
+	}
+	logger.DebugMessage("Discarded unsaved settings changes")
+	return nil
+}
+
+func postSettingsInit(
+	dlgContext, handler uintptr,
+	sessionHandle uintptr,
+	ok C.uchar,
+	initializer *mycsconfig.ConfigInitializer,
+) {
+	var (
+		deviceUserName,
+		deviceName,
+		devicePassphrase string
+
+		unlockedTimeout int
+	)
+
+	if handler == 0 {
+		return
+	}
+
+	initialized := C.uchar(0)
+	if initializer != nil {
+		deviceUserName = initializer.DeviceUsername()
+		deviceName = initializer.DeviceName()
+		devicePassphrase = initializer.DevicePassphrase()
+		unlockedTimeout = initializer.UnlockedTimeout()
+
+		if initializer.Initialized() {
+			initialized = C.uchar(1)
+		}
+	}
+
+	cDeviceUserName := C.CString(deviceUserName)
+	cDeviceName := C.CString(deviceName)
+	cDevicePassphrase := C.CString(devicePassphrase)
+
+	C.onSettingsInit(
+		unsafe.Pointer(handler),
+		unsafe.Pointer(dlgContext),
+		C.ulong(sessionHandle),
+		ok,
+		initialized,
+		cDeviceUserName,
+		cDeviceName,
+		cDevicePassphrase,
+		C.int(unlockedTimeout),
+	)
+
+	C.free(unsafe.Pointer(cDeviceUserName))
+	C.free(unsafe.Pointer(cDeviceName))
+	C.free(unsafe.Pointer(cDevicePassphrase))
+}
+
+func postSettingsDeviceOwnerLoggedIn(
+	dlgContext, handler uintptr,
+	ok C.uchar,
+	userName, deviceName string,
+	userNeedsNewKey bool,
+) {
+	if handler == 0 {
+		return
+	}
+
+	needsKey := C.uchar(0)
+	if userNeedsNewKey {
+		needsKey = C.uchar(1)
+	}
+
+	cUserName := C.CString(userName)
+	cDeviceName := C.CString(deviceName)
+
+	C.onSettingsDeviceOwnerLoggedIn(
+		unsafe.Pointer(handler),
+		unsafe.Pointer(dlgContext),
+		ok,
+		cUserName,
+		cDeviceName,
+		needsKey,
+	)
+
+	C.free(unsafe.Pointer(cUserName))
+	C.free(unsafe.Pointer(cDeviceName))
+}
+
+func postSettingsOwnerKeyLoaded(dlgContext, handler uintptr, ok C.uchar, keyFileName string) {
+	if handler == 0 {
+		return
+	}
+
+	cKeyFileName := C.CString(keyFileName)
+
+	C.onSettingsOwnerKeyLoaded(
+		unsafe.Pointer(handler),
+		unsafe.Pointer(dlgContext),
+		ok,
+		cKeyFileName,
+	)
+
+	C.free(unsafe.Pointer(cKeyFileName))
+}
+
+func postSettingsSaved(dlgContext, handler uintptr, ok C.uchar) {
+	if handler != 0 {
+		C.onSettingsSaved(
+			unsafe.Pointer(handler),
+			unsafe.Pointer(dlgContext),
+			ok,
+		)
+	}
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSettingsSessionCancel(t *testing.T) {
+
+	tc := newTestContext(t)
+	session := &settingsSession{config: tc.config}
+
+	// an unmodified session is closed without
+	// reloading the configuration
+	tc.login(t, testUsername)
+	if ended, err := session.cancel(); !ended || err != nil {
+		t.Fatalf("cancel() = %t, %v, expected the session to end", ended, err)
+	}
+	if !tc.config.AuthContext().IsLoggedIn() {
+		t.Errorf("cancel() of an unmodified session discarded the configuration")
+	}
+	if ended, _ := session.cancel(); ended {
+		t.Errorf("cancel() ended a session that was already closed")
+	}
+
+	// the changes of a modified session are discarded
+	session = &settingsSession{config: tc.config}
+	session.changed()
+	if ended, err := session.cancel(); !ended || err != nil {
+		t.Fatalf("cancel() = %t, %v, expected the session to end", ended, err)
+	}
+	if tc.config.AuthContext().IsLoggedIn() {
+		t.Errorf("cancel() did not discard the changes of the session")
+	}
+
+	// changes made after the session was cancelled are discarded
+	tc.login(t, testUsername)
+	session.changed()
+	if tc.config.AuthContext().IsLoggedIn() {
+		t.Errorf("a change made after the session was cancelled was not discarded")
+	}
+}
+
+func TestSettingsSessionCancelDuringChange(t *testing.T) {
+
+	tc := newTestContext(t)
+
+	for i := 0; i < 20; i++ {
+		session := &settingsSession{config: tc.config}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			session.changed()
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := session.cancel(); err != nil {
+				t.Errorf("cancel() failed: %s", err.Error())
+			}
+		}()
+		wg.Wait()
+
+		session.mx.Lock()
+		closed := session.closed
+		session.mx.Unlock()
+		if !closed {
+			t.Fatalf("the session was not closed by cancel()")
+		}
+	}
+}
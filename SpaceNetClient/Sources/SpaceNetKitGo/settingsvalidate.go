@@ -0,0 +1,352 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+//
+// static void onSettingsValidated(void *func, void *ctx, const BOOL ok, const char *validationJSON)
+// {
+//	 ((void(*)(void *, const BOOL, const char *))func)(ctx, ok, validationJSON);
+// }
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/appbricks/mycloudspace-client/api"
+	"github.com/hasura/go-graphql-client"
+)
+
+const (
+	// fields of the settings form
+	SETTINGS_FIELD_DEVICE_NAME            = "deviceName"
+	SETTINGS_FIELD_DEVICE_LOCK_PASSPHRASE = "deviceLockPassphrase"
+	SETTINGS_FIELD_UNLOCKED_TIMEOUT       = "unlockedTimeout"
+
+	// codes of the settings field errors
+	SETTINGS_ERROR_REQUIRED           = "required"
+	SETTINGS_ERROR_TOO_LONG           = "tooLong"
+	SETTINGS_ERROR_INVALID_CHARACTERS = "invalidCharacters"
+	SETTINGS_ERROR_DUPLICATE          = "duplicate"
+	SETTINGS_ERROR_WEAK               = "weak"
+	SETTINGS_ERROR_OUT_OF_RANGE       = "outOfRange"
+
+	DEVICE_NAME_MAX_LENGTH = 64
+
+	// passphrases are scored from 0 (very weak) to 4 (very
+	// strong) by the estimated bits of entropy they have
+	PASSPHRASE_MIN_SCORE = 2
+
+	// bounds of the unlocked timeout in minutes
+	UNLOCKED_TIMEOUT_MIN = 15
+	UNLOCKED_TIMEOUT_MAX = 1440
+)
+
+var (
+	// the lower bound of the estimated bits of
+	// entropy a passphrase must have for each score
+	passphraseScoreBits = []float64{28, 36, 60, 80}
+
+	// common passphrase fragments which add little entropy
+	commonPassphraseFragments = []string{
+		"password", "passphrase", "qwerty", "azerty", "letmein",
+		"welcome", "admin", "secret", "spacenet", "123456",
+	}
+)
+
+// JSON representation of the validation of the settings
+// form returned to the host application
+type settingsValidation struct {
+	Valid           bool                 `json:"valid"`
+	PassphraseScore int                  `json:"passphraseScore"`
+	Errors          []settingsFieldError `json:"errors"`
+}
+
+type settingsFieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//export snSettingsValidate
+func snSettingsValidate(
+	sessionHandle uintptr,
+	dlgContext uintptr,
+	deviceName *C.char,
+	deviceLockPassphrase *C.char,
+	unlockedTimeout int,
+	handler uintptr,
+) {
+	name := C.GoString(deviceName)
+	passphrase := C.GoString(deviceLockPassphrase)
+
+	if _, err := settingsSessionValue(sessionHandle); err != nil {
+		ok := setLastError("snSettingsValidate", err)
+		postSettingsValidated(dlgContext, handler, ok, nil)
+		return
+	}
+
+	go func() {
+		ok := C.uchar(1)
+		validation, err := validateSettings(name, passphrase, unlockedTimeout)
+		if err != nil {
+			// the errors of the fields that could be
+			// validated are still returned to the host
+			ok = setLastError("snSettingsValidate", err)
+		}
+		postSettingsValidated(dlgContext, handler, ok, validation)
+	}()
+}
+
+// validates the fields of the settings form. an error is
+// returned if the device name could not be checked against
+// the names of the user's other devices.
+func validateSettings(deviceName, passphrase string, unlockedTimeout int) (*settingsValidation, error) {
+
+	var (
+		err error
+
+		fieldErr *settingsFieldError
+	)
+
+	validation := &settingsValidation{
+		Errors: []settingsFieldError{},
+	}
+	addError := func(fieldErr *settingsFieldError) {
+		if fieldErr != nil {
+			validation.Errors = append(validation.Errors, *fieldErr)
+		}
+	}
+
+	fieldErr = validateDeviceName(deviceName)
+	if fieldErr == nil {
+		fieldErr, err = validateDeviceNameIsUnique(deviceName)
+	}
+	addError(fieldErr)
+
+	validation.PassphraseScore = passphraseScore(passphrase)
+	if len(passphrase) > 0 {
+		// the device lock is optional so the passphrase and the
+		// timeout are only validated if a passphrase is set
+		if validation.PassphraseScore < PASSPHRASE_MIN_SCORE {
+			addError(&settingsFieldError{
+				Field:   SETTINGS_FIELD_DEVICE_LOCK_PASSPHRASE,
+				Code:    SETTINGS_ERROR_WEAK,
+				Message: "The passphrase is too easy to guess. Use a longer passphrase with a mix of words, numbers and symbols.",
+			})
+		}
+		if unlockedTimeout < UNLOCKED_TIMEOUT_MIN || unlockedTimeout > UNLOCKED_TIMEOUT_MAX {
+			addError(&settingsFieldError{
+				Field:   SETTINGS_FIELD_UNLOCKED_TIMEOUT,
+				Code:    SETTINGS_ERROR_OUT_OF_RANGE,
+				Message: "The unlocked timeout must be between 15 minutes and 24 hours.",
+			})
+		}
+	}
+
+	validation.Valid = len(validation.Errors) == 0 && err == nil
+	return validation, err
+}
+
+// validates the length and characters of a device name. names
+// may contain letters, digits, spaces and the characters . - _ '
+func validateDeviceName(deviceName string) *settingsFieldError {
+
+	if len(strings.TrimSpace(deviceName)) == 0 {
+		return &settingsFieldError{
+			Field:   SETTINGS_FIELD_DEVICE_NAME,
+			Code:    SETTINGS_ERROR_REQUIRED,
+			Message: "A device name is required.",
+		}
+	}
+	if utf8.RuneCountInString(deviceName) > DEVICE_NAME_MAX_LENGTH {
+		return &settingsFieldError{
+			Field:   SETTINGS_FIELD_DEVICE_NAME,
+			Code:    SETTINGS_ERROR_TOO_LONG,
+			Message: "The device name cannot be longer than 64 characters.",
+		}
+	}
+	if strings.TrimSpace(deviceName) != deviceName {
+		return &settingsFieldError{
+			Field:   SETTINGS_FIELD_DEVICE_NAME,
+			Code:    SETTINGS_ERROR_INVALID_CHARACTERS,
+			Message: "The device name cannot begin or end with spaces.",
+		}
+	}
+	for _, r := range deviceName {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" .-_'’", r) {
+			return &settingsFieldError{
+				Field:   SETTINGS_FIELD_DEVICE_NAME,
+				Code:    SETTINGS_ERROR_INVALID_CHARACTERS,
+				Message: "The device name can only contain letters, digits, spaces and the characters . - _ '",
+			}
+		}
+	}
+	return nil
+}
+
+// validates that none of the logged in user's other
+// devices registered with the MyCS service has the name
+func validateDeviceNameIsUnique(deviceName string) (*settingsFieldError, error) {
+
+	var (
+		err error
+
+		query struct {
+			GetUser struct {
+				Devices struct {
+					DeviceUsers []struct {
+						Device struct {
+							DeviceID   graphql.String `graphql:"deviceID"`
+							DeviceName graphql.String
+						}
+					}
+				}
+			} `graphql:"getUser"`
+		}
+	)
+
+	cfg := currentConfig()
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		// the name cannot be checked until the
+		// device owner has been logged in
+		return nil, nil
+	}
+	if err = api.NewGraphQLClient(getServiceConfig().ApiURL, "", cfg).Query(context.Background(), &query, nil); err != nil {
+		return nil, err
+	}
+
+	deviceID, _ := cfg.DeviceContext().GetDeviceID()
+	for _, du := range query.GetUser.Devices.DeviceUsers {
+		if string(du.Device.DeviceID) != deviceID &&
+			strings.EqualFold(string(du.Device.DeviceName), deviceName) {
+
+			return &settingsFieldError{
+				Field:   SETTINGS_FIELD_DEVICE_NAME,
+				Code:    SETTINGS_ERROR_DUPLICATE,
+				Message: "Another of your devices is named '" + string(du.Device.DeviceName) + "'.",
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// scores the strength of a passphrase from 0 to 4 by estimating
+// its bits of entropy from the classes of characters it uses.
+// repeated and sequential characters and common fragments only
+// add a single bit each.
+func passphraseScore(passphrase string) int {
+
+	var (
+		lower, upper, digit, symbol, other bool
+	)
+
+	if len(passphrase) == 0 {
+		return 0
+	}
+
+	runes := []rune(passphrase)
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	poolSize := 0
+	if lower {
+		poolSize += 26
+	}
+	if upper {
+		poolSize += 26
+	}
+	if digit {
+		poolSize += 10
+	}
+	if symbol {
+		poolSize += 33
+	}
+	if other {
+		poolSize += 100
+	}
+	bitsPerRune := math.Log2(float64(poolSize))
+
+	// runes that are part of a common fragment
+	common := make([]bool, len(runes))
+	lowerRunes := []rune(strings.ToLower(passphrase))
+	for _, fragment := range commonPassphraseFragments {
+		fragmentRunes := []rune(fragment)
+		for i := 0; i+len(fragmentRunes) <= len(lowerRunes); i++ {
+			if string(lowerRunes[i:i+len(fragmentRunes)]) == fragment {
+				for j := i; j < i+len(fragmentRunes); j++ {
+					common[j] = true
+				}
+			}
+		}
+	}
+
+	bits := 0.0
+	for i, r := range runes {
+		if common[i] || (i > 0 && (r == runes[i-1] || r == runes[i-1]+1 || r == runes[i-1]-1)) {
+			bits += 1
+		} else {
+			bits += bitsPerRune
+		}
+	}
+
+	score := 0
+	for score < len(passphraseScoreBits) && bits >= passphraseScoreBits[score] {
+		score++
+	}
+	return score
+}
+
+func postSettingsValidated(dlgContext, handler uintptr, ok C.uchar, validation *settingsValidation) {
+
+	var (
+		err error
+
+		validationJSON []byte
+	)
+
+	if handler == 0 {
+		return
+	}
+	if validation != nil {
+		if validationJSON, err = json.Marshal(validation); err != nil {
+			ok = setLastError("snSettingsValidate", err)
+		}
+	}
+	if validationJSON == nil {
+		validationJSON = []byte("{}")
+	}
+
+	cValidationJSON := C.CString(string(validationJSON))
+
+	C.onSettingsValidated(
+		unsafe.Pointer(handler),
+		unsafe.Pointer(dlgContext),
+		ok,
+		cValidationJSON,
+	)
+
+	C.free(unsafe.Pointer(cValidationJSON))
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDeviceName(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+
+		deviceName string
+
+		code string
+	}{
+		{name: "simple name", deviceName: "My MacBook"},
+		{name: "allowed punctuation", deviceName: "bob's mac.local-1_2"},
+		{name: "typographic apostrophe", deviceName: "Bob’s Mac"},
+		{name: "unicode letters", deviceName: "Ünïcödé 日本"},
+		{name: "maximum length", deviceName: strings.Repeat("a", DEVICE_NAME_MAX_LENGTH)},
+		{name: "maximum length in runes", deviceName: strings.Repeat("é", DEVICE_NAME_MAX_LENGTH)},
+		{name: "empty", deviceName: "", code: SETTINGS_ERROR_REQUIRED},
+		{name: "only spaces", deviceName: "   ", code: SETTINGS_ERROR_REQUIRED},
+		{name: "too long", deviceName: strings.Repeat("a", DEVICE_NAME_MAX_LENGTH+1), code: SETTINGS_ERROR_TOO_LONG},
+		{name: "leading space", deviceName: " Mac", code: SETTINGS_ERROR_INVALID_CHARACTERS},
+		{name: "trailing space", deviceName: "Mac ", code: SETTINGS_ERROR_INVALID_CHARACTERS},
+		{name: "slash", deviceName: "mac/book", code: SETTINGS_ERROR_INVALID_CHARACTERS},
+		{name: "tab", deviceName: "Mac\tBook", code: SETTINGS_ERROR_INVALID_CHARACTERS},
+		{name: "emoji", deviceName: "Mac 💻", code: SETTINGS_ERROR_INVALID_CHARACTERS},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+
+			fieldErr := validateDeviceName(tt.deviceName)
+			if len(tt.code) == 0 {
+				if fieldErr != nil {
+					t.Errorf("validateDeviceName(%q) = %+v, expected a valid name", tt.deviceName, fieldErr)
+				}
+				return
+			}
+			if fieldErr == nil {
+				t.Fatalf("validateDeviceName(%q) = nil, expected %s", tt.deviceName, tt.code)
+			}
+			if fieldErr.Field != SETTINGS_FIELD_DEVICE_NAME || fieldErr.Code != tt.code || len(fieldErr.Message) == 0 {
+				t.Errorf("validateDeviceName(%q) = %+v, expected %s", tt.deviceName, fieldErr, tt.code)
+			}
+		})
+	}
+}
+
+func TestPassphraseScore(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+
+		passphrase string
+
+		score int
+	}{
+		{name: "empty", passphrase: "", score: 0},
+		{name: "short", passphrase: "kx7Q", score: 0},
+		{name: "sequential", passphrase: "abcdefghijklmnop", score: 0},
+		{name: "repeated", passphrase: strings.Repeat("a", 20), score: 0},
+		{name: "common fragment", passphrase: "password", score: 0},
+		{name: "common fragment with suffix", passphrase: "Password123!", score: 0},
+		{name: "lower case letters", passphrase: "fjwkqpz", score: 1},
+		{name: "mixed classes", passphrase: "kx7Qm2pZ", score: 2},
+		{name: "words", passphrase: "correct horse", score: 3},
+		{name: "all classes", passphrase: "Tr0ub4dor&3", score: 3},
+		{name: "non ascii", passphrase: "日本語のパスフレーズ", score: 3},
+		{name: "long words", passphrase: "correct horse battery staple", score: 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if score := passphraseScore(tt.passphrase); score != tt.score {
+				t.Errorf("passphraseScore(%q) = %d, expected %d", tt.passphrase, score, tt.score)
+			}
+		})
+	}
+
+	if passphraseScore("kx7Qm2pZ") < PASSPHRASE_MIN_SCORE {
+		t.Errorf("a passphrase mixing all character classes is scored below the minimum score")
+	}
+	if passphraseScore("password") >= PASSPHRASE_MIN_SCORE {
+		t.Errorf("a common passphrase is scored above the minimum score")
+	}
+}
@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+// #include <stdlib.h>
+//
+// typedef unsigned char BOOL;
+//
+// static void onSpacesLoaded(void *func, void *ctx, const BOOL ok, const char *spacesJSON)
+// {
+//	 ((void(*)(void *, const BOOL, const char *))func)(ctx, ok, spacesJSON);
+// }
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/appbricks/cloud-builder/config"
+	"github.com/appbricks/cloud-builder/userspace"
+	"github.com/appbricks/mycloudspace-client/api"
+	"github.com/appbricks/mycloudspace-client/mycscloud"
+	"github.com/hasura/go-graphql-client"
+)
+
+var (
+	// Space Targets
+	spaceNodes *mycscloud.SpaceNodes
+	// names of the space owners by space id
+	spaceOwners map[string]string
+
+	spaceNodesMx sync.Mutex
+)
+
+const (
+	SN_SPACE_ACCESS_OWNER = "owner"
+	SN_SPACE_ACCESS_ADMIN = "admin"
+	SN_SPACE_ACCESS_USER  = "user"
+)
+
+// JSON representation of a space node
+// returned to the host application
+type spaceInfo struct {
+	SpaceID   string `json:"spaceID"`
+	SpaceName string `json:"spaceName"`
+
+	IsOwned     bool   `json:"isOwned"`
+	OwnerName   string `json:"ownerName"`
+	AccessLevel string `json:"accessLevel"`
+	IsEgress    bool   `json:"isEgressNode"`
+
+	Recipe  string `json:"recipe"`
+	IaaS    string `json:"iaas"`
+	Region  string `json:"region"`
+	Version string `json:"version"`
+
+	Status    string `json:"status"`
+	IsRunning bool   `json:"isRunning"`
+	LastSeen  uint64 `json:"lastSeen"`
+
+	Endpoints []string `json:"endpoints"`
+}
+
+//export snListSpaces
+func snListSpaces(context, handler uintptr) {
+	go func() {
+		nodes, err := getSpaceNodes(false)
+		postSpacesLoaded("snListSpaces", context, handler, nodes, err)
+	}()
+}
+
+//export snRefreshSpaces
+func snRefreshSpaces(context, handler uintptr) {
+	go func() {
+		nodes, err := getSpaceNodes(true)
+		postSpacesLoaded("snRefreshSpaces", context, handler, nodes, err)
+	}()
+}
+
+// returns the cached space nodes the logged in user has access to
+// loading them from the MyCS service if they have not been loaded
+// or a refresh is requested
+func getSpaceNodes(refresh bool) ([]userspace.SpaceNode, error) {
+
+	var (
+		err error
+	)
+
+	spaceNodesMx.Lock()
+	defer spaceNodesMx.Unlock()
+
+	cfg := currentConfig()
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return nil, newError(SN_ERROR_AUTH, "spaces cannot be retrieved as no user is logged in")
+	}
+	if spaceNodes == nil || refresh {
+		if spaceNodes, err = mycscloud.GetSpaceNodes(
+			cfg,
+			getServiceConfig().ApiURL,
+		); err != nil {
+			return nil, err
+		}
+		if spaceOwners, err = fetchSpaceOwners(cfg); err != nil {
+			spaceNodes = nil
+			return nil, err
+		}
+	}
+	return spaceNodes.GetAllSpaces(), nil
+}
+
+// returns the names of the owners of the cached space nodes
+func getSpaceOwners() map[string]string {
+	spaceNodesMx.Lock()
+	defer spaceNodesMx.Unlock()
+
+	owners := make(map[string]string, len(spaceOwners))
+	for spaceID, ownerName := range spaceOwners {
+		owners[spaceID] = ownerName
+	}
+	return owners
+}
+
+// retrieves the names of the owners of the spaces the logged in
+// user has access to as they are not part of the space nodes
+func fetchSpaceOwners(cfg config.Config) (map[string]string, error) {
+
+	var (
+		query struct {
+			GetUser struct {
+				Spaces struct {
+					SpaceUsers []struct {
+						Space struct {
+							SpaceID graphql.String `graphql:"spaceID"`
+							Owner   struct {
+								UserName graphql.String
+							}
+						}
+					}
+				}
+			} `graphql:"getUser"`
+		}
+	)
+
+	if err := api.NewGraphQLClient(getServiceConfig().ApiURL, "", cfg).Query(context.Background(), &query, nil); err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, spaceUser := range query.GetUser.Spaces.SpaceUsers {
+		owners[string(spaceUser.Space.SpaceID)] = string(spaceUser.Space.Owner.UserName)
+	}
+	return owners, nil
+}
+
+// clears cached space nodes so they are
+// reloaded for the next logged in user
+func resetSpaceNodes() {
+	spaceNodesMx.Lock()
+	defer spaceNodesMx.Unlock()
+
+	spaceNodes = nil
+	spaceOwners = nil
+}
+
+func postSpacesLoaded(operation string, context, handler uintptr, nodes []userspace.SpaceNode, err error) {
+
+	var (
+		spacesJSON []byte
+	)
+
+	if err == nil {
+		spacesJSON, err = spaceNodesToJSON(nodes, getSpaceOwners())
+	}
+	ok := C.uchar(1)
+	if err != nil {
+		ok = setLastError(operation, err)
+		spacesJSON = []byte("[]")
+	}
+
+	if handler != 0 {
+
+		cSpacesJSON := C.CString(string(spacesJSON))
+
+		C.onSpacesLoaded(
+			unsafe.Pointer(handler),
+			unsafe.Pointer(context),
+			ok,
+			cSpacesJSON,
+		)
+
+		C.free(unsafe.Pointer(cSpacesJSON))
+	}
+}
+
+func spaceNodesToJSON(nodes []userspace.SpaceNode, owners map[string]string) ([]byte, error) {
+
+	spaces := make([]spaceInfo, 0, len(nodes))
+	for _, node := range nodes {
+
+		accessLevel := SN_SPACE_ACCESS_USER
+		if node.IsSpaceOwned() {
+			accessLevel = SN_SPACE_ACCESS_OWNER
+		} else if node.HasAdminAccess() {
+			accessLevel = SN_SPACE_ACCESS_ADMIN
+		}
+
+		spaces = append(spaces, spaceInfo{
+			SpaceID:   node.GetSpaceID(),
+			SpaceName: node.GetSpaceName(),
+
+			IsOwned:     node.IsSpaceOwned(),
+			OwnerName:   owners[node.GetSpaceID()],
+			AccessLevel: accessLevel,
+			IsEgress:    node.CanUseAsEgressNode(),
+
+			Recipe:  node.GetRecipe(),
+			IaaS:    node.GetIaaS(),
+			Region:  node.GetRegion(),
+			Version: node.GetVersion(),
+
+			Status:    node.GetStatus(),
+			IsRunning: node.IsRunning(),
+			LastSeen:  node.GetLastSeen(),
+
+			Endpoints: spaceEndpoints(node),
+		})
+	}
+	return json.Marshal(spaces)
+}
+
+func spaceEndpoints(node userspace.SpaceNode) []string {
+
+	endpoints := []string{}
+	if space, ok := node.(*userspace.Space); ok {
+		// a space may be reachable via its
+		// fqdn as well as its public ip
+		for _, host := range []string{space.FQDN, space.IPAddress} {
+			if len(host) > 0 {
+				endpoints = append(endpoints, fmt.Sprintf("%s:%d", host, space.Port))
+			}
+		}
+	} else if endpoint, err := node.GetEndpoint(); err == nil && len(endpoint) > 0 {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
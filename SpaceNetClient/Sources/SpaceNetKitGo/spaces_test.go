@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/appbricks/cloud-builder/userspace"
+	"github.com/appbricks/mycloudspace-client/apple/mycsfake"
+)
+
+func TestFetchSpaceOwners(t *testing.T) {
+
+	tc := newTestContext(t)
+
+	friend := &mycsfake.User{Username: "friend"}
+	tc.service.AddUser(friend)
+	owner := tc.owner
+
+	tc.service.AddSpace(&mycsfake.Space{SpaceID: "owned", Name: "home", OwnerID: owner.UserID})
+	tc.service.AddSpace(&mycsfake.Space{
+		SpaceID: "shared",
+		Name:    "office",
+		OwnerID: friend.UserID,
+		Users:   map[string]string{owner.UserID: mycsfake.USER_STATUS_ACTIVE},
+	})
+	tc.service.AddSpace(&mycsfake.Space{SpaceID: "other", Name: "other", OwnerID: friend.UserID})
+
+	tc.login(t, testUsername)
+
+	owners, err := fetchSpaceOwners(tc.config)
+	if err != nil {
+		t.Fatalf("fetchSpaceOwners(tc.config) failed: %s", err.Error())
+	}
+	expected := map[string]string{
+		"owned":  testUsername,
+		"shared": "friend",
+	}
+	if !reflect.DeepEqual(owners, expected) {
+		t.Errorf("fetchSpaceOwners(tc.config) = %v, expected %v", owners, expected)
+	}
+}
+
+func TestGetSpaceNodesRequiresLogin(t *testing.T) {
+
+	newTestContext(t)
+
+	_, err := getSpaceNodes(false)
+	snErr := &snError{}
+	if !errors.As(err, &snErr) || snErr.Code != SN_ERROR_AUTH {
+		t.Errorf("getSpaceNodes() error = %v, expected an auth error", err)
+	}
+}
+
+func TestSpaceNodesToJSON(t *testing.T) {
+
+	nodes := []userspace.SpaceNode{
+		&userspace.Space{
+			SpaceID:      "owned",
+			SpaceName:    "home",
+			IsOwned:      true,
+			IsAdmin:      true,
+			IsEgressNode: true,
+			Status:       "running",
+			FQDN:         "home.example.com",
+			IPAddress:    "10.0.0.1",
+			Port:         443,
+		},
+		&userspace.Space{
+			SpaceID:   "shared",
+			SpaceName: "office",
+			IsAdmin:   true,
+		},
+		&userspace.Space{
+			SpaceID:   "guest",
+			SpaceName: "cafe",
+		},
+	}
+	owners := map[string]string{
+		"owned":  testUsername,
+		"shared": "friend",
+	}
+
+	spacesJSON, err := spaceNodesToJSON(nodes, owners)
+	if err != nil {
+		t.Fatalf("spaceNodesToJSON() failed: %s", err.Error())
+	}
+	spaces := []spaceInfo{}
+	if err = json.Unmarshal(spacesJSON, &spaces); err != nil {
+		t.Fatalf("spaceNodesToJSON() returned invalid JSON: %s", err.Error())
+	}
+	if len(spaces) != 3 {
+		t.Fatalf("spaceNodesToJSON() returned %d spaces, expected 3", len(spaces))
+	}
+
+	for i, expected := range []struct {
+		ownerName   string
+		accessLevel string
+		isRunning   bool
+		endpoints   []string
+	}{
+		{testUsername, SN_SPACE_ACCESS_OWNER, true, []string{"home.example.com:443", "10.0.0.1:443"}},
+		{"friend", SN_SPACE_ACCESS_ADMIN, false, []string{}},
+		{"", SN_SPACE_ACCESS_USER, false, []string{}},
+	} {
+		space := spaces[i]
+		if space.OwnerName != expected.ownerName {
+			t.Errorf("space '%s' has owner '%s', expected '%s'", space.SpaceName, space.OwnerName, expected.ownerName)
+		}
+		if space.AccessLevel != expected.accessLevel {
+			t.Errorf("space '%s' has access level '%s', expected '%s'", space.SpaceName, space.AccessLevel, expected.accessLevel)
+		}
+		if space.IsRunning != expected.isRunning {
+			t.Errorf("space '%s' has isRunning %t, expected %t", space.SpaceName, space.IsRunning, expected.isRunning)
+		}
+		if !reflect.DeepEqual(space.Endpoints, expected.endpoints) {
+			t.Errorf("space '%s' has endpoints %v, expected %v", space.SpaceName, space.Endpoints, expected.endpoints)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mevansam/goutils/logger"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// renews the logged in user's token before it expires.
+	// the generation ensures a refresh that was scheduled
+	// before the refresher was stopped does not run.
+	tokenRefreshTimer *time.Timer
+	tokenRefreshGen   uint64
+	tokenRefreshMx    sync.Mutex
+)
+
+const (
+	// how long before expiry a token is renewed
+	TOKEN_REFRESH_AHEAD = 5 * time.Minute
+	// how long to wait before retrying a renewal
+	// that failed due to a transient error
+	TOKEN_REFRESH_RETRY_INTERVAL = 30 * time.Second
+
+	SN_REASON_TOKEN_EXPIRED        = "tokenExpired"
+	SN_REASON_TOKEN_REFRESH_FAILED = "tokenRefreshFailed"
+)
+
+func updateTokenRefresherForStatus(status int) {
+	switch status {
+	case SN_CFG_STATUS_LOGGED_IN:
+		startTokenRefresher()
+	case SN_CFG_STATUS_LOGGED_OUT, SN_CFG_STATUS_NEEDS_LOGIN, SN_CFG_STATUS_LOCKED:
+		stopTokenRefresher()
+	}
+}
+
+// schedules renewal of the logged in user's token
+func startTokenRefresher() {
+
+	cfg := currentConfig()
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return
+	}
+	token := cfg.AuthContext().GetToken()
+	if token == nil || token.Expiry.IsZero() {
+		return
+	}
+	scheduleTokenRefresh(tokenRefreshDelay(token))
+}
+
+func stopTokenRefresher() {
+	tokenRefreshMx.Lock()
+	defer tokenRefreshMx.Unlock()
+
+	tokenRefreshGen++
+	if tokenRefreshTimer != nil {
+		tokenRefreshTimer.Stop()
+		tokenRefreshTimer = nil
+	}
+}
+
+func scheduleTokenRefresh(after time.Duration) {
+	tokenRefreshMx.Lock()
+	defer tokenRefreshMx.Unlock()
+
+	tokenRefreshGen++
+	if tokenRefreshTimer != nil {
+		tokenRefreshTimer.Stop()
+	}
+	if after < 0 {
+		after = 0
+	}
+	logger.DebugMessage("Auth token will be renewed in %s", after.String())
+
+	gen := tokenRefreshGen
+	tokenRefreshTimer = time.AfterFunc(after, func() {
+		tokenRefreshMx.Lock()
+		current := gen == tokenRefreshGen
+		tokenRefreshMx.Unlock()
+
+		if current {
+			refreshToken()
+		}
+	})
+}
+
+// renews the token using the refresh token and saves
+// the config. the user will need to login again if
+// the token cannot be renewed before it expires.
+func refreshToken() {
+
+	var (
+		err error
+
+		token *oauth2.Token
+	)
+
+	cfg := currentConfig()
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return
+	}
+	authContext := cfg.AuthContext()
+	current := authContext.GetToken()
+	if current == nil || len(current.RefreshToken) == 0 {
+		postStatusChange(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_EXPIRED, nil)
+		return
+	}
+
+	if token, err = renewToken(current); err != nil {
+		var retrieveErr *oauth2.RetrieveError
+
+		// the refresh token has been rejected or the token can
+		// no longer be used so the user needs to login again
+		if errors.As(err, &retrieveErr) || time.Until(current.Expiry) < TOKEN_REFRESH_RETRY_INTERVAL {
+			logger.ErrorMessage("Failed to renew auth token: %s", err.Error())
+			postStatusChange(SN_CFG_STATUS_NEEDS_LOGIN, SN_REASON_TOKEN_REFRESH_FAILED, err)
+			return
+		}
+		logger.DebugMessage("Failed to renew auth token. Retrying in %s: %s", TOKEN_REFRESH_RETRY_INTERVAL.String(), err.Error())
+		scheduleTokenRefresh(TOKEN_REFRESH_RETRY_INTERVAL)
+		return
+	}
+
+	// the refresh runs on a timer so the token is set and
+	// saved while serialized with saves made by exports
+	err = updateConfig(cfg, func() (bool, error) {
+		authContext.SetToken(token)
+		return true, nil
+	})
+	if errorCode(err) == SN_ERROR_LOCK {
+		// the context was reset while the token was renewed
+		logger.DebugMessage("Discarding auth token renewed for an unloaded configuration")
+		return
+	}
+	if err != nil {
+		logger.ErrorMessage("Failed to save configuration after renewing auth token: %s", err.Error())
+	}
+	logger.DebugMessage("Auth token renewed and expires at %s", token.Expiry.String())
+	if !token.Expiry.IsZero() {
+		scheduleTokenRefresh(tokenRefreshDelay(token))
+	}
+}
+
+// returns how long to wait before renewing a token. short
+// lived tokens are renewed halfway through their lifetime.
+func tokenRefreshDelay(token *oauth2.Token) time.Duration {
+	remaining := time.Until(token.Expiry)
+	if remaining < 2*TOKEN_REFRESH_AHEAD {
+		return remaining / 2
+	}
+	return remaining - TOKEN_REFRESH_AHEAD
+}
+
+// requests a new token from the token endpoint of the
+// active environment using the given token's refresh token
+func renewToken(token *oauth2.Token) (*oauth2.Token, error) {
+
+	env := getEnvironment()
+	oauthConfig := &oauth2.Config{
+		ClientID:     env.ClientID,
+		ClientSecret: env.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  env.AuthURL,
+			TokenURL: env.TokenURL,
+		},
+	}
+
+	// a token without an access token is always renewed. if
+	// the response does not include a new refresh token the
+	// current refresh token is retained.
+	renewed, err := oauthConfig.TokenSource(
+		context.Background(),
+		&oauth2.Token{RefreshToken: token.RefreshToken},
+	).Token()
+	if err != nil {
+		return nil, err
+	}
+	if len(renewed.AccessToken) == 0 {
+		return nil, newError(SN_ERROR_AUTH, "token endpoint did not return an access token")
+	}
+	return renewed, nil
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// logs in the user of the test context with a refresh token
+func (tc *testContext) loginWithRefreshToken(t *testing.T, username string) string {
+
+	tc.login(t, username)
+	refreshToken, err := tc.service.RefreshToken(username)
+	if err != nil {
+		t.Fatalf("failed to issue a refresh token: %s", err.Error())
+	}
+	token := tc.config.AuthContext().GetToken()
+	token.RefreshToken = refreshToken
+	tc.config.AuthContext().SetToken(token)
+	if err = saveConfig(tc.config); err != nil {
+		t.Fatalf("failed to save the config: %s", err.Error())
+	}
+	return token.AccessToken
+}
+
+// meant to be run with the race detector enabled
+func TestRefreshTokenDuringSaves(t *testing.T) {
+
+	tc := newTestContext(t)
+	accessToken := tc.loginWithRefreshToken(t, testUsername)
+	t.Cleanup(stopTokenRefresher)
+
+	// saves made by exports while the token is renewed
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := saveConfig(tc.config); err != nil {
+					t.Errorf("saveConfig() failed: %s", err.Error())
+					return
+				}
+			}
+		}()
+	}
+	refreshToken()
+	close(done)
+	wg.Wait()
+
+	renewed := tc.config.AuthContext().GetToken()
+	if renewed == nil || renewed.AccessToken == accessToken {
+		t.Fatalf("the auth token was not renewed")
+	}
+	if tc.service.Requests("/oauth2/token") == 0 {
+		t.Errorf("the token endpoint was not called")
+	}
+
+	// the renewed token was saved
+	if err := tc.config.Load(); err != nil {
+		t.Fatalf("failed to reload the config: %s", err.Error())
+	}
+	if token := tc.config.AuthContext().GetToken(); token == nil || token.AccessToken != renewed.AccessToken {
+		t.Errorf("the renewed auth token was not saved")
+	}
+}
+
+func TestRefreshTokenForUnloadedConfig(t *testing.T) {
+
+	tc := newTestContext(t)
+	accessToken := tc.loginWithRefreshToken(t, testUsername)
+	t.Cleanup(stopTokenRefresher)
+
+	cfg := currentConfig()
+	token := cfg.AuthContext().GetToken()
+	renewed, err := renewToken(token)
+	if err != nil {
+		t.Fatalf("renewToken() failed: %s", err.Error())
+	}
+
+	// a token renewed after the config was unloaded is discarded
+	setConfig(nil)
+	err = updateConfig(cfg, func() (bool, error) {
+		cfg.AuthContext().SetToken(renewed)
+		return true, nil
+	})
+	if errorCode(err) != SN_ERROR_LOCK {
+		t.Errorf("updateConfig() error = %v for an unloaded config, expected a lock error", err)
+	}
+	if cfg.AuthContext().GetToken().AccessToken != accessToken {
+		t.Errorf("the renewed token was set on an unloaded config")
+	}
+}
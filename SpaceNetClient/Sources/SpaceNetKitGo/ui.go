@@ -10,23 +10,8 @@ package main
 // #include <sys/types.h>
 //
 // typedef unsigned char SN_DIALOG_TYPE;
-// const SN_DIALOG_TYPE SN_DIALOG_APP = 0;
-// const SN_DIALOG_TYPE SN_DIALOG_NOTIFY = 1;
-// const SN_DIALOG_TYPE SN_DIALOG_ALERT = 2;
-// const SN_DIALOG_TYPE SN_DIALOG_ERROR = 3;
-// const SN_DIALOG_TYPE SN_DIALOG_WAIT_MSG = 10;
-// const SN_DIALOG_TYPE SN_DIALOG_WAIT_LOGIN = 11;
 //
 // typedef unsigned char SN_DIALOG_ACCESSORY_TYPE;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_NONE = 0;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_YES_NO = 1;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_OK_CANCEL = 2;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_TEXT_INPUT = 3;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_PASSWORD_INPUT = 4;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_PASSWORD_INPUT_WITH_VERIFY = 5;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_FILE_OPEN = 6;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_SPINNER = 7;
-// const SN_DIALOG_ACCESSORY_TYPE SN_DIALOG_ACCESSORY_PROGRESS_BAR = 8;
 //
 // static void *showDialog(void *func, void *ctx, const unsigned char dialogType, const char *title, const char *msg, const unsigned char accessoryType, const char *accessoryText, const unsigned char dispathToMain, unsigned long inputContext) {
 //   return ((void *(*)(void *, const unsigned char, const char *, const char *, const unsigned char, const char *, const unsigned char, unsigned long))func)(ctx, dialogType, title, msg, accessoryType, accessoryText, dispathToMain, inputContext);
@@ -49,6 +34,8 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -57,9 +44,12 @@ import (
 )
 
 var (
-	showDialogFuncs = make(map[uintptr]*dialogContext)
+	// dialog functions keyed by host dialog context
+	showDialogFuncs = newRegistry[uintptr, dialogContext]("showDialogFuncs", 0)
 
-	dialogHandleLookup = make(map[uintptr]uintptr)
+	// host dialog handles keyed by input context. entries
+	// are removed once the dialog input has been handled.
+	dialogHandleLookup = newRegistry[uintptr, uintptr]("dialogHandleLookup", DIALOG_HANDLE_MAX_AGE)
 )
 
 const (
@@ -79,6 +69,8 @@ const (
 	SN_DIALOG_ACCESSORY_PROGRESS_BAR = 8
 
 	EMPTY_STRING = ""
+
+	DIALOG_HANDLE_MAX_AGE = time.Hour
 )
 
 type dialogContext struct {
@@ -89,7 +81,9 @@ type dialogContext struct {
 type dialogHandle struct {
 	dlgContext,
 	dlgHandle uintptr
-	dlgInputHandle *dialogInputHandle
+
+	// cgo handle to the dialog's input handle
+	dlgInputContext uintptr
 }
 
 type dialogInputHandle struct {
@@ -99,39 +93,50 @@ type dialogInputHandle struct {
 //export snRegisterShowDialogFunc
 func snRegisterShowDialogFunc(dlgContext, showFunc uintptr) {
 	if dlgContext != 0 && showFunc != 0 {
-		showDialogFuncs[dlgContext] = &dialogContext{
+		showDialogFuncs.register(dlgContext, dialogContext{
 			showFunc: showFunc,
-		}	
+		})
 	}
 }
 
 //export snSetDialogDismissHandler
 func snSetDialogDismissHandler(dlgContext, handler uintptr) {
-	if dc, ok := showDialogFuncs[dlgContext]; ok {
+	showDialogFuncs.update(dlgContext, func(dc dialogContext) dialogContext {
 		dc.dismissHandler = handler
-	}
+		return dc
+	})
 }
 
 //export snUnregisterShowDialogFunc
 func snUnregisterShowDialogFunc(dlgContext uintptr) {
-	delete(showDialogFuncs, dlgContext)
+	showDialogFuncs.unregister(dlgContext)
 }
 
 //export snHandleDialogInput
 func snHandleDialogInput(inputContext uintptr, ok uint8, result *C.char) {	
-	inputHandle := (*dialogInputHandle)(unsafe.Pointer(inputContext))
+	// only the call that releases the handle sends the input
+	// so repeated or concurrent calls are ignored
+	inputHandle, valid := takeHandle[*dialogInputHandle](inputContext)
+	if !valid {
+		return
+	}
+	dialogHandleLookup.unregister(inputContext)
+
 	if ok != 0 {
 		result := C.GoString(result)
 		inputHandle.input <- &result
 	} else {
 		inputHandle.input <- nil
 	}
-	delete(dialogHandleLookup, inputContext)
 }
 
 //export snAssociateDialogInputToHandle
 func snAssociateDialogInputToHandle(inputContext, handle uintptr) {
-	dialogHandleLookup[inputContext] = handle
+	// the dialog may have been dismissed before
+	// its handle was associated with its input
+	if isLiveHandle(inputContext) {
+		dialogHandleLookup.register(inputContext, handle)
+	}
 }
 
 func showDialog(
@@ -143,7 +148,7 @@ func showDialog(
 	dispathToMain bool,
 	inputHandle *dialogInputHandle,
 ) *dialogHandle {
-	if dc, ok := showDialogFuncs[dlgContext]; ok {
+	if dc, ok := showDialogFuncs.lookup(dlgContext); ok {
 
 		context := unsafe.Pointer(dlgContext)
 		showFunc := unsafe.Pointer(dc.showFunc)
@@ -154,9 +159,10 @@ func showDialog(
 		}
 
 		if uintptr(showFunc) != 0 {
+			inputContext := uintptr(newHandle("dialogInput", inputHandle))
 			return &dialogHandle{
 				dlgContext: dlgContext,
-				dlgInputHandle: inputHandle,
+				dlgInputContext: inputContext,
 				dlgHandle: uintptr(C.showDialog(showFunc, context, 
 					C.uchar(dialogType),
 					C.CString(title), 
@@ -164,7 +170,7 @@ func showDialog(
 					C.uchar(accessoryType),
 					C.CString(accessoryText),
 					dispatch,
-					C.ulong(uintptr(unsafe.Pointer(inputHandle))),
+					C.ulong(inputContext),
 				)),
 			}		
 		}	
@@ -175,9 +181,9 @@ func showDialog(
 }
 
 func dismissDialog(handle *dialogHandle) {
-	if dc, ok := showDialogFuncs[handle.dlgContext]; ok {
+	if dc, ok := showDialogFuncs.lookup(handle.dlgContext); ok {
 		if handle.dlgHandle == 0 {
-			handle.dlgHandle = dialogHandleLookup[uintptr(unsafe.Pointer(handle.dlgInputHandle))]
+			handle.dlgHandle, _ = dialogHandleLookup.lookup(handle.dlgInputContext)
 		}
 
 		if handle.dlgHandle != 0 {
@@ -195,6 +201,21 @@ func dismissDialog(handle *dialogHandle) {
 	} else {
 		logger.ErrorMessage("No dismiss dialog function registered for context %x", handle.dlgContext)
 	}
+	handle.releaseInput()
+}
+
+// releases the input context of a dialog dismissed by Go as
+// the host may not return its input. goroutines waiting for
+// the input receive nil as if the dialog had been cancelled.
+func (handle *dialogHandle) releaseInput() {
+	if !isLiveHandle(handle.dlgInputContext) {
+		// the host has already returned the input
+		return
+	}
+	if inputHandle, ok := takeHandle[*dialogInputHandle](handle.dlgInputContext); ok {
+		dialogHandleLookup.unregister(handle.dlgInputContext)
+		inputHandle.input <- nil
+	}
 }
 
 func getInput(
@@ -211,7 +232,7 @@ func getInput(
 			C.CString(title), 
 			C.CString(msg),
 			C.CString(defaultInput),
-			C.ulong(uintptr(unsafe.Pointer(inputHandle))),
+			C.ulong(newHandle("dialogInput", inputHandle)),
 			C.snHandleDialogInputFn(),
 		)
 	}
@@ -222,6 +243,14 @@ type appUI struct {
 	dlgContext uintptr
 
 	dispatchToMain bool
+
+	// if set the cancel functions of messages
+	// are called when this context is done
+	ctx context.Context
+
+	// messages with dialogs that are still open
+	mx           sync.Mutex
+	openMessages map[*appMessage]bool
 }
 
 type appMessage struct {
@@ -233,13 +262,20 @@ type appMessage struct {
 
 	msgBuffer strings.Builder
 
-	dlgHandle *dialogHandle
+	// the dialog is shown and dismissed from
+	// different goroutines so its handle is
+	// swapped out by the one dismissing it
+	dlgHandle atomic.Pointer[dialogHandle]
 	inputHandle *dialogInputHandle
 }
 
 type appProgressIndicator struct {
 	msg *appMessage
 
+	// set when the indicator is dismissed by Done
+	// so that it is not treated as a cancellation
+	done atomic.Bool
+
 	startMsg,
 	progressMsg,
 	endMsg string
@@ -259,6 +295,15 @@ func NewAppUIBackground(dlgContext uintptr) ui.UI {
 	}
 }
 
+// binds the ui to the given context so that the cancel
+// functions of messages created with a cancel function
+// are called when the context is done. the context must
+// be done once the operation using the ui completes.
+func (ui *appUI) withContext(ctx context.Context) *appUI {
+	ui.ctx = ctx
+	return ui
+}
+
 func (ui *appUI) NewUIMessage(title string) ui.Message {
 	return &appMessage{
 		appUI: ui,
@@ -269,6 +314,14 @@ func (ui *appUI) NewUIMessage(title string) ui.Message {
 }
 
 func (ui *appUI) NewUIMessageWithCancel(title string, cancel context.CancelFunc) ui.Message {
+	if ui.ctx != nil && cancel != nil {
+		// the bound context is always done once the
+		// operation it belongs to has completed
+		go func(ctx context.Context) {
+			<-ctx.Done()
+			cancel()
+		}(ui.ctx)
+	}
 	return &appMessage{
 		appUI:  ui,
 		cancel: cancel,
@@ -302,6 +355,41 @@ func (ui *appUI) ShowNoticeMessage(title, message string) {
 	uh.showMessage(true)
 }
 
+func (ui *appUI) trackMessage(msg *appMessage) {
+	if msg.dlgHandle.Load() == nil {
+		return
+	}
+	ui.mx.Lock()
+	defer ui.mx.Unlock()
+
+	if ui.openMessages == nil {
+		ui.openMessages = make(map[*appMessage]bool)
+	}
+	ui.openMessages[msg] = true
+}
+
+func (ui *appUI) untrackMessage(msg *appMessage) {
+	ui.mx.Lock()
+	defer ui.mx.Unlock()
+
+	delete(ui.openMessages, msg)
+}
+
+// dismisses all dialogs shown via this UI
+// that are still waiting for the user
+func (ui *appUI) dismissAll() {
+	ui.mx.Lock()
+	messages := make([]*appMessage, 0, len(ui.openMessages))
+	for msg := range ui.openMessages {
+		messages = append(messages, msg)
+	}
+	ui.mx.Unlock()
+
+	for _, msg := range messages {
+		msg.DismissMessage()
+	}
+}
+
 func (msg *appMessage) WriteMessage(message string) {
 	msg.dialogType = SN_DIALOG_APP
 	msg.WriteText(message)
@@ -355,7 +443,7 @@ func (msg *appMessage) showMessage(dispatchToMain bool) {
 		input: make(chan *string, 1),
 	}
 
-	msg.dlgHandle = showDialog(
+	msg.dlgHandle.Store(showDialog(
 		msg.appUI.dlgContext,
 		msg.dialogType, 
 		msg.title, 
@@ -364,12 +452,14 @@ func (msg *appMessage) showMessage(dispatchToMain bool) {
 		EMPTY_STRING,
 		dispatchToMain,
 		msg.inputHandle,
-	)
+	))
+	msg.appUI.trackMessage(msg)
 
 	go func() {
 		<-msg.inputHandle.input		
 		// clear dialog handle as it would have already been dismissed
-		msg.dlgHandle = nil
+		msg.dlgHandle.Store(nil)
+		msg.appUI.untrackMessage(msg)
 	}()
 }
 
@@ -403,7 +493,7 @@ func (msg *appMessage) showMessageWithInput(accType int, accessoryText string, d
 		input: make(chan *string, 1),
 	}
 
-	msg.dlgHandle = showDialog(
+	msg.dlgHandle.Store(showDialog(
 		msg.appUI.dlgContext,
 		msg.dialogType, 
 		msg.title, 
@@ -412,7 +502,14 @@ func (msg *appMessage) showMessageWithInput(accType int, accessoryText string, d
 		accessoryText,
 		dispatchToMain,
 		msg.inputHandle,
-	)
+	))
+	if msg.dlgHandle.Load() == nil {
+		// no dialog is shown without a registered show dialog
+		// function so the input is cancelled as otherwise the
+		// caller would wait for it indefinitely
+		msg.inputHandle.input <- nil
+	}
+	msg.appUI.trackMessage(msg)
 
 	go func() {
 		input := <-msg.inputHandle.input
@@ -422,7 +519,8 @@ func (msg *appMessage) showMessageWithInput(accType int, accessoryText string, d
 		handleInput(input)
 
 		// clear dialog handle as it would have already been dismissed
-		msg.dlgHandle = nil
+		msg.dlgHandle.Store(nil)
+		msg.appUI.untrackMessage(msg)
 	}()
 }
 
@@ -430,9 +528,10 @@ func (msg *appMessage) DismissMessage() {
 	if msg.cancel != nil {
 		msg.cancel()
 	}
-	if msg.dlgHandle != nil {
-		dismissDialog(msg.dlgHandle)
+	if dlgHandle := msg.dlgHandle.Swap(nil); dlgHandle != nil {
+		dismissDialog(dlgHandle)
 	}
+	msg.appUI.untrackMessage(msg)
 }
 
 func (msg *appMessage) ShowMessageWithProgressIndicator(startMsg, progressMsg, endMsg string, doneAt int) ui.ProgressMessage {
@@ -446,7 +545,7 @@ func (msg *appMessage) ShowMessageWithProgressIndicator(startMsg, progressMsg, e
 		accType = SN_DIALOG_ACCESSORY_PROGRESS_BAR
 	}
 
-	msg.dlgHandle = showDialog(
+	msg.dlgHandle.Store(showDialog(
 		msg.appUI.dlgContext,
 		msg.dialogType, 
 		msg.title, 
@@ -455,7 +554,8 @@ func (msg *appMessage) ShowMessageWithProgressIndicator(startMsg, progressMsg, e
 		startMsg,
 		msg.appUI.dispatchToMain,
 		msg.inputHandle,
-	)
+	))
+	msg.appUI.trackMessage(msg)
 
 	return &appProgressIndicator{
 		msg: msg,
@@ -470,11 +570,12 @@ func (pi *appProgressIndicator) Start() {
 
 	go func() {
 		<-pi.msg.inputHandle.input
-		if pi.msg.cancel != nil {
+		if pi.msg.cancel != nil && !pi.done.Load() {
 			pi.msg.cancel()
 		}
 		// clear dialog handle as it would have already been dismissed
-		pi.msg.dlgHandle = nil
+		pi.msg.dlgHandle.Store(nil)
+		pi.msg.appUI.untrackMessage(pi.msg)
 	}()
 }
 
@@ -482,9 +583,11 @@ func (pi *appProgressIndicator) Update(updateMsg string, progressAt int) {
 }
 
 func (pi *appProgressIndicator) Done() {
-	if pi.msg.dlgHandle != nil {
-		dismissDialog(pi.msg.dlgHandle)
+	pi.done.Store(true)
+	if dlgHandle := pi.msg.dlgHandle.Swap(nil); dlgHandle != nil {
+		dismissDialog(dlgHandle)
 	}
+	pi.msg.appUI.untrackMessage(pi.msg)
 }
 
 // Begin: Swift / Golang UX Interop TESTS
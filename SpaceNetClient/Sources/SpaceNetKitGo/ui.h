@@ -46,6 +46,9 @@ typedef void (*dismissDialog_fn_t)(
 extern void snRegisterShowDialogFunc(void *dlgContext, showDialog_fn_t);
 extern void snSetDialogDismissHandler(void* dlgContext, dismissDialog_fn_t dismissHandler);
 extern void snUnregisterShowDialogFunc(void *dlgContext);
+// The inputContext passed to a show dialog or get input function is an
+// opaque handle that is released when it is passed to snHandleDialogInput
+// so it must be passed back exactly once when the dialog is closed.
 extern void snHandleDialogInput(unsigned long inputContext, BOOL ok, const char *result);
 extern void snAssociateDialogInputToHandle(unsigned long inputContext, void *dlgHandle);
 
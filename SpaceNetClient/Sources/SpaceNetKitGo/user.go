@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import "C"
+
+import (
+	"encoding/json"
+
+	"github.com/appbricks/mycloudspace-client/auth"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mevansam/goutils/logger"
+)
+
+// JSON representation of the logged in
+// user returned to the host application
+type userProfile struct {
+	UserID      string   `json:"userID"`
+	Username    string   `json:"username"`
+	Email       string   `json:"email,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Groups      []string `json:"groups"`
+
+	// token issue and expiry times in
+	// milliseconds since the epoch
+	IssuedAt  int64 `json:"issuedAt"`
+	ExpiresAt int64 `json:"expiresAt"`
+
+	IsOwner bool `json:"isOwner"`
+}
+
+//export snUserProfile
+func snUserProfile() *C.char {
+
+	profile, err := getUserProfile()
+	if err != nil {
+		_ = setLastError("snUserProfile", err)
+		return nil
+	}
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		_ = setLastError("snUserProfile", err)
+		return nil
+	}
+	return C.CString(string(profileJSON))
+}
+
+// returns the profile of the logged in user from
+// the identity claims of the user's auth token
+func getUserProfile() (*userProfile, error) {
+
+	var (
+		err error
+
+		awsAuth *auth.AWSCognitoJWT
+	)
+
+	cfg := currentConfig()
+	if cfg == nil || !cfg.AuthContext().IsLoggedIn() {
+		return nil, newError(SN_ERROR_AUTH, "no user is logged in")
+	}
+	authContext := cfg.AuthContext()
+
+	if awsAuth, err = auth.NewAWSCognitoJWT(
+		getServiceConfig(),
+		authContext,
+	); err != nil {
+		return nil, authError(err)
+	}
+	profile := &userProfile{
+		UserID:   awsAuth.UserID(),
+		Username: awsAuth.Username(),
+		Groups:   []string{},
+	}
+
+	// the token has already been validated so its claims are
+	// read without verifying its signature. the id token has
+	// the user's identity and the access token the user's
+	// groups and the session's validity.
+	token := authContext.GetToken()
+	if idToken, ok := token.Extra("id_token").(string); ok {
+		claims := tokenClaims(idToken)
+		profile.Email, _ = claims["email"].(string)
+		profile.DisplayName, _ = claims["name"].(string)
+		profile.Groups = claimGroups(claims)
+		profile.IssuedAt = claimTime(claims, "iat")
+		profile.ExpiresAt = claimTime(claims, "exp")
+	}
+	claims := tokenClaims(token.AccessToken)
+	if groups := claimGroups(claims); len(groups) > 0 {
+		profile.Groups = groups
+	}
+	if iat := claimTime(claims, "iat"); iat > 0 {
+		profile.IssuedAt = iat
+	}
+	if exp := claimTime(claims, "exp"); exp > 0 {
+		profile.ExpiresAt = exp
+	} else if profile.ExpiresAt == 0 && !token.Expiry.IsZero() {
+		profile.ExpiresAt = token.Expiry.UnixMilli()
+	}
+
+	deviceContext := cfg.DeviceContext()
+	if ownerName, ok := deviceContext.GetOwnerUserName(); ok {
+		profile.IsOwner = ownerName == profile.Username
+	}
+	return profile, nil
+}
+
+func tokenClaims(tokenString string) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		logger.DebugMessage("Unable to parse claims of auth token: %s", err.Error())
+	}
+	return claims
+}
+
+func claimGroups(claims jwt.MapClaims) []string {
+	groups := []string{}
+	if values, ok := claims["cognito:groups"].([]interface{}); ok {
+		for _, v := range values {
+			if group, ok := v.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// returns a numeric date claim in milliseconds since the epoch
+func claimTime(claims jwt.MapClaims, name string) int64 {
+	if value, ok := claims[name].(float64); ok {
+		return int64(value) * 1000
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2023 AppBricks, Inc. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/appbricks/mycloudspace-client/apple/mycsfake"
+	"golang.org/x/oauth2"
+)
+
+// logs the config in as the given user with an id and
+// access token issued with the given claims
+func (tc *testContext) loginWithClaims(
+	t *testing.T,
+	username string,
+	idClaims, accessClaims map[string]interface{},
+	expiry time.Time,
+) {
+	idToken, err := tc.service.Token(username, "id", idClaims)
+	if err != nil {
+		t.Fatalf("failed to issue an id token: %s", err.Error())
+	}
+	accessToken, err := tc.service.Token(username, "access", accessClaims)
+	if err != nil {
+		t.Fatalf("failed to issue an access token: %s", err.Error())
+	}
+	tc.config.AuthContext().SetToken((&oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}).WithExtra(map[string]interface{}{"id_token": idToken}))
+}
+
+func TestUserProfile(t *testing.T) {
+
+	tc := newTestContext(t)
+	guest := &mycsfake.User{
+		Username: "guest",
+		Email:    "guest@example.com",
+		Name:     "Device Guest",
+	}
+	tc.registerDevice(t, map[*mycsfake.User]string{guest: mycsfake.USER_STATUS_ACTIVE})
+
+	issuedAt := time.Now().Add(-time.Minute).Unix()
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	expiry := time.Now().Add(30 * time.Minute)
+
+	for _, tt := range []struct {
+		name string
+
+		user *mycsfake.User
+
+		idClaims, accessClaims map[string]interface{}
+
+		expected map[string]interface{}
+	}{
+		{
+			name: "owner",
+			user: tc.owner,
+			// the access token's groups and times take precedence
+			idClaims: map[string]interface{}{
+				"cognito:groups": []string{"id-group"},
+				"iat":            issuedAt - 60,
+				"exp":            expiresAt - 60,
+			},
+			accessClaims: map[string]interface{}{
+				"cognito:groups": []string{"admins", "users"},
+				"iat":            issuedAt,
+				"exp":            expiresAt,
+			},
+			expected: map[string]interface{}{
+				"userID":      tc.owner.UserID,
+				"username":    testUsername,
+				"email":       tc.owner.Email,
+				"displayName": tc.owner.Name,
+				"groups":      []interface{}{"admins", "users"},
+				"issuedAt":    float64(issuedAt * 1000),
+				"expiresAt":   float64(expiresAt * 1000),
+				"isOwner":     true,
+			},
+		},
+		{
+			name: "guest",
+			user: guest,
+			// the id token's groups and times are used if
+			// the access token does not have them
+			idClaims: map[string]interface{}{
+				"cognito:groups": []string{"users"},
+				"iat":            issuedAt,
+				"exp":            expiresAt,
+			},
+			accessClaims: map[string]interface{}{
+				"cognito:groups": nil,
+				"iat":            nil,
+				"exp":            nil,
+			},
+			expected: map[string]interface{}{
+				"userID":      guest.UserID,
+				"username":    "guest",
+				"email":       guest.Email,
+				"displayName": guest.Name,
+				"groups":      []interface{}{"users"},
+				"issuedAt":    float64(issuedAt * 1000),
+				"expiresAt":   float64(expiresAt * 1000),
+				"isOwner":     false,
+			},
+		},
+		{
+			name: "token expiry",
+			user: guest,
+			// the expiry of the oauth token is used
+			// if neither token has an expiry claim
+			idClaims: map[string]interface{}{
+				"iat": issuedAt,
+				"exp": nil,
+			},
+			accessClaims: map[string]interface{}{
+				"cognito:groups": nil,
+				"iat":            nil,
+				"exp":            nil,
+			},
+			expected: map[string]interface{}{
+				"userID":      guest.UserID,
+				"username":    "guest",
+				"email":       guest.Email,
+				"displayName": guest.Name,
+				"groups":      []interface{}{},
+				"issuedAt":    float64(issuedAt * 1000),
+				"expiresAt":   float64(expiry.UnixMilli()),
+				"isOwner":     false,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tc.loginWithClaims(t, tt.user.Username, tt.idClaims, tt.accessClaims, expiry)
+
+			profile, err := getUserProfile()
+			if err != nil {
+				t.Fatalf("getUserProfile() failed: %s", err.Error())
+			}
+			profileJSON, err := json.Marshal(profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := map[string]interface{}{}
+			if err = json.Unmarshal(profileJSON, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fields, tt.expected) {
+				t.Errorf("getUserProfile() = %s, expected %v", profileJSON, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUserProfileNotLoggedIn(t *testing.T) {
+
+	newTestContext(t)
+	if _, err := getUserProfile(); errorCode(err) != SN_ERROR_AUTH {
+		t.Errorf("getUserProfile() error = %v, expected an auth error", err)
+	}
+}
@@ -56,9 +56,17 @@ type tunnelHandle struct {
 	*device.Logger
 }
 
-var tunnelHandles = make(map[int32]tunnelHandle)
+// tunnels may stay turned on for days so
+// handles are not checked for leaks by age
+var tunnelHandles = newRegistry[int32, tunnelHandle]("tunnelHandles", 0)
+
+func lookupTunnelHandle(handle int32) (tunnelHandle, bool) {
+	return tunnelHandles.lookup(handle)
+}
 
 func init() {
+	startRegistryLeakDetector(REGISTRY_LEAK_CHECK_INTERVAL)
+
 	signals := make(chan os.Signal)
 	signal.Notify(signals, unix.SIGUSR2)
 	go func() {
@@ -121,31 +129,26 @@ func wgTurnOn(settings *C.char, tunFd int32) int32 {
 
 	var i int32
 	for i = 0; i < math.MaxInt32; i++ {
-		if _, exists := tunnelHandles[i]; !exists {
-			break
+		if tunnelHandles.registerIfAbsent(i, tunnelHandle{dev, logger}) {
+			return i
 		}
 	}
-	if i == math.MaxInt32 {
-		unix.Close(dupTunFd)
-		return -1
-	}
-	tunnelHandles[i] = tunnelHandle{dev, logger}
-	return i
+	unix.Close(dupTunFd)
+	return -1
 }
 
 //export wgTurnOff
 func wgTurnOff(tunnelHandle int32) {
-	dev, ok := tunnelHandles[tunnelHandle]
+	dev, ok := tunnelHandles.unregister(tunnelHandle)
 	if !ok {
 		return
 	}
-	delete(tunnelHandles, tunnelHandle)
 	dev.Close()
 }
 
 //export wgSetConfig
 func wgSetConfig(tunnelHandle int32, settings *C.char) int64 {
-	dev, ok := tunnelHandles[tunnelHandle]
+	dev, ok := lookupTunnelHandle(tunnelHandle)
 	if !ok {
 		return 0
 	}
@@ -162,7 +165,7 @@ func wgSetConfig(tunnelHandle int32, settings *C.char) int64 {
 
 //export wgGetConfig
 func wgGetConfig(tunnelHandle int32) *C.char {
-	device, ok := tunnelHandles[tunnelHandle]
+	device, ok := lookupTunnelHandle(tunnelHandle)
 	if !ok {
 		return nil
 	}
@@ -175,7 +178,7 @@ func wgGetConfig(tunnelHandle int32) *C.char {
 
 //export wgBumpSockets
 func wgBumpSockets(tunnelHandle int32) {
-	dev, ok := tunnelHandles[tunnelHandle]
+	dev, ok := lookupTunnelHandle(tunnelHandle)
 	if !ok {
 		return
 	}
@@ -195,7 +198,7 @@ func wgBumpSockets(tunnelHandle int32) {
 
 //export wgDisableSomeRoamingForBrokenMobileSemantics
 func wgDisableSomeRoamingForBrokenMobileSemantics(tunnelHandle int32) {
-	dev, ok := tunnelHandles[tunnelHandle]
+	dev, ok := lookupTunnelHandle(tunnelHandle)
 	if !ok {
 		return
 	}